@@ -22,6 +22,42 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
 
+// NatBehavior RFC 5780 中 NAT 的映射和过滤行为
+type NatBehavior int32
+
+const (
+	NatBehavior_Unknown NatBehavior = 0
+	// 没有 NAT
+	NatBehavior_NoNat                   NatBehavior = 1
+	NatBehavior_EndpointIndependent     NatBehavior = 2
+	NatBehavior_AddressDependent        NatBehavior = 3
+	NatBehavior_AddressAndPortDependent NatBehavior = 4
+)
+
+var NatBehavior_name = map[int32]string{
+	0: "Unknown",
+	1: "NoNat",
+	2: "EndpointIndependent",
+	3: "AddressDependent",
+	4: "AddressAndPortDependent",
+}
+
+var NatBehavior_value = map[string]int32{
+	"Unknown":                 0,
+	"NoNat":                   1,
+	"EndpointIndependent":     2,
+	"AddressDependent":        3,
+	"AddressAndPortDependent": 4,
+}
+
+func (x NatBehavior) String() string {
+	return proto.EnumName(NatBehavior_name, int32(x))
+}
+
+func (NatBehavior) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_1dfa6b8f70674874, []int{0}
+}
+
 type HostMessage_MessageType int32
 
 const (
@@ -33,6 +69,10 @@ const (
 	HostMessage_HostPunchNotification   HostMessage_MessageType = 5
 	HostMessage_HostOnlineNotification  HostMessage_MessageType = 6
 	HostMessage_HostOfflineNotification HostMessage_MessageType = 7
+	// 客户端请求服务端为自己和 target 分配中继
+	HostMessage_HostRelayRequest HostMessage_MessageType = 8
+	// 通知客户端可以通过 relay_addr 中继到达 hostname
+	HostMessage_HostRelayNotification HostMessage_MessageType = 9
 )
 
 var HostMessage_MessageType_name = map[int32]string{
@@ -44,6 +84,8 @@ var HostMessage_MessageType_name = map[int32]string{
 	5: "HostPunchNotification",
 	6: "HostOnlineNotification",
 	7: "HostOfflineNotification",
+	8: "HostRelayRequest",
+	9: "HostRelayNotification",
 }
 
 var HostMessage_MessageType_value = map[string]int32{
@@ -55,6 +97,8 @@ var HostMessage_MessageType_value = map[string]int32{
 	"HostPunchNotification":   5,
 	"HostOnlineNotification":  6,
 	"HostOfflineNotification": 7,
+	"HostRelayRequest":        8,
+	"HostRelayNotification":   9,
 }
 
 func (x HostMessage_MessageType) String() string {
@@ -402,6 +446,8 @@ type HostOnlineRequest struct {
 	Ipv4Addr     []*Ipv4Addr `protobuf:"bytes,2,rep,name=ipv4_addr,json=ipv4Addr,proto3" json:"ipv4_addr,omitempty"`
 	Ipv6Addr     []*Ipv6Addr `protobuf:"bytes,3,rep,name=ipv6_addr,json=ipv6Addr,proto3" json:"ipv6_addr,omitempty"`
 	ExternalAddr *Ipv4Addr   `protobuf:"bytes,4,opt,name=external_addr,json=externalAddr,proto3" json:"external_addr,omitempty"`
+	// IPv6 外部地址
+	ExternalAddr6 *Ipv6Addr `protobuf:"bytes,5,opt,name=external_addr6,json=externalAddr6,proto3" json:"external_addr6,omitempty"`
 }
 
 func (m *HostOnlineRequest) Reset()         { *m = HostOnlineRequest{} }
@@ -465,6 +511,13 @@ func (m *HostOnlineRequest) GetExternalAddr() *Ipv4Addr {
 	return nil
 }
 
+func (m *HostOnlineRequest) GetExternalAddr6() *Ipv6Addr {
+	if m != nil {
+		return m.ExternalAddr6
+	}
+	return nil
+}
+
 type HostOnlineResponse struct {
 }
 
@@ -602,6 +655,12 @@ type HostUpdateRequest struct {
 	Ipv4Addr     []*Ipv4Addr `protobuf:"bytes,2,rep,name=ipv4_addr,json=ipv4Addr,proto3" json:"ipv4_addr,omitempty"`
 	Ipv6Addr     []*Ipv6Addr `protobuf:"bytes,3,rep,name=ipv6_addr,json=ipv6Addr,proto3" json:"ipv6_addr,omitempty"`
 	ExternalAddr *Ipv4Addr   `protobuf:"bytes,4,opt,name=external_addr,json=externalAddr,proto3" json:"external_addr,omitempty"`
+	// IPv6 外部地址
+	ExternalAddr6 *Ipv6Addr `protobuf:"bytes,5,opt,name=external_addr6,json=externalAddr6,proto3" json:"external_addr6,omitempty"`
+	// 主机所在 NAT 的类型
+	NatType *NatType `protobuf:"bytes,6,opt,name=nat_type,json=natType,proto3" json:"nat_type,omitempty"`
+	// 主机的 WireGuard 公钥，用于对端将主机名映射到 WireGuard 对端
+	PublicKey string `protobuf:"bytes,7,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
 }
 
 func (m *HostUpdateRequest) Reset()         { *m = HostUpdateRequest{} }
@@ -665,6 +724,27 @@ func (m *HostUpdateRequest) GetExternalAddr() *Ipv4Addr {
 	return nil
 }
 
+func (m *HostUpdateRequest) GetExternalAddr6() *Ipv6Addr {
+	if m != nil {
+		return m.ExternalAddr6
+	}
+	return nil
+}
+
+func (m *HostUpdateRequest) GetNatType() *NatType {
+	if m != nil {
+		return m.NatType
+	}
+	return nil
+}
+
+func (m *HostUpdateRequest) GetPublicKey() string {
+	if m != nil {
+		return m.PublicKey
+	}
+	return ""
+}
+
 type HostUpdateResponse struct {
 	Success bool `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
 }
@@ -1011,6 +1091,18 @@ type HostMessage struct {
 	Ipv4Addr     []*Ipv4Addr             `protobuf:"bytes,3,rep,name=ipv4_addr,json=ipv4Addr,proto3" json:"ipv4_addr,omitempty"`
 	Ipv6Addr     []*Ipv6Addr             `protobuf:"bytes,4,rep,name=Ipv6_addr,json=Ipv6Addr,proto3" json:"Ipv6_addr,omitempty"`
 	Hostname     string                  `protobuf:"bytes,5,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	// 可用于到达 hostname 的中继地址
+	RelayAddr []*Ipv4Addr `protobuf:"bytes,6,rep,name=relay_addr,json=relayAddr,proto3" json:"relay_addr,omitempty"`
+	// 中继请求的目标主机
+	Target string `protobuf:"bytes,7,opt,name=target,proto3" json:"target,omitempty"`
+	// IPv6 外部地址
+	ExternalAddr6 *Ipv6Addr `protobuf:"bytes,8,opt,name=external_addr6,json=externalAddr6,proto3" json:"external_addr6,omitempty"`
+	// hostname 所在 NAT 的类型，用于选择打洞策略
+	NatType *NatType `protobuf:"bytes,9,opt,name=nat_type,json=natType,proto3" json:"nat_type,omitempty"`
+	// hostname 的 WireGuard 公钥
+	PublicKey string `protobuf:"bytes,10,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	// 可用于到达 hostname 的 IPv6 中继地址
+	RelayAddr6 []*Ipv6Addr `protobuf:"bytes,11,rep,name=relay_addr6,json=relayAddr6,proto3" json:"relay_addr6,omitempty"`
 }
 
 func (m *HostMessage) Reset()         { *m = HostMessage{} }
@@ -1081,6 +1173,191 @@ func (m *HostMessage) GetHostname() string {
 	return ""
 }
 
+func (m *HostMessage) GetRelayAddr() []*Ipv4Addr {
+	if m != nil {
+		return m.RelayAddr
+	}
+	return nil
+}
+
+func (m *HostMessage) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+func (m *HostMessage) GetExternalAddr6() *Ipv6Addr {
+	if m != nil {
+		return m.ExternalAddr6
+	}
+	return nil
+}
+
+func (m *HostMessage) GetNatType() *NatType {
+	if m != nil {
+		return m.NatType
+	}
+	return nil
+}
+
+func (m *HostMessage) GetPublicKey() string {
+	if m != nil {
+		return m.PublicKey
+	}
+	return ""
+}
+
+func (m *HostMessage) GetRelayAddr6() []*Ipv6Addr {
+	if m != nil {
+		return m.RelayAddr6
+	}
+	return nil
+}
+
+// NatType RFC 5780 NAT 行为检测的结果
+type NatType struct {
+	Mapping     NatBehavior `protobuf:"varint,1,opt,name=mapping,proto3,enum=api.NatBehavior" json:"mapping,omitempty"`
+	Filtering   NatBehavior `protobuf:"varint,2,opt,name=filtering,proto3,enum=api.NatBehavior" json:"filtering,omitempty"`
+	Hairpinning bool        `protobuf:"varint,3,opt,name=hairpinning,proto3" json:"hairpinning,omitempty"`
+}
+
+func (m *NatType) Reset()         { *m = NatType{} }
+func (m *NatType) String() string { return proto.CompactTextString(m) }
+func (*NatType) ProtoMessage()    {}
+func (*NatType) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1dfa6b8f70674874, []int{20}
+}
+func (m *NatType) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *NatType) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_NatType.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *NatType) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_NatType.Merge(m, src)
+}
+func (m *NatType) XXX_Size() int {
+	return m.Size()
+}
+func (m *NatType) XXX_DiscardUnknown() {
+	xxx_messageInfo_NatType.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_NatType proto.InternalMessageInfo
+
+func (m *NatType) GetMapping() NatBehavior {
+	if m != nil {
+		return m.Mapping
+	}
+	return NatBehavior_Unknown
+}
+
+func (m *NatType) GetFiltering() NatBehavior {
+	if m != nil {
+		return m.Filtering
+	}
+	return NatBehavior_Unknown
+}
+
+func (m *NatType) GetHairpinning() bool {
+	if m != nil {
+		return m.Hairpinning
+	}
+	return false
+}
+
+// Envelope 是经过认证的灯塔 UDP 消息
+type Envelope struct {
+	// 序列化后的 HostMessage
+	Payload []byte `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	// 发送时间 (unix 纳秒)
+	Timestamp int64 `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// 随机数，与 timestamp 一起用于防重放
+	Nonce uint64 `protobuf:"varint,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	// HMAC-SHA256(psk, timestamp || nonce || len(hostname) || hostname || payload)
+	Mac []byte `protobuf:"bytes,4,opt,name=mac,proto3" json:"mac,omitempty"`
+	// 发送方的主机名，接收方先用它查找密钥并验证 mac，验证通过后才解析 payload
+	Hostname string `protobuf:"bytes,5,opt,name=hostname,proto3" json:"hostname,omitempty"`
+}
+
+func (m *Envelope) Reset()         { *m = Envelope{} }
+func (m *Envelope) String() string { return proto.CompactTextString(m) }
+func (*Envelope) ProtoMessage()    {}
+func (*Envelope) Descriptor() ([]byte, []int) {
+	return fileDescriptor_1dfa6b8f70674874, []int{21}
+}
+func (m *Envelope) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Envelope) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Envelope.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Envelope) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Envelope.Merge(m, src)
+}
+func (m *Envelope) XXX_Size() int {
+	return m.Size()
+}
+func (m *Envelope) XXX_DiscardUnknown() {
+	xxx_messageInfo_Envelope.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Envelope proto.InternalMessageInfo
+
+func (m *Envelope) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *Envelope) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *Envelope) GetNonce() uint64 {
+	if m != nil {
+		return m.Nonce
+	}
+	return 0
+}
+
+func (m *Envelope) GetMac() []byte {
+	if m != nil {
+		return m.Mac
+	}
+	return nil
+}
+
+func (m *Envelope) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
 type Ipv4Addr struct {
 	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
@@ -1090,7 +1367,7 @@ func (m *Ipv4Addr) Reset()         { *m = Ipv4Addr{} }
 func (m *Ipv4Addr) String() string { return proto.CompactTextString(m) }
 func (*Ipv4Addr) ProtoMessage()    {}
 func (*Ipv4Addr) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1dfa6b8f70674874, []int{20}
+	return fileDescriptor_1dfa6b8f70674874, []int{22}
 }
 func (m *Ipv4Addr) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -1143,7 +1420,7 @@ func (m *Ipv6Addr) Reset()         { *m = Ipv6Addr{} }
 func (m *Ipv6Addr) String() string { return proto.CompactTextString(m) }
 func (*Ipv6Addr) ProtoMessage()    {}
 func (*Ipv6Addr) Descriptor() ([]byte, []int) {
-	return fileDescriptor_1dfa6b8f70674874, []int{21}
+	return fileDescriptor_1dfa6b8f70674874, []int{23}
 }
 func (m *Ipv6Addr) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -1194,6 +1471,7 @@ func (m *Ipv6Addr) GetPort() uint32 {
 }
 
 func init() {
+	proto.RegisterEnum("api.NatBehavior", NatBehavior_name, NatBehavior_value)
 	proto.RegisterEnum("api.HostMessage_MessageType", HostMessage_MessageType_name, HostMessage_MessageType_value)
 	proto.RegisterType((*Msg)(nil), "api.Msg")
 	proto.RegisterType((*Message)(nil), "api.Message")
@@ -1215,6 +1493,8 @@ func init() {
 	proto.RegisterType((*HostSubscribeRequest)(nil), "api.HostSubscribeRequest")
 	proto.RegisterType((*HostSubscribeResponse)(nil), "api.HostSubscribeResponse")
 	proto.RegisterType((*HostMessage)(nil), "api.HostMessage")
+	proto.RegisterType((*NatType)(nil), "api.NatType")
+	proto.RegisterType((*Envelope)(nil), "api.Envelope")
 	proto.RegisterType((*Ipv4Addr)(nil), "api.ipv4Addr")
 	proto.RegisterType((*Ipv6Addr)(nil), "api.ipv6Addr")
 }
@@ -1222,60 +1502,80 @@ func init() {
 func init() { proto.RegisterFile("api/v1/api.proto", fileDescriptor_1dfa6b8f70674874) }
 
 var fileDescriptor_1dfa6b8f70674874 = []byte{
-	// 836 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xd4, 0x56, 0xcb, 0x6e, 0xf3, 0x44,
-	0x14, 0x8e, 0x2f, 0xf9, 0x93, 0x9c, 0x5c, 0xfe, 0x74, 0x9a, 0xb6, 0x21, 0x85, 0x28, 0xf2, 0x86,
-	0x0a, 0x89, 0xa4, 0xa4, 0x55, 0x91, 0x40, 0x20, 0x8a, 0x10, 0x4a, 0xa4, 0xb6, 0x04, 0x97, 0x76,
-	0xc1, 0xa6, 0x72, 0x9c, 0x69, 0x62, 0x91, 0xda, 0xc6, 0x33, 0x8e, 0xc8, 0x0b, 0xb0, 0xe6, 0x4d,
-	0x78, 0x80, 0x6e, 0xd8, 0x20, 0xb1, 0xec, 0x92, 0x25, 0x6a, 0x5f, 0x04, 0x79, 0x66, 0xec, 0x8c,
-	0x9d, 0x42, 0x54, 0x40, 0x42, 0xff, 0x2a, 0x33, 0x73, 0xee, 0xdf, 0x77, 0x72, 0x8e, 0xa1, 0x6e,
-	0xf9, 0x4e, 0x6f, 0xf1, 0x41, 0xcf, 0xf2, 0x9d, 0xae, 0x1f, 0x78, 0xd4, 0x43, 0x9a, 0xe5, 0x3b,
-	0xc6, 0x3e, 0x68, 0xe7, 0x64, 0x8a, 0x1a, 0x90, 0xbf, 0xb6, 0xe6, 0x21, 0x6e, 0x2a, 0x1d, 0xe5,
-	0xa0, 0x64, 0xf2, 0x8b, 0x71, 0x04, 0x85, 0x73, 0x4c, 0x88, 0x35, 0xc5, 0x91, 0x02, 0xf5, 0x7c,
-	0xc7, 0x8e, 0x15, 0xd8, 0x05, 0x21, 0xd0, 0x27, 0x16, 0xb5, 0x9a, 0x5a, 0x47, 0x39, 0xa8, 0x98,
-	0xec, 0x6c, 0x5c, 0x43, 0x6d, 0x14, 0x8e, 0xe7, 0x0e, 0x99, 0x99, 0xf8, 0xfb, 0x10, 0x13, 0xfa,
-	0x17, 0xb6, 0x2d, 0x28, 0xce, 0x3c, 0x42, 0x5d, 0xeb, 0x0e, 0x37, 0x55, 0x26, 0x48, 0xee, 0xcf,
-	0xfa, 0xdd, 0x82, 0xd7, 0x89, 0x5f, 0xe2, 0x7b, 0x2e, 0xc1, 0xc6, 0x17, 0x50, 0xbf, 0x0c, 0xc7,
-	0xc4, 0x0e, 0x9c, 0x31, 0xfe, 0xc7, 0xc1, 0x8c, 0x2f, 0x01, 0x5d, 0xb9, 0xe4, 0xdf, 0xfb, 0xd9,
-	0x81, 0xed, 0x94, 0x1f, 0x91, 0xe4, 0xbd, 0x02, 0x5b, 0x03, 0x8f, 0xd0, 0xaf, 0xdc, 0xb9, 0xe3,
-	0x26, 0xee, 0x65, 0x47, 0x4a, 0xa6, 0xfa, 0xf7, 0xa0, 0xe4, 0xf8, 0x8b, 0xe3, 0x1b, 0x6b, 0x32,
-	0x09, 0x9a, 0x6a, 0x47, 0x3b, 0x28, 0xf7, 0xab, 0xdd, 0x88, 0xb7, 0xe8, 0xf5, 0x74, 0x32, 0x09,
-	0xcc, 0x62, 0x7c, 0x12, 0xba, 0x27, 0x5c, 0x57, 0x4b, 0xeb, 0x9e, 0x24, 0xba, 0xec, 0x84, 0xfa,
-	0x50, 0xc5, 0x3f, 0x50, 0x1c, 0xb8, 0xd6, 0x9c, 0xeb, 0xeb, 0x1d, 0x65, 0xdd, 0x77, 0x25, 0xd6,
-	0x89, 0x6e, 0x46, 0x03, 0x90, 0x9c, 0xbc, 0xa8, 0xe9, 0x63, 0xa8, 0x47, 0xaf, 0x5f, 0x87, 0x38,
-	0x58, 0xc6, 0x15, 0xbd, 0x0b, 0xaf, 0xa9, 0x15, 0x4c, 0x31, 0xbd, 0xc9, 0x14, 0x56, 0xe3, 0xcf,
-	0x83, 0x18, 0xa7, 0xef, 0x38, 0x1e, 0xc2, 0x98, 0x7b, 0x4c, 0xd7, 0xac, 0xbc, 0xa0, 0x66, 0xf5,
-	0x6f, 0x6b, 0x4e, 0xd0, 0xbf, 0xf2, 0x27, 0x16, 0x7d, 0xe3, 0xd0, 0xef, 0x72, 0xf4, 0xe3, 0xe4,
-	0x05, 0x56, 0x4d, 0x28, 0x90, 0xd0, 0xb6, 0x31, 0x21, 0x2c, 0xf9, 0xa2, 0x19, 0x5f, 0x63, 0x5e,
-	0x46, 0xa1, 0x6b, 0xcf, 0x5e, 0xcc, 0xcb, 0xfb, 0x1c, 0x29, 0x61, 0xbc, 0x31, 0xd6, 0x8f, 0x0a,
-	0x0f, 0x76, 0xee, 0x2d, 0xf0, 0xe4, 0x7f, 0x04, 0x36, 0xce, 0x5b, 0xe4, 0xb1, 0x31, 0xef, 0x01,
-	0x34, 0x22, 0xf5, 0xff, 0x60, 0x70, 0x9c, 0xc2, 0x4e, 0xc6, 0x93, 0x08, 0xde, 0x80, 0x3c, 0x5e,
-	0x60, 0x97, 0xc6, 0xae, 0xd8, 0x25, 0x19, 0x6a, 0xdc, 0x0d, 0x1f, 0x6a, 0x3f, 0x6b, 0x50, 0x66,
-	0xc9, 0x8b, 0x31, 0x7b, 0x08, 0x3a, 0x5d, 0xfa, 0x1c, 0xbb, 0x5a, 0xff, 0x6d, 0x56, 0xb2, 0x24,
-	0xef, 0x8a, 0xdf, 0x6f, 0x96, 0x3e, 0x36, 0x99, 0xe6, 0x7a, 0x5b, 0xa9, 0x1b, 0xdb, 0x2a, 0xcd,
-	0x84, 0xb6, 0x91, 0x89, 0x61, 0xc2, 0x84, 0xfe, 0x2c, 0x13, 0xc3, 0xb8, 0xc5, 0x65, 0xb0, 0xf2,
-	0x19, 0xb0, 0x7e, 0x55, 0xa0, 0x2c, 0x65, 0x8f, 0x8a, 0xa0, 0x5f, 0x78, 0x2e, 0xae, 0xe7, 0x50,
-	0x15, 0x4a, 0xc9, 0x3c, 0xa8, 0x2b, 0x08, 0x41, 0x4d, 0x1a, 0x0f, 0xfe, 0x7c, 0x59, 0x57, 0x51,
-	0x0b, 0x76, 0x57, 0xff, 0x83, 0x0b, 0x8f, 0x3a, 0xb7, 0x8e, 0x6d, 0x51, 0xc7, 0x73, 0xeb, 0x1a,
-	0x7a, 0x8b, 0xb3, 0xc0, 0xe8, 0x4f, 0x89, 0xf4, 0x58, 0xc4, 0x3a, 0x3a, 0x25, 0xca, 0xc7, 0x1e,
-	0xf9, 0x5c, 0x4b, 0xc9, 0x5e, 0xa1, 0x7d, 0xd8, 0x63, 0xb2, 0xdb, 0xdb, 0x35, 0x61, 0xc1, 0xe8,
-	0xc2, 0x0a, 0x9b, 0x1a, 0xa8, 0x43, 0x9f, 0x71, 0x55, 0x35, 0xd5, 0xa1, 0x1f, 0x31, 0x3c, 0xf2,
-	0x02, 0xca, 0x28, 0xa8, 0x9a, 0xec, 0x6c, 0x7c, 0x0a, 0xab, 0x11, 0x50, 0x03, 0x75, 0xe0, 0x30,
-	0x7d, 0xdd, 0x54, 0x07, 0x4e, 0x74, 0x3f, 0xf3, 0x98, 0xb6, 0x6e, 0xaa, 0x67, 0x5e, 0x62, 0xaf,
-	0xad, 0xec, 0xfb, 0xf7, 0x0a, 0x54, 0x47, 0xe1, 0xf8, 0x32, 0x1c, 0x5f, 0xe2, 0x60, 0xe1, 0xd8,
-	0x18, 0x1d, 0x43, 0x41, 0x2c, 0x42, 0xb4, 0xcd, 0x98, 0x48, 0xaf, 0xdb, 0x56, 0x23, 0xfd, 0x28,
-	0x7a, 0xb2, 0x0f, 0xa5, 0xa4, 0x51, 0xd1, 0x0e, 0x53, 0xc9, 0xfe, 0x05, 0x5a, 0x15, 0xf6, 0x2c,
-	0x58, 0x3a, 0x54, 0xd0, 0x67, 0x50, 0x96, 0x36, 0x1a, 0xda, 0x63, 0xe2, 0xf5, 0x5d, 0xd9, 0x6a,
-	0xae, 0x0b, 0x78, 0xd4, 0xfe, 0x2f, 0x2a, 0x54, 0x18, 0xfc, 0x71, 0xf2, 0x9f, 0x00, 0xac, 0x70,
-	0x47, 0xbb, 0x49, 0x83, 0xa7, 0xb6, 0x63, 0x6b, 0x6f, 0xed, 0x5d, 0x54, 0xf1, 0x91, 0xd4, 0x2b,
-	0xa2, 0x8a, 0xec, 0x22, 0x6a, 0xed, 0x66, 0x9f, 0x85, 0xad, 0x08, 0xcd, 0x9b, 0x48, 0x0a, 0x9d,
-	0x5a, 0x0d, 0x52, 0xe8, 0xcc, 0xd4, 0x15, 0xa1, 0x59, 0x35, 0x52, 0x68, 0x79, 0xd6, 0x4a, 0xa1,
-	0xd3, 0x53, 0x54, 0xd8, 0xb2, 0x1e, 0x95, 0x6c, 0xe5, 0xd1, 0x29, 0xd9, 0xa6, 0x26, 0xd9, 0xe7,
-	0x1f, 0xfe, 0xf6, 0xd8, 0x56, 0x1e, 0x1e, 0xdb, 0xca, 0x1f, 0x8f, 0x6d, 0xe5, 0xa7, 0xa7, 0x76,
-	0xee, 0xe1, 0xa9, 0x9d, 0xfb, 0xfd, 0xa9, 0x9d, 0xfb, 0xf6, 0x9d, 0xa9, 0x43, 0x67, 0xe1, 0xb8,
-	0x6b, 0x7b, 0x77, 0x3d, 0xdb, 0x23, 0x84, 0x62, 0xeb, 0xae, 0xe7, 0x47, 0x81, 0xa3, 0xaf, 0xbc,
-	0xf1, 0x2b, 0xf6, 0x99, 0x77, 0xf4, 0x67, 0x00, 0x00, 0x00, 0xff, 0xff, 0x97, 0x46, 0x97, 0x81,
-	0xfa, 0x09, 0x00, 0x00,
+	// 1153 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe4, 0x57, 0xcf, 0x6e, 0xdb, 0x46,
+	0x13, 0x37, 0x49, 0xc9, 0x12, 0x47, 0x7f, 0x42, 0x6f, 0x64, 0x59, 0x9f, 0x92, 0x08, 0x06, 0x2f,
+	0x09, 0x8c, 0xaf, 0x72, 0xaa, 0x18, 0x2a, 0xd0, 0xa2, 0x45, 0x1d, 0x24, 0x85, 0x8d, 0xc6, 0xae,
+	0x4b, 0xd7, 0x39, 0xf4, 0x62, 0xac, 0xc8, 0xb5, 0x45, 0x58, 0xda, 0xdd, 0x90, 0x2b, 0xb5, 0x7a,
+	0x81, 0xf6, 0xda, 0xd7, 0x29, 0x7a, 0xe9, 0xb1, 0xc7, 0x1c, 0x7a, 0xe8, 0xb1, 0xb0, 0x9f, 0xa0,
+	0x97, 0x9e, 0x0b, 0x2e, 0x97, 0x14, 0x29, 0x39, 0x71, 0xdd, 0x16, 0xe8, 0xa1, 0x27, 0xed, 0xce,
+	0xfc, 0x66, 0x66, 0x77, 0x66, 0x7e, 0xc3, 0x15, 0x58, 0x98, 0xfb, 0xdb, 0xd3, 0x77, 0xb7, 0x31,
+	0xf7, 0xbb, 0x3c, 0x60, 0x82, 0x21, 0x03, 0x73, 0xdf, 0xbe, 0x07, 0xc6, 0x41, 0x78, 0x8e, 0x1a,
+	0x50, 0x7c, 0x89, 0x47, 0x13, 0xd2, 0xd2, 0x36, 0xb5, 0x47, 0xa6, 0x13, 0x6f, 0xec, 0x27, 0x50,
+	0x3a, 0x20, 0x61, 0x88, 0xcf, 0x49, 0x04, 0x10, 0x8c, 0xfb, 0x6e, 0x02, 0x90, 0x1b, 0x84, 0xa0,
+	0xe0, 0x61, 0x81, 0x5b, 0xc6, 0xa6, 0xf6, 0xa8, 0xea, 0xc8, 0xb5, 0xfd, 0x12, 0xea, 0x47, 0x93,
+	0xc1, 0xc8, 0x0f, 0x87, 0x0e, 0x79, 0x35, 0x21, 0xa1, 0x78, 0x83, 0x6d, 0x1b, 0xca, 0x43, 0x16,
+	0x0a, 0x8a, 0xc7, 0xa4, 0xa5, 0x4b, 0x45, 0xba, 0xbf, 0xd6, 0xef, 0x1a, 0xdc, 0x49, 0xfd, 0x86,
+	0x9c, 0xd1, 0x90, 0xd8, 0xcf, 0xc0, 0x3a, 0x9e, 0x0c, 0x42, 0x37, 0xf0, 0x07, 0xe4, 0x2f, 0x07,
+	0xb3, 0x3f, 0x01, 0x74, 0x42, 0xc3, 0xbf, 0xef, 0x67, 0x1d, 0xee, 0xe6, 0xfc, 0xa8, 0x43, 0xfe,
+	0xa6, 0xc1, 0xda, 0x1e, 0x0b, 0xc5, 0x67, 0x74, 0xe4, 0xd3, 0xd4, 0x7d, 0xd6, 0x91, 0xb6, 0x70,
+	0xfb, 0x2d, 0x30, 0x7d, 0x3e, 0xdd, 0x39, 0xc5, 0x9e, 0x17, 0xb4, 0xf4, 0x4d, 0xe3, 0x51, 0xa5,
+	0x57, 0xeb, 0x46, 0x75, 0x8b, 0xa4, 0xbb, 0x9e, 0x17, 0x38, 0xe5, 0x64, 0xa5, 0xb0, 0xfd, 0x18,
+	0x6b, 0xe4, 0xb1, 0xfd, 0x14, 0x2b, 0x57, 0xa8, 0x07, 0x35, 0xf2, 0xb5, 0x20, 0x01, 0xc5, 0xa3,
+	0x18, 0x5f, 0xd8, 0xd4, 0x96, 0x7d, 0x57, 0x13, 0x8c, 0xb4, 0xd9, 0x81, 0x7a, 0xce, 0xa6, 0xdf,
+	0x2a, 0xe6, 0x8d, 0xe2, 0x20, 0xb5, 0xac, 0x51, 0xdf, 0x6e, 0x00, 0xca, 0x5e, 0x59, 0x65, 0xe2,
+	0x03, 0xb0, 0x22, 0xe9, 0xe7, 0x13, 0x12, 0xcc, 0x92, 0x3c, 0x3c, 0x84, 0x3b, 0x02, 0x07, 0xe7,
+	0x44, 0x9c, 0x2e, 0xa4, 0xa3, 0x1e, 0x8b, 0xf7, 0x92, 0xec, 0x5e, 0xc0, 0x5a, 0xc6, 0x38, 0xf6,
+	0x98, 0xcf, 0x94, 0x76, 0x8b, 0x4c, 0xe9, 0x6f, 0xcd, 0x94, 0xfd, 0xbd, 0x1e, 0x47, 0x3b, 0xe1,
+	0x1e, 0x16, 0xff, 0x8d, 0x9a, 0xa1, 0x87, 0x50, 0xa6, 0x58, 0x9c, 0x8a, 0x19, 0x27, 0xad, 0x55,
+	0x89, 0xaf, 0x4a, 0xfc, 0x21, 0x16, 0x5f, 0xcc, 0x38, 0x71, 0x4a, 0x34, 0x5e, 0xa0, 0x07, 0x00,
+	0x3c, 0x22, 0xa2, 0x7b, 0x7a, 0x41, 0x66, 0xad, 0x92, 0x4c, 0x84, 0x19, 0x4b, 0x3e, 0x25, 0x33,
+	0xbb, 0x0b, 0x28, 0x9b, 0x3a, 0x55, 0xa9, 0x16, 0x94, 0xc2, 0x89, 0xeb, 0x92, 0x30, 0x94, 0xa9,
+	0x2b, 0x3b, 0xc9, 0x36, 0xe9, 0x8a, 0xa3, 0x09, 0x75, 0x87, 0xb7, 0xee, 0x8a, 0x77, 0x60, 0x2d,
+	0x63, 0x7c, 0x63, 0xac, 0x6f, 0xb4, 0x38, 0xd8, 0x01, 0x9b, 0x12, 0xef, 0x5f, 0x2c, 0x6b, 0x72,
+	0x6e, 0x75, 0x8e, 0x1b, 0xcf, 0xbd, 0x07, 0x8d, 0x08, 0xfe, 0x0f, 0x0c, 0xbb, 0x5d, 0x58, 0x5f,
+	0xf0, 0xa4, 0x82, 0x37, 0xa0, 0x48, 0xa6, 0x84, 0x8a, 0xc4, 0x95, 0xdc, 0xa4, 0x83, 0x38, 0x76,
+	0x23, 0xd7, 0xf6, 0xcf, 0x45, 0xa8, 0xc8, 0xc3, 0xab, 0x4f, 0xc3, 0x63, 0x28, 0xc8, 0xa6, 0x89,
+	0x0c, 0xeb, 0xbd, 0xfb, 0xf2, 0xca, 0x19, 0x7d, 0x57, 0xfd, 0xca, 0x26, 0x92, 0xc8, 0xe5, 0xa6,
+	0xd6, 0x6f, 0x6e, 0xea, 0x5c, 0x25, 0x8c, 0x1b, 0x2b, 0xb1, 0x9f, 0x56, 0xa2, 0x70, 0x6d, 0x25,
+	0xf6, 0xd5, 0x2a, 0x97, 0xac, 0xe2, 0x42, 0xf5, 0xff, 0x0f, 0x10, 0x90, 0x11, 0x9e, 0xc5, 0x8e,
+	0x56, 0xaf, 0x0b, 0x6a, 0x4a, 0x80, 0xf4, 0xd4, 0x84, 0xd5, 0xb8, 0x3b, 0x15, 0x27, 0xd4, 0xee,
+	0x1a, 0x3a, 0x96, 0x6f, 0x49, 0x47, 0xf3, 0xcf, 0xd3, 0x11, 0x16, 0xe8, 0x88, 0xba, 0x50, 0x99,
+	0xdf, 0xa1, 0xdf, 0xaa, 0x5c, 0x97, 0x0d, 0x48, 0x2f, 0xd1, 0xb7, 0x7f, 0xd7, 0xa0, 0x92, 0xa9,
+	0x18, 0x2a, 0x43, 0xe1, 0x90, 0x51, 0x62, 0xad, 0xa0, 0x1a, 0x98, 0xe9, 0x04, 0xb6, 0x34, 0x84,
+	0xa0, 0x9e, 0x19, 0xc8, 0x7c, 0x34, 0xb3, 0x74, 0xd4, 0x86, 0xe6, 0x9c, 0xfb, 0x87, 0x4c, 0xf8,
+	0x67, 0xbe, 0x8b, 0x85, 0xcf, 0xa8, 0x65, 0xa0, 0xff, 0xc1, 0x7a, 0xda, 0xf2, 0x39, 0x55, 0x21,
+	0x51, 0x49, 0x16, 0xe7, 0x54, 0xc5, 0xc4, 0x63, 0xfc, 0x25, 0xc9, 0xe9, 0x56, 0xd1, 0x3d, 0xd8,
+	0x90, 0xba, 0xb3, 0xb3, 0x25, 0x65, 0x09, 0x35, 0x62, 0xa6, 0x3b, 0xd1, 0xcd, 0x14, 0x5d, 0xac,
+	0x72, 0x12, 0x49, 0x4a, 0x73, 0x06, 0xa6, 0xfd, 0xad, 0x06, 0x25, 0x95, 0x5c, 0xb4, 0x05, 0xa5,
+	0x31, 0xe6, 0xdc, 0xa7, 0xe7, 0xaa, 0xab, 0xad, 0x24, 0xf7, 0x4f, 0xc9, 0x10, 0x4f, 0x7d, 0x16,
+	0x38, 0x09, 0x00, 0x75, 0xc1, 0x3c, 0xf3, 0x47, 0x82, 0x04, 0x11, 0x5a, 0x7f, 0x03, 0x7a, 0x0e,
+	0x41, 0x9b, 0x50, 0x19, 0x62, 0x3f, 0xe0, 0x3e, 0xa5, 0x91, 0x85, 0x21, 0x99, 0x9e, 0x15, 0x45,
+	0x53, 0xaa, 0xfc, 0x9c, 0x4e, 0xc9, 0x88, 0x71, 0x39, 0x14, 0x38, 0x9e, 0x8d, 0x18, 0xf6, 0xe4,
+	0x51, 0xaa, 0x4e, 0xb2, 0x45, 0xf7, 0xc1, 0x14, 0xfe, 0x98, 0x84, 0x02, 0x8f, 0xb9, 0x0c, 0x6c,
+	0x38, 0x73, 0x41, 0xc4, 0x67, 0xca, 0xa8, 0x4b, 0x64, 0x80, 0x82, 0x13, 0x6f, 0x90, 0x05, 0xc6,
+	0x18, 0xbb, 0xf2, 0x23, 0x52, 0x75, 0xa2, 0xe5, 0xdb, 0xfa, 0xdf, 0xee, 0xc2, 0x9c, 0x53, 0x75,
+	0xd0, 0xf7, 0xb9, 0x3c, 0x42, 0xcd, 0xd1, 0xf7, 0x79, 0x34, 0x19, 0x8e, 0x58, 0x20, 0x64, 0xe0,
+	0x9a, 0x23, 0xd7, 0xf6, 0x47, 0x30, 0xff, 0x70, 0xd5, 0x41, 0xdf, 0xf3, 0x25, 0xbe, 0xe0, 0xe8,
+	0x7b, 0x7e, 0xb4, 0x7f, 0xc1, 0x24, 0xba, 0xe0, 0xe8, 0x2f, 0x58, 0x6a, 0x6f, 0xcc, 0xed, 0xb7,
+	0x5e, 0x41, 0x25, 0x93, 0x34, 0x54, 0x81, 0xd2, 0x09, 0xbd, 0xa0, 0xec, 0x2b, 0x6a, 0xad, 0x20,
+	0x13, 0x8a, 0x87, 0xec, 0x10, 0x0b, 0x4b, 0x43, 0x1b, 0x70, 0xf7, 0x39, 0xf5, 0x38, 0xf3, 0xa9,
+	0xd8, 0xa7, 0x1e, 0xe1, 0x84, 0x7a, 0x84, 0x0a, 0x4b, 0x8f, 0x6a, 0x1e, 0xc5, 0x26, 0x61, 0xf8,
+	0x2c, 0x95, 0x1a, 0x51, 0x9b, 0x28, 0xe9, 0x2e, 0xf5, 0xa2, 0x38, 0x73, 0x65, 0xa1, 0xf7, 0x83,
+	0x06, 0xb5, 0xa3, 0xc9, 0xe0, 0x78, 0x32, 0x38, 0x26, 0xc1, 0xd4, 0x77, 0x09, 0xda, 0x81, 0x92,
+	0x7a, 0x67, 0xa2, 0xbb, 0xb2, 0x8e, 0xf9, 0xd7, 0x6c, 0xbb, 0x91, 0x17, 0xaa, 0xf1, 0xd9, 0x03,
+	0x33, 0x9d, 0xa9, 0x68, 0x5d, 0x42, 0x16, 0xa7, 0x75, 0x3b, 0x26, 0xb0, 0x22, 0xd7, 0x63, 0x0d,
+	0x7d, 0x0c, 0x95, 0xcc, 0x83, 0x11, 0x6d, 0x48, 0xf5, 0xf2, 0x53, 0xb4, 0xdd, 0x5a, 0x56, 0xc4,
+	0x51, 0x7b, 0x3f, 0xea, 0x50, 0x95, 0xac, 0x49, 0x0e, 0xff, 0x21, 0xc0, 0x9c, 0x2e, 0xa8, 0x99,
+	0xce, 0xe2, 0xdc, 0xe3, 0xb3, 0xbd, 0xb1, 0x24, 0x57, 0xb7, 0x78, 0x3f, 0x43, 0x71, 0x75, 0x8b,
+	0xc5, 0x17, 0x5b, 0xbb, 0xb9, 0x28, 0x56, 0xb6, 0x2a, 0x74, 0xcc, 0xfd, 0x4c, 0xe8, 0xdc, 0x1b,
+	0xaa, 0xbd, 0xb1, 0x24, 0xcf, 0x87, 0x96, 0xb7, 0xc9, 0x84, 0xce, 0x3e, 0x0b, 0xda, 0xcd, 0x45,
+	0x71, 0xde, 0x56, 0x8e, 0x96, 0x8c, 0x6d, 0xf6, 0x2b, 0xdf, 0x6e, 0x2e, 0x8a, 0x63, 0xdb, 0xa7,
+	0xef, 0xfd, 0x74, 0xd9, 0xd1, 0x5e, 0x5f, 0x76, 0xb4, 0x5f, 0x2f, 0x3b, 0xda, 0x77, 0x57, 0x9d,
+	0x95, 0xd7, 0x57, 0x9d, 0x95, 0x5f, 0xae, 0x3a, 0x2b, 0x5f, 0x3e, 0x38, 0xf7, 0xc5, 0x70, 0x32,
+	0xe8, 0xba, 0x6c, 0xbc, 0xed, 0xb2, 0x30, 0x14, 0x04, 0x8f, 0xb7, 0x79, 0x14, 0x38, 0xfa, 0x13,
+	0x35, 0x58, 0x95, 0xff, 0xa2, 0x9e, 0xfc, 0x31, 0x00, 0x3b, 0x92, 0x3d, 0xde, 0x59, 0x0d, 0x00,
+	0x00,
 }
 
 func (m *Msg) Marshal() (dAtA []byte, err error) {
@@ -1529,6 +1829,18 @@ func (m *HostOnlineRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.ExternalAddr6 != nil {
+		{
+			size, err := m.ExternalAddr6.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintApi(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x2a
+	}
 	if m.ExternalAddr != nil {
 		{
 			size, err := m.ExternalAddr.MarshalToSizedBuffer(dAtA[:i])
@@ -1703,6 +2015,37 @@ func (m *HostUpdateRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.PublicKey) > 0 {
+		i -= len(m.PublicKey)
+		copy(dAtA[i:], m.PublicKey)
+		i = encodeVarintApi(dAtA, i, uint64(len(m.PublicKey)))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.NatType != nil {
+		{
+			size, err := m.NatType.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintApi(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x32
+	}
+	if m.ExternalAddr6 != nil {
+		{
+			size, err := m.ExternalAddr6.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintApi(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x2a
+	}
 	if m.ExternalAddr != nil {
 		{
 			size, err := m.ExternalAddr.MarshalToSizedBuffer(dAtA[:i])
@@ -2034,6 +2377,72 @@ func (m *HostMessage) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.RelayAddr6) > 0 {
+		for iNdEx := len(m.RelayAddr6) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RelayAddr6[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintApi(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x5a
+		}
+	}
+	if len(m.PublicKey) > 0 {
+		i -= len(m.PublicKey)
+		copy(dAtA[i:], m.PublicKey)
+		i = encodeVarintApi(dAtA, i, uint64(len(m.PublicKey)))
+		i--
+		dAtA[i] = 0x52
+	}
+	if m.NatType != nil {
+		{
+			size, err := m.NatType.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintApi(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x4a
+	}
+	if m.ExternalAddr6 != nil {
+		{
+			size, err := m.ExternalAddr6.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintApi(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x42
+	}
+	if len(m.Target) > 0 {
+		i -= len(m.Target)
+		copy(dAtA[i:], m.Target)
+		i = encodeVarintApi(dAtA, i, uint64(len(m.Target)))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if len(m.RelayAddr) > 0 {
+		for iNdEx := len(m.RelayAddr) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RelayAddr[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintApi(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x32
+		}
+	}
 	if len(m.Hostname) > 0 {
 		i -= len(m.Hostname)
 		copy(dAtA[i:], m.Hostname)
@@ -2089,7 +2498,7 @@ func (m *HostMessage) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
-func (m *Ipv4Addr) Marshal() (dAtA []byte, err error) {
+func (m *NatType) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalToSizedBuffer(dAtA[:size])
@@ -2099,30 +2508,40 @@ func (m *Ipv4Addr) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *Ipv4Addr) MarshalTo(dAtA []byte) (int, error) {
+func (m *NatType) MarshalTo(dAtA []byte) (int, error) {
 	size := m.Size()
 	return m.MarshalToSizedBuffer(dAtA[:size])
 }
 
-func (m *Ipv4Addr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+func (m *NatType) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	i := len(dAtA)
 	_ = i
 	var l int
 	_ = l
-	if m.Port != 0 {
-		i = encodeVarintApi(dAtA, i, uint64(m.Port))
+	if m.Hairpinning {
+		i--
+		if m.Hairpinning {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Filtering != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Filtering))
 		i--
 		dAtA[i] = 0x10
 	}
-	if m.Ip != 0 {
-		i = encodeVarintApi(dAtA, i, uint64(m.Ip))
+	if m.Mapping != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Mapping))
 		i--
 		dAtA[i] = 0x8
 	}
 	return len(dAtA) - i, nil
 }
 
-func (m *Ipv6Addr) Marshal() (dAtA []byte, err error) {
+func (m *Envelope) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalToSizedBuffer(dAtA[:size])
@@ -2132,35 +2551,122 @@ func (m *Ipv6Addr) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *Ipv6Addr) MarshalTo(dAtA []byte) (int, error) {
+func (m *Envelope) MarshalTo(dAtA []byte) (int, error) {
 	size := m.Size()
 	return m.MarshalToSizedBuffer(dAtA[:size])
 }
 
-func (m *Ipv6Addr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+func (m *Envelope) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	i := len(dAtA)
 	_ = i
 	var l int
 	_ = l
-	if m.Port != 0 {
-		i = encodeVarintApi(dAtA, i, uint64(m.Port))
+	if len(m.Hostname) > 0 {
+		i -= len(m.Hostname)
+		copy(dAtA[i:], m.Hostname)
+		i = encodeVarintApi(dAtA, i, uint64(len(m.Hostname)))
+		i--
+		dAtA[i] = 0x2a
+	}
+	if len(m.Mac) > 0 {
+		i -= len(m.Mac)
+		copy(dAtA[i:], m.Mac)
+		i = encodeVarintApi(dAtA, i, uint64(len(m.Mac)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if m.Nonce != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Nonce))
 		i--
 		dAtA[i] = 0x18
 	}
-	if m.Lo != 0 {
-		i = encodeVarintApi(dAtA, i, uint64(m.Lo))
+	if m.Timestamp != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Timestamp))
 		i--
 		dAtA[i] = 0x10
 	}
-	if m.Hi != 0 {
-		i = encodeVarintApi(dAtA, i, uint64(m.Hi))
+	if len(m.Payload) > 0 {
+		i -= len(m.Payload)
+		copy(dAtA[i:], m.Payload)
+		i = encodeVarintApi(dAtA, i, uint64(len(m.Payload)))
 		i--
-		dAtA[i] = 0x8
+		dAtA[i] = 0xa
 	}
 	return len(dAtA) - i, nil
 }
 
-func encodeVarintApi(dAtA []byte, offset int, v uint64) int {
+func (m *Ipv4Addr) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Ipv4Addr) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Ipv4Addr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Port != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Port))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Ip != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Ip))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *Ipv6Addr) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Ipv6Addr) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Ipv6Addr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Port != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Port))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Lo != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Lo))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Hi != 0 {
+		i = encodeVarintApi(dAtA, i, uint64(m.Hi))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func encodeVarintApi(dAtA []byte, offset int, v uint64) int {
 	offset -= sovApi(v)
 	base := offset
 	for v >= 1<<7 {
@@ -2300,6 +2806,10 @@ func (m *HostOnlineRequest) Size() (n int) {
 		l = m.ExternalAddr.Size()
 		n += 1 + l + sovApi(uint64(l))
 	}
+	if m.ExternalAddr6 != nil {
+		l = m.ExternalAddr6.Size()
+		n += 1 + l + sovApi(uint64(l))
+	}
 	return n
 }
 
@@ -2372,6 +2882,18 @@ func (m *HostUpdateRequest) Size() (n int) {
 		l = m.ExternalAddr.Size()
 		n += 1 + l + sovApi(uint64(l))
 	}
+	if m.ExternalAddr6 != nil {
+		l = m.ExternalAddr6.Size()
+		n += 1 + l + sovApi(uint64(l))
+	}
+	if m.NatType != nil {
+		l = m.NatType.Size()
+		n += 1 + l + sovApi(uint64(l))
+	}
+	l = len(m.PublicKey)
+	if l > 0 {
+		n += 1 + l + sovApi(uint64(l))
+	}
 	return n
 }
 
@@ -2512,6 +3034,79 @@ func (m *HostMessage) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovApi(uint64(l))
 	}
+	if len(m.RelayAddr) > 0 {
+		for _, e := range m.RelayAddr {
+			l = e.Size()
+			n += 1 + l + sovApi(uint64(l))
+		}
+	}
+	l = len(m.Target)
+	if l > 0 {
+		n += 1 + l + sovApi(uint64(l))
+	}
+	if m.ExternalAddr6 != nil {
+		l = m.ExternalAddr6.Size()
+		n += 1 + l + sovApi(uint64(l))
+	}
+	if m.NatType != nil {
+		l = m.NatType.Size()
+		n += 1 + l + sovApi(uint64(l))
+	}
+	l = len(m.PublicKey)
+	if l > 0 {
+		n += 1 + l + sovApi(uint64(l))
+	}
+	if len(m.RelayAddr6) > 0 {
+		for _, e := range m.RelayAddr6 {
+			l = e.Size()
+			n += 1 + l + sovApi(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *NatType) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Mapping != 0 {
+		n += 1 + sovApi(uint64(m.Mapping))
+	}
+	if m.Filtering != 0 {
+		n += 1 + sovApi(uint64(m.Filtering))
+	}
+	if m.Hairpinning {
+		n += 2
+	}
+	return n
+}
+
+func (m *Envelope) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Payload)
+	if l > 0 {
+		n += 1 + l + sovApi(uint64(l))
+	}
+	if m.Timestamp != 0 {
+		n += 1 + sovApi(uint64(m.Timestamp))
+	}
+	if m.Nonce != 0 {
+		n += 1 + sovApi(uint64(m.Nonce))
+	}
+	l = len(m.Mac)
+	if l > 0 {
+		n += 1 + l + sovApi(uint64(l))
+	}
+	l = len(m.Hostname)
+	if l > 0 {
+		n += 1 + l + sovApi(uint64(l))
+	}
 	return n
 }
 
@@ -3393,6 +3988,42 @@ func (m *HostOnlineRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ExternalAddr6", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ExternalAddr6 == nil {
+				m.ExternalAddr6 = &Ipv6Addr{}
+			}
+			if err := m.ExternalAddr6.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipApi(dAtA[iNdEx:])
@@ -3829,6 +4460,110 @@ func (m *HostUpdateRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ExternalAddr6", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ExternalAddr6 == nil {
+				m.ExternalAddr6 = &Ipv6Addr{}
+			}
+			if err := m.ExternalAddr6.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NatType", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.NatType == nil {
+				m.NatType = &NatType{}
+			}
+			if err := m.NatType.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PublicKey", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PublicKey = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipApi(dAtA[iNdEx:])
@@ -4704,6 +5439,506 @@ func (m *HostMessage) Unmarshal(dAtA []byte) error {
 			}
 			m.Hostname = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayAddr", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RelayAddr = append(m.RelayAddr, &Ipv4Addr{})
+			if err := m.RelayAddr[len(m.RelayAddr)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Target", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Target = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ExternalAddr6", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ExternalAddr6 == nil {
+				m.ExternalAddr6 = &Ipv6Addr{}
+			}
+			if err := m.ExternalAddr6.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NatType", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.NatType == nil {
+				m.NatType = &NatType{}
+			}
+			if err := m.NatType.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PublicKey", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PublicKey = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayAddr6", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RelayAddr6 = append(m.RelayAddr6, &Ipv6Addr{})
+			if err := m.RelayAddr6[len(m.RelayAddr6)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipApi(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthApi
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NatType) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowApi
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NatType: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NatType: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Mapping", wireType)
+			}
+			m.Mapping = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Mapping |= NatBehavior(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Filtering", wireType)
+			}
+			m.Filtering = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Filtering |= NatBehavior(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hairpinning", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Hairpinning = bool(v != 0)
+		default:
+			iNdEx = preIndex
+			skippy, err := skipApi(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthApi
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Envelope) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowApi
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Envelope: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Envelope: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Payload", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Payload = append(m.Payload[:0], dAtA[iNdEx:postIndex]...)
+			if m.Payload == nil {
+				m.Payload = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timestamp", wireType)
+			}
+			m.Timestamp = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Timestamp |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Nonce", wireType)
+			}
+			m.Nonce = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Nonce |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Mac", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Mac = append(m.Mac[:0], dAtA[iNdEx:postIndex]...)
+			if m.Mac == nil {
+				m.Mac = []byte{}
+			}
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hostname", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowApi
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthApi
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthApi
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hostname = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipApi(dAtA[iNdEx:])
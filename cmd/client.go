@@ -1,12 +1,26 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/auth"
 	"github.com/cossteam/punchline/pkg/controller"
+	controllerClient "github.com/cossteam/punchline/pkg/controller/client"
+	"github.com/cossteam/punchline/pkg/host"
 	"github.com/cossteam/punchline/pkg/ice"
 	"github.com/cossteam/punchline/pkg/log"
+	"github.com/cossteam/punchline/pkg/netmon"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
 	"github.com/cossteam/punchline/pkg/signal"
+	stunclient "github.com/cossteam/punchline/pkg/sutn"
+	"github.com/cossteam/punchline/pkg/transport/udp"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
 )
 
 func init() {
@@ -34,11 +48,10 @@ var Client = &cli.Command{
 			Usage: "hostname",
 			Value: "",
 		},
-		&cli.StringFlag{
+		&cli.UintFlag{
 			Name:    "endpointPort",
 			Usage:   "endpointPort",
 			Aliases: []string{"ep"},
-			Value:   "0",
 		},
 		&cli.StringFlag{
 			Name:    "server",
@@ -54,8 +67,7 @@ var Client = &cli.Command{
 		&cli.StringSliceFlag{
 			Name:    "stunServer",
 			Aliases: []string{"ss"},
-			Usage:   "List of names",
-			Value:   cli.NewStringSlice("stun:stun3.l.google.com:19302", "stun:stun.cunicu.li:3478", "stun:stun.easyvoip.com:3478"),
+			Usage:   "STUN servers, defaults to the STUN service on the lighthouse port",
 		},
 		&cli.StringSliceFlag{
 			Name:    "subscriptions",
@@ -71,59 +83,335 @@ func runClient(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := c.ValidateClient(); err != nil {
+		return err
+	}
+
+	logger, level, err := log.NewLogger(c.Logging.Level)
+	if err != nil {
+		return err
+	}
+	if fields := c.IgnoredClientFields(); len(fields) > 0 {
+		logger.Warn("configuration fields are only used by the lighthouse client and are ignored when server is not set",
+			zap.Strings("fields", fields))
+	}
 
-	logger, err := log.SetupLogger(c.Logging.Level)
+	ps, err := plugin.LoadPlugins(logger, c)
 	if err != nil {
 		return err
 	}
+	// 插件的事件按顺序在各自的队列中处理，所有 Peer 共用同一个插件集合，重新加载配置时可以替换其中的插件
+	reloader := newClientReloader(logger, level, c)
+	for _, p := range ps {
+		if err := reloader.addPlugin(p.Name(), p); err != nil {
+			return err
+		}
+	}
+
+	// 没有配置主机名时使用插件发现的公钥，与灯塔客户端和自动模式下对端订阅的主机名一致
+	hostname := c.Hostname
+	if hostname == "" {
+		if hostname, err = reloader.plugins.PublicKey(); err != nil {
+			logger.Error("Failed to discover public key", zap.Error(err))
+		}
+		if hostname != "" {
+			logger.Info("No hostname configured, using public key as hostname", zap.String("hostname", hostname))
+		}
+	}
 
-	//raddr, err := net.ResolveUDPAddr("udp", c.Server)
-	//if err != nil {
-	//	return err
-	//}
-	//
-	//makeup, err := udp.DialMakeup(raddr.IP, raddr.Port)
-	//if err != nil {
-	//	return fmt.Errorf("failed to dial makeup: %w", err)
-	//}
-
-	//coordinator := make([]*net.UDPAddr, 0)
-	//if raddr != nil {
-	//	coordinator = append(coordinator, raddr)
-	//}
-
-	//ps, err := plugin.LoadPlugins(logger, c)
-	//if err != nil {
-	//	return err
-	//}
-
-	//client := controllerClient.NewClientController(
-	//	logger.With(zap.String("controller", "client")),
-	//	c.Hostname,
-	//	uint32(c.EndpointPort),
-	//	makeup,
-	//	coordinator,
-	//	c,
-	//	controllerClient.WithClientPlugins(ps),
-	//)
-
-	signalingClient, err := signal.NewClient(c.SignalServer, signal.WithClientName(c.Hostname))
+	signalingClient, err := signal.NewClient(c.SignalServer, signal.WithClientName(hostname))
 	if err != nil {
 		return err
 	}
 
-	var peers []controller.Runnable
-	for _, sub := range c.Subscriptions {
-		wrapper, err := ice.NewICEAgentWrapper(logger, signalingClient, c.StunServer, c.Hostname, sub.Topic)
+	// 配置了灯塔时从 endpointPort 打洞，STUN 查询也从 endpointPort 发出
+	var (
+		ep       *endpoint
+		stunConn net.PacketConn
+	)
+	if c.Server != "" {
+		if ep, err = newEndpoint(logger, c); err != nil {
+			return err
+		}
+		defer ep.Close()
+		stunConn = ep.stunConn
+	}
+
+	var monitor *netmon.Monitor
+	if !c.Network.Disabled {
+		monitor, reloader.stun, err = networkMonitor(logger.With(zap.String("controller", "netmon")), c, stunConn)
+		if err != nil {
+			return err
+		}
+		defer reloader.stun.Close()
+	}
+
+	runnables := []controller.Runnable{reloader.pluginRunners, reloader.peers}
+
+	var lighthouse controllerClient.Client
+	if c.Server != "" {
+		// 灯塔客户端与 ICE 的 Peer 同时运行，主机消息和 ICE 事件交给同一个插件集合
+		lighthouse, err = newLighthouseClient(logger.With(zap.String("controller", "client")), c,
+			ep, monitor, []plugin.Plugin{reloader.plugins})
 		if err != nil {
 			return err
 		}
-		peers = append(peers, wrapper)
+		runnables = append(runnables, lighthouse)
+		reloader.lighthouse = lighthouse
+	}
+
+	peerPlugins := []plugin.Plugin{reloader.plugins}
+	if lighthouse != nil {
+		// ICE 连接的状态作为灯塔客户端与对端直连的状态
+		peerPlugins = append(peerPlugins, lighthouse)
+	}
+	peerOpts := []ice.PeerOption{ice.WithPlugins(peerPlugins)}
+	for _, p := range ps {
+		// 与 WireGuard 共用端口，ICE 选中的端点对 WireGuard 才有效
+		if m, ok := p.(plugin.UDPMuxer); ok && m.UDPMux() != nil {
+			peerOpts = append(peerOpts, ice.WithUDPMux(m.UDPMux()))
+			break
+		}
+	}
+
+	// 新的 Peer 使用重新加载后的 STUN 服务器，STUN 服务器变化时重建所有 Peer，主机名需要重启才能修改
+	reloader.newPeer = func(cfg *config.Config, topic string) (controller.Runnable, error) {
+		wrapper, err := ice.NewICEAgentWrapper(logger, signalingClient, cfg.StunServers(), hostname, topic, peerOpts...)
+		if err != nil {
+			return nil, err
+		}
+		return controller.RunnableFunc(func(ctx context.Context) error {
+			if monitor != nil {
+				defer monitor.Subscribe(wrapper.OnNetworkChange)()
+			}
+			return wrapper.Start(ctx)
+		}), nil
+	}
+	if err := reloader.addPeers(c); err != nil {
+		return err
+	}
+
+	if monitor != nil {
+		runnables = append(runnables, monitor)
+	}
+	if c.Metrics.Listen != "" {
+		runnables = append(runnables, metricsServer(logger.With(zap.String("controller", "metrics")), c.Metrics.Listen))
+	}
+	if ctx.String("config") != "" {
+		runnables = append(runnables, configWatcher(ctx, logger, (*config.Config).ValidateClient, reloader.apply))
 	}
 
 	ctrl := controller.NewManager(
 		logger.With(zap.String("controller", "manager")),
-		peers...,
+		runnables...,
 	)
 	return ctrl.Start(SetupSignalHandler())
 }
+
+// newLighthouseClient 按配置创建灯塔客户端，从 ep 所在的 endpointPort 打洞并向灯塔发送主机更新，
+// monitor 可以为 nil，收到的主机消息交给 plugins 处理
+func newLighthouseClient(
+	logger *zap.Logger,
+	c *config.Config,
+	ep *endpoint,
+	monitor *netmon.Monitor,
+	plugins []plugin.Plugin,
+) (controllerClient.Client, error) {
+	raddr, err := net.ResolveUDPAddr("udp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	localAllowList, err := host.NewAllowList(c.AllowList.Local)
+	if err != nil {
+		return nil, err
+	}
+	remoteAllowList, err := host.NewAllowList(c.AllowList.Remote)
+	if err != nil {
+		return nil, err
+	}
+	preferredRanges, err := host.ParsePreferredRanges(c.PreferredRanges)
+	if err != nil {
+		return nil, err
+	}
+	familyPolicy, err := host.ParseFamilyPolicy(c.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []controllerClient.ClientOption{
+		controllerClient.WithClientPlugins(plugins),
+		controllerClient.WithLocalAllowList(localAllowList),
+		controllerClient.WithRemoteAllowList(remoteAllowList),
+		controllerClient.WithPreferredRanges(preferredRanges),
+		controllerClient.WithFamilyPolicy(familyPolicy),
+	}
+	if monitor != nil {
+		opts = append(opts, controllerClient.WithNetworkMonitor(monitor))
+	}
+	if ep.makeup6 != nil {
+		opts = append(opts, controllerClient.WithMakeupWriter6(ep.makeup6))
+	}
+	if ep.stunConn != nil {
+		opts = append(opts, controllerClient.WithSTUNConn(ep.stunConn))
+	}
+	if c.Auth.PSK != "" {
+		opts = append(opts, controllerClient.WithSigner(auth.NewSigner([]byte(c.Auth.PSK))))
+	}
+
+	return controllerClient.NewClientController(
+		logger,
+		c.Hostname,
+		uint32(c.EndpointPort),
+		ep.makeup,
+		[]*net.UDPAddr{raddr},
+		c,
+		opts...,
+	), nil
+}
+
+// endpoint 是 endpointPort 上用于打洞和查询 STUN 服务器的套接字
+type endpoint struct {
+	// makeup 从 endpointPort 向对端打洞
+	makeup udp.MakeupWriter
+	// makeup6 reuseport 模式下从 endpointPort 向 IPv6 对端打洞，makeup 只绑定 IPv4。
+	// raw 和 forward 模式下 makeup 同时支持两个地址族，makeup6 为 nil
+	makeup6 udp.MakeupWriter
+	// stunConn 从 endpointPort 查询 STUN 服务器，使上报的外部地址就是被打洞端口的映射，无法创建时为 nil
+	stunConn net.PacketConn
+}
+
+// newEndpoint 按打洞模式创建 endpointPort 上的套接字
+func newEndpoint(logger *zap.Logger, c *config.Config) (*endpoint, error) {
+	punchMode, err := udp.ParsePunchMode(c.Punch.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	var forwardAddr *net.UDPAddr
+	if c.Punch.ForwardAddr != "" {
+		if forwardAddr, err = net.ResolveUDPAddr("udp", c.Punch.ForwardAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	punchMode = udp.ResolvePunchMode(logger, punchMode)
+	opts := udp.MakeupOptions{
+		Mode:        punchMode,
+		Port:        int(c.EndpointPort),
+		ForwardAddr: forwardAddr,
+	}
+	if punchMode == udp.PunchModeReusePort {
+		opts.Network = "udp4"
+	}
+	makeup, punchMode, err := udp.NewMakeupWriter(logger, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s makeup writer: %w", punchMode, err)
+	}
+	ep := &endpoint{makeup: makeup}
+
+	if punchMode == udp.PunchModeReusePort {
+		// 主机没有 IPv6 时只向 IPv4 对端打洞
+		opts.Network = "udp6"
+		if ep.makeup6, _, err = udp.NewMakeupWriter(logger, opts); err != nil {
+			logger.Warn("Failed to create IPv6 makeup writer, punching IPv6 peers is disabled",
+				zap.Uint("endpointPort", c.EndpointPort), zap.Error(err))
+			ep.makeup6 = nil
+		}
+	}
+
+	if ep.stunConn, err = udp.STUNConn(makeup, int(c.EndpointPort)); err != nil {
+		logger.Warn("Failed to create STUN conn on endpoint port", zap.Uint("endpointPort", c.EndpointPort), zap.Error(err))
+		ep.stunConn = nil
+	}
+
+	return ep, nil
+}
+
+// Close 关闭 endpointPort 上的所有套接字
+func (ep *endpoint) Close() {
+	// PacketConner 提供的套接字随 MakeupWriter 一起关闭
+	if _, ok := ep.makeup.(udp.PacketConner); !ok && ep.stunConn != nil {
+		_ = ep.stunConn.Close()
+	}
+	if ep.makeup6 != nil {
+		_ = ep.makeup6.Close()
+	}
+	_ = ep.makeup.Close()
+}
+
+// stunProbe 是网络监控使用的外部地址探测，重新加载配置时可以替换其中的 STUN 客户端
+type stunProbe struct {
+	opts   []stunclient.Option
+	client atomic.Pointer[stunclient.MultiClient]
+}
+
+func newSTUNProbe(servers []string, opts ...stunclient.Option) (*stunProbe, error) {
+	p := &stunProbe{opts: opts}
+	if err := p.reset(servers); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reset 使用 servers 创建新的 STUN 客户端并关闭原来的客户端，创建失败时保留原来的客户端
+func (p *stunProbe) reset(servers []string) error {
+	client, err := stunclient.NewMultiClient(servers, p.opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create STUN client: %w", err)
+	}
+	if old := p.client.Swap(client); old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+func (p *stunProbe) Close() error {
+	if client := p.client.Swap(nil); client != nil {
+		return client.Close()
+	}
+	return nil
+}
+
+// external 返回所有 STUN 服务器看到的外部 IP，排序后以逗号连接
+func (p *stunProbe) external() (string, error) {
+	client := p.client.Load()
+	if client == nil {
+		return "", net.ErrClosed
+	}
+	addrs, err := client.ExternalAddrs()
+	if err != nil {
+		return "", err
+	}
+	// 只比较外部 IP，对称 NAT 上不同服务器看到的端口不同，个别服务器超时不应视为网络变化
+	ips := make(map[string]struct{})
+	for _, addr := range addrs {
+		ips[addr.IP.String()] = struct{}{}
+	}
+	keys := make([]string, 0, len(ips))
+	for ip := range ips {
+		keys = append(keys, ip)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ","), nil
+}
+
+// networkMonitor 创建监听本地网络变化的 Monitor，STUN 观察到的外部地址变化也视为网络变化。
+// stunConn 不为 nil 时从它 (endpointPort) 查询 STUN 服务器，观察的就是被打洞端口的映射，否则使用临时端口
+func networkMonitor(logger *zap.Logger, c *config.Config, stunConn net.PacketConn) (*netmon.Monitor, *stunProbe, error) {
+	stunOpts := []stunclient.Option{stunclient.WithTimeout(c.Stun.Timeout)}
+	if stunConn != nil {
+		stunOpts = append(stunOpts, stunclient.WithPacketConn(stunConn))
+	}
+	probe, err := newSTUNProbe(c.StunServers(), stunOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	monitor := netmon.NewMonitor(logger,
+		netmon.WithDebounce(c.Network.Debounce),
+		netmon.WithPollInterval(c.Network.PollInterval),
+		netmon.WithExternalProbe(probe.external),
+	)
+	return monitor, probe, nil
+}
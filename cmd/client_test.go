@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/auth"
+	controllersrv "github.com/cossteam/punchline/pkg/controller/server"
+	"github.com/cossteam/punchline/pkg/controller/signaling"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordPlugin 将收到的主机消息放入 msgs
+type recordPlugin struct {
+	msgs chan *api.HostMessage
+}
+
+func (p *recordPlugin) Name() string {
+	return "record"
+}
+
+func (p *recordPlugin) Handle(ctx context.Context, msg *api.HostMessage) {
+	select {
+	case p.msgs <- msg:
+	default:
+	}
+}
+
+// freePort 返回一个当前空闲的本地端口
+func freePort(t *testing.T, network string) int {
+	switch network {
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	default:
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+}
+
+// startLighthouse 启动一个只接受 hosts 中的主机签名消息的灯塔，返回灯塔 UDP 地址和 gRPC 地址
+func startLighthouse(t *testing.T, ctx context.Context, hosts map[string]string) (string, string) {
+	logger := zap.NewNop()
+	outside, err := udp.NewGenericListener(logger, net.IPv4(127, 0, 0, 1), 0)
+	require.NoError(t, err)
+	addr, err := outside.LocalAddr()
+	require.NoError(t, err)
+
+	c := &config.Config{
+		Server: addr.String(),
+		Addr:   fmt.Sprintf("127.0.0.1:%d", freePort(t, "tcp")),
+		Auth:   config.Auth{Hosts: hosts},
+	}
+	c.SetDefaults()
+
+	keys := make(map[string][]byte, len(hosts))
+	for hostname, psk := range hosts {
+		keys[hostname] = []byte(psk)
+	}
+	grpcServer := signaling.NewSignalingController(c.Addr, logger)
+	srv := controllersrv.NewServerController(logger, outside, c,
+		controllersrv.WithVerifier(auth.NewVerifier(keys, c.Auth.MaxSkew)),
+		controllersrv.WithGRPCServer(grpcServer.GRPCServer()),
+	)
+	go func() { _ = srv.Start(ctx) }()
+	go func() { _ = grpcServer.Start(ctx) }()
+	return c.Server, c.Addr
+}
+
+func TestLighthouseClientAuth(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		psk      string
+		accepted bool
+	}{
+		{name: "valid psk", psk: "secret", accepted: true},
+		{name: "wrong psk", psk: "wrong", accepted: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server, signalServer := startLighthouse(t, ctx, map[string]string{"a": "secret"})
+
+			// 订阅自己，灯塔接受主机更新后会推送打洞通知
+			c := &config.Config{
+				Server:        server,
+				SignalServer:  signalServer,
+				Hostname:      "a",
+				EndpointPort:  uint(freePort(t, "udp")),
+				Subscriptions: []config.Subscriptions{{Topic: "a"}},
+				Punch:         config.Punch{Mode: "reuseport"},
+				Auth:          config.Auth{PSK: tt.psk},
+			}
+			c.SetDefaults()
+			require.NoError(t, c.ValidateClient())
+
+			ep, err := newEndpoint(zap.NewNop(), c)
+			require.NoError(t, err)
+			defer ep.Close()
+
+			rec := &recordPlugin{msgs: make(chan *api.HostMessage, 16)}
+			client, err := newLighthouseClient(zap.NewNop(), c, ep, nil, []plugin.Plugin{rec})
+			require.NoError(t, err)
+
+			rejected := authRejected()
+			go func() { _ = client.Start(ctx) }()
+
+			timeout := time.After(3 * time.Second)
+			for {
+				select {
+				case hm := <-rec.msgs:
+					if hm.Type != api.HostMessage_HostPunchNotification {
+						continue
+					}
+					assert.True(t, tt.accepted, "host update with a wrong psk was accepted")
+					assert.Equal(t, "a", hm.Hostname)
+					return
+				case <-timeout:
+					assert.False(t, tt.accepted, "host update was not accepted")
+					assert.Greater(t, authRejected(), rejected)
+					return
+				}
+			}
+		})
+	}
+}
+
+// authRejected 返回灯塔拒绝的未经认证的消息总数
+func authRejected() int64 {
+	var n int64
+	expvar.Get("punchline_lighthouse_auth_rejected").(*expvar.Map).Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			n += v.Value()
+		}
+	})
+	return n
+}
+
+func TestNewEndpointReusePort(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	_ = conn.Close()
+
+	c := &config.Config{
+		EndpointPort: uint(freePort(t, "udp")),
+		Punch:        config.Punch{Mode: "reuseport"},
+	}
+	ep, err := newEndpoint(zap.NewNop(), c)
+	require.NoError(t, err)
+	defer ep.Close()
+
+	// IPv4 和 IPv6 对端分别从两个绑定在 endpointPort 上的套接字打洞
+	require.NotNil(t, ep.makeup6)
+	peer, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	require.NoError(t, err)
+	defer peer.Close()
+	paddr := udp.NewAddr(net.IPv6loopback, uint16(peer.LocalAddr().(*net.UDPAddr).Port))
+	require.NoError(t, ep.makeup6.WriteTo(uint16(c.EndpointPort), paddr.Port, []byte("punch"), paddr))
+
+	buf := make([]byte, 16)
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, from, err := peer.ReadFromUDP(buf)
+	require.NoError(t, err)
+	assert.Equal(t, int(c.EndpointPort), from.Port)
+	assert.Error(t, ep.makeup.WriteTo(uint16(c.EndpointPort), paddr.Port, []byte("punch"), paddr))
+}
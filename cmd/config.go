@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	App.Commands = append(App.Commands, Config)
+}
+
+var Config = &cli.Command{
+	Name:  "config",
+	Usage: "configuration utilities",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "check",
+			Usage: "check the configuration file, including PUNCHLINE_* environment overrides",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "config",
+					Aliases:  []string{"c"},
+					Usage:    "config file path",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "role",
+					Usage: "the command the configuration is used by (client server signal)",
+					Value: "client",
+				},
+			},
+			Action: runConfigCheck,
+		},
+	},
+}
+
+func runConfigCheck(ctx *cli.Context) error {
+	c, err := applyConfig(ctx)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var validate func() error
+	switch role := ctx.String("role"); role {
+	case "client":
+		validate = c.ValidateClient
+	case "server":
+		validate = c.ValidateServer
+	case "signal":
+		validate = c.Validate
+	default:
+		return fmt.Errorf("unknown role %q (client server signal)", role)
+	}
+
+	if err := validate(); err != nil {
+		// 每个字段的错误单独一行
+		var joined interface{ Unwrap() []error }
+		if errors.As(err, &joined) {
+			for _, e := range joined.Unwrap() {
+				fmt.Fprintln(ctx.App.ErrWriter, e)
+			}
+		} else {
+			fmt.Fprintln(ctx.App.ErrWriter, err)
+		}
+		return cli.Exit("invalid configuration", 1)
+	}
+
+	if ctx.String("role") == "client" {
+		for _, field := range c.IgnoredClientFields() {
+			fmt.Fprintf(ctx.App.ErrWriter, "warning: %s is ignored when server is not set\n", field)
+		}
+	}
+	fmt.Fprintf(ctx.App.Writer, "%s: configuration is valid for %s\n", ctx.String("config"), ctx.String("role"))
+	return nil
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+
+	"github.com/cossteam/punchline/pkg/controller"
+	"go.uber.org/zap"
+)
+
+// metricsServer 在 addr 上通过 HTTP 提供 expvar 指标，路径为 /debug/vars
+func metricsServer(logger *zap.Logger, addr string) controller.Runnable {
+	return controller.RunnableFunc(func(ctx context.Context) error {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		srv := &http.Server{Handler: mux}
+
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		logger.Info("Serving metrics", zap.Stringer("addr", lis.Addr()))
+
+		go func() {
+			<-ctx.Done()
+			_ = srv.Close()
+		}()
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+
+	stunclient "github.com/cossteam/punchline/pkg/sutn"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	App.Commands = append(App.Commands, NATCheck)
+}
+
+var NATCheck = &cli.Command{
+	Name:  "nat-check",
+	Usage: "detect the NAT mapping and filtering behavior (RFC 5780)",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Aliases: []string{"c"},
+			Usage:   "config file path",
+			Value:   "",
+		},
+		&cli.StringFlag{
+			Name:    "server",
+			Aliases: []string{"srv"},
+			Usage:   "lighthouse server, used as the STUN server when none is configured",
+			Value:   "",
+		},
+		&cli.StringSliceFlag{
+			Name:    "stunServer",
+			Aliases: []string{"ss"},
+			Usage:   "STUN servers supporting RFC 5780, tried in order",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "timeout of each behavior test",
+		},
+	},
+	Action: runNATCheck,
+}
+
+func runNATCheck(ctx *cli.Context) error {
+	c, err := applyConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, uri := range c.StunServers() {
+		server, err := stunclient.ServerAddr(uri)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		nat, err := stunclient.DetectNAT(server, ctx.Duration("timeout"))
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", uri, err)
+			continue
+		}
+
+		fmt.Printf("STUN server:  %s\n", uri)
+		fmt.Printf("Mapped addr:  %s\n", nat.MappedAddr)
+		fmt.Printf("Mapping:      %s\n", nat.Mapping)
+		fmt.Printf("Filtering:    %s\n", nat.Filtering)
+		fmt.Printf("Hairpinning:  %t\n", nat.Hairpinning)
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no STUN server configured")
+	}
+	return lastErr
+}
@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"reflect"
+
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/controller"
+	controllerClient "github.com/cossteam/punchline/pkg/controller/client"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
+	"github.com/cossteam/punchline/pkg/reload"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// reloadableFields 可以在运行时应用的顶层配置字段，其他字段的变化需要重启才能生效
+var reloadableFields = map[string]bool{
+	"logging":       true,
+	"subscriptions": true,
+	"stunServer":    true,
+	"plugins":       true,
+}
+
+// configWatcher 创建监听配置文件的 Watcher，重新加载时与启动时一样应用环境变量和命令行参数
+func configWatcher(ctx *cli.Context, logger *zap.Logger, validate func(*config.Config) error, apply func(*config.Config)) *reload.Watcher {
+	return reload.NewWatcher(logger.With(zap.String("controller", "reload")), ctx.String("config"), func() (*config.Config, error) {
+		c, err := applyConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := validate(c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}, apply)
+}
+
+// setLogLevel 修改运行中的日志级别，配置已经通过校验，级别总是有效的
+func setLogLevel(logger *zap.Logger, level zap.AtomicLevel, old, new *config.Config) {
+	if old.Logging.Level == new.Logging.Level {
+		return
+	}
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(new.Logging.Level)); err != nil {
+		logger.Error("invalid log level", zap.String("level", new.Logging.Level), zap.Error(err))
+		return
+	}
+	// 先记录日志，降低日志级别后这条日志不再输出
+	logger.Info("log level changed", zap.String("level", new.Logging.Level))
+	level.SetLevel(l)
+}
+
+// warnRestart 对需要重启才能生效的字段变化记录警告
+func warnRestart(logger *zap.Logger, old, new *config.Config, reloadable map[string]bool) {
+	var fields []string
+	for _, field := range config.Diff(old, new) {
+		if !reloadable[field] {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > 0 {
+		logger.Warn("configuration changes require a restart to take effect", zap.Strings("fields", fields))
+	}
+}
+
+// clientReloader 将重新加载的配置增量应用到运行中的客户端，
+// 只有增减的订阅和变化的插件受影响，其他 Peer 保持连接
+type clientReloader struct {
+	// base 用于创建插件，logger 记录重新加载的过程
+	base   *zap.Logger
+	logger *zap.Logger
+	level  zap.AtomicLevel
+	config *config.Config
+
+	// peers 按订阅主题保存每个 Peer
+	peers   *controller.Group
+	newPeer func(c *config.Config, topic string) (controller.Runnable, error)
+
+	// plugins 是所有 Peer 共用的插件集合，pluginRunners 按插件名称保存对应的 Runner，
+	// specs 是正在运行的插件配置
+	plugins       *plugin.Set
+	pluginRunners *controller.Group
+	specs         map[string]config.Plugin
+
+	// lighthouse 是配置了灯塔时的灯塔客户端，stun 是网络监控的外部地址探测，没有时为 nil
+	lighthouse controllerClient.Client
+	stun       *stunProbe
+}
+
+func newClientReloader(logger *zap.Logger, level zap.AtomicLevel, c *config.Config) *clientReloader {
+	r := &clientReloader{
+		base:          logger,
+		logger:        logger.With(zap.String("controller", "reload")),
+		level:         level,
+		config:        c,
+		peers:         controller.NewGroup(logger.With(zap.String("controller", "peers"))),
+		plugins:       plugin.NewSet(),
+		pluginRunners: controller.NewGroup(logger.With(zap.String("controller", "plugins"))),
+		specs:         make(map[string]config.Plugin),
+	}
+	for _, p := range c.Plugins {
+		r.specs[p.Name] = p
+	}
+	return r
+}
+
+// addPlugin 将插件放入集合并启动它的 Runner
+func (r *clientReloader) addPlugin(name string, p plugin.Plugin) error {
+	runner := plugin.NewRunner(r.base, p)
+	if err := r.pluginRunners.Add(name, runner); err != nil {
+		return err
+	}
+	r.plugins.Put(name, runner)
+	return nil
+}
+
+// topics 返回配置的订阅和插件发现的主机名 (例如自动模式下 WireGuard 的对端)，
+// 与灯塔客户端订阅的主机一致，发现失败时仍然返回配置的订阅
+func (r *clientReloader) topics(c *config.Config) []string {
+	var topics []string
+	seen := make(map[string]bool)
+	add := func(topic string) {
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	for _, sub := range c.Subscriptions {
+		add(sub.Topic)
+	}
+	hosts, err := r.plugins.Subscriptions()
+	if err != nil {
+		r.logger.Error("failed to discover subscriptions", zap.Error(err))
+	}
+	for _, h := range hosts {
+		add(h)
+	}
+	return topics
+}
+
+// addPeers 为所有订阅创建 Peer
+func (r *clientReloader) addPeers(c *config.Config) error {
+	for _, topic := range r.topics(c) {
+		if err := r.addPeer(c, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *clientReloader) addPeer(c *config.Config, topic string) error {
+	peer, err := r.newPeer(c, topic)
+	if err != nil {
+		return err
+	}
+	return r.peers.Add(topic, peer)
+}
+
+func (r *clientReloader) apply(c *config.Config) {
+	old := r.config
+	r.config = c
+
+	setLogLevel(r.logger, r.level, old, c)
+	r.applyPlugins(c)
+	if !reflect.DeepEqual(old.StunServers(), c.StunServers()) {
+		r.applySTUNServers(c)
+	}
+	r.applySubscriptions(c)
+	warnRestart(r.logger, old, c, reloadableFields)
+}
+
+// applySTUNServers 替换网络监控和灯塔客户端的 STUN 客户端，Peer 的 ICE Agent 在创建时收集候选地址，
+// 因此停止所有 Peer 并按新的配置重新创建
+func (r *clientReloader) applySTUNServers(c *config.Config) {
+	servers := c.StunServers()
+	r.logger.Info("STUN servers changed", zap.Strings("servers", servers))
+	if r.stun != nil {
+		if err := r.stun.reset(servers); err != nil {
+			r.logger.Error("failed to reset network monitor STUN client", zap.Error(err))
+		}
+	}
+	if r.lighthouse != nil {
+		if err := r.lighthouse.SetSTUNServers(servers); err != nil {
+			r.logger.Error("failed to reset lighthouse STUN client", zap.Error(err))
+		}
+	}
+	for _, topic := range r.peers.Names() {
+		r.peers.Remove(topic)
+		if err := r.addPeer(c, topic); err != nil {
+			r.logger.Error("failed to recreate peer", zap.String("topic", topic), zap.Error(err))
+		}
+	}
+}
+
+// applySubscriptions 停止取消订阅的 Peer，为新的订阅创建 Peer，并同步灯塔客户端订阅的主机，
+// 插件发现的主机按重新加载后的插件重新发现
+func (r *clientReloader) applySubscriptions(c *config.Config) {
+	topics := r.topics(c)
+	if r.lighthouse != nil {
+		r.lighthouse.SetSubscriptions(topics)
+	}
+	keep := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		keep[topic] = true
+	}
+	for _, topic := range r.peers.Names() {
+		if !keep[topic] {
+			r.peers.Remove(topic)
+			r.logger.Info("subscription removed", zap.String("topic", topic))
+		}
+	}
+	for _, topic := range topics {
+		if r.peers.Has(topic) {
+			continue
+		}
+		if err := r.addPeer(c, topic); err != nil {
+			r.logger.Error("failed to add subscription", zap.String("topic", topic), zap.Error(err))
+			continue
+		}
+		r.logger.Info("subscription added", zap.String("topic", topic))
+	}
+}
+
+// applyPlugins 停止移除或者配置变化的插件，再按新的配置创建插件。
+// 提供 UDPMux 的插件 (例如 wg) 与 Peer 共用端口，替换它需要重建所有 Peer，因此只记录警告
+func (r *clientReloader) applyPlugins(c *config.Config) {
+	specs := make(map[string]config.Plugin, len(c.Plugins))
+	for _, p := range c.Plugins {
+		specs[p.Name] = p
+	}
+
+	for name, running := range r.specs {
+		if spec, ok := specs[name]; ok && reflect.DeepEqual(running, spec) {
+			continue
+		}
+		if p, ok := r.plugins.Get(name); ok {
+			if m, ok := plugin.Unwrap(p).(plugin.UDPMuxer); ok && m.UDPMux() != nil {
+				r.logger.Warn("plugin shares the ICE port and requires a restart to change", zap.String("plugin", name))
+				continue
+			}
+		}
+		r.plugins.Remove(name)
+		r.pluginRunners.Remove(name)
+		delete(r.specs, name)
+		r.logger.Info("plugin stopped", zap.String("plugin", name))
+	}
+
+	for i := range c.Plugins {
+		spec := c.Plugins[i]
+		if _, ok := r.specs[spec.Name]; ok {
+			continue
+		}
+		p, err := plugin.LoadPlugin(r.base, &spec)
+		if err != nil {
+			r.logger.Error("failed to load plugin", zap.String("plugin", spec.Name), zap.Error(err))
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		if err := r.addPlugin(spec.Name, p); err != nil {
+			r.logger.Error("failed to start plugin", zap.String("plugin", spec.Name), zap.Error(err))
+			continue
+		}
+		r.specs[spec.Name] = spec
+		r.logger.Info("plugin loaded", zap.String("plugin", spec.Name))
+	}
+}
+
+// serverReloader 将重新加载的配置应用到运行中的服务端，目前只有日志级别可以在运行时修改
+type serverReloader struct {
+	logger *zap.Logger
+	level  zap.AtomicLevel
+	config *config.Config
+}
+
+func (r *serverReloader) apply(c *config.Config) {
+	old := r.config
+	r.config = c
+	setLogLevel(r.logger, r.level, old, c)
+	warnRestart(r.logger, old, c, map[string]bool{"logging": true})
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/controller"
+	controllerClient "github.com/cossteam/punchline/pkg/controller/client"
+	"github.com/cossteam/punchline/pkg/ice"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
+	"github.com/cossteam/punchline/pkg/signal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// discoverPlugin 模拟自动模式下从 WireGuard 对端发现订阅的插件
+type discoverPlugin struct {
+	hosts []string
+}
+
+func (p *discoverPlugin) Name() string { return "discover" }
+
+func (p *discoverPlugin) Handle(ctx context.Context, msg *api.HostMessage) {}
+
+func (p *discoverPlugin) PublicKey() (string, error) { return "key", nil }
+
+func (p *discoverPlugin) Subscriptions() ([]string, error) { return p.hosts, nil }
+
+func TestClientReloaderDiscoveredSubscriptions(t *testing.T) {
+	c := &config.Config{Subscriptions: []config.Subscriptions{{Topic: "a"}}}
+	r := newClientReloader(zap.NewNop(), zap.NewAtomicLevel(), c)
+	r.newPeer = func(c *config.Config, topic string) (controller.Runnable, error) {
+		return controller.RunnableFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}), nil
+	}
+	require.NoError(t, r.addPlugin("wg", &discoverPlugin{hosts: []string{"b"}}))
+
+	// 启动时为配置的订阅和插件发现的主机创建 Peer
+	require.NoError(t, r.addPeers(c))
+	assert.ElementsMatch(t, []string{"a", "b"}, r.peers.Names())
+
+	// 重新加载后发现的主机仍然保持订阅
+	r.apply(&config.Config{Subscriptions: []config.Subscriptions{{Topic: "c"}}})
+	assert.ElementsMatch(t, []string{"b", "c"}, r.peers.Names())
+}
+
+// lighthouseClient 记录重新加载时灯塔客户端收到的订阅和 STUN 服务器
+type lighthouseClient struct {
+	controllerClient.Client
+	subscriptions []string
+	stunServers   []string
+}
+
+func (c *lighthouseClient) SetSubscriptions(topics []string) { c.subscriptions = topics }
+
+func (c *lighthouseClient) SetSTUNServers(servers []string) error {
+	c.stunServers = servers
+	return nil
+}
+
+func TestClientReloaderLighthouse(t *testing.T) {
+	c := &config.Config{
+		Server:        "192.0.2.1:7777",
+		StunServer:    []string{"stun:192.0.2.1:3478"},
+		Subscriptions: []config.Subscriptions{{Topic: "a"}},
+	}
+	r := newClientReloader(zap.NewNop(), zap.NewAtomicLevel(), c)
+	created := make(map[string]int)
+	r.newPeer = func(c *config.Config, topic string) (controller.Runnable, error) {
+		created[topic]++
+		return controller.RunnableFunc(func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}), nil
+	}
+	lighthouse := &lighthouseClient{}
+	r.lighthouse = lighthouse
+	require.NoError(t, r.addPeers(c))
+
+	// 订阅的变化同步到灯塔客户端，STUN 服务器不变时不重建 Peer
+	r.apply(&config.Config{
+		Server:        c.Server,
+		StunServer:    c.StunServer,
+		Subscriptions: []config.Subscriptions{{Topic: "a"}, {Topic: "b"}},
+	})
+	assert.Equal(t, []string{"a", "b"}, lighthouse.subscriptions)
+	assert.Nil(t, lighthouse.stunServers)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, created)
+
+	// STUN 服务器变化时替换灯塔客户端的 STUN 客户端并重建所有 Peer
+	r.apply(&config.Config{
+		Server:        c.Server,
+		StunServer:    []string{"stun:192.0.2.2:3478"},
+		Subscriptions: []config.Subscriptions{{Topic: "a"}, {Topic: "b"}},
+	})
+	assert.Equal(t, []string{"stun:192.0.2.2:3478"}, lighthouse.stunServers)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, created)
+	assert.ElementsMatch(t, []string{"a", "b"}, r.peers.Names())
+}
+
+// memorySignal 是进程内的信令，每个订阅者按顺序在自己的 goroutine 中处理消息
+type memorySignal struct {
+	mu   sync.Mutex
+	subs map[string][]chan *signal.Message
+}
+
+func (s *memorySignal) Publish(ctx context.Context, msg *signal.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs[msg.Topic] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *memorySignal) Subscribe(ctx context.Context, topic string, handler func(*signal.Message) error) error {
+	ch := make(chan *signal.Message, 256)
+	s.mu.Lock()
+	if s.subs == nil {
+		s.subs = make(map[string][]chan *signal.Message)
+	}
+	s.subs[topic] = append(s.subs[topic], ch)
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-ch:
+				_ = handler(msg)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *memorySignal) Unsubscribe(ctx context.Context, topic string) error { return nil }
+
+func (s *memorySignal) Close() error { return nil }
+
+// connectedPlugin 在 ICE 连接建立时关闭 connected
+type connectedPlugin struct {
+	once      sync.Once
+	connected chan struct{}
+}
+
+func (p *connectedPlugin) Name() string { return "connected" }
+
+func (p *connectedPlugin) Handle(ctx context.Context, msg *api.HostMessage) {}
+
+func (p *connectedPlugin) HandleICE(ctx context.Context, event *plugin.ICEEvent) {
+	if event.Type == plugin.ICEConnected {
+		p.once.Do(func() { close(p.connected) })
+	}
+}
+
+func TestClientReloaderRemoveConnectedPeer(t *testing.T) {
+	bus := &memorySignal{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newPeer := func(source, target string, plugins ...plugin.Plugin) (*ice.Peer, error) {
+		return ice.NewICEAgentWrapper(zap.NewNop(), bus, nil, source, target, ice.WithPlugins(plugins))
+	}
+
+	// 对端 b 在重新加载的过程中保持运行
+	b, err := newPeer("b", "a")
+	require.NoError(t, err)
+	go func() { _ = b.Start(ctx) }()
+
+	connected := &connectedPlugin{connected: make(chan struct{})}
+	c := &config.Config{Subscriptions: []config.Subscriptions{{Topic: "b"}}}
+	r := newClientReloader(zap.NewNop(), zap.NewAtomicLevel(), c)
+	r.newPeer = func(c *config.Config, topic string) (controller.Runnable, error) {
+		peer, err := newPeer("a", topic, connected)
+		if err != nil {
+			return nil, err
+		}
+		return controller.RunnableFunc(peer.Start), nil
+	}
+	require.NoError(t, r.addPeers(c))
+	go func() { _ = r.peers.Start(ctx) }()
+
+	select {
+	case <-connected.connected:
+	case <-time.After(10 * time.Second):
+		t.Skip("ICE connection could not be established in this environment")
+	}
+
+	// 取消订阅关闭已经连接的 Peer，连接的读循环正常退出而不是让进程崩溃
+	r.apply(&config.Config{})
+	assert.Empty(t, r.peers.Names())
+	time.Sleep(500 * time.Millisecond)
+}
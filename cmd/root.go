@@ -40,49 +40,36 @@ func SetupSignalHandler() context.Context {
 
 var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT}
 
-func applyConfig(ctx *cli.Context) (config2 *config.Config, err error) {
+// applyConfig 依次应用配置文件、PUNCHLINE_ 环境变量和命令行参数，最后设置默认值。
+// 命令行参数只有显式设置时才覆盖配置，参数的默认值只在配置中没有该字段时使用
+func applyConfig(ctx *cli.Context) (*config.Config, error) {
 	cfg := &config.Config{}
 	if ctx.String("config") != "" {
+		var err error
 		cfg, err = config.Load(ctx.String("config"))
 		if err != nil {
 			return nil, err
 		}
 	}
-
-	// Apply command line flags, overriding configuration file values
-	//udpPort := ctx.Uint("udpPort")
-	//if udpPort != 0 {
-	//	cfg.UdpPort = udpPort
-	//}
-
-	grpcServer := ctx.String("signalServer")
-	if grpcServer != "" {
-		cfg.SignalServer = grpcServer
-	}
-
-	endpointPort := ctx.Uint("endpointPort")
-	if endpointPort != 0 {
-		cfg.EndpointPort = endpointPort
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, err
 	}
 
-	logLevel := ctx.String("loglevel")
-	if logLevel != "" {
-		cfg.Logging.Level = logLevel
-	}
-
-	hostname := ctx.String("hostname")
-	if hostname != "" {
-		cfg.Hostname = hostname
-	}
-
-	server := ctx.String("server")
-	if server != "" {
-		cfg.Server = server
+	setString := func(name string, target *string) {
+		if ctx.IsSet(name) || *target == "" {
+			if v := ctx.String(name); v != "" {
+				*target = v
+			}
+		}
 	}
+	setString("signalServer", &cfg.SignalServer)
+	setString("loglevel", &cfg.Logging.Level)
+	setString("hostname", &cfg.Hostname)
+	setString("server", &cfg.Server)
+	setString("addr", &cfg.Addr)
 
-	signalServer := ctx.String("signalServer")
-	if signalServer != "" {
-		cfg.SignalServer = signalServer
+	if endpointPort := ctx.Uint("endpointPort"); endpointPort != 0 && (ctx.IsSet("endpointPort") || cfg.EndpointPort == 0) {
+		cfg.EndpointPort = endpointPort
 	}
 
 	stunServers := ctx.StringSlice("stunServer")
@@ -97,5 +84,6 @@ func applyConfig(ctx *cli.Context) (config2 *config.Config, err error) {
 		})
 	}
 
+	cfg.SetDefaults()
 	return cfg, nil
 }
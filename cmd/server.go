@@ -1,14 +1,21 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/auth"
 	"github.com/cossteam/punchline/pkg/controller"
 	controllersrv "github.com/cossteam/punchline/pkg/controller/server"
+	"github.com/cossteam/punchline/pkg/controller/signaling"
+	"github.com/cossteam/punchline/pkg/host"
 	"github.com/cossteam/punchline/pkg/log"
-	plugin "github.com/cossteam/punchline/pkg/plugin/client"
 	"github.com/cossteam/punchline/pkg/transport/udp"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"net"
+	"os"
+	"strings"
 )
 
 func init() {
@@ -43,9 +50,10 @@ var Server = &cli.Command{
 			Value: "",
 		},
 		&cli.StringFlag{
-			Name:    "grpcServer",
-			Usage:   "grpcServer",
-			Aliases: []string{"gs"},
+			Name:  "addr",
+			Usage: "gRPC address serving signaling and the lighthouse services (empty to disable)",
+			// grpcServer 和 gs 是改名前的参数，保留为已弃用的别名
+			Aliases: []string{"grpcServer", "gs"},
 			Value:   "0.0.0.0:7777",
 		},
 	},
@@ -57,38 +65,167 @@ func runServer(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := c.ValidateServer(); err != nil {
+		return err
+	}
 
 	uaddr := c.Server
 
-	logger, err := log.SetupLogger(c.Logging.Level)
+	logger, level, err := log.NewLogger(c.Logging.Level)
 	if err != nil {
 		return err
 	}
+	if deprecatedFlagUsed(os.Args, "grpcServer", "gs") {
+		logger.Warn("flag --grpcServer is deprecated, use --addr instead")
+	}
 
 	raddr, err := net.ResolveUDPAddr("udp", uaddr)
 	if err != nil {
 		return err
 	}
 
-	outside, err := udp.NewGenericListener(logger, raddr.IP, raddr.Port)
+	routines := c.Listen.Routines
+	if routines <= 0 {
+		routines = 1
+	}
+	listeners, err := udp.NewBatchListeners(logger, raddr.IP, raddr.Port, routines, c.Listen.Batch)
+	if err != nil {
+		return err
+	}
+	outside := listeners[0]
+
+	remoteAllowList, err := host.NewAllowList(c.AllowList.Remote)
 	if err != nil {
 		return err
 	}
 
-	_, err = plugin.LoadPlugins(logger, c)
+	preferredRanges, err := host.ParsePreferredRanges(c.PreferredRanges)
 	if err != nil {
 		return err
 	}
 
+	familyPolicy, err := host.ParseFamilyPolicy(c.AddressFamily)
+	if err != nil {
+		return err
+	}
+
+	opts := []controllersrv.ServerOption{
+		controllersrv.WithRemoteAllowList(remoteAllowList),
+		controllersrv.WithPreferredRanges(preferredRanges),
+		controllersrv.WithFamilyPolicy(familyPolicy),
+		controllersrv.WithReaders(listeners[1:]...),
+	}
+
+	if len(c.Auth.Hosts) > 0 {
+		keys := make(map[string][]byte, len(c.Auth.Hosts))
+		for hostname, psk := range c.Auth.Hosts {
+			keys[hostname] = []byte(psk)
+		}
+		opts = append(opts, controllersrv.WithVerifier(auth.NewVerifier(keys, c.Auth.MaxSkew)))
+	}
+
+	if c.Relay.Enabled {
+		advertiseIP := raddr.IP
+		if c.Relay.AdvertiseAddr != "" {
+			advertiseIP = net.ParseIP(c.Relay.AdvertiseAddr)
+			if advertiseIP == nil {
+				return fmt.Errorf("invalid relay advertise address %q", c.Relay.AdvertiseAddr)
+			}
+		}
+		if advertiseIP == nil || advertiseIP.IsUnspecified() {
+			return errors.New("relay.advertiseAddr is required when the server listens on an unspecified address")
+		}
+		opts = append(opts, controllersrv.WithRelay(advertiseIP, c.Relay.IdleTimeout))
+	}
+
+	if c.Stun.AlternateAddr != "" {
+		opt, err := stunAlternate(logger, raddr, c.Stun.AlternateAddr)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, opt)
+	}
+
+	var signalingServer *signaling.SignalingController
+	if c.Addr != "" {
+		// 客户端通过 signalServer 连接灯塔的 PunchService 和 PubSubService，与信令服务共用一个端口
+		signalingServer = signaling.NewSignalingController(c.Addr, logger)
+		opts = append(opts, controllersrv.WithGRPCServer(signalingServer.GRPCServer()))
+	}
+
 	srv := controllersrv.NewServerController(
 		logger.With(zap.String("controller", "server")),
 		outside,
 		c,
+		opts...,
 	)
 
+	runnables := []controller.Runnable{srv}
+	if signalingServer != nil {
+		runnables = append(runnables, signalingServer)
+	}
+	if c.Metrics.Listen != "" {
+		runnables = append(runnables, metricsServer(logger.With(zap.String("controller", "metrics")), c.Metrics.Listen))
+	}
+	if ctx.String("config") != "" {
+		reloader := &serverReloader{logger: logger.With(zap.String("controller", "reload")), level: level, config: c}
+		runnables = append(runnables, configWatcher(ctx, logger, (*config.Config).ValidateServer, reloader.apply))
+	}
+
 	ctrl := controller.NewManager(
 		logger.With(zap.String("controller", "manager")),
-		srv,
+		runnables...,
 	)
 	return ctrl.Start(SetupSignalHandler())
 }
+
+// stunAlternate 在备用地址上创建 RFC 5780 行为测试所需的三个监听器，
+// 主监听器必须绑定在具体的 IP 上，否则备用 IP 上的主端口会与之冲突
+func stunAlternate(logger *zap.Logger, primary *net.UDPAddr, alternate string) (controllersrv.ServerOption, error) {
+	alt, err := net.ResolveUDPAddr("udp", alternate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stun.alternateAddr: %w", err)
+	}
+	if primary.IP == nil || primary.IP.IsUnspecified() {
+		return nil, errors.New("stun.alternateAddr requires the server to listen on a specific IP")
+	}
+	if alt.IP.Equal(primary.IP) || alt.Port == primary.Port {
+		return nil, errors.New("stun.alternateAddr must differ from the server address in both IP and port")
+	}
+
+	var conns []udp.Conn
+	for _, addr := range []*net.UDPAddr{
+		{IP: primary.IP, Port: alt.Port},
+		{IP: alt.IP, Port: primary.Port},
+		alt,
+	} {
+		conn, err := udp.NewGenericListener(logger, addr.IP, addr.Port)
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on STUN alternate address %s: %w", addr, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	return controllersrv.WithSTUNAlternate(primary.IP, conns[0], conns[1], conns[2]), nil
+}
+
+// deprecatedFlagUsed 报告命令行中是否使用了 names 中的参数名，
+// cli 不区分参数的别名，只能从原始参数中查找
+func deprecatedFlagUsed(args []string, names ...string) bool {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimLeft(arg, "-")
+		arg, _, _ = strings.Cut(arg, "=")
+		for _, name := range names {
+			if arg == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/cossteam/punchline/pkg/controller"
 	"github.com/cossteam/punchline/pkg/controller/signaling"
 	"github.com/cossteam/punchline/pkg/log"
-	plugin "github.com/cossteam/punchline/pkg/plugin/client"
 	"github.com/urfave/cli/v2"
 )
 
@@ -42,20 +41,16 @@ func runSignal(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-
-	addr := ctx.String("addr")
-
-	logger, err := log.SetupLogger(c.Logging.Level)
-	if err != nil {
+	if err := c.Validate(); err != nil {
 		return err
 	}
 
-	_, err = plugin.LoadPlugins(logger, c)
+	logger, err := log.SetupLogger(c.Logging.Level)
 	if err != nil {
 		return err
 	}
 
-	srv := signaling.NewSignalingController(addr, logger)
+	srv := signaling.NewSignalingController(c.Addr, logger)
 	ctrl := controller.NewManager(logger, srv)
 	return ctrl.Start(SetupSignalHandler())
 }
@@ -1,22 +1,52 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/mitchellh/mapstructure"
 	"gopkg.in/yaml.v3"
+	"io"
 	"io/ioutil"
+	"time"
 )
 
 type Config struct {
 	EndpointPort uint   `yaml:"endpointPort"`
 	SignalServer string `yaml:"signalServer"`
 	Server       string `yaml:"server"`
-	Addr         string `yaml:"addr"`
-	Hostname     string `yaml:"hostname"`
+	// Addr signal 服务监听的地址
+	Addr     string `yaml:"addr"`
+	Hostname string `yaml:"hostname"`
 
 	StunServer []string `yaml:"stunServer"`
 
+	Stun Stun `yaml:"stun"`
+
+	Network Network `yaml:"network"`
+
 	Subscriptions []Subscriptions `yaml:"subscriptions"`
 
+	// PreferredRanges 首选网段，当两台主机处于同一网段时优先使用这些网段内的地址
+	PreferredRanges []string `yaml:"preferredRanges"`
+
+	// AddressFamily 地址族策略 ("", "prefer-ipv4", "prefer-ipv6", "ipv4-only", "ipv6-only")
+	AddressFamily string `yaml:"addressFamily"`
+
+	AllowList AllowList `yaml:"allowList"`
+
+	Relay Relay `yaml:"relay"`
+
+	Auth Auth `yaml:"auth"`
+
+	Limits Limits `yaml:"limits"`
+
+	Listen Listen `yaml:"listen"`
+
+	Metrics Metrics `yaml:"metrics"`
+
+	Punch Punch `yaml:"punch"`
+
 	Logging struct {
 		Level string `yaml:"level"`
 	} `yaml:"logging"`
@@ -24,21 +54,172 @@ type Config struct {
 	Plugins []Plugin `yaml:"plugins"`
 }
 
+// AllowList 定义地址的允许/拒绝列表，键为 CIDR，值为 true 表示允许，false 表示拒绝
+type AllowList struct {
+	// Local 过滤客户端上报的本地地址，例如不上报 docker 网桥地址 172.17.0.0/16
+	Local map[string]bool `yaml:"local"`
+
+	// Remote 过滤上报和学习到的远端地址，例如拒绝 CGNAT 地址 100.64.0.0/10
+	Remote map[string]bool `yaml:"remote"`
+}
+
+// Relay 中继配置，用于无法直接打洞的两个客户端之间转发 UDP 数据
+type Relay struct {
+	// Enabled 服务端是否为客户端提供中继
+	Enabled bool `yaml:"enabled"`
+
+	// AdvertiseAddr 服务端通告给客户端的中继 IP，服务端监听在未指定地址时必须配置
+	AdvertiseAddr string `yaml:"advertiseAddr"`
+
+	// IdleTimeout 服务端中继会话空闲多久后被回收
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+
+	// Mode 客户端的中继模式 ("auto", "always", "never")
+	Mode string `yaml:"mode"`
+
+	// Timeout 客户端在 auto 模式下打洞多久未成功后请求中继
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Auth 灯塔 UDP 消息的认证配置，使用每个主机的预共享密钥进行 HMAC 认证
+type Auth struct {
+	// PSK 客户端本机的预共享密钥，配置后发送给服务端的消息都会被签名
+	PSK string `yaml:"psk"`
+
+	// Hosts 服务端每个主机的预共享密钥，配置后服务端拒绝所有未经认证的消息
+	Hosts map[string]string `yaml:"hosts"`
+
+	// MaxSkew 允许的时间偏差，超出范围的消息将被拒绝
+	MaxSkew time.Duration `yaml:"maxSkew"`
+}
+
+// Limits 服务端灯塔 UDP 监听器的限速和防滥用配置，未配置的字段使用默认值。
+// 主机数量上限和空闲移除同样适用于通过 gRPC 上报的主机，按 gRPC 连接的对端 IP 计入来源
+type Limits struct {
+	// PacketsPerSecond 每个来源 IP 每秒允许的数据包数量
+	PacketsPerSecond float64 `yaml:"packetsPerSecond"`
+
+	// Burst 每个来源 IP 允许的突发数据包数量
+	Burst int `yaml:"burst"`
+
+	// MaxHostsPerSource 每个来源 IP 最多可以创建的主机数量
+	MaxHostsPerSource int `yaml:"maxHostsPerSource"`
+
+	// MaxHosts 灯塔最多保存的主机数量，空闲的主机会被移除
+	MaxHosts int `yaml:"maxHosts"`
+
+	// MaxHostnameLength 主机名的最大长度
+	MaxHostnameLength int `yaml:"maxHostnameLength"`
+
+	// MaxMessageSize 灯塔消息的最大字节数
+	MaxMessageSize int `yaml:"maxMessageSize"`
+}
+
+// Punch 客户端打洞方式的配置
+type Punch struct {
+	// Mode 打洞模式 ("auto", "raw", "reuseport", "forward")，auto 在有权限时使用原始套接字，否则使用 reuseport
+	Mode string `yaml:"mode"`
+
+	// ForwardAddr forward 模式下应用实际监听的地址，punchline 持有 endpointPort 并将数据转发到该地址
+	ForwardAddr string `yaml:"forwardAddr"`
+
+	// Strategies 依次尝试的打洞策略 ("direct", "lowttl", "predict", "birthday")，未配置时根据两端的 NAT 类型选择
+	Strategies []string `yaml:"strategies"`
+
+	// StrategyTimeout 每个策略执行后等待直连成功的时间，超时后尝试下一个策略
+	StrategyTimeout time.Duration `yaml:"strategyTimeout"`
+
+	// LowTTL lowttl 策略中预热数据包的 TTL，需要足以穿过本端 NAT 但不足以到达对端 NAT
+	LowTTL int `yaml:"lowTTL"`
+
+	// PredictRange predict 策略在对端外部端口两侧各尝试的端口数量
+	PredictRange int `yaml:"predictRange"`
+
+	// BirthdaySockets birthday 策略中打开映射的一端使用的套接字数量
+	BirthdaySockets int `yaml:"birthdaySockets"`
+
+	// BirthdayProbes birthday 策略中探测的一端发送的探测包数量
+	BirthdayProbes int `yaml:"birthdayProbes"`
+
+	// Cooldown 一轮策略全部失败后，再次执行第一个以外的策略前等待的时间，连续失败时加倍，
+	// 冷却期间收到的打洞通知只执行第一个策略
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Stun STUN 相关配置，未配置的字段使用默认值
+type Stun struct {
+	// AlternateAddr 服务端用于 RFC 5780 行为测试的备用地址 (备用 IP:备用端口)，备用 IP 必须是本机的另一个地址，
+	// 配置后服务端还会在 (主 IP, 备用端口) 和 (备用 IP, 主端口) 上响应 STUN 请求
+	AlternateAddr string `yaml:"alternateAddr"`
+
+	// Timeout 每个 STUN 服务器的超时时间，所有服务器并行查询
+	Timeout time.Duration `yaml:"timeout"`
+
+	// ProbeInterval 重新查询外部地址的间隔，外部地址变化时立即发送主机更新
+	ProbeInterval time.Duration `yaml:"probeInterval"`
+}
+
+// Network 客户端本地网络变化检测配置，本地地址、默认路由或外部地址变化时立即发送主机更新并重启 ICE 会话
+type Network struct {
+	// Disabled 关闭网络变化检测，只依赖周期性的主机更新
+	Disabled bool `yaml:"disabled"`
+
+	// Debounce 合并连续网络事件的时间窗口
+	Debounce time.Duration `yaml:"debounce"`
+
+	// PollInterval 轮询网络状态和外部地址的间隔，不支持 rtnetlink 的平台依赖轮询
+	PollInterval time.Duration `yaml:"pollInterval"`
+}
+
+// Listen 服务端灯塔 UDP 监听器的接收配置
+type Listen struct {
+	// Routines 通过 SO_REUSEPORT 绑定在同一端口上的监听器数量，每个监听器由独立的 goroutine 读取，仅支持 linux
+	Routines int `yaml:"routines"`
+
+	// Batch 每次系统调用最多读取的数据包数量 (recvmmsg)
+	Batch int `yaml:"batch"`
+}
+
+// Metrics 指标的 HTTP 服务配置
+type Metrics struct {
+	// Listen 通过 HTTP 提供 expvar 指标 (/debug/vars) 的地址，为空时不提供
+	Listen string `yaml:"listen"`
+}
+
 type Subscriptions struct {
 	Topic string `yaml:"topic"`
 }
 
 type Plugin struct {
-	Name    string                 `yaml:"name"`
+	Name string `yaml:"name"`
+	// Address 外部插件的地址，为空时使用名为 Name 的内置插件。
+	// exec:///path/to/hook 对每个事件运行一次 hook，事件以 JSON 写入标准输入，见 ExecSpec
 	Address string                 `yaml:"address"`
 	Spec    map[string]interface{} `yaml:"spec"`
 }
 
+// StunServers 返回客户端查询的 STUN 服务器，未配置时使用灯塔端口上内置的 STUN 服务
+func (c *Config) StunServers() []string {
+	if len(c.StunServer) > 0 || c.Server == "" {
+		return c.StunServer
+	}
+	return []string{"stun:" + c.Server}
+}
+
 // LoadPluginConfig loads the specific configuration for a plugin
+// 时间间隔可以写成 "10s" 这样的字符串
 func (p *Plugin) LoadPluginConfig(target interface{}) error {
-	return mapstructure.Decode(p.Spec, target)
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     target,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(p.Spec)
 }
 
+// Load 读取配置文件，未知的字段视为错误
 func Load(filename string) (*Config, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -46,8 +227,10 @@ func Load(filename string) (*Config, error) {
 	}
 
 	var cfg Config
-	if err = yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
 	}
 
 	return &cfg, nil
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadStrict(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("server: \"127.0.0.1:6976\"\ngrpcServer: \"127.0.0.1:7777\"\n"), 0o644))
+	_, err := Load(file)
+	assert.ErrorContains(t, err, "field grpcServer not found")
+
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	c, err := Load(file)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{}, c)
+
+	// 示例配置必须能够通过严格解析和校验
+	for _, example := range []string{"example-client.yaml", "example-server.yaml"} {
+		c, err := Load(example)
+		require.NoError(t, err, example)
+		assert.NoError(t, c.Validate(), example)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := &Config{
+		EndpointPort:    70000,
+		Server:          "lighthouse",
+		StunServer:      []string{"stun.example.com"},
+		Subscriptions:   []Subscriptions{{Topic: "a"}, {Topic: "a"}},
+		PreferredRanges: []string{"10.0.0.0/33"},
+		Relay:           Relay{Mode: "sometimes"},
+		Punch:           Punch{Mode: "forward", Strategies: []string{"direct", "teleport"}},
+		Logging: struct {
+			Level string `yaml:"level"`
+		}{Level: "loud"},
+		Plugins: []Plugin{{Name: "wg"}, {}},
+	}
+
+	var fields []string
+	var joined interface{ Unwrap() []error }
+	require.True(t, errors.As(c.ValidateClient(), &joined))
+	for _, err := range joined.Unwrap() {
+		var fe *FieldError
+		require.True(t, errors.As(err, &fe))
+		fields = append(fields, fe.Field)
+	}
+	assert.Equal(t, []string{
+		"endpointPort",
+		"server",
+		"stunServer[0]",
+		"subscriptions[1].topic",
+		"preferredRanges[0]",
+		"relay.mode",
+		"punch.forwardAddr",
+		"punch.strategies[1]",
+		"logging.level",
+		"plugins[1].name",
+		"signalServer",
+	}, fields)
+
+	c = &Config{Server: "lighthouse:6976", SignalServer: "signal:7777"}
+	assert.ErrorContains(t, c.ValidateClient(), "endpointPort: required when server is set")
+	assert.Empty(t, c.IgnoredClientFields())
+
+	// 只使用 ICE 时打洞和地址过滤的配置不会生效
+	c = &Config{
+		Punch:     Punch{Mode: "auto", Strategies: []string{"direct"}},
+		AllowList: AllowList{Remote: map[string]bool{"100.64.0.0/10": false}},
+	}
+	assert.Equal(t, []string{"punch.strategies", "allowList.remote"}, c.IgnoredClientFields())
+
+	c = &Config{Server: "0.0.0.0:6976", Relay: Relay{Enabled: true}}
+	c.SetDefaults()
+	assert.Equal(t, "auto", c.Relay.Mode)
+	assert.ErrorContains(t, c.ValidateServer(), "relay.advertiseAddr: required")
+	c.Relay.AdvertiseAddr = "192.0.2.1"
+	assert.NoError(t, c.ValidateServer())
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"PUNCHLINE_SIGNAL_SERVER":             "signal:7777",
+		"PUNCHLINE_ENDPOINT_PORT":             "51820",
+		"PUNCHLINE_STUN_SERVER":               "stun:a:3478, stun:b:3478",
+		"PUNCHLINE_STUN_PROBE_INTERVAL":       "15s",
+		"PUNCHLINE_RELAY_ENABLED":             "true",
+		"PUNCHLINE_LIMITS_PACKETS_PER_SECOND": "2.5",
+		"PUNCHLINE_PUNCH_LOW_TTL":             "3",
+		"PUNCHLINE_LOGGING_LEVEL":             "warn",
+		"PUNCHLINE_SUBSCRIPTIONS":             "client2,client3",
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	c := &Config{SignalServer: "file:7777", Subscriptions: []Subscriptions{{Topic: "client4"}}}
+	require.NoError(t, c.applyEnv(lookup))
+	assert.Equal(t, "signal:7777", c.SignalServer)
+	assert.Equal(t, uint(51820), c.EndpointPort)
+	assert.Equal(t, []string{"stun:a:3478", "stun:b:3478"}, c.StunServer)
+	assert.Equal(t, 15*time.Second, c.Stun.ProbeInterval)
+	assert.True(t, c.Relay.Enabled)
+	assert.Equal(t, 2.5, c.Limits.PacketsPerSecond)
+	assert.Equal(t, 3, c.Punch.LowTTL)
+	assert.Equal(t, "warn", c.Logging.Level)
+	assert.Equal(t, []Subscriptions{{Topic: "client2"}, {Topic: "client3"}}, c.Subscriptions)
+
+	env["PUNCHLINE_ENDPOINT_PORT"] = "port"
+	assert.ErrorContains(t, c.applyEnv(lookup), "PUNCHLINE_ENDPOINT_PORT")
+}
+
+func TestDiff(t *testing.T) {
+	old := &Config{Server: "lighthouse:6976", Subscriptions: []Subscriptions{{Topic: "a"}}}
+	old.Logging.Level = "info"
+	assert.Empty(t, Diff(old, old))
+
+	new := *old
+	new.Subscriptions = []Subscriptions{{Topic: "a"}, {Topic: "b"}}
+	new.Logging.Level = "debug"
+	new.Plugins = []Plugin{{Name: "wg"}}
+	assert.Equal(t, []string{"subscriptions", "logging", "plugins"}, Diff(old, &new))
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Diff 返回 old 和 new 之间取值不同的顶层字段，字段以 YAML 键表示，按定义的顺序排列
+func Diff(old, new *Config) []string {
+	var fields []string
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			fields = append(fields, tag)
+		}
+	}
+	return fields
+}
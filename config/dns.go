@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// DnsSpec 是 DNS 插件的配置
+type DnsSpec struct {
+	// Listen DNS 服务监听的 UDP 地址，未配置 HostsFile 时默认 127.0.0.1:5353
+	Listen string `yaml:"listen"`
+	// Domain 主机名所在的域，client2 解析为 client2.punch.，默认 punch
+	Domain string `yaml:"domain"`
+	// TTL 应答中记录的 TTL，地址随时可能变化，默认 5s
+	TTL time.Duration `yaml:"ttl"`
+	// HostsFile 不为空时将主机的当前地址写入该文件，文件完全由插件管理，退出时删除
+	HostsFile string `yaml:"hostsFile"`
+	// Concern 只解析这些主机，为空时解析所有主机
+	Concern []string `yaml:"concern"`
+	// Prefer 主机消息中的本地地址落在这些网段 (CIDR) 内时才会被解析，
+	// 其他本地地址在另一个站点上通常不可达，只解析 ICE 选中的地址和外部地址
+	Prefer []string `yaml:"prefer"`
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix 覆盖配置的环境变量的前缀
+const EnvPrefix = "PUNCHLINE_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ApplyEnv 使用 PUNCHLINE_ 开头的环境变量覆盖配置，变量名由 YAML 路径转换而来，
+// 例如 signalServer 对应 PUNCHLINE_SIGNAL_SERVER，relay.mode 对应 PUNCHLINE_RELAY_MODE。
+// 支持字符串、布尔、数字、时间间隔和以逗号分隔的字符串列表，
+// PUNCHLINE_SUBSCRIPTIONS 是以逗号分隔的订阅主题
+func (c *Config) ApplyEnv() error {
+	return c.applyEnv(os.LookupEnv)
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if value, ok := lookup(EnvPrefix + "SUBSCRIPTIONS"); ok {
+		c.Subscriptions = nil
+		for _, topic := range splitList(value) {
+			c.Subscriptions = append(c.Subscriptions, Subscriptions{Topic: topic})
+		}
+	}
+	return applyEnvStruct(reflect.ValueOf(c).Elem(), EnvPrefix, lookup)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + envName(tag)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnvStruct(fv, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(fv, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setEnvValue 解析 value 并设置到字段，不支持的类型 (例如 map) 被忽略
+func setEnvValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			v.Set(reflect.ValueOf(splitList(value)))
+		}
+	}
+	return nil
+}
+
+// envName 将 YAML 键转换为环境变量名，例如 probeInterval 转换为 PROBE_INTERVAL，lowTTL 转换为 LOW_TTL
+func envName(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+// ExecSpec 是 exec 外部插件的配置
+type ExecSpec struct {
+	// Args 传给 hook 的参数
+	Args []string `yaml:"args"`
+	// Env 追加到 hook 环境变量中的 KEY=VALUE
+	Env []string `yaml:"env"`
+	// Timeout 单个事件的最长运行时间，超时后 hook 被杀死，默认 10s
+	Timeout time.Duration `yaml:"timeout"`
+}
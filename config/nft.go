@@ -0,0 +1,21 @@
+package config
+
+import "time"
+
+// NftSpec 是 nftables 插件的配置。
+// 一个表中的 accept 不会阻止其他表中的链丢弃数据包，因此主机有默认拒绝的规则集时有两种用法:
+// 配置 chain 将规则插入已有的 inet 表 table 的链的开头，或者使用独占的表并配置 mark，
+// 由默认拒绝的链放行该 mark (例如 meta mark 0x1 accept)
+type NftSpec struct {
+	// Table 规则所在的 inet 表，默认 punchline。
+	// 没有配置 Chain 时是插件独占的表，启动时重新创建，退出时删除；否则是已有的表，插件只管理自己的集合和规则
+	Table string `yaml:"table"`
+	// Chain 已有的表中插入放行规则的链，例如 input
+	Chain string `yaml:"chain"`
+	// TTL 对端地址在没有新的打洞通知后保留的时间，ICE 连接使用中的地址在连接断开后才开始计时，默认 10m
+	TTL time.Duration `yaml:"ttl"`
+	// Mark 为放行的数据包设置的 meta mark，使用独占的表时必须配置，默认拒绝的链需要放行该 mark
+	Mark uint32 `yaml:"mark"`
+	// Concern 只为这些主机开放端口，为空时关注所有主机
+	Concern []string `yaml:"concern"`
+}
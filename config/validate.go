@@ -0,0 +1,264 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pion/stun"
+	"go.uber.org/zap/zapcore"
+)
+
+// FieldError 是配置中某个字段的错误，Field 是 YAML 中的路径，例如 relay.mode
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+var errRequired = errors.New("required")
+
+// validator 收集所有字段的错误，一次报告全部问题
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(field string, err error) {
+	v.errs = append(v.errs, &FieldError{Field: field, Err: err})
+}
+
+func (v *validator) addf(field, format string, args ...interface{}) {
+	v.add(field, fmt.Errorf(format, args...))
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// hostPort 检查 host:port 形式的地址，host 可以为空
+func (v *validator) hostPort(field, addr string) {
+	if addr == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.add(field, err)
+		return
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		v.addf(field, "invalid port %q in %q", port, addr)
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.addf(field, "unknown value %q %v", value, allowed)
+}
+
+func (v *validator) cidr(field, s string) {
+	if _, _, err := net.ParseCIDR(s); err != nil {
+		v.add(field, err)
+	}
+}
+
+func (v *validator) nonNegative(field string, n float64) {
+	if n < 0 {
+		v.addf(field, "must not be negative")
+	}
+}
+
+// SetDefaults 为未配置的字段设置默认值，各组件自己的默认值 (例如 STUN 超时) 不在这里设置
+func (c *Config) SetDefaults() {
+	if c.Relay.Mode == "" {
+		c.Relay.Mode = "auto"
+	}
+	if c.Punch.Mode == "" {
+		c.Punch.Mode = "auto"
+	}
+}
+
+// Validate 检查已配置字段的格式和取值，返回的错误包含所有字段的 FieldError
+func (c *Config) Validate() error {
+	v := &validator{}
+	c.validate(v)
+	return v.err()
+}
+
+// ValidateClient 在 Validate 的基础上检查客户端必须的字段
+func (c *Config) ValidateClient() error {
+	v := &validator{}
+	c.validate(v)
+	if c.SignalServer == "" {
+		v.add("signalServer", errRequired)
+	}
+	if len(c.StunServers()) == 0 {
+		v.add("stunServer", errors.New("required when server is not set"))
+	}
+	if c.Server != "" && c.EndpointPort == 0 {
+		// 灯塔客户端从 endpointPort 打洞并上报它的映射
+		v.add("endpointPort", errors.New("required when server is set"))
+	}
+	return v.err()
+}
+
+// IgnoredClientFields 返回客户端配置了但不会生效的字段。打洞、地址过滤和地址选择只由灯塔客户端使用，
+// 没有配置 server 时 (只使用 ICE) 这些字段被忽略
+func (c *Config) IgnoredClientFields() []string {
+	if c.Server != "" {
+		return nil
+	}
+
+	var fields []string
+	set := func(field string, configured bool) {
+		if configured {
+			fields = append(fields, field)
+		}
+	}
+	set("punch.mode", c.Punch.Mode != "" && c.Punch.Mode != "auto")
+	set("punch.forwardAddr", c.Punch.ForwardAddr != "")
+	set("punch.strategies", len(c.Punch.Strategies) > 0)
+	set("punch.strategyTimeout", c.Punch.StrategyTimeout != 0)
+	set("punch.lowTTL", c.Punch.LowTTL != 0)
+	set("punch.predictRange", c.Punch.PredictRange != 0)
+	set("punch.birthdaySockets", c.Punch.BirthdaySockets != 0)
+	set("punch.birthdayProbes", c.Punch.BirthdayProbes != 0)
+	set("punch.cooldown", c.Punch.Cooldown != 0)
+	set("allowList.local", len(c.AllowList.Local) > 0)
+	set("allowList.remote", len(c.AllowList.Remote) > 0)
+	set("preferredRanges", len(c.PreferredRanges) > 0)
+	set("addressFamily", c.AddressFamily != "")
+	return fields
+}
+
+// ValidateServer 在 Validate 的基础上检查服务端必须的字段
+func (c *Config) ValidateServer() error {
+	v := &validator{}
+	c.validate(v)
+	if c.Server == "" {
+		v.add("server", errRequired)
+	}
+	if c.Relay.Enabled && c.Relay.AdvertiseAddr == "" {
+		if host, _, err := net.SplitHostPort(c.Server); err == nil {
+			if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+				v.add("relay.advertiseAddr", errors.New("required when server listens on an unspecified address"))
+			}
+		}
+	}
+	return v.err()
+}
+
+func (c *Config) validate(v *validator) {
+	if c.EndpointPort > 65535 {
+		v.addf("endpointPort", "%d is not a valid port", c.EndpointPort)
+	}
+	v.hostPort("signalServer", c.SignalServer)
+	v.hostPort("server", c.Server)
+	v.hostPort("addr", c.Addr)
+
+	for i, s := range c.StunServer {
+		if _, err := stun.ParseURI(s); err != nil {
+			v.add(fmt.Sprintf("stunServer[%d]", i), err)
+		}
+	}
+	v.hostPort("stun.alternateAddr", c.Stun.AlternateAddr)
+	v.nonNegative("stun.timeout", float64(c.Stun.Timeout))
+	v.nonNegative("stun.probeInterval", float64(c.Stun.ProbeInterval))
+
+	v.nonNegative("network.debounce", float64(c.Network.Debounce))
+	v.nonNegative("network.pollInterval", float64(c.Network.PollInterval))
+
+	seen := make(map[string]bool)
+	for i, sub := range c.Subscriptions {
+		field := fmt.Sprintf("subscriptions[%d].topic", i)
+		if sub.Topic == "" {
+			v.add(field, errRequired)
+		} else if seen[sub.Topic] {
+			v.addf(field, "duplicated topic %q", sub.Topic)
+		}
+		seen[sub.Topic] = true
+	}
+
+	for i, r := range c.PreferredRanges {
+		v.cidr(fmt.Sprintf("preferredRanges[%d]", i), r)
+	}
+	v.oneOf("addressFamily", c.AddressFamily, "prefer-ipv4", "prefer-ipv6", "ipv4-only", "ipv6-only")
+	for r := range c.AllowList.Local {
+		v.cidr("allowList.local", r)
+	}
+	for r := range c.AllowList.Remote {
+		v.cidr("allowList.remote", r)
+	}
+
+	v.oneOf("relay.mode", c.Relay.Mode, "auto", "always", "never")
+	if c.Relay.AdvertiseAddr != "" && net.ParseIP(c.Relay.AdvertiseAddr) == nil {
+		v.addf("relay.advertiseAddr", "%q is not an IP address", c.Relay.AdvertiseAddr)
+	}
+	v.nonNegative("relay.idleTimeout", float64(c.Relay.IdleTimeout))
+	v.nonNegative("relay.timeout", float64(c.Relay.Timeout))
+
+	v.nonNegative("auth.maxSkew", float64(c.Auth.MaxSkew))
+	for hostname, psk := range c.Auth.Hosts {
+		if psk == "" {
+			v.add("auth.hosts."+hostname, errRequired)
+		}
+	}
+
+	v.nonNegative("limits.packetsPerSecond", c.Limits.PacketsPerSecond)
+	v.nonNegative("limits.burst", float64(c.Limits.Burst))
+	v.nonNegative("limits.maxHostsPerSource", float64(c.Limits.MaxHostsPerSource))
+	v.nonNegative("limits.maxHosts", float64(c.Limits.MaxHosts))
+	v.nonNegative("limits.maxHostnameLength", float64(c.Limits.MaxHostnameLength))
+	v.nonNegative("limits.maxMessageSize", float64(c.Limits.MaxMessageSize))
+
+	v.nonNegative("listen.routines", float64(c.Listen.Routines))
+	v.nonNegative("listen.batch", float64(c.Listen.Batch))
+	v.hostPort("metrics.listen", c.Metrics.Listen)
+
+	v.oneOf("punch.mode", c.Punch.Mode, "auto", "raw", "reuseport", "forward")
+	v.hostPort("punch.forwardAddr", c.Punch.ForwardAddr)
+	if c.Punch.Mode == "forward" && c.Punch.ForwardAddr == "" {
+		v.add("punch.forwardAddr", errors.New("required in forward mode"))
+	}
+	for i, s := range c.Punch.Strategies {
+		v.oneOf(fmt.Sprintf("punch.strategies[%d]", i), s, "direct", "lowttl", "predict", "birthday")
+	}
+	v.nonNegative("punch.strategyTimeout", float64(c.Punch.StrategyTimeout))
+	if c.Punch.LowTTL < 0 || c.Punch.LowTTL > 255 {
+		v.addf("punch.lowTTL", "%d is not a valid TTL", c.Punch.LowTTL)
+	}
+	v.nonNegative("punch.predictRange", float64(c.Punch.PredictRange))
+	v.nonNegative("punch.birthdaySockets", float64(c.Punch.BirthdaySockets))
+	v.nonNegative("punch.birthdayProbes", float64(c.Punch.BirthdayProbes))
+
+	if c.Logging.Level != "" {
+		if _, err := zapcore.ParseLevel(c.Logging.Level); err != nil {
+			v.add("logging.level", err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, p := range c.Plugins {
+		field := fmt.Sprintf("plugins[%d].name", i)
+		if p.Name == "" {
+			v.add(field, errRequired)
+		} else if names[p.Name] {
+			v.addf(field, "duplicated plugin %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+}
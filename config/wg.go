@@ -1,13 +1,54 @@
 package config
 
 type WgSpec struct {
-	Iface      string      `yaml:"iface"`
+	// Iface 未配置 Interfaces 时使用的接口，关注所有主机
+	Iface string `yaml:"iface"`
+	// Keepalive 与 Iface 一起使用的 persistent keepalive 秒数，0 表示不修改
+	Keepalive int `yaml:"keepalive"`
+	// Auto 与 Iface 一起使用，见 Interface.Auto
+	Auto bool `yaml:"auto"`
+	// Peers 与 Iface 一起使用的对端表
+	Peers      []WgPeer    `yaml:"peers"`
 	Interfaces []Interface `yaml:"interfaces"`
+
+	// Mux 不为 nil 时与 ICE 共用端口，只能配置一个接口
+	Mux *WgMux `yaml:"mux"`
 }
 
 type Interface struct {
-	Iface     string   `yaml:"iface"`
-	Publickey string   `yaml:"publickey"`
-	Port      int      `yaml:"port"`
-	Concern   []string `yaml:"concern"`
+	Iface     string `yaml:"iface"`
+	Publickey string `yaml:"publickey"`
+	Port      int    `yaml:"port"`
+	// Keepalive 更新端点时设置的 persistent keepalive 秒数，0 表示不修改
+	Keepalive int `yaml:"keepalive"`
+	// Concern 只更新这些主机的端点，为空时关注所有主机
+	Concern []string `yaml:"concern"`
+
+	// Auto 从本地 WireGuard 接口读取公钥和对端，在主机消息中发布本端的公钥，
+	// 自动订阅接口上的所有对端，并使用对端发布的公钥将主机名映射到对端
+	Auto bool `yaml:"auto"`
+
+	// Peers 主机名到 WireGuard 对端的映射，优先于自动发现
+	Peers []WgPeer `yaml:"peers"`
+}
+
+// WgPeer punchline 主机名与 WireGuard 对端的对应关系
+type WgPeer struct {
+	Hostname  string `yaml:"hostname"`
+	PublicKey string `yaml:"publicKey"`
+	// AllowedIPs 不为空时对端不存在会被创建，已存在时确保其 allowed ips 与配置一致
+	AllowedIPs []string `yaml:"allowedIPs"`
+}
+
+// WgMux 让 ICE 和 WireGuard 共用 Port，ICE 学到的端点对 WireGuard 才有效
+type WgMux struct {
+	// Port punchline 持有的端口，对端通过这个端口到达 ICE 和 WireGuard
+	Port int `yaml:"port"`
+	// Mode kernel 将 WireGuard 数据转发给监听在 ForwardAddr 上的内核接口，
+	// userspace 在进程内运行 wireguard-go，默认为 kernel
+	Mode string `yaml:"mode"`
+	// ForwardAddr kernel 模式下内核接口的监听地址，例如 127.0.0.1:51821 (wg0 的 listen-port 为 51821)
+	ForwardAddr string `yaml:"forwardAddr"`
+	// MTU userspace 模式下 TUN 设备的 MTU
+	MTU int `yaml:"mtu"`
 }
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cossteam/punchline/api/v1"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxSkew 默认允许的发送方与接收方之间的时间偏差
+	DefaultMaxSkew = 30 * time.Second
+)
+
+var (
+	ErrUnknownHost = errors.New("unknown host")
+	ErrBadMAC      = errors.New("message authentication failed")
+	ErrExpired     = errors.New("message timestamp out of range")
+	ErrReplay      = errors.New("message replayed")
+	ErrHostname    = errors.New("message hostname does not match envelope")
+)
+
+// Signer 使用本机的预共享密钥对灯塔消息进行签名
+type Signer struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewSigner 创建一个 Signer
+func NewSigner(key []byte) *Signer {
+	return &Signer{
+		key: key,
+		now: time.Now,
+	}
+}
+
+// Seal 将 hm 序列化并封装为经过认证的 Envelope
+func (s *Signer) Seal(hm *api.HostMessage) ([]byte, error) {
+	payload, err := hm.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	var n [8]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	env := &api.Envelope{
+		Payload:   payload,
+		Timestamp: s.now().UnixNano(),
+		Nonce:     binary.BigEndian.Uint64(n[:]),
+		Hostname:  hm.Hostname,
+	}
+	env.Mac = mac(s.key, env)
+
+	return env.Marshal()
+}
+
+// Verifier 使用每个主机的预共享密钥验证灯塔消息，并拒绝超出时间窗口或重放的消息
+type Verifier struct {
+	sync.Mutex
+
+	keys    map[string][]byte
+	maxSkew time.Duration
+	now     func() time.Time
+
+	// seen 记录时间窗口内每个主机已经收到的 nonce 及其时间戳
+	seen map[string]map[uint64]int64
+}
+
+// NewVerifier 创建一个 Verifier，keys 为主机名到预共享密钥的映射，maxSkew 为 0 时使用 DefaultMaxSkew
+func NewVerifier(keys map[string][]byte, maxSkew time.Duration) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	return &Verifier{
+		keys:    keys,
+		maxSkew: maxSkew,
+		now:     time.Now,
+		seen:    make(map[string]map[uint64]int64),
+	}
+}
+
+// Open 验证 b 并返回其中的 HostMessage，密钥按信封中的主机名查找，
+// 只有 mac、时间戳和 nonce 都通过检查后才会解析 payload
+func (v *Verifier) Open(b []byte) (*api.HostMessage, error) {
+	env := &api.Envelope{}
+	if err := env.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	key, ok := v.keys[env.Hostname]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHost, env.Hostname)
+	}
+
+	if !hmac.Equal(env.Mac, mac(key, env)) {
+		return nil, ErrBadMAC
+	}
+
+	now := v.now()
+	ts := time.Unix(0, env.Timestamp)
+	if ts.Before(now.Add(-v.maxSkew)) || ts.After(now.Add(v.maxSkew)) {
+		return nil, ErrExpired
+	}
+
+	if err := v.checkReplay(env.Hostname, env, now); err != nil {
+		return nil, err
+	}
+
+	hm := &api.HostMessage{}
+	if err := hm.Unmarshal(env.Payload); err != nil {
+		return nil, err
+	}
+	if hm.Hostname != env.Hostname {
+		return nil, fmt.Errorf("%w: %q != %q", ErrHostname, hm.Hostname, env.Hostname)
+	}
+
+	return hm, nil
+}
+
+// checkReplay 记录 nonce，并清理已经超出时间窗口的记录，超出窗口的消息已经被时间戳检查拒绝
+func (v *Verifier) checkReplay(hostname string, env *api.Envelope, now time.Time) error {
+	v.Lock()
+	defer v.Unlock()
+
+	seen, ok := v.seen[hostname]
+	if !ok {
+		seen = make(map[uint64]int64)
+		v.seen[hostname] = seen
+	}
+
+	if _, ok := seen[env.Nonce]; ok {
+		return ErrReplay
+	}
+
+	oldest := now.Add(-v.maxSkew).UnixNano()
+	for nonce, ts := range seen {
+		if ts < oldest {
+			delete(seen, nonce)
+		}
+	}
+
+	seen[env.Nonce] = env.Timestamp
+	return nil
+}
+
+func mac(key []byte, env *api.Envelope) []byte {
+	var hdr [20]byte
+	binary.BigEndian.PutUint64(hdr[0:], uint64(env.Timestamp))
+	binary.BigEndian.PutUint64(hdr[8:], env.Nonce)
+	binary.BigEndian.PutUint32(hdr[16:], uint32(len(env.Hostname)))
+
+	h := hmac.New(sha256.New, key)
+	h.Write(hdr[:])
+	h.Write([]byte(env.Hostname))
+	h.Write(env.Payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := []byte("client1-psk")
+	s := NewSigner(key)
+	v := NewVerifier(map[string][]byte{"client1": key}, time.Second*30)
+
+	hm := &api.HostMessage{
+		Type:     api.HostMessage_HostUpdateNotification,
+		Hostname: "client1",
+	}
+
+	b, err := s.Seal(hm)
+	assert.NoError(t, err)
+
+	got, err := v.Open(b)
+	assert.NoError(t, err)
+	assert.Equal(t, hm.Hostname, got.Hostname)
+	assert.Equal(t, hm.Type, got.Type)
+
+	// 重放
+	_, err = v.Open(b)
+	assert.ErrorIs(t, err, ErrReplay)
+
+	// 伪造其他主机
+	forged, err := s.Seal(&api.HostMessage{Hostname: "client2"})
+	assert.NoError(t, err)
+	_, err = v.Open(forged)
+	assert.ErrorIs(t, err, ErrUnknownHost)
+
+	// 错误的密钥
+	b, err = NewSigner([]byte("wrong")).Seal(hm)
+	assert.NoError(t, err)
+	_, err = v.Open(b)
+	assert.ErrorIs(t, err, ErrBadMAC)
+
+	// 过期
+	s.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	b, err = s.Seal(hm)
+	assert.NoError(t, err)
+	_, err = v.Open(b)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	// 信封中的主机名与消息不一致
+	env := &api.Envelope{}
+	b, err = NewSigner(key).Seal(hm)
+	assert.NoError(t, err)
+	assert.NoError(t, env.Unmarshal(b))
+	assert.Equal(t, "client1", env.Hostname)
+	env.Payload, err = (&api.HostMessage{Hostname: "client2"}).Marshal()
+	assert.NoError(t, err)
+	env.Mac = mac(key, env)
+	b, err = env.Marshal()
+	assert.NoError(t, err)
+	_, err = v.Open(b)
+	assert.ErrorIs(t, err, ErrHostname)
+
+	// payload 被篡改时在解析前被拒绝
+	env.Payload = []byte{0xff, 0xff}
+	b, err = env.Marshal()
+	assert.NoError(t, err)
+	_, err = v.Open(b)
+	assert.ErrorIs(t, err, ErrBadMAC)
+
+	// 未经认证的消息
+	plain, err := hm.Marshal()
+	assert.NoError(t, err)
+	_, err = v.Open(plain)
+	assert.Error(t, err)
+}
@@ -6,20 +6,36 @@ import (
 	apiv1 "github.com/cossteam/punchline/api"
 	"github.com/cossteam/punchline/api/v1"
 	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/auth"
 	"github.com/cossteam/punchline/pkg/host"
+	"github.com/cossteam/punchline/pkg/netmon"
 	plugin "github.com/cossteam/punchline/pkg/plugin/client"
 	"github.com/cossteam/punchline/pkg/publisher"
 	stunclient "github.com/cossteam/punchline/pkg/sutn"
 	"github.com/cossteam/punchline/pkg/transport/udp"
-	"github.com/cossteam/punchline/pkg/utils"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var _ apiv1.Runnable = &clientController{}
+var _ Client = &clientController{}
+
+// Client 是灯塔客户端，同时作为 ICE 模式的插件接收 ICE 事件，
+// 与对端的 ICE 连接建立或断开即视为直连建立或断开
+type Client interface {
+	apiv1.Runnable
+	plugin.Plugin
+	plugin.ICEHandler
+
+	// SetSubscriptions 在运行时将订阅的主机替换为 topics
+	SetSubscriptions(topics []string)
+	// SetSTUNServers 在运行时使用新的 STUN 服务器查询外部地址和 NAT 类型
+	SetSTUNServers(servers []string) error
+}
 
 func NewClientController(
 	logger *zap.Logger,
@@ -29,7 +45,7 @@ func NewClientController(
 	coordinator []*net.UDPAddr,
 	c *config.Config,
 	opts ...ClientOption,
-) apiv1.Runnable {
+) Client {
 	cc := &clientController{
 		logger:       logger,
 		hostname:     hostname,
@@ -37,10 +53,14 @@ func NewClientController(
 		makeupWriter: makeupWriter,
 		coordinator:  coordinator,
 		c:            c,
+		paths:        make(map[string]*peerPath),
+		punchDelay:   defaultPunchDelay,
+		stunServers:  c.StunServers(),
 	}
 	for _, opt := range opts {
 		opt(cc)
 	}
+	cc.hostMap = host.NewHostMap(logger, cc.preferredRanges)
 	return cc
 }
 
@@ -51,6 +71,8 @@ type clientController struct {
 	logger       *zap.Logger
 	listenPort   uint32
 	makeupWriter udp.MakeupWriter
+	// makeupWriter6 用于向 IPv6 地址打洞，为 nil 时使用 makeupWriter
+	makeupWriter6 udp.MakeupWriter
 
 	hostname string
 
@@ -59,8 +81,45 @@ type clientController struct {
 
 	hostMap *host.HostMap
 
-	plugins     []plugin.Plugin
-	stunClient  stunclient.STUNClient
+	pathsLock sync.Mutex
+	paths     map[string]*peerPath
+
+	// punchDelay 收到打洞通知后等待对端也收到通知的时间
+	punchDelay time.Duration
+	// trialInterval 使用中继时尝试切换回直连的间隔，为 0 时使用 directTrialInterval
+	trialInterval time.Duration
+
+	localAllowList  *host.AllowList
+	remoteAllowList *host.AllowList
+	preferredRanges []*net.IPNet
+	familyPolicy    host.FamilyPolicy
+
+	// external 最近一次查询 STUN 服务器的结果
+	external atomic.Pointer[stunclient.Result]
+
+	// natType 本端的 NAT 类型，检测完成前为 nil
+	natType atomic.Pointer[api.NatType]
+
+	// publicKey 插件发现的本端公钥，随主机消息发布
+	publicKey string
+	// subsLock 保护 subscriptions 和 pubClient，订阅可以在重新加载配置时修改
+	subsLock sync.Mutex
+	// subscriptions 配置的和插件发现的需要订阅的主机
+	subscriptions []string
+
+	// monitor 不为 nil 时本地网络变化会立即触发主机更新
+	monitor *netmon.Monitor
+
+	// signer 不为 nil 时发送给灯塔的消息都会被签名
+	signer *auth.Signer
+
+	plugins []plugin.Plugin
+	// stunConn 不为 nil 时通过它查询 STUN 服务器，否则使用临时端口
+	stunConn net.PacketConn
+	// stunLock 保护 stunServers 并串行化 STUN 客户端的重建，stunClient 在 Start 之后才可用
+	stunLock    sync.Mutex
+	stunServers []string
+	stunClient  atomic.Pointer[stunclient.MultiClient]
 	pubClient   publisher.PublisherClient
 	punchClient api.PunchServiceClient
 }
@@ -72,19 +131,24 @@ func (cc *clientController) Start(ctx context.Context) error {
 	go func() {
 		<-ctx.Done()
 		cc.logger.Info("Shutting down Client")
-		if err := cc.pubClient.Close(); err != nil {
-			cc.logger.Error("Failed to close Client", zap.Error(err))
+		cc.subsLock.Lock()
+		if cc.pubClient != nil {
+			if err := cc.pubClient.Close(); err != nil {
+				cc.logger.Error("Failed to close Client", zap.Error(err))
+			}
 		}
+		cc.subsLock.Unlock()
 		close(serverShutdown)
 	}()
 
-	stunClient, err := stunclient.NewClient(cc.c.StunServer[0])
-	if err != nil {
+	if cc.stunConn == nil {
+		cc.logger.Warn("No STUN conn on the endpoint port, the reported external port may not match the punched port")
+	}
+	if err := cc.startSTUNClient(); err != nil {
 		cc.logger.Error("Failed to create STUN client", zap.Error(err))
 		return err
 	}
-	defer stunClient.Close()
-	cc.stunClient = stunClient
+	defer cc.stopSTUNClient()
 
 	conn, err := grpc.NewClient(cc.c.SignalServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -93,6 +157,8 @@ func (cc *clientController) Start(ctx context.Context) error {
 	defer conn.Close()
 	cc.punchClient = api.NewPunchServiceClient(conn)
 
+	cc.discover()
+
 	if err := cc.InitAndSubscribe(); err != nil {
 		cc.logger.Error("Failed to init and subscribe", zap.Error(err))
 		return err
@@ -100,7 +166,15 @@ func (cc *clientController) Start(ctx context.Context) error {
 
 	go cc.sendHostOnline(ctx)
 
+	go cc.watchExternal(ctx)
+
+	if cc.monitor != nil {
+		cc.monitor.Subscribe(func() { go cc.onNetworkChange() })
+	}
+
 	go func() {
+		cc.detectNAT()
+
 		clockSource := time.NewTicker(time.Second * time.Duration(30))
 		defer clockSource.Stop()
 
@@ -123,22 +197,70 @@ func (cc *clientController) Start(ctx context.Context) error {
 
 // InitAndSubscribe 初始化并订阅主题
 func (cc *clientController) InitAndSubscribe() error {
-	cc.logger.Info("Initializing publisher", zap.Any("subscriptions", cc.c.Subscriptions))
-	pubSubServiceClient, err := publisher.NewClient(cc.c.SignalServer, publisher.WithClientName(cc.c.Hostname))
+	cc.logger.Info("Initializing publisher", zap.Strings("subscriptions", cc.subscriptions))
+	pubSubServiceClient, err := publisher.NewClient(cc.c.SignalServer, publisher.WithClientName(cc.hostname))
 	if err != nil {
 		return fmt.Errorf("failed to create publisher clientController: %w", err)
 	}
+
+	cc.subsLock.Lock()
+	defer cc.subsLock.Unlock()
 	cc.pubClient = pubSubServiceClient
+	for _, topic := range cc.subscriptions {
+		if err := cc.subscribe(topic); err != nil {
+			return fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
+		}
+	}
 
+	return nil
+}
+
+// discover 合并配置的订阅和插件发现的主机，并获取本端公钥。
+// 没有配置主机名时使用本端公钥作为主机名，与自动模式下对端订阅的主机名一致
+func (cc *clientController) discover() {
+	cc.subsLock.Lock()
+	defer cc.subsLock.Unlock()
+
+	// 启动前 SetSubscriptions 设置的订阅保留，不重复添加
+	seen := make(map[string]bool)
+	for _, topic := range cc.subscriptions {
+		seen[topic] = true
+	}
+	add := func(topic string) {
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			cc.subscriptions = append(cc.subscriptions, topic)
+		}
+	}
 	for _, sub := range cc.c.Subscriptions {
-		if err := cc.pubClient.Subscribe(context.Background(), sub.Topic, func(message *publisher.Message) error {
-			return cc.handleSubscribe(message)
-		}); err != nil {
-			return fmt.Errorf("failed to subscribe to topic %s: %w", sub.Topic, err)
+		add(sub.Topic)
+	}
+
+	for _, p := range cc.plugins {
+		d, ok := plugin.Unwrap(p).(plugin.Discoverer)
+		if !ok {
+			continue
+		}
+		if cc.publicKey == "" {
+			key, err := d.PublicKey()
+			if err != nil {
+				cc.logger.Error("Failed to discover public key", zap.String("plugin", p.Name()), zap.Error(err))
+			}
+			cc.publicKey = key
+		}
+		hosts, err := d.Subscriptions()
+		if err != nil {
+			cc.logger.Error("Failed to discover subscriptions", zap.String("plugin", p.Name()), zap.Error(err))
+		}
+		for _, h := range hosts {
+			add(h)
 		}
 	}
 
-	return nil
+	if cc.hostname == "" && cc.publicKey != "" {
+		cc.hostname = cc.publicKey
+		cc.logger.Info("No hostname configured, using public key as hostname", zap.String("hostname", cc.hostname))
+	}
 }
 
 func (cc *clientController) sendHostOnline(ctx context.Context) {
@@ -149,10 +271,11 @@ func (cc *clientController) sendHostOnline(ctx context.Context) {
 	}
 
 	_, err = cc.punchClient.HostOnline(ctx, &api.HostOnlineRequest{
-		Hostname:     message.Hostname,
-		Ipv4Addr:     message.Ipv4Addr,
-		Ipv6Addr:     message.Ipv6Addr,
-		ExternalAddr: message.ExternalAddr,
+		Hostname:      message.Hostname,
+		Ipv4Addr:      message.Ipv4Addr,
+		Ipv6Addr:      message.Ipv6Addr,
+		ExternalAddr:  message.ExternalAddr,
+		ExternalAddr6: message.ExternalAddr6,
 	})
 	if err != nil {
 		cc.logger.Error("Failed to send host online", zap.Error(err))
@@ -172,22 +295,36 @@ func (cc *clientController) handleSubscribe(message *publisher.Message) error {
 		zap.Any("hm", hm),
 	)
 
-	go func() {
-		for _, p := range cc.plugins {
-			p.Handle(context.Background(), hm)
-		}
-	}()
+	if cc.shouldDispatch(hm) {
+		cc.dispatch(hm)
+	}
 
 	switch hm.Type {
 	case api.HostMessage_HostOnlineNotification:
 		cc.handleHostOnlineNotification(hm)
 	case api.HostMessage_HostPunchNotification:
 		cc.handleHostPunchNotification(hm)
+	case api.HostMessage_HostRelayNotification:
+		cc.handleHostRelayNotification(hm)
 	}
 
 	return nil
 }
 
+func (cc *clientController) Name() string {
+	return "lighthouse"
+}
+
+// Handle 灯塔客户端自己产生主机消息，不处理其他来源的消息
+func (cc *clientController) Handle(ctx context.Context, msg *api.HostMessage) {}
+
+// dispatch 将消息交给所有插件处理，插件是 plugin.Runner 时只是放入插件的事件队列
+func (cc *clientController) dispatch(hm *api.HostMessage) {
+	for _, p := range cc.plugins {
+		p.Handle(context.Background(), hm)
+	}
+}
+
 func (cc *clientController) handleHostOnlineNotification(hm *api.HostMessage) {
 	cc.logger.Debug("收到主机上线通知", zap.Any("hm", hm), zap.Any("makeupPort", cc.listenPort))
 	cc.handleHostPunchNotification(hm)
@@ -195,37 +332,51 @@ func (cc *clientController) handleHostOnlineNotification(hm *api.HostMessage) {
 
 func (cc *clientController) handleHostPunchNotification(hm *api.HostMessage) {
 	cc.logger.Debug("收到主机打洞通知", zap.Any("hm", hm), zap.Any("makeupPort", cc.listenPort))
-	//empty := []byte{0}
-	newHm := &api.HostMessage{
-		Type:     api.HostMessage_None,
-		Hostname: "empty",
-	}
-	empty, err := newHm.Marshal()
-	if err != nil {
-		cc.logger.Error("Error while marshalling for lighthouse update", zap.Error(err))
-		return
-	}
+	// 经过允许列表过滤，去掉被阻止的地址，并按首选网段排序
+	hostInfo := cc.getOrCreateHostInfo(hm.Hostname)
+	hostInfo.Remotes.Lock()
+	hostInfo.Remotes.UnlockedSetV4(hm.Hostname, hm.Ipv4Addr)
+	hostInfo.Remotes.UnlockedSetV6(hm.Hostname, hm.Ipv6Addr)
+	hostInfo.Remotes.Unlock()
 
-	punch := func(vpnPeer *udp.Addr) {
-		time.Sleep(time.Second)
-		if err := cc.makeupWriter.WriteTo(uint16(cc.listenPort), vpnPeer.Port, empty, vpnPeer); err != nil {
-			cc.logger.Error("Error while sending lighthouse punch", zap.Error(err))
-		} else {
-			cc.logger.Debug(fmt.Sprintf("Punching on %s for %s", vpnPeer.String(), hm.Hostname))
-		}
+	go cc.punch(hm, hostInfo.Remotes.CopyAddrs(cc.hostMap.GetPreferredRanges()))
+
+	cc.schedulePathSelection(hm)
+}
+
+// writerFor 根据目标地址的地址族选择 MakeupWriter
+func (cc *clientController) writerFor(addr *udp.Addr) udp.MakeupWriter {
+	if addr.IP.To4() == nil && cc.makeupWriter6 != nil {
+		return cc.makeupWriter6
 	}
+	return cc.makeupWriter
+}
 
-	for _, a := range hm.Ipv4Addr {
-		vpnPeer := utils.NewUDPAddrFromLH4(a)
-		if vpnPeer != nil {
-			go punch(vpnPeer)
-		}
+// BlockRemote 将对端的某个地址标记为不可用，例如本机没有到该地址的路由，之后不会再向该地址打洞
+func (cc *clientController) BlockRemote(hostname string, addr *udp.Addr) {
+	cc.getOrCreateHostInfo(hostname).Remotes.BlockRemote(addr)
+}
+
+// resetBlockedRemotes 清除所有对端被阻止的地址，本地网络变化后之前不可达的地址可能已经可达
+func (cc *clientController) resetBlockedRemotes() {
+	cc.hostMap.RLock()
+	defer cc.hostMap.RUnlock()
+	for _, h := range cc.hostMap.Hosts {
+		h.Remotes.ResetBlockedRemotes()
 	}
+}
+
+func (cc *clientController) getOrCreateHostInfo(hostname string) *host.HostInfo {
+	cc.hostMap.Lock()
+	defer cc.hostMap.Unlock()
 
-	for _, a := range hm.Ipv6Addr {
-		vpnPeer := utils.NewUDPAddrFromLH6(a)
-		if vpnPeer != nil {
-			go punch(vpnPeer)
+	hostInfo, ok := cc.hostMap.Hosts[hostname]
+	if !ok {
+		hostInfo = &host.HostInfo{
+			Name:    hostname,
+			Remotes: host.NewRemoteList(cc.remoteAllowList, cc.familyPolicy),
 		}
+		cc.hostMap.Hosts[hostname] = hostInfo
 	}
+	return hostInfo
 }
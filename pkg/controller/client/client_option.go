@@ -1,6 +1,13 @@
 package controller
 
-import plugin "github.com/cossteam/punchline/pkg/plugin/client"
+import (
+	"github.com/cossteam/punchline/pkg/auth"
+	"github.com/cossteam/punchline/pkg/host"
+	"github.com/cossteam/punchline/pkg/netmon"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"net"
+)
 
 func WithClientPlugin(plugin plugin.Plugin) ClientOption {
 	return func(cc *clientController) {
@@ -8,8 +15,68 @@ func WithClientPlugin(plugin plugin.Plugin) ClientOption {
 	}
 }
 
+// WithClientPlugins 设置处理主机消息的插件，Handle 在收到消息的 goroutine 中调用，
+// 不能阻塞的插件应该先用 plugin.NewRunner 包装
 func WithClientPlugins(plugins []plugin.Plugin) ClientOption {
 	return func(cc *clientController) {
 		cc.plugins = append(cc.plugins, plugins...)
 	}
 }
+
+// WithLocalAllowList 设置过滤上报的本地地址的允许列表
+func WithLocalAllowList(allowList *host.AllowList) ClientOption {
+	return func(cc *clientController) {
+		cc.localAllowList = allowList
+	}
+}
+
+// WithRemoteAllowList 设置过滤对端地址的允许列表，不被允许的地址不会进行打洞
+func WithRemoteAllowList(allowList *host.AllowList) ClientOption {
+	return func(cc *clientController) {
+		cc.remoteAllowList = allowList
+	}
+}
+
+// WithPreferredRanges 设置首选网段，打洞时优先尝试这些网段内的地址
+func WithPreferredRanges(preferredRanges []*net.IPNet) ClientOption {
+	return func(cc *clientController) {
+		cc.preferredRanges = preferredRanges
+	}
+}
+
+// WithFamilyPolicy 设置地址族策略
+func WithFamilyPolicy(family host.FamilyPolicy) ClientOption {
+	return func(cc *clientController) {
+		cc.familyPolicy = family
+	}
+}
+
+// WithSigner 使用预共享密钥对发送给灯塔的消息进行签名
+func WithSigner(signer *auth.Signer) ClientOption {
+	return func(cc *clientController) {
+		cc.signer = signer
+	}
+}
+
+// WithMakeupWriter6 设置用于向 IPv6 地址打洞的 MakeupWriter
+func WithMakeupWriter6(w udp.MakeupWriter) ClientOption {
+	return func(cc *clientController) {
+		cc.makeupWriter6 = w
+	}
+}
+
+// WithSTUNConn 使用 conn 查询 STUN 服务器，conn 应该从 endpointPort 收发数据，
+// 使上报的外部地址就是 endpointPort 在 NAT 上的映射，见 udp.STUNConn
+func WithSTUNConn(conn net.PacketConn) ClientOption {
+	return func(cc *clientController) {
+		cc.stunConn = conn
+	}
+}
+
+// WithNetworkMonitor 在本地网络变化时立即重新查询外部地址并发送主机更新，
+// monitor 需要由调用者启动
+func WithNetworkMonitor(monitor *netmon.Monitor) ClientOption {
+	return func(cc *clientController) {
+		cc.monitor = monitor
+	}
+}
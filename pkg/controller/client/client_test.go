@@ -1 +1,384 @@
 package controller
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/host"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeWriter 记录所有写入的目标地址和 TTL，写入 fail 中的地址时返回对应的错误
+type fakeWriter struct {
+	sync.Mutex
+	addrs []*udp.Addr
+	ttls  []int
+	fail  map[string]error
+}
+
+func (w *fakeWriter) WriteTo(srcPort uint16, destPort uint16, b []byte, addr *udp.Addr) error {
+	return w.WriteToTTL(srcPort, destPort, b, addr, 0)
+}
+
+func (w *fakeWriter) WriteToTTL(srcPort uint16, destPort uint16, b []byte, addr *udp.Addr, ttl int) error {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.fail[addr.String()]; err != nil {
+		return err
+	}
+	w.addrs = append(w.addrs, udp.NewAddr(addr.IP, destPort))
+	w.ttls = append(w.ttls, ttl)
+	return nil
+}
+
+func (w *fakeWriter) sent() ([]string, []int) {
+	w.Lock()
+	defer w.Unlock()
+	var addrs []string
+	for _, a := range w.addrs {
+		addrs = append(addrs, a.String())
+	}
+	return addrs, append([]int(nil), w.ttls...)
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+func TestWriterFor(t *testing.T) {
+	v4, v6 := &fakeWriter{}, &fakeWriter{}
+	cc := &clientController{makeupWriter: v4}
+
+	a4 := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	a6 := udp.NewAddr(net.ParseIP("2001:db8::1"), 4242)
+
+	assert.Same(t, udp.MakeupWriter(v4), cc.writerFor(a4))
+	// MakeupWriter 可以同时发送 IPv4 和 IPv6
+	assert.Same(t, udp.MakeupWriter(v4), cc.writerFor(a6))
+
+	WithMakeupWriter6(v6)(cc)
+	assert.Same(t, udp.MakeupWriter(v6), cc.writerFor(a6))
+}
+
+func TestSetExternalAddr(t *testing.T) {
+	hm := &api.HostMessage{}
+	setExternalAddr(hm, udp.NewAddr(net.ParseIP("1.2.3.4"), 4242))
+	assert.NotNil(t, hm.ExternalAddr)
+	assert.Nil(t, hm.ExternalAddr6)
+
+	hm = &api.HostMessage{}
+	setExternalAddr(hm, udp.NewAddr(net.ParseIP("2001:db8::1"), 4242))
+	assert.Nil(t, hm.ExternalAddr)
+	assert.Equal(t, api.NewIpv6Addr(net.ParseIP("2001:db8::1"), 4242), hm.ExternalAddr6)
+}
+
+func newTestClientController(hostname string, w udp.MakeupWriter, punch config.Punch) *clientController {
+	return &clientController{
+		c:            &config.Config{Punch: punch},
+		logger:       zap.NewNop(),
+		hostname:     hostname,
+		listenPort:   51820,
+		makeupWriter: w,
+		paths:        make(map[string]*peerPath),
+		hostMap:      host.NewHostMap(zap.NewNop(), nil),
+	}
+}
+
+func metricValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestPunchStrategies(t *testing.T) {
+	w := &fakeWriter{}
+	cc := newTestClientController("b", w, config.Punch{
+		Strategies:      []string{"direct", "lowttl", "predict", "birthday", "unknown"},
+		StrategyTimeout: time.Millisecond,
+		PredictRange:    2,
+		BirthdayProbes:  5,
+	})
+
+	hm := &api.HostMessage{
+		Hostname:     "a",
+		ExternalAddr: api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 5000),
+	}
+	addrs := []*udp.Addr{
+		udp.NewAddr(net.ParseIP("1.2.3.4"), 5000),
+		udp.NewAddr(net.ParseIP("192.168.1.2"), 51820),
+	}
+	cc.punch(hm, addrs)
+
+	sent, ttls := w.sent()
+	assert.Len(t, sent, 2+4+4+5)
+	// direct
+	assert.Equal(t, []string{"1.2.3.4:5000", "192.168.1.2:51820"}, sent[:2])
+	// lowttl 预热包
+	assert.Equal(t, []string{"1.2.3.4:5000", "1.2.3.4:5000", "192.168.1.2:51820", "192.168.1.2:51820"}, sent[2:6])
+	assert.Equal(t, []int{defaultLowTTL, 0, defaultLowTTL, 0}, ttls[2:6])
+	// predict
+	assert.Equal(t, []string{"1.2.3.4:4999", "1.2.3.4:5001", "1.2.3.4:4998", "1.2.3.4:5002"}, sent[6:10])
+	// birthday，主机名较大的一端发送探测包
+	for _, a := range sent[10:] {
+		assert.Contains(t, a, "1.2.3.4:")
+	}
+}
+
+func TestPunchCooldown(t *testing.T) {
+	w := &fakeWriter{}
+	cc := newTestClientController("b", w, config.Punch{
+		Strategies:      []string{"direct", "predict"},
+		StrategyTimeout: time.Millisecond,
+		PredictRange:    1,
+		Cooldown:        time.Hour,
+	})
+
+	hm := &api.HostMessage{
+		Hostname:     "a",
+		ExternalAddr: api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 5000),
+	}
+	addrs := []*udp.Addr{udp.NewAddr(net.ParseIP("1.2.3.4"), 5000)}
+
+	// 策略用尽后进入冷却，之后的打洞只执行第一个策略
+	cc.punch(hm, addrs)
+	sent, _ := w.sent()
+	assert.Len(t, sent, 1+2)
+	cc.punch(hm, addrs)
+	sent, _ = w.sent()
+	assert.Len(t, sent, 1+2+1)
+
+	// 冷却期间只执行第一个策略，不延长冷却
+	cooldown := cc.paths["a"].cooldown
+	assert.WithinDuration(t, time.Now().Add(time.Hour), cooldown, time.Minute)
+
+	// 直连成功后清除冷却
+	cc.MarkDirect("a")
+	cc.MarkDisconnected("a")
+	cc.punch(hm, addrs)
+	sent, _ = w.sent()
+	assert.Len(t, sent, 1+2+1+1+2)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), cc.paths["a"].cooldown, time.Minute)
+
+	cc.punch(hm, addrs)
+	cc.resetPunchCooldown()
+	cc.punch(hm, addrs)
+	sent, _ = w.sent()
+	assert.Len(t, sent, 1+2+1+1+2+1+1+2)
+	// 网络变化清除了失败次数，重新从配置的冷却时间开始
+	assert.WithinDuration(t, time.Now().Add(time.Hour), cc.paths["a"].cooldown, time.Minute)
+
+	// 连续失败时冷却时间加倍
+	cc.paths["a"].cooldown = time.Time{}
+	cc.punch(hm, addrs)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), cc.paths["a"].cooldown, time.Minute)
+}
+
+func TestPunchStopsWhenDirect(t *testing.T) {
+	w := &fakeWriter{}
+	cc := newTestClientController("b", w, config.Punch{
+		Strategies:      []string{"direct", "predict"},
+		StrategyTimeout: 5 * time.Second,
+	})
+	success := metricValue(metricPunchSuccess, string(PunchDirect))
+
+	hm := &api.HostMessage{
+		Hostname:     "a",
+		ExternalAddr: api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 5000),
+	}
+	done := make(chan struct{})
+	go func() {
+		cc.punch(hm, []*udp.Addr{udp.NewAddr(net.ParseIP("1.2.3.4"), 5000)})
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		sent, _ := w.sent()
+		return len(sent) == 1
+	}, time.Second, time.Millisecond)
+	// ICE 连接建立后停止打洞，并计入当前策略的成功次数
+	cc.HandleICE(context.Background(), &plugin.ICEEvent{Type: plugin.ICEConnected, Hostname: "a"})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("punch did not stop after the direct path was established")
+	}
+
+	sent, _ := w.sent()
+	assert.Len(t, sent, 1)
+	assert.Equal(t, success+1, metricValue(metricPunchSuccess, string(PunchDirect)))
+}
+
+func TestPunchBirthdayOpen(t *testing.T) {
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer peer.Close()
+	external := udp.NewAddr(net.IPv4(127, 0, 0, 1), uint16(peer.LocalAddr().(*net.UDPAddr).Port))
+
+	cc := newTestClientController("a", &fakeWriter{}, config.Punch{})
+	reachable := metricBirthdayReachable.Value()
+	success := metricValue(metricPunchSuccess, string(PunchBirthday))
+
+	b := cc.punchBudget(nil)
+	b.birthdaySockets = 4
+	b.strategyTimeout = 2 * time.Second
+	assert.Equal(t, 4, cc.punchBirthday("b", external, []byte("punch"), b))
+
+	// 对端的探测包命中其中一个映射
+	buf := make([]byte, 16)
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, from, err := peer.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	_, err = peer.WriteToUDP([]byte("probe"), from)
+	assert.NoError(t, err)
+
+	// 命中只说明对端可达，不计入打洞成功
+	assert.Eventually(t, func() bool {
+		return metricBirthdayReachable.Value() == reachable+1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, success, metricValue(metricPunchSuccess, string(PunchBirthday)))
+}
+
+func TestSelectStrategies(t *testing.T) {
+	eim := &api.NatType{Mapping: api.NatBehavior_EndpointIndependent, Filtering: api.NatBehavior_EndpointIndependent}
+	restricted := &api.NatType{Mapping: api.NatBehavior_EndpointIndependent, Filtering: api.NatBehavior_AddressAndPortDependent}
+	symmetric := &api.NatType{Mapping: api.NatBehavior_AddressAndPortDependent, Filtering: api.NatBehavior_AddressAndPortDependent}
+
+	assert.Equal(t, []PunchStrategy{PunchDirect}, selectStrategies(nil, symmetric))
+	assert.Equal(t, []PunchStrategy{PunchDirect}, selectStrategies(eim, eim))
+	assert.Equal(t, []PunchStrategy{PunchDirect, PunchLowTTL}, selectStrategies(eim, restricted))
+	assert.Equal(t, []PunchStrategy{PunchDirect, PunchLowTTL, PunchPredict}, selectStrategies(eim, symmetric))
+	assert.Equal(t, []PunchStrategy{PunchDirect, PunchLowTTL, PunchPredict, PunchBirthday}, selectStrategies(symmetric, symmetric))
+}
+
+func TestBlockUnreachableRemote(t *testing.T) {
+	unreachable := udp.NewAddr(net.ParseIP("10.0.0.2"), 51820)
+	reachable := udp.NewAddr(net.ParseIP("1.2.3.4"), 5000)
+	w := &fakeWriter{fail: map[string]error{unreachable.String(): syscall.ENETUNREACH}}
+	cc := newTestClientController("b", w, config.Punch{})
+
+	hostInfo := cc.getOrCreateHostInfo("a")
+	hostInfo.Remotes.Lock()
+	hostInfo.Remotes.UnlockedSetV4("a", []*api.Ipv4Addr{
+		api.NewIpv4Addr(reachable.IP, uint32(reachable.Port)),
+		api.NewIpv4Addr(unreachable.IP, uint32(unreachable.Port)),
+	})
+	hostInfo.Remotes.Unlock()
+
+	assert.Equal(t, 1, cc.punchDirect("a", hostInfo.Remotes.CopyAddrs(nil), nil))
+	// 没有路由的地址不再参与打洞
+	assert.Equal(t, []*udp.Addr{reachable}, hostInfo.Remotes.CopyAddrs(nil))
+
+	// 本地网络变化后重新尝试
+	cc.resetBlockedRemotes()
+	assert.Len(t, hostInfo.Remotes.CopyAddrs(nil), 2)
+}
+
+// recordPlugin 记录收到的主机消息
+type recordPlugin struct {
+	sync.Mutex
+	msgs []*api.HostMessage
+}
+
+func (p *recordPlugin) Name() string {
+	return "record"
+}
+
+func (p *recordPlugin) Handle(ctx context.Context, msg *api.HostMessage) {
+	p.Lock()
+	defer p.Unlock()
+	p.msgs = append(p.msgs, msg)
+}
+
+func TestHandleICE(t *testing.T) {
+	rec := &recordPlugin{}
+	cc := newTestClientController("b", &fakeWriter{}, config.Punch{})
+	cc.plugins = []plugin.Plugin{rec}
+
+	punch := &api.HostMessage{Type: api.HostMessage_HostPunchNotification, Hostname: "a"}
+	cc.paths["a"] = &peerPath{relayed: true, lastPunch: punch}
+
+	// ICE 连接建立后从中继切换回直连
+	cc.HandleICE(context.Background(), &plugin.ICEEvent{Type: plugin.ICEConnected, Hostname: "a"})
+	assert.True(t, cc.paths["a"].direct)
+	assert.False(t, cc.paths["a"].relayed)
+	assert.Equal(t, []*api.HostMessage{punch}, rec.msgs)
+
+	cc.HandleICE(context.Background(), &plugin.ICEEvent{Type: plugin.ICEDisconnected, Hostname: "a"})
+	assert.False(t, cc.paths["a"].direct)
+}
+
+// probePlugin 模拟可以观察 WireGuard 握手的插件
+type probePlugin struct {
+	recordPlugin
+	direct bool
+}
+
+func (p *probePlugin) DirectSince(hostname string, since time.Time) (bool, bool) {
+	p.Lock()
+	defer p.Unlock()
+	return p.direct, true
+}
+
+func (p *probePlugin) messages() []api.HostMessage_MessageType {
+	p.Lock()
+	defer p.Unlock()
+	var types []api.HostMessage_MessageType
+	for _, msg := range p.msgs {
+		types = append(types, msg.Type)
+	}
+	return types
+}
+
+func TestTryDirect(t *testing.T) {
+	probe := &probePlugin{}
+	cc := newTestClientController("b", &fakeWriter{}, config.Punch{
+		Strategies:      []string{"direct"},
+		StrategyTimeout: time.Millisecond,
+	})
+	cc.c.Relay.Timeout = 20 * time.Millisecond
+	cc.trialInterval = 10 * time.Millisecond
+	cc.plugins = []plugin.Plugin{probe}
+
+	punch := &api.HostMessage{
+		Type:         api.HostMessage_HostPunchNotification,
+		Hostname:     "a",
+		ExternalAddr: api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 5000),
+	}
+	relay := &api.HostMessage{
+		Type:      api.HostMessage_HostRelayNotification,
+		Hostname:  "a",
+		RelayAddr: []*api.Ipv4Addr{api.NewIpv4Addr(net.ParseIP("5.6.7.8"), 4242)},
+	}
+	cc.paths["a"] = &peerPath{lastPunch: punch}
+	cc.handleHostRelayNotification(relay)
+
+	// 插件没有确认直连时切换回直连地址后恢复中继
+	punchType, relayType := api.HostMessage_HostPunchNotification, api.HostMessage_HostRelayNotification
+	assert.Eventually(t, func() bool {
+		return len(probe.messages()) >= 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []api.HostMessage_MessageType{relayType, punchType, relayType}, probe.messages()[:3])
+
+	// 插件观察到直连握手后保持直连，不再尝试
+	probe.Lock()
+	probe.direct = true
+	probe.Unlock()
+	assert.Eventually(t, func() bool {
+		cc.pathsLock.Lock()
+		defer cc.pathsLock.Unlock()
+		return cc.paths["a"].direct && !cc.paths["a"].relayed && cc.paths["a"].trial == nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, punchType, probe.messages()[len(probe.messages())-1])
+}
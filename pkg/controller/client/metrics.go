@@ -0,0 +1,17 @@
+package controller
+
+import "expvar"
+
+var (
+	// metricPunchAttempts 按策略统计执行的打洞次数
+	metricPunchAttempts = expvar.NewMap("punchline_punch_attempts")
+
+	// metricPunchSuccess 按策略统计成功的打洞次数，以 ICE 连接建立为准
+	metricPunchSuccess = expvar.NewMap("punchline_punch_success")
+
+	// metricBirthdayReachable 统计生日悖论打洞命中临时套接字的次数，只说明对端可达，不计入 metricPunchSuccess
+	metricBirthdayReachable = expvar.NewInt("punchline_punch_birthday_reachable")
+
+	// metricPunchCooldown 统计因为冷却只执行了第一个策略的打洞次数
+	metricPunchCooldown = expvar.NewInt("punchline_punch_cooldown")
+)
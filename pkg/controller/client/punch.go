@@ -0,0 +1,461 @@
+package controller
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/cossteam/punchline/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPunchDelay      = time.Second
+	defaultProbeInterval   = 15 * time.Second
+	defaultStrategyTimeout = 2 * time.Second
+	defaultLowTTL          = 3
+	defaultPredictRange    = 16
+	defaultBirthdaySockets = 256
+	defaultBirthdayProbes  = 1024
+	defaultPunchCooldown   = 30 * time.Second
+
+	// maxCooldownFactor 连续失败时冷却时间最多加倍到配置值的倍数
+	maxCooldownFactor = 16
+
+	// punchPacketInterval 连续发送大量打洞包时的间隔，避免触发 NAT 或防火墙的洪泛保护
+	punchPacketInterval = time.Millisecond
+	// directPollInterval 等待直连成功时检查的间隔
+	directPollInterval = 50 * time.Millisecond
+)
+
+var errNoWriter = errors.New("no makeup writer for address family")
+
+// PunchStrategy 打洞策略
+type PunchStrategy string
+
+const (
+	// PunchDirect 向对端的每个地址发送一个打洞包
+	PunchDirect PunchStrategy = "direct"
+	// PunchLowTTL 先发送低 TTL 的预热包在本端 NAT 上建立映射，再发送正常的打洞包，
+	// 预热包不会到达对端 NAT，因此不会让对端 NAT 因为收到未经请求的数据包而拦截该地址
+	PunchLowTTL PunchStrategy = "lowttl"
+	// PunchPredict 在对端外部端口两侧扫描，用于按顺序分配端口的 NAT
+	PunchPredict PunchStrategy = "predict"
+	// PunchBirthday 生日悖论打洞，一端打开大量映射，另一端向随机端口发送大量探测包。
+	// 打开映射的一端使用临时端口而不是 endpointPort，命中只能证明两端之间可以打通，
+	// 应用的端口需要随后由 ICE 或其他策略打通
+	PunchBirthday PunchStrategy = "birthday"
+)
+
+// punchBudget 打洞策略及其预算
+type punchBudget struct {
+	strategies      []PunchStrategy
+	strategyTimeout time.Duration
+	lowTTL          int
+	predictRange    int
+	birthdaySockets int
+	birthdayProbes  int
+	cooldown        time.Duration
+}
+
+// punchBudget 根据配置返回打洞策略及其预算，未配置的字段使用默认值，
+// 未配置打洞策略时根据本端和对端 remote 的 NAT 类型选择
+func (cc *clientController) punchBudget(remote *api.NatType) punchBudget {
+	pc := cc.c.Punch
+	b := punchBudget{
+		strategyTimeout: pc.StrategyTimeout,
+		lowTTL:          pc.LowTTL,
+		predictRange:    pc.PredictRange,
+		birthdaySockets: pc.BirthdaySockets,
+		birthdayProbes:  pc.BirthdayProbes,
+		cooldown:        pc.Cooldown,
+	}
+
+	for _, s := range pc.Strategies {
+		switch strategy := PunchStrategy(s); strategy {
+		case PunchDirect, PunchLowTTL, PunchPredict, PunchBirthday:
+			b.strategies = append(b.strategies, strategy)
+		default:
+			cc.logger.Warn("Ignoring unknown punch strategy", zap.String("strategy", s))
+		}
+	}
+	if len(b.strategies) == 0 {
+		b.strategies = selectStrategies(cc.natType.Load(), remote)
+	}
+
+	if b.strategyTimeout <= 0 {
+		b.strategyTimeout = defaultStrategyTimeout
+	}
+	if b.lowTTL <= 0 {
+		b.lowTTL = defaultLowTTL
+	}
+	if b.predictRange <= 0 {
+		b.predictRange = defaultPredictRange
+	}
+	if b.birthdaySockets <= 0 {
+		b.birthdaySockets = defaultBirthdaySockets
+	}
+	if b.birthdayProbes <= 0 {
+		b.birthdayProbes = defaultBirthdayProbes
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = defaultPunchCooldown
+	}
+	return b
+}
+
+// punch 依次执行配置的打洞策略，直到与对端直连成功、策略用尽或收到了新的打洞通知。
+// 策略用尽仍未直连时进入冷却，冷却期间只执行代价最小的第一个策略，
+// 避免每次打洞通知都重复 lowttl、predict 和 birthday 这样大量发包的策略
+func (cc *clientController) punch(hm *api.HostMessage, addrs []*udp.Addr) {
+	hostname := hm.Hostname
+	logger := cc.logger.With(zap.String("hostname", hostname))
+
+	payload, err := (&api.HostMessage{Type: api.HostMessage_None, Hostname: "empty"}).Marshal()
+	if err != nil {
+		logger.Error("Error while marshalling punch packet", zap.Error(err))
+		return
+	}
+
+	b := cc.punchBudget(hm.NatType)
+	external := externalAddr(hm)
+	gen := cc.startPunch(hostname)
+
+	strategies := b.strategies
+	if cc.inCooldown(hostname) && len(strategies) > 1 {
+		metricPunchCooldown.Add(1)
+		logger.Debug("Punch cooling down, only running the first strategy", zap.String("strategy", string(strategies[0])))
+		strategies = strategies[:1]
+	}
+
+	if cc.punchDelay > 0 {
+		time.Sleep(cc.punchDelay)
+	}
+
+	for i, strategy := range strategies {
+		if !cc.setPunchStrategy(hostname, gen, strategy, i == 0) {
+			return
+		}
+
+		var sent int
+		switch strategy {
+		case PunchDirect:
+			sent = cc.punchDirect(hostname, addrs, payload)
+		case PunchLowTTL:
+			sent = cc.punchLowTTL(hostname, addrs, payload, b.lowTTL)
+		case PunchPredict:
+			sent = cc.punchPredict(external, payload, b.predictRange)
+		case PunchBirthday:
+			sent = cc.punchBirthday(hostname, external, payload, b)
+		}
+
+		metricPunchAttempts.Add(string(strategy), 1)
+		logger.Debug("执行打洞策略", zap.String("strategy", string(strategy)), zap.Int("sent", sent))
+
+		if sent > 0 && cc.waitDirect(hostname, b.strategyTimeout) {
+			return
+		}
+	}
+
+	if len(strategies) == len(b.strategies) {
+		cc.punchFailed(hostname, gen, b.cooldown)
+	}
+}
+
+// selectStrategies 根据两端的 NAT 类型选择打洞策略，任一端类型未知时只直接打洞:
+// 对端过滤受端口限制时先发送低 TTL 包，避免对端 NAT 拦截打洞地址；
+// 对端映射依赖目的地址时其外部端口无法直接使用，需要端口预测；
+// 两端映射都依赖目的地址时端口预测成功率很低，最后使用生日悖论打洞
+func selectStrategies(local, remote *api.NatType) []PunchStrategy {
+	strategies := []PunchStrategy{PunchDirect}
+	if local == nil || remote == nil ||
+		local.Mapping == api.NatBehavior_Unknown || remote.Mapping == api.NatBehavior_Unknown {
+		return strategies
+	}
+
+	if remote.Filtering == api.NatBehavior_AddressAndPortDependent {
+		strategies = append(strategies, PunchLowTTL)
+	}
+	if symmetricMapping(remote) {
+		strategies = append(strategies, PunchPredict)
+		if symmetricMapping(local) {
+			strategies = append(strategies, PunchBirthday)
+		}
+	}
+	return strategies
+}
+
+// symmetricMapping 判断 NAT 是否为每个目的地址分配不同的外部端口
+func symmetricMapping(t *api.NatType) bool {
+	return t.Mapping == api.NatBehavior_AddressDependent || t.Mapping == api.NatBehavior_AddressAndPortDependent
+}
+
+// detectNAT 检测本端的 NAT 类型，结果随主机更新发送给灯塔，由对端用来选择打洞策略
+func (cc *clientController) detectNAT() {
+	client := cc.stunClient.Load()
+	if client == nil {
+		return
+	}
+
+	nat, err := client.DetectNAT()
+	if err != nil {
+		cc.logger.Warn("Failed to detect NAT type", zap.Error(err))
+		return
+	}
+
+	cc.logger.Info("检测到 NAT 类型", zap.Stringer("nat", nat))
+	cc.natType.Store(nat.Proto())
+}
+
+// punchDirect 向对端的每个地址发送一个打洞包
+func (cc *clientController) punchDirect(hostname string, addrs []*udp.Addr, payload []byte) int {
+	var sent int
+	for _, addr := range addrs {
+		if cc.checkPunch(hostname, addr, cc.sendPunch(addr, payload, 0)) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// punchLowTTL 向对端的每个地址先发送低 TTL 的预热包，再发送正常的打洞包，MakeupWriter 不支持 TTL 时跳过
+func (cc *clientController) punchLowTTL(hostname string, addrs []*udp.Addr, payload []byte, ttl int) int {
+	var sent int
+	for _, addr := range addrs {
+		if _, ok := cc.writerFor(addr).(udp.TTLWriter); !ok {
+			cc.logger.Debug("MakeupWriter does not support TTL, skipping low TTL punch", zap.Stringer("addr", addr))
+			continue
+		}
+		if cc.checkPunch(hostname, addr, cc.sendPunch(addr, payload, ttl)) &&
+			cc.checkPunch(hostname, addr, cc.sendPunch(addr, payload, 0)) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// punchPredict 向对端外部端口两侧各 n 个端口发送打洞包
+func (cc *clientController) punchPredict(external *udp.Addr, payload []byte, n int) int {
+	if external == nil {
+		cc.logger.Debug("No external address, skipping port prediction")
+		return 0
+	}
+
+	var sent int
+	for d := 1; d <= n; d++ {
+		for _, port := range []int{int(external.Port) - d, int(external.Port) + d} {
+			if port <= 0 || port > 65535 {
+				continue
+			}
+			if cc.sendPunch(udp.NewAddr(external.IP, uint16(port)), payload, 0) == nil {
+				sent++
+			}
+			time.Sleep(punchPacketInterval)
+		}
+	}
+	return sent
+}
+
+// punchBirthday 执行生日悖论打洞，两端按主机名确定角色，不需要额外协商：
+// 主机名较小的一端打开大量套接字向对端外部地址发送数据，在本端 NAT 上建立大量映射，
+// 另一端从应用端口向对端 IP 的随机端口发送探测包，命中任一映射即打通
+func (cc *clientController) punchBirthday(hostname string, external *udp.Addr, payload []byte, b punchBudget) int {
+	if external == nil {
+		cc.logger.Debug("No external address, skipping birthday punch")
+		return 0
+	}
+
+	if cc.hostname < hostname {
+		return cc.birthdayOpen(hostname, external, payload, b.birthdaySockets, b.strategyTimeout)
+	}
+
+	var sent int
+	for i := 0; i < b.birthdayProbes; i++ {
+		port := 1024 + rand.Intn(65536-1024)
+		if cc.sendPunch(udp.NewAddr(external.IP, uint16(port)), payload, 0) == nil {
+			sent++
+		}
+		time.Sleep(punchPacketInterval)
+	}
+	return sent
+}
+
+// birthdayOpen 打开 n 个套接字向 external 发送数据，并在 timeout 内等待对端的探测包命中其中之一。
+// 命中的映射属于临时端口，应用无法使用，因此只记录对端可达并回复对端，超时后所有套接字都会关闭
+func (cc *clientController) birthdayOpen(hostname string, external *udp.Addr, payload []byte, n int, timeout time.Duration) int {
+	network := "udp4"
+	if external.IP.To4() == nil {
+		network = "udp6"
+	}
+	raddr := &net.UDPAddr{IP: external.IP, Port: int(external.Port)}
+
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			cc.logger.Debug("Failed to open birthday socket", zap.Error(err))
+			break
+		}
+		if _, err := conn.WriteToUDP(payload, raddr); err != nil {
+			_ = conn.Close()
+			continue
+		}
+		conns = append(conns, conn)
+	}
+
+	deadline := time.Now().Add(timeout)
+	var once sync.Once
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			defer conn.Close()
+			_ = conn.SetReadDeadline(deadline)
+
+			buffer := make([]byte, udp.MTU)
+			_, from, err := conn.ReadFromUDP(buffer)
+			if err != nil || !from.IP.Equal(external.IP) {
+				return
+			}
+
+			once.Do(func() {
+				metricBirthdayReachable.Add(1)
+				cc.logger.Info("生日悖论打洞命中，对端可达",
+					zap.String("hostname", hostname),
+					zap.Stringer("local", conn.LocalAddr()),
+					zap.Stringer("remote", from),
+				)
+			})
+			// 回复对端，使对端也能确认这条路径
+			_, _ = conn.WriteToUDP(payload, from)
+		}(conn)
+	}
+
+	return len(conns)
+}
+
+// sendPunch 从应用端口向 addr 发送打洞包，ttl 为 0 时使用系统默认值
+func (cc *clientController) sendPunch(addr *udp.Addr, payload []byte, ttl int) error {
+	w := cc.writerFor(addr)
+	if w == nil {
+		cc.logger.Debug("No makeup writer for address family, skipping punch", zap.Stringer("addr", addr))
+		return errNoWriter
+	}
+
+	var err error
+	if tw, ok := w.(udp.TTLWriter); ok && ttl > 0 {
+		err = tw.WriteToTTL(uint16(cc.listenPort), addr.Port, payload, addr, ttl)
+	} else {
+		err = w.WriteTo(uint16(cc.listenPort), addr.Port, payload, addr)
+	}
+	if err != nil {
+		cc.logger.Debug("Error while sending punch", zap.Stringer("addr", addr), zap.Error(err))
+	}
+	return err
+}
+
+// checkPunch 返回打洞包是否发送成功，本机没有到 addr 的路由时将其从对端的地址列表中阻止，
+// 之后的打洞不再尝试该地址，直到本地网络发生变化
+func (cc *clientController) checkPunch(hostname string, addr *udp.Addr, err error) bool {
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		cc.logger.Info("Blocking unreachable remote", zap.String("hostname", hostname), zap.Stringer("addr", addr))
+		cc.BlockRemote(hostname, addr)
+	}
+	return false
+}
+
+// startPunch 开始一轮新的打洞并返回其编号，之前仍在进行的打洞会在下一个策略前停止
+func (cc *clientController) startPunch(hostname string) uint64 {
+	cc.pathsLock.Lock()
+	defer cc.pathsLock.Unlock()
+	p := cc.unlockedGetPath(hostname)
+	p.punchGen++
+	return p.punchGen
+}
+
+// setPunchStrategy 记录即将执行的策略，已经开始了新一轮打洞时返回 false。
+// 第一个策略总是执行，以便对端地址变化后仍然打洞，之后的策略只在尚未直连时执行
+func (cc *clientController) setPunchStrategy(hostname string, gen uint64, strategy PunchStrategy, first bool) bool {
+	cc.pathsLock.Lock()
+	defer cc.pathsLock.Unlock()
+	p := cc.unlockedGetPath(hostname)
+	if p.punchGen != gen || (p.direct && !first) {
+		return false
+	}
+	p.strategy = strategy
+	return true
+}
+
+// inCooldown 返回对端是否处于打洞失败后的冷却期
+func (cc *clientController) inCooldown(hostname string) bool {
+	cc.pathsLock.Lock()
+	defer cc.pathsLock.Unlock()
+	return time.Now().Before(cc.unlockedGetPath(hostname).cooldown)
+}
+
+// punchFailed 在一轮策略全部执行后仍未直连时开始冷却，连续失败时冷却时间加倍，
+// 已经开始了新一轮打洞或者已经直连时不记录
+func (cc *clientController) punchFailed(hostname string, gen uint64, cooldown time.Duration) {
+	cc.pathsLock.Lock()
+	defer cc.pathsLock.Unlock()
+	p := cc.unlockedGetPath(hostname)
+	if p.punchGen != gen || p.direct {
+		return
+	}
+	factor := 1 << p.failures
+	if factor < maxCooldownFactor {
+		p.failures++
+	} else {
+		factor = maxCooldownFactor
+	}
+	p.cooldown = time.Now().Add(time.Duration(factor) * cooldown)
+	cc.logger.Info("打洞策略已用尽，进入冷却",
+		zap.String("hostname", hostname),
+		zap.Duration("cooldown", time.Duration(factor)*cooldown),
+	)
+}
+
+// resetPunchCooldown 清除所有对端的冷却，本地网络变化后之前失败的策略可能成功
+func (cc *clientController) resetPunchCooldown() {
+	cc.pathsLock.Lock()
+	defer cc.pathsLock.Unlock()
+	for _, p := range cc.paths {
+		p.failures = 0
+		p.cooldown = time.Time{}
+	}
+}
+
+// waitDirect 等待与对端直连成功 (由 HandleICE 收到的 ICE 连接事件标记)，超时返回 false
+func (cc *clientController) waitDirect(hostname string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		cc.pathsLock.Lock()
+		direct := cc.unlockedGetPath(hostname).direct
+		cc.pathsLock.Unlock()
+		if direct {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(directPollInterval)
+	}
+}
+
+// externalAddr 返回打洞通知中对端的外部地址，优先使用 IPv4
+func externalAddr(hm *api.HostMessage) *udp.Addr {
+	switch {
+	case hm.ExternalAddr != nil:
+		return utils.NewUDPAddrFromLH4(hm.ExternalAddr)
+	case hm.ExternalAddr6 != nil:
+		return utils.NewUDPAddrFromLH6(hm.ExternalAddr6)
+	default:
+		return nil
+	}
+}
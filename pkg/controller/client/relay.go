@@ -0,0 +1,327 @@
+package controller
+
+import (
+	"context"
+	"github.com/cossteam/punchline/api/v1"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	defaultRelayTimeout = 10 * time.Second
+
+	// directTrialInterval 使用中继时尝试切换回直连的间隔，连续失败时加倍，最多为 maxCooldownFactor 倍
+	directTrialInterval = time.Minute
+)
+
+// RelayMode 决定客户端何时通过服务端中继到达对端
+type RelayMode string
+
+const (
+	// RelayModeAuto 打洞在超时时间内未成功时请求中继，打洞成功后自动切换回直连
+	RelayModeAuto RelayMode = "auto"
+	// RelayModeAlways 总是使用中继
+	RelayModeAlways RelayMode = "always"
+	// RelayModeNever 从不使用中继
+	RelayModeNever RelayMode = "never"
+)
+
+// peerPath 记录到达某个对端的路径
+type peerPath struct {
+	// direct 表示已经确认与对端直连成功
+	direct bool
+	// relayed 表示插件当前正在使用中继地址
+	relayed bool
+
+	timer *time.Timer
+
+	// lastPunch 最近一次收到的打洞通知，用于从中继切换回直连
+	lastPunch *api.HostMessage
+
+	// punchGen 打洞的轮次，收到新的打洞通知后旧的一轮停止
+	punchGen uint64
+	// strategy 最近一次执行的打洞策略，直连成功时视为该策略成功
+	strategy PunchStrategy
+
+	// failures 连续执行完所有策略仍未直连的轮数，cooldown 之前只执行第一个策略
+	failures int
+	cooldown time.Time
+
+	// lastRelay 最近一次收到的中继通知，切换回直连失败时恢复中继
+	lastRelay *api.HostMessage
+	// trial 下一次尝试切换回直连的定时器，trials 为连续失败的次数
+	trial  *time.Timer
+	trials int
+}
+
+func (cc *clientController) relayMode() RelayMode {
+	switch mode := RelayMode(cc.c.Relay.Mode); mode {
+	case RelayModeAlways, RelayModeNever:
+		return mode
+	default:
+		return RelayModeAuto
+	}
+}
+
+func (cc *clientController) relayTimeout() time.Duration {
+	if cc.c.Relay.Timeout > 0 {
+		return cc.c.Relay.Timeout
+	}
+	return defaultRelayTimeout
+}
+
+// unlockedGetPath 假设您持有 pathsLock
+func (cc *clientController) unlockedGetPath(hostname string) *peerPath {
+	p, ok := cc.paths[hostname]
+	if !ok {
+		p = &peerPath{}
+		cc.paths[hostname] = p
+	}
+	return p
+}
+
+// shouldDispatch 判断消息是否应该直接交给插件，当对端正在使用中继时，
+// 打洞通知不会交给插件，避免插件把端点切回无法直连的地址
+func (cc *clientController) shouldDispatch(hm *api.HostMessage) bool {
+	switch hm.Type {
+	case api.HostMessage_HostRelayNotification:
+		// 由 handleHostRelayNotification 决定
+		return false
+	case api.HostMessage_HostPunchNotification, api.HostMessage_HostOnlineNotification:
+		cc.pathsLock.Lock()
+		defer cc.pathsLock.Unlock()
+		return !cc.unlockedGetPath(hm.Hostname).relayed
+	default:
+		return true
+	}
+}
+
+// schedulePathSelection 在向对端打洞后根据中继模式决定是否请求中继
+func (cc *clientController) schedulePathSelection(hm *api.HostMessage) {
+	mode := cc.relayMode()
+	if mode == RelayModeNever {
+		return
+	}
+
+	hostname := hm.Hostname
+
+	cc.pathsLock.Lock()
+	p := cc.unlockedGetPath(hostname)
+	p.lastPunch = hm
+	if p.direct || p.relayed {
+		cc.pathsLock.Unlock()
+		return
+	}
+
+	if mode == RelayModeAlways {
+		cc.pathsLock.Unlock()
+		cc.requestRelay(hostname)
+		return
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(cc.relayTimeout(), func() {
+		cc.pathsLock.Lock()
+		direct := cc.unlockedGetPath(hostname).direct
+		cc.pathsLock.Unlock()
+		if !direct {
+			cc.logger.Info("打洞超时，请求中继", zap.String("hostname", hostname))
+			cc.requestRelay(hostname)
+		}
+	})
+	cc.pathsLock.Unlock()
+}
+
+// requestRelay 请求服务端为自己和 target 分配中继，请求从打洞端口发出，以便服务端学习到正确的映射
+func (cc *clientController) requestRelay(target string) {
+	hm := &api.HostMessage{
+		Type:     api.HostMessage_HostRelayRequest,
+		Hostname: cc.hostname,
+		Target:   target,
+	}
+
+	mm, err := cc.marshalLighthouse(hm)
+	if err != nil {
+		cc.logger.Error("Error while marshaling for lighthouse relay request", zap.Error(err))
+		return
+	}
+
+	for _, v := range cc.coordinator {
+		if err := cc.writeLighthouse(mm, v); err != nil {
+			cc.logger.Error("Error while sending lighthouse relay request", zap.Error(err))
+			return
+		}
+	}
+}
+
+// handleHostRelayNotification 在未确认直连时将中继地址交给插件
+func (cc *clientController) handleHostRelayNotification(hm *api.HostMessage) {
+	cc.logger.Debug("收到主机中继通知", zap.Any("hm", hm))
+
+	if len(hm.RelayAddr)+len(hm.RelayAddr6) == 0 || cc.relayMode() == RelayModeNever {
+		return
+	}
+
+	cc.pathsLock.Lock()
+	p := cc.unlockedGetPath(hm.Hostname)
+	if p.direct {
+		cc.pathsLock.Unlock()
+		return
+	}
+	p.relayed = true
+	p.lastRelay = hm
+	cc.unlockedScheduleDirectTrial(hm.Hostname, p)
+	cc.pathsLock.Unlock()
+
+	cc.dispatch(hm)
+}
+
+// unlockedScheduleDirectTrial 假设您持有 pathsLock，在使用中继时安排下一次切换回直连的尝试。
+// ICE 与应用共用端口时 ICE 连接建立即可切换回直连，这里用于没有 ICE 事件的情况
+func (cc *clientController) unlockedScheduleDirectTrial(hostname string, p *peerPath) {
+	if p.trial != nil || cc.relayMode() != RelayModeAuto {
+		return
+	}
+	factor := 1 << p.trials
+	if factor > maxCooldownFactor {
+		factor = maxCooldownFactor
+	}
+	p.trial = time.AfterFunc(time.Duration(factor)*cc.directTrialInterval(), func() {
+		cc.tryDirect(hostname)
+	})
+}
+
+func (cc *clientController) directTrialInterval() time.Duration {
+	if cc.trialInterval > 0 {
+		return cc.trialInterval
+	}
+	return directTrialInterval
+}
+
+// directProbers 返回可以在 ICE 之外确认直连的插件
+func (cc *clientController) directProbers() []plugin.DirectProber {
+	var probers []plugin.DirectProber
+	for _, p := range cc.plugins {
+		if d, ok := plugin.Unwrap(p).(plugin.DirectProber); ok {
+			probers = append(probers, d)
+		}
+	}
+	return probers
+}
+
+// directSince 返回插件是否确认了 since 之后与对端的直连，ok 为 false 表示没有插件可以判断
+func (cc *clientController) directSince(hostname string, since time.Time) (direct, ok bool) {
+	for _, d := range cc.directProbers() {
+		memberDirect, memberOK := d.DirectSince(hostname, since)
+		if memberOK {
+			ok = true
+			direct = direct || memberDirect
+		}
+	}
+	return direct, ok
+}
+
+// tryDirect 将插件切换到最近一次打洞通知中的直连地址并重新打洞，
+// 在中继超时时间内 ICE 或插件确认直连则保持直连，否则恢复中继并稍后再试
+func (cc *clientController) tryDirect(hostname string) {
+	logger := cc.logger.With(zap.String("hostname", hostname))
+
+	cc.pathsLock.Lock()
+	p := cc.unlockedGetPath(hostname)
+	p.trial = nil
+	lastPunch, lastRelay := p.lastPunch, p.lastRelay
+	if p.direct || !p.relayed || lastPunch == nil || lastRelay == nil {
+		cc.pathsLock.Unlock()
+		return
+	}
+	cc.pathsLock.Unlock()
+
+	// 没有插件可以确认直连时只能等待 ICE 事件，切换端点只会中断通过中继的流量
+	if _, ok := cc.directSince(hostname, time.Now()); !ok {
+		logger.Debug("No plugin can confirm a direct path, waiting for ICE")
+		return
+	}
+
+	logger.Info("尝试从中继切换回直连")
+	since := time.Now()
+	cc.dispatch(lastPunch)
+	cc.punch(lastPunch, cc.getOrCreateHostInfo(hostname).Remotes.CopyAddrs(cc.hostMap.GetPreferredRanges()))
+	if cc.waitDirect(hostname, cc.relayTimeout()) {
+		return
+	}
+	if direct, _ := cc.directSince(hostname, since); direct {
+		cc.MarkDirect(hostname)
+		return
+	}
+
+	cc.pathsLock.Lock()
+	p = cc.unlockedGetPath(hostname)
+	if p.direct || !p.relayed {
+		cc.pathsLock.Unlock()
+		return
+	}
+	p.trials++
+	lastRelay = p.lastRelay
+	cc.unlockedScheduleDirectTrial(hostname, p)
+	cc.pathsLock.Unlock()
+
+	logger.Info("直连仍不可用，恢复中继")
+	cc.dispatch(lastRelay)
+}
+
+// MarkDirect 标记与对端的直连已经建立 (例如插件观察到了直连握手)，
+// 如果当前正在使用中继，则把最近一次打洞通知交给插件，切换回直连地址
+func (cc *clientController) MarkDirect(hostname string) {
+	cc.pathsLock.Lock()
+	p := cc.unlockedGetPath(hostname)
+	p.direct = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	upgrade := p.relayed && p.lastPunch != nil && cc.relayMode() != RelayModeAlways
+	if upgrade {
+		p.relayed = false
+	}
+	lastPunch := p.lastPunch
+	strategy := p.strategy
+	p.strategy = ""
+	p.failures = 0
+	p.cooldown = time.Time{}
+	if p.trial != nil {
+		p.trial.Stop()
+		p.trial = nil
+	}
+	p.trials = 0
+	cc.pathsLock.Unlock()
+
+	if strategy != "" {
+		metricPunchSuccess.Add(string(strategy), 1)
+		cc.logger.Info("打洞成功", zap.String("hostname", hostname), zap.String("strategy", string(strategy)))
+	}
+
+	if upgrade {
+		cc.logger.Info("打洞成功，从中继切换回直连", zap.String("hostname", hostname))
+		cc.dispatch(lastPunch)
+	}
+}
+
+// MarkDisconnected 标记与对端的直连已经断开，之后的打洞将重新按照中继模式选择路径
+func (cc *clientController) MarkDisconnected(hostname string) {
+	cc.pathsLock.Lock()
+	cc.unlockedGetPath(hostname).direct = false
+	cc.pathsLock.Unlock()
+}
+
+// HandleICE 根据 ICE 连接的状态标记与对端的直连，ICE 与应用共用端口时连接建立说明该端口已经打通
+func (cc *clientController) HandleICE(ctx context.Context, event *plugin.ICEEvent) {
+	switch event.Type {
+	case plugin.ICEConnected, plugin.ICESelectedPairChanged:
+		cc.MarkDirect(event.Hostname)
+	case plugin.ICEDisconnected:
+		cc.MarkDisconnected(event.Hostname)
+	}
+}
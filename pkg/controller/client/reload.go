@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cossteam/punchline/pkg/publisher"
+	stunclient "github.com/cossteam/punchline/pkg/sutn"
+	"go.uber.org/zap"
+)
+
+var errNoSTUNClient = errors.New("STUN client is not started")
+
+// subscribe 订阅 topic 的主机消息，假设您持有 subsLock
+func (cc *clientController) subscribe(topic string) error {
+	return cc.pubClient.Subscribe(context.Background(), topic, func(message *publisher.Message) error {
+		return cc.handleSubscribe(message)
+	})
+}
+
+// SetSubscriptions 取消不在 topics 中的订阅并订阅新的主题，尚未启动时只记录，由 Start 订阅
+func (cc *clientController) SetSubscriptions(topics []string) {
+	cc.subsLock.Lock()
+	defer cc.subsLock.Unlock()
+
+	keep := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		keep[topic] = true
+	}
+	old := make(map[string]bool, len(cc.subscriptions))
+	for _, topic := range cc.subscriptions {
+		old[topic] = true
+	}
+
+	var subscriptions []string
+	for _, topic := range cc.subscriptions {
+		if keep[topic] {
+			subscriptions = append(subscriptions, topic)
+			continue
+		}
+		if cc.pubClient != nil {
+			if err := cc.pubClient.Unsubscribe(context.Background(), topic); err != nil {
+				cc.logger.Error("Failed to unsubscribe", zap.String("topic", topic), zap.Error(err))
+			}
+		}
+		cc.logger.Info("Lighthouse subscription removed", zap.String("topic", topic))
+	}
+	for _, topic := range topics {
+		if old[topic] {
+			continue
+		}
+		if cc.pubClient != nil {
+			if err := cc.subscribe(topic); err != nil {
+				// 保留在订阅中，下次重新加载时不会再次尝试，记录错误以便排查
+				cc.logger.Error("Failed to subscribe", zap.String("topic", topic), zap.Error(err))
+			}
+		}
+		subscriptions = append(subscriptions, topic)
+		cc.logger.Info("Lighthouse subscription added", zap.String("topic", topic))
+	}
+	cc.subscriptions = subscriptions
+}
+
+// stunOptions 返回创建 STUN 客户端的选项，查询从 endpointPort 发出
+func (cc *clientController) stunOptions() []stunclient.Option {
+	opts := []stunclient.Option{stunclient.WithTimeout(cc.c.Stun.Timeout)}
+	if cc.stunConn != nil {
+		opts = append(opts, stunclient.WithPacketConn(cc.stunConn))
+	}
+	return opts
+}
+
+// startSTUNClient 使用当前的 STUN 服务器创建 STUN 客户端
+func (cc *clientController) startSTUNClient() error {
+	cc.stunLock.Lock()
+	defer cc.stunLock.Unlock()
+	client, err := stunclient.NewMultiClient(cc.stunServers, cc.stunOptions()...)
+	if err != nil {
+		return err
+	}
+	cc.stunClient.Store(client)
+	return nil
+}
+
+// stopSTUNClient 关闭 STUN 客户端，之后的查询返回 errNoSTUNClient
+func (cc *clientController) stopSTUNClient() {
+	cc.stunLock.Lock()
+	defer cc.stunLock.Unlock()
+	if client := cc.stunClient.Swap(nil); client != nil {
+		_ = client.Close()
+	}
+}
+
+// SetSTUNServers 使用新的 STUN 服务器重建 STUN 客户端，并重新检测外部地址和 NAT 类型。
+// 尚未启动时只记录，由 Start 使用新的服务器
+func (cc *clientController) SetSTUNServers(servers []string) error {
+	cc.stunLock.Lock()
+	cc.stunServers = servers
+	if cc.stunClient.Load() == nil {
+		cc.stunLock.Unlock()
+		return nil
+	}
+	client, err := stunclient.NewMultiClient(servers, cc.stunOptions()...)
+	if err != nil {
+		cc.stunLock.Unlock()
+		return err
+	}
+	if old := cc.stunClient.Swap(client); old != nil {
+		_ = old.Close()
+	}
+	cc.stunLock.Unlock()
+
+	cc.logger.Info("STUN servers changed", zap.Strings("servers", servers))
+	go func() {
+		cc.detectNAT()
+		cc.onNetworkChange()
+	}()
+	return nil
+}
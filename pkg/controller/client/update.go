@@ -1,31 +1,25 @@
 package controller
 
 import (
+	"context"
+	"fmt"
 	"github.com/cossteam/punchline/api/v1"
+	stunclient "github.com/cossteam/punchline/pkg/sutn"
 	"github.com/cossteam/punchline/pkg/transport/udp"
 	"github.com/cossteam/punchline/pkg/utils"
 	"go.uber.org/zap"
 	"net"
+	"time"
 )
 
 func (cc *clientController) SendUpdate() {
-	var v4 []*api.Ipv4Addr
-	var v6 []*api.Ipv6Addr
-
-	localIps := utils.LocalIps()
-	for _, e := range *localIps {
-		if ip := e.To4(); ip != nil {
-			v4 = append(v4, api.NewIpv4Addr(e, cc.listenPort))
-		} else {
-			v6 = append(v6, api.NewIpv6Addr(e, cc.listenPort))
-		}
-	}
+	v4, v6 := cc.localAddrs()
 
-	externalAddrs, err := cc.stunClient.ExternalAddrs()
+	external, err := cc.externalResult()
 	if err != nil {
 		cc.logger.Error("Error while getting external addresses", zap.Error(err))
 	} else {
-		for _, a := range externalAddrs {
+		for _, a := range external.Addrs {
 			if a.IP.To4() != nil {
 				v4 = append(v4, api.NewIpv4Addr(a.IP, uint32(a.Port)))
 			} else {
@@ -35,20 +29,17 @@ func (cc *clientController) SendUpdate() {
 	}
 
 	hm := &api.HostMessage{
-		Type:     api.HostMessage_HostUpdateNotification,
-		Hostname: cc.hostname,
-		Ipv4Addr: v4,
-		Ipv6Addr: v6,
+		Type:      api.HostMessage_HostUpdateNotification,
+		Hostname:  cc.hostname,
+		Ipv4Addr:  v4,
+		Ipv6Addr:  v6,
+		NatType:   cc.natType.Load(),
+		PublicKey: cc.publicKey,
 		//ExternalAddr: api.NewIpv4Addr(externalAddr.IP, uint32(externalAddr.Port)),
 	}
 
-	externalAddr, err := cc.stunClient.ExternalAddr()
-	if err == nil {
-		if externalAddr.IP.To4() != nil {
-			hm.ExternalAddr = api.NewIpv4Addr(externalAddr.IP, uint32(externalAddr.Port))
-		}
-	} else {
-		cc.logger.Error("Error while getting single external address", zap.Error(err))
+	if external != nil && len(external.Addrs) > 0 {
+		setExternalAddr(hm, external.Addrs[0])
 	}
 
 	//for _, p := range cc.plugins {
@@ -65,17 +56,14 @@ func (cc *clientController) SendUpdate() {
 	//}
 
 	//out := make([]byte, mtu)
-	mm, err := hm.Marshal()
+	mm, err := cc.marshalLighthouse(hm)
 	if err != nil {
 		cc.logger.Error("Error while marshaling for lighthouse update", zap.Error(err))
 		return
 	}
 
 	for _, v := range cc.coordinator {
-		if err := cc.makeupWriter.WriteTo(uint16(cc.listenPort), uint16(v.Port), mm, &udp.Addr{
-			IP:   v.IP,
-			Port: uint16(v.Port),
-		}); err != nil {
+		if err := cc.writeLighthouse(mm, v); err != nil {
 			cc.logger.Error("Error while sending lighthouse update", zap.Error(err))
 			return
 		}
@@ -92,7 +80,7 @@ func (cc *clientController) SendUpdate() {
 
 			cc.logger.Debug("发送主机更新通知",
 				zap.Stringer("target", target),
-				zap.Stringer("externalAddr", externalAddr),
+				zap.Stringer("externalAddr", externalAddr(hm)),
 				zap.Any("v4Addr", v4addr),
 				zap.Any("v6Addr", v4addr),
 			)
@@ -102,13 +90,34 @@ func (cc *clientController) SendUpdate() {
 	}
 }
 
-func (cc *clientController) createHostMessage() (*api.HostMessage, error) {
+// marshalLighthouse 序列化发送给灯塔的消息，配置了预共享密钥时对消息进行签名
+func (cc *clientController) marshalLighthouse(hm *api.HostMessage) ([]byte, error) {
+	if cc.signer != nil {
+		return cc.signer.Seal(hm)
+	}
+	return hm.Marshal()
+}
+
+// writeLighthouse 从打洞端口向灯塔发送消息，以便灯塔学习到打洞端口的映射
+func (cc *clientController) writeLighthouse(b []byte, lighthouse *net.UDPAddr) error {
+	addr := udp.NewAddr(lighthouse.IP, uint16(lighthouse.Port))
+	w := cc.writerFor(addr)
+	if w == nil {
+		return fmt.Errorf("no makeup writer for lighthouse %s", addr)
+	}
+	return w.WriteTo(uint16(cc.listenPort), addr.Port, b, addr)
+}
+
+// localAddrs 返回需要上报的本地地址，不在本地允许列表中的地址 (例如 docker 网桥地址) 不会被上报
+func (cc *clientController) localAddrs() ([]*api.Ipv4Addr, []*api.Ipv6Addr) {
 	var v4 []*api.Ipv4Addr
 	var v6 []*api.Ipv6Addr
 
-	// 获取本地IP地址
-	localIps := utils.LocalIps()
-	for _, e := range *localIps {
+	for _, e := range *utils.LocalIps() {
+		if !cc.localAllowList.Allow(e) {
+			continue
+		}
+
 		if ip := e.To4(); ip != nil {
 			v4 = append(v4, api.NewIpv4Addr(e, cc.listenPort))
 		} else {
@@ -116,13 +125,20 @@ func (cc *clientController) createHostMessage() (*api.HostMessage, error) {
 		}
 	}
 
+	return v4, v6
+}
+
+func (cc *clientController) createHostMessage() (*api.HostMessage, error) {
+	// 获取本地IP地址
+	v4, v6 := cc.localAddrs()
+
 	// 获取外部地址
-	externalAddrs, err := cc.stunClient.ExternalAddrs()
+	external, err := cc.externalResult()
 	if err != nil {
 		cc.logger.Error("Error while getting external addresses", zap.Error(err))
 		return nil, err
 	} else {
-		for _, a := range externalAddrs {
+		for _, a := range external.Addrs {
 			if a.IP.To4() != nil {
 				v4 = append(v4, api.NewIpv4Addr(a.IP, uint32(a.Port)))
 			} else {
@@ -139,18 +155,94 @@ func (cc *clientController) createHostMessage() (*api.HostMessage, error) {
 		Ipv6Addr: v6,
 	}
 
-	// 获取单个外部地址
-	externalAddr, err := cc.stunClient.ExternalAddr()
-	if err != nil {
-		cc.logger.Error("Error while getting single external address", zap.Error(err))
+	// 第一个成功响应的 STUN 服务器看到的外部地址
+	setExternalAddr(hm, external.Addrs[0])
+
+	return hm, nil
+}
+
+// externalResult 返回最近一次查询 STUN 服务器的结果，尚未查询过时立即查询
+func (cc *clientController) externalResult() (*stunclient.Result, error) {
+	if r := cc.external.Load(); r != nil {
+		return r, nil
+	}
+	if _, err := cc.probeExternal(); err != nil {
 		return nil, err
 	}
+	return cc.external.Load(), nil
+}
 
-	if externalAddr.IP.To4() != nil {
-		hm.ExternalAddr = api.NewIpv4Addr(externalAddr.IP, uint32(externalAddr.Port))
+// probeExternal 并行查询所有 STUN 服务器并保存结果，返回外部地址是否发生了变化，
+// 所有服务器都失败时保留上一次的结果
+func (cc *clientController) probeExternal() (bool, error) {
+	client := cc.stunClient.Load()
+	if client == nil {
+		return false, errNoSTUNClient
+	}
+	r, err := client.Query()
+	for uri, e := range r.Errors {
+		cc.logger.Debug("STUN server failed", zap.String("server", uri), zap.Error(e))
+	}
+	if err != nil {
+		return false, err
 	}
 
-	return hm, nil
+	if r.Symmetric {
+		cc.logger.Warn("STUN servers disagree on the external address, NAT mapping is likely symmetric",
+			zap.Stringers("addrs", r.Addrs))
+	}
+
+	old := cc.external.Swap(r)
+	return old != nil && !old.Equal(r), nil
+}
+
+// watchExternal 定期重新查询外部地址，发生变化时立即发送主机更新
+func (cc *clientController) watchExternal(ctx context.Context) {
+	interval := cc.c.Stun.ProbeInterval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := cc.probeExternal()
+		if err != nil {
+			cc.logger.Error("Error while probing external addresses", zap.Error(err))
+			continue
+		}
+		if changed {
+			cc.logger.Info("外部地址发生变化，立即发送主机更新", zap.Stringers("addrs", cc.external.Load().Addrs))
+			cc.SendUpdate()
+		}
+	}
+}
+
+// onNetworkChange 本地网络变化后重新查询外部地址并立即发送主机更新，不等待下一个更新周期
+func (cc *clientController) onNetworkChange() {
+	cc.resetBlockedRemotes()
+	cc.resetPunchCooldown()
+	if _, err := cc.probeExternal(); err != nil {
+		cc.logger.Error("Error while probing external addresses", zap.Error(err))
+	}
+	cc.logger.Info("本地网络发生变化，立即发送主机更新")
+	cc.SendUpdate()
+}
+
+// setExternalAddr 根据地址族设置 ExternalAddr 或 ExternalAddr6
+func setExternalAddr(hm *api.HostMessage, addr *udp.Addr) {
+	if addr.IP.To4() != nil {
+		hm.ExternalAddr = api.NewIpv4Addr(addr.IP, uint32(addr.Port))
+	} else {
+		hm.ExternalAddr6 = api.NewIpv6Addr(addr.IP, uint32(addr.Port))
+	}
 }
 
 //func (cc *clientController) SendUpdate() {
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// RunnableFunc 将函数适配为 Runnable
+type RunnableFunc func(context.Context) error
+
+func (f RunnableFunc) Start(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Group 是可以在运行时按名称添加和移除成员的 Runnable，例如重新加载配置时增减的订阅。
+// Start 之前添加的成员在 Start 时启动，Group 退出时等待所有成员退出
+type Group struct {
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	ctx     context.Context
+	members map[string]*member
+	wg      sync.WaitGroup
+}
+
+type member struct {
+	r      Runnable
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewGroup(logger *zap.Logger) *Group {
+	return &Group{
+		logger:  logger,
+		members: make(map[string]*member),
+	}
+}
+
+// Add 添加名为 name 的成员，Group 已经启动时立即启动该成员
+func (g *Group) Add(name string, r Runnable) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.members[name]; ok {
+		return fmt.Errorf("runnable %s already exists", name)
+	}
+	if g.ctx != nil && g.ctx.Err() != nil {
+		return g.ctx.Err()
+	}
+	m := &member{r: r}
+	g.members[name] = m
+	if g.ctx != nil {
+		g.run(name, m)
+	}
+	return nil
+}
+
+// Remove 停止并移除名为 name 的成员，等待成员退出后返回
+func (g *Group) Remove(name string) bool {
+	g.mu.Lock()
+	m, ok := g.members[name]
+	delete(g.members, name)
+	g.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+	}
+	return true
+}
+
+// Has 判断名为 name 的成员是否存在
+func (g *Group) Has(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.members[name]
+	return ok
+}
+
+// Names 返回所有成员的名称
+func (g *Group) Names() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	names := make([]string, 0, len(g.members))
+	for name := range g.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run 在持有 mu 时调用
+func (g *Group) run(name string, m *member) {
+	ctx, cancel := context.WithCancel(g.ctx)
+	m.cancel = cancel
+	m.done = make(chan struct{})
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer close(m.done)
+		defer cancel()
+		if err := m.r.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			g.logger.Error("runnable error", zap.String("name", name), zap.Error(err))
+		}
+	}()
+}
+
+// Start 启动所有成员，直到上下文关闭并且所有成员退出
+func (g *Group) Start(ctx context.Context) error {
+	g.mu.Lock()
+	if g.ctx != nil {
+		g.mu.Unlock()
+		return errors.New("group already started")
+	}
+	g.ctx = ctx
+	for name, m := range g.members {
+		g.run(name, m)
+	}
+	g.mu.Unlock()
+
+	<-ctx.Done()
+	g.wg.Wait()
+	return nil
+}
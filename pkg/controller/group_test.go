@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestGroup(t *testing.T) {
+	var mu sync.Mutex
+	running := make(map[string]bool)
+	member := func(name string) Runnable {
+		return RunnableFunc(func(ctx context.Context) error {
+			mu.Lock()
+			running[name] = true
+			mu.Unlock()
+			<-ctx.Done()
+			mu.Lock()
+			running[name] = false
+			mu.Unlock()
+			return nil
+		})
+	}
+	isRunning := func(name string) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return running[name]
+		}
+	}
+
+	g := NewGroup(zap.NewNop())
+	require.NoError(t, g.Add("a", member("a")))
+	assert.Error(t, g.Add("a", member("a")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- g.Start(ctx) }()
+	assert.Eventually(t, isRunning("a"), time.Second, 10*time.Millisecond)
+
+	// 启动后添加的成员立即运行，移除成员不影响其他成员
+	require.NoError(t, g.Add("b", member("b")))
+	assert.Eventually(t, isRunning("b"), time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a", "b"}, g.Names())
+
+	assert.True(t, g.Remove("a"))
+	assert.False(t, isRunning("a")())
+	assert.True(t, isRunning("b")())
+	assert.False(t, g.Remove("a"))
+	assert.False(t, g.Has("a"))
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.False(t, isRunning("b")())
+	assert.ErrorIs(t, g.Add("c", member("c")), context.Canceled)
+}
@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cossteam/punchline/config"
+)
+
+const (
+	defaultPacketsPerSecond  = 20
+	defaultBurst             = 40
+	defaultMaxHostsPerSource = 16
+	defaultMaxHosts          = 65536
+	// defaultMaxHostnameLength 与 DNS 名称的最大长度一致
+	defaultMaxHostnameLength = 253
+	defaultMaxMessageSize    = 1500
+
+	// defaultSourceIdleTimeout 来源空闲多久后清除其令牌桶
+	defaultSourceIdleTimeout = 10 * time.Minute
+	// defaultHostIdleTimeout 主机多久没有发送消息后被移除，客户端每 30 秒发送一次主机更新
+	defaultHostIdleTimeout = 5 * time.Minute
+)
+
+// 丢弃数据包的原因，用作 metricDropped 的键
+const (
+	dropRateLimited     = "rate_limited"
+	dropTooLarge        = "too_large"
+	dropEmpty           = "empty"
+	dropMalformed       = "malformed"
+	dropInvalidHostname = "invalid_hostname"
+	dropTooManyHosts    = "too_many_hosts"
+	dropHostLimit       = "host_limit"
+	dropUnauthenticated = "unauthenticated"
+)
+
+// limiter 对灯塔 UDP 监听器按来源 IP 进行限制，防止伪造大量主机名的 UDP 洪泛耗尽服务端内存
+type limiter struct {
+	sync.Mutex
+
+	rate              float64
+	burst             float64
+	maxHostsPerSource int
+	maxHosts          int
+	maxHostnameLength int
+	maxMessageSize    int
+	idleTimeout       time.Duration
+	hostIdleTimeout   time.Duration
+
+	now func() time.Time
+
+	sources map[string]*source
+	// hosts 通过 UDP 消息创建或更新的主机，键为主机名
+	hosts map[string]*hostEntry
+}
+
+// source 记录单个来源 IP 的令牌桶以及当前属于它的主机
+type source struct {
+	tokens   float64
+	lastSeen time.Time
+	hosts    map[string]struct{}
+}
+
+// hostEntry 记录主机最近一次发送消息的来源和时间
+type hostEntry struct {
+	source   string
+	lastSeen time.Time
+}
+
+// newLimiter 根据配置创建 limiter，未配置的字段使用默认值
+func newLimiter(c config.Limits) *limiter {
+	l := &limiter{
+		rate:              c.PacketsPerSecond,
+		burst:             float64(c.Burst),
+		maxHostsPerSource: c.MaxHostsPerSource,
+		maxHosts:          c.MaxHosts,
+		maxHostnameLength: c.MaxHostnameLength,
+		maxMessageSize:    c.MaxMessageSize,
+		idleTimeout:       defaultSourceIdleTimeout,
+		hostIdleTimeout:   defaultHostIdleTimeout,
+		now:               time.Now,
+		sources:           make(map[string]*source),
+		hosts:             make(map[string]*hostEntry),
+	}
+	if l.rate <= 0 {
+		l.rate = defaultPacketsPerSecond
+	}
+	if l.burst <= 0 {
+		l.burst = defaultBurst
+	}
+	if l.maxHostsPerSource <= 0 {
+		l.maxHostsPerSource = defaultMaxHostsPerSource
+	}
+	if l.maxHosts <= 0 {
+		l.maxHosts = defaultMaxHosts
+	}
+	if l.maxHostnameLength <= 0 {
+		l.maxHostnameLength = defaultMaxHostnameLength
+	}
+	if l.maxMessageSize <= 0 || l.maxMessageSize > mtu {
+		l.maxMessageSize = defaultMaxMessageSize
+	}
+	return l
+}
+
+// checkPacket 在解析之前检查数据包大小和来源速率，返回丢弃原因，允许时返回空字符串
+func (l *limiter) checkPacket(ip string, size int) string {
+	if size == 0 {
+		return dropEmpty
+	}
+	if size > l.maxMessageSize {
+		return dropTooLarge
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	s := l.unlockedGetSource(ip, now)
+	s.tokens += now.Sub(s.lastSeen).Seconds() * l.rate
+	if s.tokens > l.burst {
+		s.tokens = l.burst
+	}
+	s.lastSeen = now
+
+	if s.tokens < 1 {
+		return dropRateLimited
+	}
+	s.tokens--
+	return ""
+}
+
+// checkHostname 检查主机名长度
+func (l *limiter) checkHostname(hostname string) string {
+	if hostname == "" || len(hostname) > l.maxHostnameLength {
+		return dropInvalidHostname
+	}
+	return ""
+}
+
+// admitHost 在来源 ip 发送了主机 hostname 的消息时调用，刷新主机的空闲时间。
+// 主机从新的来源发送消息时 (例如地址发生变化) 从原来的来源转移到新的来源，
+// 超过每个来源或全局的主机上限时返回丢弃原因
+func (l *limiter) admitHost(ip string, hostname string) string {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	if h, ok := l.hosts[hostname]; ok && h.source == ip {
+		h.lastSeen = now
+		return ""
+	}
+	return l.unlockedAddHost(ip, hostname, now)
+}
+
+// admitTarget 在来源 ip 的消息引用了主机 hostname 时调用 (例如中继请求的目标)，
+// 已经存在的主机不受影响，否则像 admitHost 一样计入来源 ip
+func (l *limiter) admitTarget(ip string, hostname string) string {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.hosts[hostname]; ok {
+		return ""
+	}
+	return l.unlockedAddHost(ip, hostname, l.now())
+}
+
+// unlockedAddHost 假设您持有锁，将主机计入来源 ip，主机属于其他来源时从原来的来源中移除
+func (l *limiter) unlockedAddHost(ip string, hostname string, now time.Time) string {
+	h, ok := l.hosts[hostname]
+	if !ok && len(l.hosts) >= l.maxHosts {
+		return dropHostLimit
+	}
+	s := l.unlockedGetSource(ip, now)
+	if len(s.hosts) >= l.maxHostsPerSource {
+		return dropTooManyHosts
+	}
+	if ok {
+		if old, ok := l.sources[h.source]; ok {
+			delete(old.hosts, hostname)
+		}
+	}
+	s.hosts[hostname] = struct{}{}
+	l.hosts[hostname] = &hostEntry{source: ip, lastSeen: now}
+	return ""
+}
+
+// expire 移除空闲的主机并返回它们的主机名，再清除没有主机的空闲来源。
+// 仍有主机的来源不会被清除，否则每个来源的主机上限可以通过等待绕过
+func (l *limiter) expire(now time.Time) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	var expired []string
+	for hostname, h := range l.hosts {
+		if now.Sub(h.lastSeen) > l.hostIdleTimeout {
+			if s, ok := l.sources[h.source]; ok {
+				delete(s.hosts, hostname)
+			}
+			delete(l.hosts, hostname)
+			expired = append(expired, hostname)
+		}
+	}
+
+	for ip, s := range l.sources {
+		if len(s.hosts) == 0 && now.Sub(s.lastSeen) > l.idleTimeout {
+			delete(l.sources, ip)
+		}
+	}
+	return expired
+}
+
+// unlockedGetSource 假设您持有锁
+func (l *limiter) unlockedGetSource(ip string, now time.Time) *source {
+	s, ok := l.sources[ip]
+	if !ok {
+		s = &source{
+			tokens:   l.burst,
+			lastSeen: now,
+			hosts:    make(map[string]struct{}),
+		}
+		l.sources[ip] = s
+	}
+	return s
+}
@@ -0,0 +1,14 @@
+package controller
+
+import "expvar"
+
+var (
+	// metricAuthRejected 按原因统计被拒绝的未经认证的灯塔消息
+	metricAuthRejected = expvar.NewMap("punchline_lighthouse_auth_rejected")
+
+	// metricDropped 按原因统计灯塔 UDP 监听器丢弃的数据包
+	metricDropped = expvar.NewMap("punchline_lighthouse_dropped")
+
+	// metricSTUN 灯塔端口上发送的 STUN 响应数量
+	metricSTUN = expvar.NewInt("punchline_lighthouse_stun_responses")
+)
@@ -5,23 +5,54 @@ import (
 	"errors"
 	"github.com/cossteam/punchline/api/v1"
 	"github.com/cossteam/punchline/pkg/host"
+	"github.com/cossteam/punchline/pkg/transport/udp"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
 )
 
 var _ api.PunchServiceServer = &serverController{}
 
+// grpcSource 无法取得 gRPC 对端地址时使用的来源
+const grpcSource = "grpc"
+
+// admitGRPCHost 与 UDP 消息一样通过 limiter 检查 gRPC 请求中的主机，按 gRPC 连接的对端 IP 计入来源，
+// 使通过 gRPC 创建的主机同样受主机数量上限约束并在空闲后被移除
+func (sc *serverController) admitGRPCHost(ctx context.Context, hostname string) error {
+	ip := grpcSource
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			ip = host
+		}
+	}
+	if reason := sc.admitHost(ip, hostname, sc.limiter.admitHost); reason != "" {
+		metricDropped.Add(reason, 1)
+		if reason == dropInvalidHostname {
+			return status.Errorf(codes.InvalidArgument, "invalid hostname %q", hostname)
+		}
+		return status.Errorf(codes.ResourceExhausted, "host %q rejected: %s", hostname, reason)
+	}
+	return nil
+}
+
 func (sc *serverController) HostOnline(ctx context.Context, request *api.HostOnlineRequest) (*api.HostOnlineResponse, error) {
 	sc.logger.Debug("主机上线通知", zap.Any("request", request))
 
 	hostname := request.Hostname
+	if err := sc.admitGRPCHost(ctx, hostname); err != nil {
+		return nil, err
+	}
 
 	newHm := &api.HostMessage{}
-	found, ln, err := sc.queryAndPrepMessage(hostname, func(cache *host.Cache) (int, error) {
+	found, b, err := sc.queryAndPrepMessage(hostname, func(cache *host.Cache) ([]byte, error) {
 		newHm.Type = api.HostMessage_HostOnlineNotification
 		newHm.Hostname = hostname
 		newHm.ExternalAddr = request.ExternalAddr
+		newHm.ExternalAddr6 = request.ExternalAddr6
 		sc.coalesceAnswers(cache, newHm)
-		return newHm.MarshalTo(sc.p)
+		return newHm.Marshal()
 	})
 	if !found {
 		sc.GetOrCreateHostInfo(hostname)
@@ -35,7 +66,7 @@ func (sc *serverController) HostOnline(ctx context.Context, request *api.HostOnl
 
 	if _, err = sc.Publish(context.Background(), &api.PublishRequest{
 		Topic: hostname,
-		Data:  sc.p[:ln],
+		Data:  b,
 	}); err != nil {
 		sc.logger.Error("Failed to publish lighthouse host update ack",
 			zap.String("hostname", hostname),
@@ -53,75 +84,82 @@ func (sc *serverController) HostQuery(ctx context.Context, request *api.HostQuer
 }
 
 func (sc *serverController) HostUpdate(ctx context.Context, request *api.HostUpdateRequest) (*api.HostUpdateResponse, error) {
+	if err := sc.admitGRPCHost(ctx, request.Hostname); err != nil {
+		return nil, err
+	}
+	if err := sc.updateHost(request, nil); err != nil {
+		return nil, err
+	}
+	return &api.HostUpdateResponse{}, nil
+}
+
+// updateHost 更新主机上报的地址，learned 为服务端观察到的主机地址，可以为 nil。
+// 只有当去重排序后的地址列表、NAT 类型或者公钥真正发生变化时才推送 HostPunchNotification。
+func (sc *serverController) updateHost(request *api.HostUpdateRequest, learned *udp.Addr) error {
 	hostname := request.Hostname
+	preferredRanges := sc.hostMap.GetPreferredRanges()
 
 	var hostInfo *host.HostInfo
 	hostInfo = sc.GetOrCreateHostInfo(hostname)
 
-	//hostInfo.SetRemote(addr)
-	//fmt.Println("hostInfo.Remote => ", hostInfo.Remote)
-	//fmt.Println("addr => ", addr)
-
-	oldAddr := hostInfo.Remotes.CopyAddrs()
-	//hostInfo.SetRemote(addr)
+	// 在学习新地址之前记录旧地址，否则学习到的地址变化不会被检测到
+	oldAddr := hostInfo.Remotes.CopyAddrs(preferredRanges)
+	if learned != nil {
+		hostInfo.SetRemote(learned)
+	}
 
+	newAttrs := hostAttrs{natType: request.NatType, publicKey: request.PublicKey}
 	sc.Lock()
+	oldAttrs := sc.attrs[hostname]
+	sc.attrs[hostname] = newAttrs
 	am := sc.unlockedGetRemoteList(hostname)
 	am.Lock()
 	sc.Unlock()
 	am.UnlockedSetV4(hostname, request.Ipv4Addr)
 	am.UnlockedSetV6(hostname, request.Ipv6Addr)
 	am.Unlock()
-	newAddr := am.CopyAddrs()
+	newAddr := am.CopyAddrs(preferredRanges)
+
+	if !hasAddressChanged(oldAddr, newAddr) && !hasAttrsChanged(oldAttrs, newAttrs) {
+		sc.logger.Debug("地址未发生变化，跳过推送",
+			zap.String("handle", "HostUpdate"),
+			zap.String("hostname", hostname),
+			zap.Stringers("addr", newAddr),
+		)
+		return nil
+	}
 
 	newHm := &api.HostMessage{}
-	found, ln, err := sc.queryAndPrepMessage(hostname, func(cache *host.Cache) (int, error) {
+	found, b, err := sc.queryAndPrepMessage(hostname, func(cache *host.Cache) ([]byte, error) {
 		newHm.Type = api.HostMessage_HostPunchNotification
 		newHm.Hostname = hostname
 		newHm.ExternalAddr = request.ExternalAddr
+		newHm.ExternalAddr6 = request.ExternalAddr6
+		newHm.NatType = request.NatType
+		newHm.PublicKey = request.PublicKey
 		sc.coalesceAnswers(cache, newHm)
-		return newHm.MarshalTo(sc.p)
+		return newHm.Marshal()
 	})
 	if !found {
 		sc.logger.Debug("未找到主机信息", zap.String("hostname", hostname))
-		return nil, errors.New("未找到主机信息")
+		return errors.New("未找到主机信息")
 	}
 
 	if err != nil {
 		sc.logger.Error("Failed to marshal lighthouse host query reply", zap.String("hostname", hostname))
-		return nil, err
+		return err
 	}
 
-	sc.logger.Debug("收到主机更新通知",
+	sc.logger.Info("地址发生变化，开始推送",
 		zap.String("handle", "HostUpdate"),
-		//zap.Any("oldHm", request),
-		//zap.Any("newHm", newHm),
-		zap.Any("oldAddr", oldAddr),
-		zap.Any("newAddr", newAddr),
+		zap.String("topic", hostname),
+		zap.Stringers("oldAddr", oldAddr),
+		zap.Stringers("newAddr", newAddr),
 	)
 
-	//hm.Reset()
-	//hm.Type = api.HostMessage_None
-	//hm.Type = api.HostMessage_HostPunchNotification
-	//hm.Hostname = sc.hostname
-	//ln, err := hm.MarshalTo(sc.p)
-	//if err != nil {
-	//	sc.logger.Error("Failed to marshal lighthouse host update ack",
-	//		zap.String("hostname", hm.Hostname),
-	//	)
-	//	return
-	//}
-
-	// TODO 暂时每次都推送
-	//if hasAddressChanged(oldAddr, newAddr) {
-	//	sc.logger.Info("地址发送变化，开始推送",
-	//		zap.String("handle", "HostUpdate"),
-	//		zap.Any("topic", hostname),
-	//	)
-
 	_, err = sc.Publish(context.Background(), &api.PublishRequest{
 		Topic: hostname,
-		Data:  sc.p[:ln],
+		Data:  b,
 	})
 	if err != nil {
 		sc.logger.Error("Failed to publish lighthouse host update ack",
@@ -129,9 +167,8 @@ func (sc *serverController) HostUpdate(ctx context.Context, request *api.HostUpd
 			zap.Error(err),
 		)
 	}
-	//}
 
-	return &api.HostUpdateResponse{}, nil
+	return nil
 }
 
 func (sc *serverController) HostPunch(ctx context.Context, request *api.HostPunchRequest) (*api.HostPunchResponse, error) {
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRelayIdleTimeout = 5 * time.Minute
+)
+
+var errRelaySelf = errors.New("can not relay a host to itself")
+
+// relayManager 为无法直接打洞的两个客户端分配中继会话，每个会话独占一个 UDP 端口，
+// 在两个客户端之间原样转发数据，这相当于不使用 ICE 时的 TURN
+type relayManager struct {
+	sync.Mutex
+
+	logger      *zap.Logger
+	advertiseIP net.IP
+	idleTimeout time.Duration
+
+	// learned 返回服务端观察到的主机地址
+	learned func(hostname string) *udp.Addr
+	// onExpire 在会话因空闲被回收后调用
+	onExpire func(s *relaySession)
+
+	sessions map[string]*relaySession
+}
+
+// relaySession 是两个客户端之间的一个中继会话
+type relaySession struct {
+	sync.Mutex
+
+	conn  *net.UDPConn
+	addr  *udp.Addr
+	hosts [2]string
+	// peers 记录会话中实际观察到的两端地址，对称 NAT 下它与服务端学习到的地址端口不同
+	peers [2]*udp.Addr
+
+	lastActive atomic.Int64
+}
+
+func newRelayManager(logger *zap.Logger, advertiseIP net.IP, idleTimeout time.Duration, learned func(hostname string) *udp.Addr) *relayManager {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultRelayIdleTimeout
+	}
+
+	return &relayManager{
+		logger:      logger,
+		advertiseIP: advertiseIP,
+		idleTimeout: idleTimeout,
+		learned:     learned,
+		sessions:    make(map[string]*relaySession),
+	}
+}
+
+func relayKey(a, b string) string {
+	hosts := []string{a, b}
+	sort.Strings(hosts)
+	return strings.Join(hosts, "|")
+}
+
+// allocate 返回 a 和 b 之间的中继会话，不存在时创建一个新的
+func (rm *relayManager) allocate(a, b string) (*relaySession, error) {
+	if a == b {
+		return nil, errRelaySelf
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	key := relayKey(a, b)
+	if s, ok := rm.sessions[key]; ok {
+		s.touch()
+		return s, nil
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: rm.advertiseIP})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &relaySession{
+		conn:  conn,
+		addr:  udp.NewAddr(rm.advertiseIP, uint16(conn.LocalAddr().(*net.UDPAddr).Port)),
+		hosts: [2]string{a, b},
+	}
+	s.touch()
+	rm.sessions[key] = s
+
+	rm.logger.Info("Allocated relay session",
+		zap.String("a", a),
+		zap.String("b", b),
+		zap.Stringer("addr", s.addr),
+	)
+
+	go rm.serve(s)
+
+	return s, nil
+}
+
+// run 定期回收空闲的会话，直到上下文关闭
+func (rm *relayManager) run(ctx context.Context) {
+	ticker := time.NewTicker(rm.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			rm.Lock()
+			for key, s := range rm.sessions {
+				_ = s.conn.Close()
+				delete(rm.sessions, key)
+			}
+			rm.Unlock()
+			return
+		case <-ticker.C:
+			rm.expire(time.Now())
+		}
+	}
+}
+
+func (rm *relayManager) expire(now time.Time) {
+	var expired []*relaySession
+
+	rm.Lock()
+	for key, s := range rm.sessions {
+		if now.Sub(time.Unix(0, s.lastActive.Load())) > rm.idleTimeout {
+			_ = s.conn.Close()
+			delete(rm.sessions, key)
+			expired = append(expired, s)
+		}
+	}
+	rm.Unlock()
+
+	for _, s := range expired {
+		rm.logger.Info("Relay session expired",
+			zap.String("a", s.hosts[0]),
+			zap.String("b", s.hosts[1]),
+			zap.Stringer("addr", s.addr),
+		)
+		if rm.onExpire != nil {
+			rm.onExpire(s)
+		}
+	}
+}
+
+func (rm *relayManager) serve(s *relaySession) {
+	buffer := make([]byte, udp.MTU)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			rm.logger.Debug("relay socket is closed, exiting read loop", zap.Stringer("addr", s.addr), zap.Error(err))
+			return
+		}
+
+		src := udp.NewAddr(from.IP, uint16(from.Port))
+		side, ok := s.identify(src, rm.learned)
+		if !ok {
+			rm.logger.Debug("Dropping relay packet from unknown source",
+				zap.Stringer("addr", s.addr),
+				zap.Stringer("from", src),
+			)
+			continue
+		}
+
+		dst := s.peer(1-side, rm.learned)
+		if dst == nil {
+			continue
+		}
+
+		s.touch()
+		if _, err := s.conn.WriteToUDP(buffer[:n], &net.UDPAddr{IP: dst.IP, Port: int(dst.Port)}); err != nil {
+			rm.logger.Debug("Failed to forward relay packet",
+				zap.Stringer("addr", s.addr),
+				zap.Stringer("to", dst),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (s *relaySession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// identify 判断 src 属于会话的哪一端，优先精确匹配，其次匹配服务端学习到的 IP，
+// 匹配成功后记录该端在会话中实际使用的地址
+func (s *relaySession) identify(src *udp.Addr, learned func(string) *udp.Addr) (int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range s.hosts {
+		if s.peers[i].Equals(src) {
+			return i, true
+		}
+	}
+
+	side := -1
+	for i, h := range s.hosts {
+		if l := learned(h); l != nil && l.IP.Equal(src.IP) {
+			if side != -1 {
+				// 两端位于同一公网 IP 后面且无法通过端口区分
+				if l.Port == src.Port {
+					side = i
+				}
+				continue
+			}
+			side = i
+		}
+	}
+	if side == -1 {
+		return 0, false
+	}
+
+	s.peers[side] = src.Copy()
+	return side, true
+}
+
+// peer 返回会话一端的地址，尚未观察到时使用服务端学习到的地址
+func (s *relaySession) peer(side int, learned func(string) *udp.Addr) *udp.Addr {
+	s.Lock()
+	p := s.peers[side]
+	s.Unlock()
+	if p != nil {
+		return p
+	}
+	return learned(s.hosts[side])
+}
@@ -3,15 +3,20 @@ package controller
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	apiv1 "github.com/cossteam/punchline/api"
 	"github.com/cossteam/punchline/api/v1"
 	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/auth"
 	"github.com/cossteam/punchline/pkg/host"
 	"github.com/cossteam/punchline/pkg/publisher"
 	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/pion/stun"
 	"go.uber.org/zap"
+	"net"
 	"sync"
+	"time"
 )
 
 var (
@@ -32,29 +37,67 @@ type serverController struct {
 
 	addrMap map[string]*host.RemoteList
 	hostMap *host.HostMap
+	// attrs 记录主机最近一次上报的 NAT 类型和公钥，与 addrMap 一样由 sc 的锁保护
+	attrs map[string]hostAttrs
 
-	p   []byte
-	out []byte
+	remoteAllowList *host.AllowList
+	preferredRanges []*net.IPNet
+	familyPolicy    host.FamilyPolicy
+
+	relay *relayManager
+
+	// verifier 不为 nil 时只接受经过认证的灯塔消息
+	verifier *auth.Verifier
+
+	limiter *limiter
+
+	// readers 与 outside 绑定在同一端口上的其他监听器，每个监听器由独立的 goroutine 读取
+	readers []udp.Conn
+
+	stun stunResponder
+	// stunPrimaryIP outside 绑定在未指定地址上时通告给客户端的 IP
+	stunPrimaryIP net.IP
 }
 
 func NewServerController(
 	logger *zap.Logger,
 	outside udp.Conn,
 	c *config.Config,
+	opts ...ServerOption,
 ) apiv1.Runnable {
-	return &serverController{
-		//server:  grpc.NewServer(),
+	sc := &serverController{
 		logger:  logger,
 		outside: outside,
 		c:       c,
 
 		pubSvc: publisher.NewPubsubService(logger),
 
-		hostMap: host.NewHostMap(logger),
 		addrMap: make(map[string]*host.RemoteList),
-		p:       make([]byte, mtu),
-		out:     make([]byte, mtu),
+		attrs:   make(map[string]hostAttrs),
+		limiter: newLimiter(c.Limits),
+	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	sc.hostMap = host.NewHostMap(logger, sc.preferredRanges)
+	sc.stun.conns[0][0] = outside
+	if sc.stun.hasAlternate() {
+		for i := range sc.stun.conns {
+			ip := sc.stunPrimaryIP
+			if i == 1 {
+				ip = nil
+			}
+			for p := range sc.stun.conns[i] {
+				sc.stun.addrs[i][p] = advertisedAddr(sc.stun.conns[i][p], ip)
+			}
+		}
+	}
+	if sc.relay != nil {
+		sc.relay.logger = logger.With(zap.String("component", "relay"))
+		sc.relay.learned = sc.learnedAddr
+		sc.relay.onExpire = sc.handleRelayExpired
 	}
+	return sc
 }
 
 func (sc *serverController) Start(ctx context.Context) error {
@@ -62,10 +105,11 @@ func (sc *serverController) Start(ctx context.Context) error {
 	go func() {
 		<-ctx.Done()
 		sc.logger.Info("Shutting down Server")
-		if err := sc.outside.Close(); err != nil {
-			sc.logger.Error("Failed to close Server", zap.Error(err))
+		for _, conn := range append(sc.conns(), sc.alternates()...) {
+			if err := conn.Close(); err != nil {
+				sc.logger.Error("Failed to close Server", zap.Error(err))
+			}
 		}
-		//sc.server.Stop()
 		close(serverShutdown)
 	}()
 
@@ -74,29 +118,15 @@ func (sc *serverController) Start(ctx context.Context) error {
 		return err
 	}
 
-	go func() {
-		sc.logger.Info("Starting Server", zap.Any("addr", addr))
-		sc.listenOutside()
-	}()
-
-	//gaddr := fmt.Sprintf("0.0.0.0:%d", sc.listenPort)
-	//gaddr := sc.c.SignalServer
-	//lis, err := net.Listen("tcp", gaddr)
-	//if err != nil {
-	//	return err
-	//}
+	sc.logger.Info("Starting Server", zap.Any("addr", addr), zap.Int("routines", len(sc.conns())))
+	sc.listenOutside()
+	sc.listenAlternates()
 
-	//api.RegisterPunchServiceServer(sc.server, sc)
-	//api.RegisterPubSubServiceServer(sc.server, sc.pubSvc)
+	if sc.relay != nil {
+		go sc.relay.run(ctx)
+	}
 
-	go func() {
-		//sc.logger.Info("Starting grpcServer", zap.Any("addr", gaddr))
-		//if err := sc.server.Serve(lis); err != nil {
-		//	if !errors.Is(err, grpc.ErrServerStopped) {
-		//		sc.logger.Error("Failed to serve grpcServer", zap.Error(err))
-		//	}
-		//}
-	}()
+	go sc.expireSources(ctx)
 
 	<-serverShutdown
 
@@ -123,24 +153,59 @@ func (sc *serverController) Subscribe(request *api.SubscribeRequest, subscribeSe
 	return nil
 }
 
+// conns 返回所有绑定在监听端口上的连接
+func (sc *serverController) conns() []udp.Conn {
+	return append([]udp.Conn{sc.outside}, sc.readers...)
+}
+
+// listenOutside 为每个连接启动一个读取 goroutine，HandleRequest 会被并发调用
 func (sc *serverController) listenOutside() {
-	sc.outside.Listen(func(addr *udp.Addr, out []byte, packet []byte) {
-		sc.HandleRequest(addr.Copy(), packet)
-	})
+	for _, conn := range sc.conns() {
+		go conn.Listen(func(addr *udp.Addr, out []byte, packet []byte) {
+			sc.HandleRequest(addr.Copy(), packet)
+		})
+	}
 }
 
 func (sc *serverController) HandleRequest(addr *udp.Addr, p []byte) {
-	//fmt.Println("p => ", p)
-	//fmt.Println("p len => ", len(p))
-	hm := &api.HostMessage{}
-	if err := hm.Unmarshal(p); err != nil {
-		sc.logger.Error("Failed to unmarshal lighthouse packet",
+	ip := addr.IP.String()
+	if reason := sc.limiter.checkPacket(ip, len(p)); reason != "" {
+		sc.drop(reason, addr)
+		return
+	}
+
+	// 灯塔端口同时作为 STUN 服务器，通过 magic cookie 区分 STUN 消息
+	if stun.IsMessage(p) {
+		sc.handleSTUN(0, 0, addr, p)
+		return
+	}
+
+	hm, err := sc.unmarshalRequest(p)
+	if err != nil {
+		sc.logger.Debug("Failed to unmarshal lighthouse packet",
+			zap.Stringer("addr", addr),
 			zap.Error(err),
 		)
+		if sc.verifier != nil {
+			sc.drop(dropUnauthenticated, addr)
+		} else {
+			sc.drop(dropMalformed, addr)
+		}
 		//TODO: send recv_error?
 		return
 	}
 
+	if reason := sc.admitHost(ip, hm.Hostname, sc.limiter.admitHost); reason != "" {
+		sc.drop(reason, addr)
+		return
+	}
+	if hm.Type == api.HostMessage_HostRelayRequest {
+		if reason := sc.admitHost(ip, hm.Target, sc.limiter.admitTarget); reason != "" {
+			sc.drop(reason, addr)
+			return
+		}
+	}
+
 	var hostInfo *host.HostInfo
 	hostInfo = sc.GetOrCreateHostInfo(hm.Hostname)
 
@@ -157,6 +222,86 @@ func (sc *serverController) HandleRequest(addr *udp.Addr, p []byte) {
 
 	case api.HostMessage_HostOnlineNotification:
 		sc.handleHostOnlineNotification(hm, addr)
+
+	case api.HostMessage_HostRelayRequest:
+		sc.handleHostRelayRequest(hm, addr, hostInfo)
+	}
+}
+
+// admitHost 检查主机名，再通过 admit 检查来源和全局是否超过了可以创建的主机数量
+func (sc *serverController) admitHost(ip string, hostname string, admit func(ip, hostname string) string) string {
+	if reason := sc.limiter.checkHostname(hostname); reason != "" {
+		return reason
+	}
+	return admit(ip, hostname)
+}
+
+// drop 记录被丢弃的数据包，洪泛时会产生大量丢弃，因此只输出调试日志
+func (sc *serverController) drop(reason string, addr *udp.Addr) {
+	metricDropped.Add(reason, 1)
+	sc.logger.Debug("Dropping lighthouse packet",
+		zap.String("reason", reason),
+		zap.Stringer("addr", addr),
+	)
+}
+
+// expireSources 定期移除空闲的主机并清除空闲来源的限速状态，直到上下文关闭
+func (sc *serverController) expireSources(ctx context.Context) {
+	ticker := time.NewTicker(sc.limiter.hostIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, hostname := range sc.limiter.expire(time.Now()) {
+				sc.removeHost(hostname)
+			}
+		}
+	}
+}
+
+// removeHost 移除主机及其地址列表
+func (sc *serverController) removeHost(hostname string) {
+	sc.Lock()
+	defer sc.Unlock()
+	delete(sc.addrMap, hostname)
+	delete(sc.attrs, hostname)
+	sc.hostMap.DeleteHost(hostname)
+	sc.logger.Debug("Removed idle host", zap.String("hostname", hostname))
+}
+
+// unmarshalRequest 解析灯塔消息，启用认证时只接受经过认证的 Envelope
+func (sc *serverController) unmarshalRequest(p []byte) (*api.HostMessage, error) {
+	if sc.verifier == nil {
+		hm := &api.HostMessage{}
+		if err := hm.Unmarshal(p); err != nil {
+			return nil, err
+		}
+		return hm, nil
+	}
+
+	hm, err := sc.verifier.Open(p)
+	if err != nil {
+		metricAuthRejected.Add(authRejectReason(err), 1)
+		return nil, fmt.Errorf("unauthenticated lighthouse packet: %w", err)
+	}
+	return hm, nil
+}
+
+func authRejectReason(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrUnknownHost):
+		return "unknown_host"
+	case errors.Is(err, auth.ErrBadMAC):
+		return "bad_mac"
+	case errors.Is(err, auth.ErrExpired):
+		return "expired"
+	case errors.Is(err, auth.ErrReplay):
+		return "replay"
+	default:
+		return "malformed"
 	}
 }
 
@@ -165,14 +310,20 @@ func (sc *serverController) handleHostUpdateNotification(hm *api.HostMessage, ad
 		zap.String("handle", "handleHostUpdateNotification"),
 		zap.Stringer("addr", addr),
 	)
-	hostInfo.SetRemote(addr)
-
-	_, err := sc.HostUpdate(context.Background(), &api.HostUpdateRequest{
-		Hostname:     hm.Hostname,
-		Ipv4Addr:     hm.Ipv4Addr,
-		Ipv6Addr:     hm.Ipv6Addr,
-		ExternalAddr: api.NewIpv4Addr(addr.IP, uint32(addr.Port)),
-	})
+	request := &api.HostUpdateRequest{
+		Hostname:  hm.Hostname,
+		Ipv4Addr:  hm.Ipv4Addr,
+		Ipv6Addr:  hm.Ipv6Addr,
+		NatType:   hm.NatType,
+		PublicKey: hm.PublicKey,
+	}
+	// 外部地址使用服务端观察到的地址
+	if addr.IP.To4() != nil {
+		request.ExternalAddr = api.NewIpv4Addr(addr.IP, uint32(addr.Port))
+	} else {
+		request.ExternalAddr6 = api.NewIpv6Addr(addr.IP, uint32(addr.Port))
+	}
+	err := sc.updateHost(request, addr)
 	if err != nil {
 		sc.logger.Error("Failed to update host",
 			zap.String("hostname", hm.Hostname),
@@ -264,29 +415,33 @@ func (sc *serverController) handleHostUpdateNotification(hm *api.HostMessage, ad
 	//}
 }
 
+// hasAddressChanged 比较两个由 RemoteList.CopyAddrs 返回的地址列表，
+// 由于列表已经去重并稳定排序，顺序变化也意味着优先级发生了变化
 func hasAddressChanged(oldAddrs, newAddrs []*udp.Addr) bool {
-	if len(oldAddrs) != len(newAddrs) {
-		return true
-	}
+	return !udp.AddrSlice(oldAddrs).Equal(newAddrs)
+}
 
-	oldAddrMap := make(map[string]struct{}, len(oldAddrs))
-	for _, addr := range oldAddrs {
-		oldAddrMap[addr.String()] = struct{}{}
-	}
+// hostAttrs 是主机上报的地址以外的信息，变化时同样需要推送给订阅者
+type hostAttrs struct {
+	natType   *api.NatType
+	publicKey string
+}
 
-	for _, addr := range newAddrs {
-		if _, exists := oldAddrMap[addr.String()]; !exists {
-			return true
-		}
+// hasAttrsChanged 比较两次上报的 NAT 类型和公钥，NAT 类型为 nil 表示尚未检测
+func hasAttrsChanged(old, new hostAttrs) bool {
+	if old.publicKey != new.publicKey {
+		return true
 	}
-
-	return false
+	if old.natType == nil || new.natType == nil {
+		return old.natType != new.natType
+	}
+	return *old.natType != *new.natType
 }
 
 func (sc *serverController) unlockedGetRemoteList(name string) *host.RemoteList {
 	am, ok := sc.addrMap[name]
 	if !ok {
-		am = host.NewRemoteList()
+		am = host.NewRemoteList(sc.remoteAllowList, sc.familyPolicy)
 		sc.addrMap[name] = am
 	}
 	return am
@@ -298,6 +453,13 @@ func (sc *serverController) handleHostOnlineNotification(hm *api.HostMessage, ad
 
 // GetOrCreateHostInfo retrieves the existing HostInfo or creates a new one if it doesn't exist.
 func (sc *serverController) GetOrCreateHostInfo(hostname string) *host.HostInfo {
+	if hostInfo := sc.hostMap.GetHost(hostname); hostInfo != nil {
+		return hostInfo
+	}
+
+	// 多个读取 goroutine 可能同时为同一主机创建 HostInfo，持有锁后再检查一次
+	sc.Lock()
+	defer sc.Unlock()
 	hostInfo := sc.hostMap.GetHost(hostname)
 	if hostInfo == nil {
 		hostInfo = &host.HostInfo{
@@ -1 +1,74 @@
 package controller
+
+import (
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/pkg/auth"
+	"github.com/cossteam/punchline/pkg/host"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"google.golang.org/grpc"
+	"net"
+	"time"
+)
+
+type ServerOption func(*serverController)
+
+// WithRemoteAllowList 设置过滤上报和学习到的地址的允许列表
+func WithRemoteAllowList(allowList *host.AllowList) ServerOption {
+	return func(sc *serverController) {
+		sc.remoteAllowList = allowList
+	}
+}
+
+// WithPreferredRanges 设置首选网段
+func WithPreferredRanges(preferredRanges []*net.IPNet) ServerOption {
+	return func(sc *serverController) {
+		sc.preferredRanges = preferredRanges
+	}
+}
+
+// WithFamilyPolicy 设置地址族策略
+func WithFamilyPolicy(family host.FamilyPolicy) ServerOption {
+	return func(sc *serverController) {
+		sc.familyPolicy = family
+	}
+}
+
+// WithRelay 启用中继，中继端口绑定在 advertiseIP 上并通告给客户端，空闲超过 idleTimeout 的会话将被回收
+func WithRelay(advertiseIP net.IP, idleTimeout time.Duration) ServerOption {
+	return func(sc *serverController) {
+		sc.relay = newRelayManager(nil, advertiseIP, idleTimeout, nil)
+	}
+}
+
+// WithVerifier 启用灯塔消息认证，拒绝所有未经认证的消息
+func WithVerifier(verifier *auth.Verifier) ServerOption {
+	return func(sc *serverController) {
+		sc.verifier = verifier
+	}
+}
+
+// WithReaders 添加与 outside 绑定在同一端口上的其他监听器 (SO_REUSEPORT)，用于并发接收灯塔消息
+func WithReaders(readers ...udp.Conn) ServerOption {
+	return func(sc *serverController) {
+		sc.readers = append(sc.readers, readers...)
+	}
+}
+
+// WithSTUNAlternate 在备用地址上提供 RFC 5780 的 NAT 行为测试，primaryIP 是灯塔监听器通告给客户端的 IP，
+// altPort 绑定在 (主 IP, 备用端口)，altIP 绑定在 (备用 IP, 主端口)，altBoth 绑定在 (备用 IP, 备用端口)
+func WithSTUNAlternate(primaryIP net.IP, altPort, altIP, altBoth udp.Conn) ServerOption {
+	return func(sc *serverController) {
+		sc.stun.conns[0][1] = altPort
+		sc.stun.conns[1][0] = altIP
+		sc.stun.conns[1][1] = altBoth
+		sc.stunPrimaryIP = primaryIP
+	}
+}
+
+// WithGRPCServer 在 server 上注册客户端使用的 PunchService 和 PubSubService，server 由调用者启动
+func WithGRPCServer(server *grpc.Server) ServerOption {
+	return func(sc *serverController) {
+		api.RegisterPunchServiceServer(server, sc)
+		api.RegisterPubSubServiceServer(server, sc.pubSvc)
+	}
+}
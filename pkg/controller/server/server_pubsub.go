@@ -24,9 +24,16 @@ func (sc *serverController) coalesceAnswers(c *host.Cache, n *api.HostMessage) {
 		}
 		n.Ipv6Addr = append(n.Ipv6Addr, v6Cache.Reported()...)
 	}
+
+	if relayCache := c.GetRelay(); relayCache != nil {
+		n.RelayAddr = append(n.RelayAddr, relayCache.Relay()...)
+		n.RelayAddr6 = append(n.RelayAddr6, relayCache.Relay6()...)
+	}
 }
 
-func (sc *serverController) queryAndPrepMessage(name string, f func(cache *host.Cache) (int, error)) (bool, int, error) {
+// queryAndPrepMessage 在持有主机地址列表读锁时调用 f 序列化消息，
+// 返回的数据会被异步推送给订阅者，因此每次都使用新的缓冲区，不能复用
+func (sc *serverController) queryAndPrepMessage(name string, f func(cache *host.Cache) ([]byte, error)) (bool, []byte, error) {
 	sc.RLock()
 	// Do we have an entry in the main cache?
 	if v, ok := sc.addrMap[name]; ok {
@@ -40,13 +47,13 @@ func (sc *serverController) queryAndPrepMessage(name string, f func(cache *host.
 		c := v.GetCache(name)
 		// Make sure we have
 		if c != nil {
-			n, err := f(c)
-			return true, n, err
+			b, err := f(c)
+			return true, b, err
 		} else {
 			sc.logger.Debug("No cache for vpnIp", zap.String("name", name))
 		}
-		return false, 0, nil
+		return false, nil, nil
 	}
 	sc.RUnlock()
-	return false, 0, nil
+	return false, nil, nil
 }
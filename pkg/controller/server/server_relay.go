@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/pkg/host"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"go.uber.org/zap"
+)
+
+// handleHostRelayRequest 为请求方和目标主机分配中继，并分别向双方的主题推送 HostRelayNotification
+func (sc *serverController) handleHostRelayRequest(hm *api.HostMessage, addr *udp.Addr, hostInfo *host.HostInfo) {
+	logger := sc.logger.With(
+		zap.String("handle", "handleHostRelayRequest"),
+		zap.String("hostname", hm.Hostname),
+		zap.String("target", hm.Target),
+	)
+
+	if sc.relay == nil {
+		logger.Warn("收到中继请求，但服务端未启用中继")
+		return
+	}
+
+	// 中继请求从客户端的打洞端口发出，借此更新学习到的地址
+	hostInfo.SetRemote(addr)
+	sc.GetOrCreateHostInfo(hm.Target)
+
+	s, err := sc.relay.allocate(hm.Hostname, hm.Target)
+	if err != nil {
+		logger.Error("Failed to allocate relay", zap.Error(err))
+		return
+	}
+
+	// 中继地址按会话的地址族放入 relay_addr 或 relay_addr6
+	var (
+		relayAddr  []*api.Ipv4Addr
+		relayAddr6 []*api.Ipv6Addr
+	)
+	if s.addr.IP.To4() != nil {
+		relayAddr = []*api.Ipv4Addr{api.NewIpv4Addr(s.addr.IP, uint32(s.addr.Port))}
+	} else {
+		relayAddr6 = []*api.Ipv6Addr{api.NewIpv6Addr(s.addr.IP, uint32(s.addr.Port))}
+	}
+	for _, name := range s.hosts {
+		sc.setRelay(name, relayAddr, relayAddr6)
+		sc.publishRelay(name)
+	}
+}
+
+// handleRelayExpired 在中继会话被回收后清除双方的中继地址
+func (sc *serverController) handleRelayExpired(s *relaySession) {
+	for _, name := range s.hosts {
+		sc.setRelay(name, nil, nil)
+	}
+}
+
+func (sc *serverController) setRelay(name string, relayAddr []*api.Ipv4Addr, relayAddr6 []*api.Ipv6Addr) {
+	sc.Lock()
+	am := sc.unlockedGetRemoteList(name)
+	am.Lock()
+	sc.Unlock()
+	am.UnlockedSetRelay(name, relayAddr, relayAddr6)
+	am.Unlock()
+}
+
+func (sc *serverController) publishRelay(name string) {
+	newHm := &api.HostMessage{}
+	found, b, err := sc.queryAndPrepMessage(name, func(cache *host.Cache) ([]byte, error) {
+		newHm.Type = api.HostMessage_HostRelayNotification
+		newHm.Hostname = name
+		sc.coalesceAnswers(cache, newHm)
+		return newHm.Marshal()
+	})
+	if !found {
+		sc.logger.Debug("未找到主机信息", zap.String("hostname", name))
+		return
+	}
+	if err != nil {
+		sc.logger.Error("Failed to marshal lighthouse relay notification", zap.String("hostname", name), zap.Error(err))
+		return
+	}
+
+	if _, err = sc.Publish(context.Background(), &api.PublishRequest{
+		Topic: name,
+		Data:  b,
+	}); err != nil {
+		sc.logger.Error("Failed to publish lighthouse relay notification",
+			zap.String("hostname", name),
+			zap.Error(err),
+		)
+	}
+}
+
+// learnedAddr 返回服务端观察到的主机地址
+func (sc *serverController) learnedAddr(hostname string) *udp.Addr {
+	hostInfo := sc.hostMap.GetHost(hostname)
+	if hostInfo == nil {
+		return nil
+	}
+	return hostInfo.GetRemote()
+}
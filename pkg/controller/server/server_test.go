@@ -1 +1,282 @@
 package controller
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	stunclient "github.com/cossteam/punchline/pkg/sutn"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestHasAddressChanged(t *testing.T) {
+	a := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	b := udp.NewAddr(net.ParseIP("5.6.7.8"), 4242)
+
+	assert.False(t, hasAddressChanged(nil, nil))
+	assert.False(t, hasAddressChanged([]*udp.Addr{a, b}, []*udp.Addr{a.Copy(), b.Copy()}))
+	assert.True(t, hasAddressChanged(nil, []*udp.Addr{a}))
+	assert.True(t, hasAddressChanged([]*udp.Addr{a, b}, []*udp.Addr{a}))
+	// 优先级变化也视为变化
+	assert.True(t, hasAddressChanged([]*udp.Addr{a, b}, []*udp.Addr{b, a}))
+
+	// 地址以外的 NAT 类型和公钥变化也需要推送
+	cone := &api.NatType{Mapping: api.NatBehavior_EndpointIndependent, Filtering: api.NatBehavior_EndpointIndependent}
+	symmetric := &api.NatType{Mapping: api.NatBehavior_AddressAndPortDependent, Filtering: api.NatBehavior_AddressAndPortDependent}
+	assert.False(t, hasAttrsChanged(hostAttrs{}, hostAttrs{}))
+	assert.False(t, hasAttrsChanged(hostAttrs{natType: cone, publicKey: "k"}, hostAttrs{natType: &api.NatType{Mapping: cone.Mapping, Filtering: cone.Filtering}, publicKey: "k"}))
+	assert.True(t, hasAttrsChanged(hostAttrs{}, hostAttrs{natType: cone}))
+	assert.True(t, hasAttrsChanged(hostAttrs{natType: cone}, hostAttrs{natType: symmetric}))
+	assert.True(t, hasAttrsChanged(hostAttrs{publicKey: "k1"}, hostAttrs{publicKey: "k2"}))
+}
+
+func TestRelayManager(t *testing.T) {
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer a.Close()
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer b.Close()
+
+	learned := map[string]*udp.Addr{
+		"a": udp.NewAddr(net.IPv4(127, 0, 0, 1), uint16(a.LocalAddr().(*net.UDPAddr).Port)),
+		"b": udp.NewAddr(net.IPv4(127, 0, 0, 1), uint16(b.LocalAddr().(*net.UDPAddr).Port)),
+	}
+
+	rm := newRelayManager(zap.NewNop(), net.IPv4(127, 0, 0, 1), time.Minute, func(hostname string) *udp.Addr {
+		return learned[hostname]
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rm.run(ctx)
+
+	s, err := rm.allocate("a", "b")
+	assert.NoError(t, err)
+	s2, err := rm.allocate("b", "a")
+	assert.NoError(t, err)
+	assert.Same(t, s, s2)
+
+	_, err = rm.allocate("a", "a")
+	assert.ErrorIs(t, err, errRelaySelf)
+
+	relayAddr := &net.UDPAddr{IP: s.addr.IP, Port: int(s.addr.Port)}
+	buf := make([]byte, 64)
+
+	_, err = a.WriteToUDP([]byte("ping"), relayAddr)
+	assert.NoError(t, err)
+	_ = b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := b.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	_, err = b.WriteToUDP([]byte("pong"), relayAddr)
+	assert.NoError(t, err)
+	_ = a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err = a.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(buf[:n]))
+
+	expired := make(chan *relaySession, 1)
+	rm.onExpire = func(s *relaySession) { expired <- s }
+	rm.expire(time.Now().Add(2 * time.Minute))
+	assert.Same(t, s, <-expired)
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(config.Limits{PacketsPerSecond: 2, Burst: 2, MaxHostsPerSource: 2})
+	l.now = func() time.Time { return now }
+
+	assert.Equal(t, dropEmpty, l.checkPacket("1.1.1.1", 0))
+	assert.Equal(t, dropTooLarge, l.checkPacket("1.1.1.1", defaultMaxMessageSize+1))
+
+	assert.Empty(t, l.checkPacket("1.1.1.1", 10))
+	assert.Empty(t, l.checkPacket("1.1.1.1", 10))
+	assert.Equal(t, dropRateLimited, l.checkPacket("1.1.1.1", 10))
+	// 其他来源不受影响
+	assert.Empty(t, l.checkPacket("2.2.2.2", 10))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Empty(t, l.checkPacket("1.1.1.1", 10))
+	assert.Equal(t, dropRateLimited, l.checkPacket("1.1.1.1", 10))
+
+	assert.Equal(t, dropInvalidHostname, l.checkHostname(""))
+	assert.Equal(t, dropInvalidHostname, l.checkHostname(strings.Repeat("a", defaultMaxHostnameLength+1)))
+	assert.Empty(t, l.checkHostname("client1"))
+
+	assert.Empty(t, l.admitHost("1.1.1.1", "a"))
+	assert.Empty(t, l.admitHost("1.1.1.1", "b"))
+	assert.Empty(t, l.admitHost("1.1.1.1", "a"))
+	assert.Equal(t, dropTooManyHosts, l.admitHost("1.1.1.1", "c"))
+	assert.Empty(t, l.admitHost("2.2.2.2", "c"))
+
+	// 主机没有空闲时不会被移除
+	assert.Empty(t, l.expire(now.Add(time.Minute)))
+	assert.Len(t, l.sources, 2)
+	assert.Equal(t, dropTooManyHosts, l.admitHost("1.1.1.1", "d"))
+
+	// 中继请求的目标不会从原来的来源转移
+	assert.Empty(t, l.admitTarget("2.2.2.2", "a"))
+	assert.Equal(t, dropTooManyHosts, l.admitHost("1.1.1.1", "d"))
+
+	// 主机从新的来源发送消息后从原来的来源转移
+	assert.Empty(t, l.admitHost("2.2.2.2", "a"))
+	assert.Empty(t, l.admitHost("1.1.1.1", "d"))
+
+	// 空闲的主机被移除，之后没有主机的空闲来源也被清除
+	now = now.Add(defaultHostIdleTimeout / 2)
+	assert.Empty(t, l.admitHost("1.1.1.1", "d"))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, l.expire(now.Add(defaultHostIdleTimeout/2+time.Second)))
+	assert.ElementsMatch(t, []string{"d"}, l.expire(now.Add(defaultSourceIdleTimeout+time.Second)))
+	assert.Empty(t, l.sources)
+	assert.Empty(t, l.hosts)
+
+	// 全局主机上限
+	l = newLimiter(config.Limits{MaxHosts: 2})
+	assert.Empty(t, l.admitHost("1.1.1.1", "a"))
+	assert.Empty(t, l.admitHost("2.2.2.2", "b"))
+	assert.Equal(t, dropHostLimit, l.admitHost("3.3.3.3", "c"))
+	// 已有的主机转移来源不受全局上限影响
+	assert.Empty(t, l.admitHost("3.3.3.3", "a"))
+}
+
+func TestLighthouseFlood(t *testing.T) {
+	outside, err := udp.NewGenericListener(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0)
+	assert.NoError(t, err)
+
+	c := &config.Config{Limits: config.Limits{PacketsPerSecond: 1, Burst: 10, MaxHostsPerSource: 3}}
+	sc := NewServerController(zap.NewNop(), outside, c).(*serverController)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sc.Start(ctx)
+
+	laddr, err := outside.LocalAddr()
+	assert.NoError(t, err)
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: laddr.IP, Port: int(laddr.Port)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	dropped := func(reason string) int64 {
+		if v, ok := metricDropped.Get(reason).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	rateLimited := dropped(dropRateLimited)
+	tooManyHosts := dropped(dropTooManyHosts)
+
+	// 使用随机主机名进行洪泛
+	for i := 0; i < 200; i++ {
+		hm := &api.HostMessage{
+			Type:     api.HostMessage_HostOnlineNotification,
+			Hostname: fmt.Sprintf("flood-%d", i),
+		}
+		b, err := hm.Marshal()
+		assert.NoError(t, err)
+		_, err = conn.Write(b)
+		assert.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return dropped(dropTooManyHosts)-tooManyHosts > 0 && dropped(dropRateLimited)-rateLimited > 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	sc.hostMap.RLock()
+	defer sc.hostMap.RUnlock()
+	assert.Len(t, sc.hostMap.Hosts, 3)
+}
+
+func TestGRPCHostLimits(t *testing.T) {
+	outside, err := udp.NewGenericListener(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0)
+	require.NoError(t, err)
+	defer outside.Close()
+
+	c := &config.Config{Limits: config.Limits{MaxHostsPerSource: 1}}
+	sc := NewServerController(zap.NewNop(), outside, c).(*serverController)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}})
+
+	// gRPC 创建的主机与 UDP 消息一样按对端 IP 计入上限
+	_, err = sc.HostUpdate(ctx, &api.HostUpdateRequest{Hostname: "a"})
+	require.NoError(t, err)
+	_, err = sc.HostUpdate(ctx, &api.HostUpdateRequest{Hostname: "b"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = sc.HostOnline(ctx, &api.HostOnlineRequest{Hostname: "b"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = sc.HostUpdate(ctx, &api.HostUpdateRequest{Hostname: ""})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Nil(t, sc.hostMap.GetHost("b"))
+
+	// 空闲的主机被移除
+	for _, hostname := range sc.limiter.expire(time.Now().Add(time.Hour)) {
+		sc.removeHost(hostname)
+	}
+	assert.Nil(t, sc.hostMap.GetHost("a"))
+	_, err = sc.HostUpdate(ctx, &api.HostUpdateRequest{Hostname: "b"})
+	assert.NoError(t, err)
+}
+
+func TestLighthouseSTUN(t *testing.T) {
+	listen := func(ip net.IP, port int) udp.Conn {
+		conn, err := udp.NewGenericListener(zap.NewNop(), ip, port)
+		require.NoError(t, err)
+		return conn
+	}
+	primaryIP, altIP := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+
+	t.Run("binding", func(t *testing.T) {
+		outside := listen(primaryIP, 0)
+		sc := NewServerController(zap.NewNop(), outside, &config.Config{}).(*serverController)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go sc.Start(ctx)
+
+		laddr, err := outside.LocalAddr()
+		require.NoError(t, err)
+		server := laddr.String()
+
+		c, err := stunclient.NewMultiClient([]string{"stun:" + server}, stunclient.WithTimeout(time.Second))
+		require.NoError(t, err)
+		defer c.Close()
+		addr, err := c.ExternalAddr()
+		require.NoError(t, err)
+		assert.True(t, addr.IP.Equal(primaryIP))
+
+		// 没有备用地址时不支持 RFC 5780 行为测试
+		_, err = stunclient.DetectNAT(server, 600*time.Millisecond)
+		assert.ErrorIs(t, err, stunclient.ErrNoOtherAddress)
+	})
+
+	t.Run("rfc5780", func(t *testing.T) {
+		outside := listen(primaryIP, 0)
+		laddr, err := outside.LocalAddr()
+		require.NoError(t, err)
+		altBoth := listen(altIP, 0)
+		alt, err := altBoth.LocalAddr()
+		require.NoError(t, err)
+
+		sc := NewServerController(zap.NewNop(), outside, &config.Config{},
+			WithSTUNAlternate(primaryIP, listen(primaryIP, int(alt.Port)), listen(altIP, int(laddr.Port)), altBoth),
+		).(*serverController)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go sc.Start(ctx)
+
+		nat, err := stunclient.DetectNAT(laddr.String(), 600*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, api.NatBehavior_NoNat, nat.Mapping)
+		assert.Equal(t, api.NatBehavior_EndpointIndependent, nat.Filtering)
+		assert.True(t, nat.Hairpinning)
+	})
+}
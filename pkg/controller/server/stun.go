@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"net"
+
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/pion/stun"
+	"go.uber.org/zap"
+)
+
+const stunSoftware = "punchline"
+
+// stunResponder 在灯塔端口上响应 STUN Binding 请求，客户端不再依赖公共 STUN 服务器。
+// 配置了备用地址时按照 RFC 5780 在 (主 IP, 主端口) (主 IP, 备用端口) (备用 IP, 主端口) (备用 IP, 备用端口)
+// 四个地址上响应，并支持 OTHER-ADDRESS 和 CHANGE-REQUEST，客户端可以据此检测 NAT 类型
+type stunResponder struct {
+	// conns[ip][port]，下标 0 为主地址，1 为备用地址，conns[0][0] 是灯塔监听器，
+	// 没有配置备用地址时其余为 nil
+	conns [2][2]udp.Conn
+	// addrs 与 conns 对应的通告给客户端的地址，用于 OTHER-ADDRESS，未知时为 nil
+	addrs [2][2]*udp.Addr
+}
+
+// hasAlternate 是否配置了备用地址
+func (r *stunResponder) hasAlternate() bool {
+	return r.conns[1][1] != nil
+}
+
+// alternates 返回备用地址上的监听器
+func (sc *serverController) alternates() []udp.Conn {
+	if !sc.stun.hasAlternate() {
+		return nil
+	}
+	return []udp.Conn{sc.stun.conns[0][1], sc.stun.conns[1][0], sc.stun.conns[1][1]}
+}
+
+// listenAlternates 在备用地址上接收 STUN 请求，灯塔消息只在主地址上处理
+func (sc *serverController) listenAlternates() {
+	if !sc.stun.hasAlternate() {
+		return
+	}
+	for i := range sc.stun.conns {
+		for p := range sc.stun.conns[i] {
+			if i == 0 && p == 0 {
+				continue
+			}
+			go func(i, p int) {
+				sc.stun.conns[i][p].Listen(func(addr *udp.Addr, out []byte, packet []byte) {
+					if reason := sc.limiter.checkPacket(addr.IP.String(), len(packet)); reason != "" {
+						sc.drop(reason, addr)
+						return
+					}
+					if !stun.IsMessage(packet) {
+						sc.drop(dropMalformed, addr)
+						return
+					}
+					sc.handleSTUN(i, p, addr.Copy(), packet)
+				})
+			}(i, p)
+		}
+	}
+}
+
+// handleSTUN 响应在 (ip, port) 地址上收到的 STUN Binding 请求，XOR-MAPPED-ADDRESS 为服务端观察到的地址
+func (sc *serverController) handleSTUN(ip, port int, addr *udp.Addr, p []byte) {
+	req := &stun.Message{Raw: append([]byte(nil), p...)}
+	if err := req.Decode(); err != nil || req.Type != stun.BindingRequest {
+		sc.drop(dropMalformed, addr)
+		return
+	}
+
+	var setters []stun.Setter
+	ri, rp := ip, port
+
+	change, err := req.Get(stun.AttrChangeRequest)
+	switch {
+	case err == nil && !sc.stun.hasAlternate():
+		// RFC 5780 6.1: 没有备用地址时以 420 拒绝 CHANGE-REQUEST
+		setters = []stun.Setter{
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stun.BindingError,
+			stun.CodeUnknownAttribute,
+			stun.UnknownAttributes{stun.AttrChangeRequest},
+		}
+	default:
+		setters = []stun.Setter{
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: addr.IP, Port: int(addr.Port)},
+			&stun.MappedAddress{IP: addr.IP, Port: int(addr.Port)},
+		}
+		if other := sc.stun.addrs[1-ip][1-port]; other != nil {
+			setters = append(setters, &stun.OtherAddress{IP: other.IP, Port: int(other.Port)})
+		}
+		if err == nil && len(change) == 4 {
+			if change[3]&0x04 != 0 {
+				ri = 1 - ri
+			}
+			if change[3]&0x02 != 0 {
+				rp = 1 - rp
+			}
+		}
+	}
+	setters = append(setters, stun.NewSoftware(stunSoftware))
+
+	res, err := stun.Build(setters...)
+	if err != nil {
+		sc.logger.Error("Failed to build STUN response", zap.Error(err))
+		return
+	}
+
+	metricSTUN.Add(1)
+	if err := sc.stun.conns[ri][rp].WriteTo(res.Raw, addr); err != nil {
+		sc.logger.Debug("Failed to send STUN response", zap.Stringer("addr", addr), zap.Error(err))
+	}
+}
+
+// advertisedAddr 返回 conn 通告给客户端的地址，conn 绑定在未指定地址上时使用 ip，两者都未知时返回 nil
+func advertisedAddr(conn udp.Conn, ip net.IP) *udp.Addr {
+	local, err := conn.LocalAddr()
+	if err != nil {
+		return nil
+	}
+	if !local.IP.IsUnspecified() {
+		return local
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	return udp.NewAddr(ip, local.Port)
+}
@@ -43,6 +43,11 @@ func NewSignalingController(addr string, logger *zap.Logger, opts ...grpc.Server
 	return sc
 }
 
+// GRPCServer 返回信令服务使用的 grpc.Server，可以在 Start 之前注册其他服务，与信令服务共用同一个端口
+func (sc *SignalingController) GRPCServer() *grpc.Server {
+	return sc.server
+}
+
 func (sc *SignalingController) Start(ctx context.Context) error {
 	serverShutdown := make(chan struct{})
 	go func() {
@@ -0,0 +1,101 @@
+package host
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// AllowList 是一个基于 CIDR 的允许/拒绝列表，按最长前缀匹配进行判定。
+//
+// 规则的值为 true 表示允许，false 表示拒绝。对于未命中任何规则的地址：
+// 如果该地址族 (v4/v6) 中存在任意一条允许规则，则默认拒绝；否则默认允许。
+// 因此只写拒绝规则即可实现黑名单，只写允许规则即可实现白名单。
+type AllowList struct {
+	rules []allowRule
+
+	defaultV4 bool
+	defaultV6 bool
+}
+
+type allowRule struct {
+	cidr  *net.IPNet
+	allow bool
+}
+
+// NewAllowList 从 CIDR -> 是否允许 的映射中构建 AllowList，rules 为空时返回 nil，nil 的 AllowList 允许所有地址
+func NewAllowList(rules map[string]bool) (*AllowList, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	al := &AllowList{
+		defaultV4: true,
+		defaultV6: true,
+	}
+
+	for s, allow := range rules {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow list cidr %q: %w", s, err)
+		}
+
+		if allow {
+			if cidr.IP.To4() != nil {
+				al.defaultV4 = false
+			} else {
+				al.defaultV6 = false
+			}
+		}
+
+		al.rules = append(al.rules, allowRule{cidr: cidr, allow: allow})
+	}
+
+	// 最长前缀优先，前缀长度相同时按字符串排序保证结果稳定
+	sort.Slice(al.rules, func(i, j int) bool {
+		oi, _ := al.rules[i].cidr.Mask.Size()
+		oj, _ := al.rules[j].cidr.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return al.rules[i].cidr.String() < al.rules[j].cidr.String()
+	})
+
+	return al, nil
+}
+
+// Allow 判断 ip 是否被允许
+func (al *AllowList) Allow(ip net.IP) bool {
+	if al == nil {
+		return true
+	}
+
+	v4 := ip.To4()
+	for _, r := range al.rules {
+		// 避免 v4 规则匹配到 v6 地址，反之亦然
+		if (r.cidr.IP.To4() != nil) != (v4 != nil) {
+			continue
+		}
+		if r.cidr.Contains(ip) {
+			return r.allow
+		}
+	}
+
+	if v4 != nil {
+		return al.defaultV4
+	}
+	return al.defaultV6
+}
+
+// ParsePreferredRanges 解析首选网段列表
+func ParsePreferredRanges(ranges []string) ([]*net.IPNet, error) {
+	var preferred []*net.IPNet
+	for _, s := range ranges {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preferred range %q: %w", s, err)
+		}
+		preferred = append(preferred, cidr)
+	}
+	return preferred, nil
+}
@@ -0,0 +1,88 @@
+package host
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/cossteam/punchline/pkg/transport/udp"
+)
+
+// FamilyPolicy 决定 RemoteList 中 v4 和 v6 地址的取舍和先后顺序
+type FamilyPolicy int
+
+const (
+	// FamilyPolicyNone 不区分地址族
+	FamilyPolicyNone FamilyPolicy = iota
+	// FamilyPolicyPreferV4 同一优先级内 v4 地址排在 v6 地址前面
+	FamilyPolicyPreferV4
+	// FamilyPolicyPreferV6 同一优先级内 v6 地址排在 v4 地址前面
+	FamilyPolicyPreferV6
+	// FamilyPolicyV4Only 只使用 v4 地址
+	FamilyPolicyV4Only
+	// FamilyPolicyV6Only 只使用 v6 地址
+	FamilyPolicyV6Only
+)
+
+// ParseFamilyPolicy 解析配置中的地址族策略，可选值为 "", "prefer-ipv4", "prefer-ipv6", "ipv4-only", "ipv6-only"
+func ParseFamilyPolicy(s string) (FamilyPolicy, error) {
+	switch s {
+	case "":
+		return FamilyPolicyNone, nil
+	case "prefer-ipv4":
+		return FamilyPolicyPreferV4, nil
+	case "prefer-ipv6":
+		return FamilyPolicyPreferV6, nil
+	case "ipv4-only":
+		return FamilyPolicyV4Only, nil
+	case "ipv6-only":
+		return FamilyPolicyV6Only, nil
+	default:
+		return FamilyPolicyNone, fmt.Errorf("unknown address family policy %q", s)
+	}
+}
+
+func (f FamilyPolicy) String() string {
+	switch f {
+	case FamilyPolicyPreferV4:
+		return "prefer-ipv4"
+	case FamilyPolicyPreferV6:
+		return "prefer-ipv6"
+	case FamilyPolicyV4Only:
+		return "ipv4-only"
+	case FamilyPolicyV6Only:
+		return "ipv6-only"
+	default:
+		return ""
+	}
+}
+
+// allow 判断 ip 的地址族是否被允许
+func (f FamilyPolicy) allow(ip net.IP) bool {
+	switch f {
+	case FamilyPolicyV4Only:
+		return ip.To4() != nil
+	case FamilyPolicyV6Only:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// less 按地址族策略、地址和端口比较两个地址
+func (f FamilyPolicy) less(a, b *udp.Addr) bool {
+	a4, b4 := a.IP.To4() != nil, b.IP.To4() != nil
+	if a4 != b4 {
+		switch f {
+		case FamilyPolicyPreferV4:
+			return a4
+		case FamilyPolicyPreferV6:
+			return b4
+		}
+	}
+
+	if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+		return c < 0
+	}
+	return a.Port < b.Port
+}
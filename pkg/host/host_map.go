@@ -8,11 +8,12 @@ import (
 	"sync"
 )
 
-func NewHostMap(logger *zap.Logger) *HostMap {
+func NewHostMap(logger *zap.Logger, preferredRanges []*net.IPNet) *HostMap {
 	h := map[string]*HostInfo{}
 	m := HostMap{
-		Hosts:  h,
-		logger: logger,
+		Hosts:           h,
+		logger:          logger,
+		preferredRanges: preferredRanges,
 	}
 
 	return &m
@@ -29,6 +30,11 @@ type HostMap struct {
 	metricsEnabled  bool
 }
 
+// GetPreferredRanges 返回首选网段，用于对远端地址排序
+func (hm *HostMap) GetPreferredRanges() []*net.IPNet {
+	return hm.preferredRanges
+}
+
 func (hm *HostMap) GetHost(name string) *HostInfo {
 	hm.RLock()
 	h, ok := hm.Hosts[name]
@@ -45,8 +51,17 @@ func (hm *HostMap) AddHost(hostInfo *HostInfo) {
 	hm.Hosts[hostInfo.Name] = hostInfo
 }
 
+func (hm *HostMap) DeleteHost(name string) {
+	hm.Lock()
+	defer hm.Unlock()
+	delete(hm.Hosts, name)
+}
+
 type HostInfo struct {
-	Remote  *udp.Addr
+	// remoteLock 保护 remote，多个读取 goroutine 会并发更新同一主机学习到的地址
+	remoteLock sync.RWMutex
+	remote     *udp.Addr
+
 	Remotes *RemoteList
 	//RemoteIndexId uint32
 	//LocalIndexId  uint32
@@ -69,25 +84,42 @@ type HostInfo struct {
 }
 
 func (h *HostInfo) SetRemote(remote *udp.Addr) {
+	h.remoteLock.Lock()
+	defer h.remoteLock.Unlock()
 	// 我们在这里复制是因为我们很可能从一个重用对象的源获取了这个 remote
 	// 如果当前的 Remote 与传入的 remote 不相等，我们进行更新
-	if !h.Remote.Equals(remote) {
-		h.Remote = remote.Copy()
+	if !h.remote.Equals(remote) {
+		h.remote = remote.Copy()
 		h.Remotes.LearnRemote(h.Name, remote.Copy())
 	}
 }
 
+// GetRemote 返回最近一次学习到的地址，返回值不能被修改
+func (h *HostInfo) GetRemote() *udp.Addr {
+	h.remoteLock.RLock()
+	defer h.remoteLock.RUnlock()
+	return h.remote
+}
+
 func (h *HostInfo) String() string {
-	marshal, err := json.Marshal(h)
+	marshal, err := json.Marshal(struct {
+		Remote  *udp.Addr
+		Remotes *RemoteList
+		Name    string
+	}{h.GetRemote(), h.Remotes, h.Name})
 	if err != nil {
 		return ""
 	}
 	return string(marshal)
 }
 
-func NewRemoteList() *RemoteList {
+// NewRemoteList 创建一个 RemoteList，allowList 用于过滤学习到和上报的地址，为 nil 时允许所有地址，
+// family 决定 v4 和 v6 地址的取舍和先后顺序
+func NewRemoteList(allowList *AllowList, family FamilyPolicy) *RemoteList {
 	return &RemoteList{
-		addrs: make([]*udp.Addr, 0),
-		cache: make(map[string]*Cache),
+		addrs:     make([]*udp.Addr, 0),
+		cache:     make(map[string]*Cache),
+		allowList: allowList,
+		family:    family,
 	}
 }
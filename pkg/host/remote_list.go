@@ -2,10 +2,10 @@ package host
 
 import (
 	"encoding/binary"
-	"fmt"
 	"github.com/cossteam/punchline/api/v1"
 	"github.com/cossteam/punchline/pkg/transport/udp"
 	"net"
+	"sort"
 	"sync"
 )
 
@@ -15,9 +15,9 @@ const (
 
 // Cache is an internal struct that splits v4 and v6 addresses inside the cache map
 type Cache struct {
-	v4 *CacheV4
-	v6 *CacheV6
-	//relay *CacheRelay
+	v4    *CacheV4
+	v6    *CacheV6
+	relay *CacheRelay
 }
 
 func (c *Cache) GetV4() *CacheV4 {
@@ -28,9 +28,9 @@ func (c *Cache) GetV46() *CacheV6 {
 	return c.v6
 }
 
-//func (c *Cache) GetRelay() *CacheRelay {
-//	return c.relay
-//}
+func (c *Cache) GetRelay() *CacheRelay {
+	return c.relay
+}
 
 type CacheV4 struct {
 	learned  *api.Ipv4Addr
@@ -58,14 +58,20 @@ func (c *CacheV6) Reported() []*api.Ipv6Addr {
 	return c.reported
 }
 
+// CacheRelay 记录可用于到达拥有者的中继地址
 type CacheRelay struct {
-	relay []uint32
+	relay  []*api.Ipv4Addr
+	relay6 []*api.Ipv6Addr
 }
 
-func (c *CacheRelay) Relay() []uint32 {
+func (c *CacheRelay) Relay() []*api.Ipv4Addr {
 	return c.relay
 }
 
+func (c *CacheRelay) Relay6() []*api.Ipv6Addr {
+	return c.relay6
+}
+
 // RemoteList is a unifying concept for lighthouse servers and clients as well as hostinfos.
 // It serves as a local cache of query replies, host update notifications, and locally learned addresses
 type RemoteList struct {
@@ -75,6 +81,9 @@ type RemoteList struct {
 	// A deduplicated set of addresses. Any accessor should lock beforehand.
 	addrs []*udp.Addr
 
+	// A deduplicated set of relay addresses. Any accessor should lock beforehand.
+	relays []*udp.Addr
+
 	// These are maps to store v4 and v6 addresses per lighthouse
 	// Map key is the vpnIp of the person that told us about this the cached entries underneath.
 	// For learned addresses, this is the vpnIp that sent the packet
@@ -84,6 +93,15 @@ type RemoteList struct {
 	// They should not be tried again during a handshake
 	badRemotes []*udp.Addr
 
+	// allowList 用于过滤学习到和上报的地址，为 nil 时允许所有地址
+	allowList *AllowList
+
+	// family 决定 v4 和 v6 地址的取舍和先后顺序
+	family FamilyPolicy
+
+	// addrs 中前 learnedLen 个地址是学习到的地址
+	learnedLen int
+
 	// A flag that the cache may have changed and addrs needs to be rebuilt
 	shouldRebuild bool
 }
@@ -99,12 +117,13 @@ func (r *RemoteList) GetCache(name string) *Cache {
 }
 
 // CopyAddrs locks and makes a deep copy of the deduplicated address list
-func (r *RemoteList) CopyAddrs() []*udp.Addr {
+// The deduplication work may need to occur here, so you must pass preferredRanges
+func (r *RemoteList) CopyAddrs(preferredRanges []*net.IPNet) []*udp.Addr {
 	if r == nil {
 		return nil
 	}
 
-	r.Rebuild()
+	r.Rebuild(preferredRanges)
 
 	r.RLock()
 	defer r.RUnlock()
@@ -126,11 +145,13 @@ func (r *RemoteList) ForEach(forEach func(addr *udp.Addr)) {
 // LearnRemote 锁定并设置拥有者 VPN IP 的已学习地址槽位为提供的 addr。
 // 目前仅在调用 HostInfo.SetRemote 时需要使用，因为该方法应涵盖握手和漫游两种情况。
 // 它将标记去重后的地址列表为脏状态，因此仅在有新信息可用时调用它。
-// TODO: 需要支持允许列表
+// 不在允许列表中的地址会被忽略。
 func (r *RemoteList) LearnRemote(name string, addr *udp.Addr) {
-	fmt.Println("LearnRemote")
 	r.Lock()
 	defer r.Unlock()
+	if !r.allowList.Allow(addr.IP) {
+		return
+	}
 	if v4 := addr.IP.To4(); v4 != nil {
 		r.unlockedSetLearnedV4(name, api.NewIpv4Addr(v4, uint32(addr.Port)))
 	} else {
@@ -178,14 +199,51 @@ func (r *RemoteList) unlockedGetOrMakeV6(name string) *CacheV6 {
 	return am.v6
 }
 
+// BlockRemote 锁定并将 bad 加入阻止的远程列表，例如多次打洞失败的地址，它将不再出现在地址列表中
+func (r *RemoteList) BlockRemote(bad *udp.Addr) {
+	if bad == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	// 避免重复添加
+	if r.unlockedIsBad(bad) {
+		return
+	}
+
+	r.badRemotes = append(r.badRemotes, bad.Copy())
+
+	// 标记为脏，以便下次访问地址列表时将其过滤掉
+	r.shouldRebuild = true
+}
+
+// CopyBlockedRemotes 锁定并返回阻止的远程列表的副本
+func (r *RemoteList) CopyBlockedRemotes() []*udp.Addr {
+	r.RLock()
+	defer r.RUnlock()
+
+	c := make([]*udp.Addr, len(r.badRemotes))
+	for i, v := range r.badRemotes {
+		c[i] = v.Copy()
+	}
+	return c
+}
+
 // ResetBlockedRemotes 锁定并清除阻止的远程列表
 func (r *RemoteList) ResetBlockedRemotes() {
 	r.Lock()
 	r.badRemotes = nil
+	r.shouldRebuild = true
 	r.Unlock()
 }
 
 func (r *RemoteList) UnlockedPrependV4(name string, to *api.Ipv4Addr) {
+	if !r.unlockedShouldAddV4(to) {
+		return
+	}
+
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV4(name)
 
@@ -197,6 +255,10 @@ func (r *RemoteList) UnlockedPrependV4(name string, to *api.Ipv4Addr) {
 }
 
 func (r *RemoteList) UnlockedPrependV6(name string, to *api.Ipv6Addr) {
+	if !r.unlockedShouldAddV6(to) {
+		return
+	}
+
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV6(name)
 
@@ -207,65 +269,132 @@ func (r *RemoteList) UnlockedPrependV6(name string, to *api.Ipv6Addr) {
 	}
 }
 
-func (r *RemoteList) Rebuild() {
+// Rebuild 锁定并在缓存更改后重新生成去重且按优先级排序的地址列表，
+// 优先级依次为：学习到的地址 > 上报的公网地址 > 上报的首选网段内的私有地址 > 其他地址
+func (r *RemoteList) Rebuild(preferredRanges []*net.IPNet) {
 	r.Lock()
 	defer r.Unlock()
 
 	// 仅在缓存更改时重建
-	// TODO:shouldRebuild可能毫无意义，因为当灯塔更新到来时，我们不会检查实际的变化
 	if r.shouldRebuild {
 		r.unlockedCollect()
 		r.shouldRebuild = false
 	}
+
+	// 首选网段可能发生变化，所以每次都重新排序
+	r.unlockedSort(preferredRanges)
+}
+
+// unlockedSort 假设您具有写锁定，学习到的地址始终位于列表前面，
+// 上报的地址按 addrRank 排序，同一优先级内按地址族策略和地址本身排序，保证结果稳定
+func (r *RemoteList) unlockedSort(preferredRanges []*net.IPNet) {
+	learned := r.addrs[:r.learnedLen]
+	sort.Slice(learned, func(i, j int) bool {
+		return r.family.less(learned[i], learned[j])
+	})
+
+	reported := r.addrs[r.learnedLen:]
+	sort.Slice(reported, func(i, j int) bool {
+		ri, rj := rankAddr(reported[i].IP, preferredRanges), rankAddr(reported[j].IP, preferredRanges)
+		if ri != rj {
+			return ri < rj
+		}
+		return r.family.less(reported[i], reported[j])
+	})
+}
+
+// addrRank 上报地址的优先级，值越小越优先
+type addrRank int
+
+const (
+	addrRankPublic addrRank = iota
+	addrRankPreferred
+	addrRankOther
+)
+
+// cgnatRange RFC 6598 运营商级 NAT 的共享地址空间，与私有地址一样在其他网络中不可达
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+func rankAddr(ip net.IP, preferredRanges []*net.IPNet) addrRank {
+	if ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnatRange.Contains(ip) {
+		return addrRankPublic
+	}
+	if isPreferred(ip, preferredRanges) {
+		return addrRankPreferred
+	}
+	return addrRankOther
+}
+
+func isPreferred(ip net.IP, preferredRanges []*net.IPNet) bool {
+	for _, p := range preferredRanges {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
+// unlockedCollect 假设您具有写锁定，从缓存中收集学习到的和上报的地址并去重，
+// 学习到的地址放在前面，learnedLen 记录其数量
 func (r *RemoteList) unlockedCollect() {
 	addrs := r.addrs[:0]
-	//relays := r.relays[:0]
+	relays := r.relays[:0]
+	seen := make(map[string]struct{})
+
+	add := func(u *udp.Addr) {
+		if r.unlockedIsBad(u) || !r.family.allow(u.IP) {
+			return
+		}
+		key := u.String()
+		if _, ok := seen[key]; ok {
+			return
+		}
+		seen[key] = struct{}{}
+		addrs = append(addrs, u)
+	}
 
 	for _, c := range r.cache {
-		if c.v4 != nil {
-			if c.v4.learned != nil {
-				u := NewUDPAddrFromLH4(c.v4.learned)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
-			}
+		if c.v4 != nil && c.v4.learned != nil {
+			add(NewUDPAddrFromLH4(c.v4.learned))
+		}
+		if c.v6 != nil && c.v6.learned != nil {
+			add(NewUDPAddrFromLH6(c.v6.learned))
+		}
+	}
+
+	r.learnedLen = len(addrs)
 
+	for _, c := range r.cache {
+		if c.v4 != nil {
 			for _, v := range c.v4.reported {
-				u := NewUDPAddrFromLH4(v)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
+				add(NewUDPAddrFromLH4(v))
 			}
 		}
 
 		if c.v6 != nil {
-			if c.v6.learned != nil {
-				u := NewUDPAddrFromLH6(c.v6.learned)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
-				}
+			for _, v := range c.v6.reported {
+				add(NewUDPAddrFromLH6(v))
 			}
+		}
 
-			for _, v := range c.v6.reported {
+		if c.relay != nil {
+			for _, v := range c.relay.relay {
+				u := NewUDPAddrFromLH4(v)
+				if !containsAddr(relays, u) {
+					relays = append(relays, u)
+				}
+			}
+			for _, v := range c.relay.relay6 {
 				u := NewUDPAddrFromLH6(v)
-				if !r.unlockedIsBad(u) {
-					addrs = append(addrs, u)
+				if !containsAddr(relays, u) {
+					relays = append(relays, u)
 				}
 			}
 		}
-
-		//if c.relay != nil {
-		//	for _, v := range c.relay.relay {
-		//		ip := api.VpnIp(v)
-		//		relays = append(relays, &ip)
-		//	}
-		//}
 	}
 
 	r.addrs = addrs
-	//r.relays = relays
+	r.relays = relays
 }
 
 func NewUDPAddrFromLH4(ipp *api.Ipv4Addr) *udp.Addr {
@@ -304,8 +433,13 @@ func (r *RemoteList) UnlockedSetV4(name string, to []*api.Ipv4Addr) {
 	c.reported = c.reported[:0]
 
 	// We can't take their array but we can take their pointers
-	for _, v := range to[:minInt(len(to), MaxRemotes)] {
-		c.reported = append(c.reported, v)
+	for _, v := range to {
+		if len(c.reported) >= MaxRemotes {
+			break
+		}
+		if r.unlockedShouldAddV4(v) {
+			c.reported = append(c.reported, v)
+		}
 	}
 }
 
@@ -317,34 +451,78 @@ func (r *RemoteList) UnlockedSetV6(name string, to []*api.Ipv6Addr) {
 	c.reported = c.reported[:0]
 
 	// We can't take their array but we can take their pointers
-	for _, v := range to[:minInt(len(to), MaxRemotes)] {
-		c.reported = append(c.reported, v)
-	}
-}
-
-//func (r *RemoteList) unlockedGetOrMakeRelay(name string) *CacheRelay {
-//	am := r.cache[name]
-//	if am == nil {
-//		am = &Cache{}
-//		r.cache[name] = am
-//	}
-//	// Avoid occupying memory for relay if we never have any
-//	if am.relay == nil {
-//		am.relay = &CacheRelay{}
-//	}
-//	return am.relay
-//}
-
-//func (r *RemoteList) UnlockedSetRelay(ownerVpnIp api.VpnIp, vpnIp api.VpnIp, to []uint32) {
-//	r.shouldRebuild = true
-//	c := r.unlockedGetOrMakeRelay(ownerVpnIp)
-//
-//	// Reset the slice
-//	c.relay = c.relay[:0]
-//
-//	// We can't take their array but we can take their pointers
-//	c.relay = append(c.relay, to[:minInt(len(to), MaxRemotes)]...)
-//}
+	for _, v := range to {
+		if len(c.reported) >= MaxRemotes {
+			break
+		}
+		if r.unlockedShouldAddV6(v) {
+			c.reported = append(c.reported, v)
+		}
+	}
+}
+
+// unlockedShouldAddV4 检查上报的 v4 地址是否在允许列表中
+func (r *RemoteList) unlockedShouldAddV4(to *api.Ipv4Addr) bool {
+	return to != nil && r.allowList.Allow(NewUDPAddrFromLH4(to).IP)
+}
+
+// unlockedShouldAddV6 检查上报的 v6 地址是否在允许列表中
+func (r *RemoteList) unlockedShouldAddV6(to *api.Ipv6Addr) bool {
+	return to != nil && r.allowList.Allow(lhIp6ToIp(to))
+}
+
+func (r *RemoteList) unlockedGetOrMakeRelay(name string) *CacheRelay {
+	am := r.cache[name]
+	if am == nil {
+		am = &Cache{}
+		r.cache[name] = am
+	}
+	// Avoid occupying memory for relay if we never have any
+	if am.relay == nil {
+		am.relay = &CacheRelay{}
+	}
+	return am.relay
+}
+
+// UnlockedSetRelay 假设您具有写锁定，并将 name 的中继地址设置为 to 和 to6，两者都为空时清除中继地址
+func (r *RemoteList) UnlockedSetRelay(name string, to []*api.Ipv4Addr, to6 []*api.Ipv6Addr) {
+	r.shouldRebuild = true
+	c := r.unlockedGetOrMakeRelay(name)
+
+	// Reset the slice
+	c.relay = c.relay[:0]
+	c.relay6 = c.relay6[:0]
+
+	// We can't take their array but we can take their pointers
+	c.relay = append(c.relay, to[:minInt(len(to), MaxRemotes)]...)
+	c.relay6 = append(c.relay6, to6[:minInt(len(to6), MaxRemotes)]...)
+}
+
+// CopyRelays locks and makes a deep copy of the deduplicated relay address list
+func (r *RemoteList) CopyRelays() []*udp.Addr {
+	if r == nil {
+		return nil
+	}
+
+	r.Rebuild(nil)
+
+	r.RLock()
+	defer r.RUnlock()
+	c := make([]*udp.Addr, len(r.relays))
+	for i, v := range r.relays {
+		c[i] = v.Copy()
+	}
+	return c
+}
+
+func containsAddr(addrs []*udp.Addr, addr *udp.Addr) bool {
+	for _, v := range addrs {
+		if v.Equals(addr) {
+			return true
+		}
+	}
+	return false
+}
 
 // minInt returns the minimum integer of a or b
 func minInt(a, b int) int {
@@ -0,0 +1,175 @@
+package host
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowList(t *testing.T) {
+	al, err := NewAllowList(map[string]bool{
+		"172.17.0.0/16": false,
+		"100.64.0.0/10": false,
+	})
+	assert.NoError(t, err)
+
+	assert.False(t, al.Allow(net.ParseIP("172.17.0.2")))
+	assert.False(t, al.Allow(net.ParseIP("100.100.1.1")))
+	assert.True(t, al.Allow(net.ParseIP("192.168.1.1")))
+	assert.True(t, al.Allow(net.ParseIP("2001:db8::1")))
+
+	al, err = NewAllowList(map[string]bool{
+		"10.0.0.0/8":  true,
+		"10.1.0.0/16": false,
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, al.Allow(net.ParseIP("10.2.0.1")))
+	assert.False(t, al.Allow(net.ParseIP("10.1.0.1")))
+	assert.False(t, al.Allow(net.ParseIP("192.168.1.1")))
+	// 没有 v6 允许规则，v6 默认允许
+	assert.True(t, al.Allow(net.ParseIP("2001:db8::1")))
+
+	var nilList *AllowList
+	assert.True(t, nilList.Allow(net.ParseIP("172.17.0.2")))
+
+	_, err = NewAllowList(map[string]bool{"not-a-cidr": true})
+	assert.Error(t, err)
+}
+
+func TestRemoteList_AllowList(t *testing.T) {
+	al, err := NewAllowList(map[string]bool{"172.17.0.0/16": false})
+	assert.NoError(t, err)
+
+	r := NewRemoteList(al, FamilyPolicyNone)
+	r.Lock()
+	r.UnlockedSetV4("h1", []*api.Ipv4Addr{
+		api.NewIpv4Addr(net.ParseIP("172.17.0.2"), 4242),
+		api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 4242),
+	})
+	r.Unlock()
+	r.LearnRemote("h1", udp.NewAddr(net.ParseIP("172.17.0.3"), 4242))
+
+	addrs := r.CopyAddrs(nil)
+	assert.Len(t, addrs, 1)
+	assert.Equal(t, "1.2.3.4:4242", addrs[0].String())
+}
+
+func TestRemoteList_BlockRemote(t *testing.T) {
+	r := NewRemoteList(nil, FamilyPolicyNone)
+	r.Lock()
+	r.UnlockedSetV4("h1", []*api.Ipv4Addr{
+		api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 4242),
+		api.NewIpv4Addr(net.ParseIP("5.6.7.8"), 4242),
+	})
+	r.Unlock()
+	assert.Len(t, r.CopyAddrs(nil), 2)
+
+	bad := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	r.BlockRemote(bad)
+	r.BlockRemote(bad)
+	assert.Len(t, r.CopyBlockedRemotes(), 1)
+
+	addrs := r.CopyAddrs(nil)
+	assert.Len(t, addrs, 1)
+	assert.Equal(t, "5.6.7.8:4242", addrs[0].String())
+
+	r.ResetBlockedRemotes()
+	assert.Len(t, r.CopyAddrs(nil), 2)
+}
+
+func TestRemoteList_PreferredRanges(t *testing.T) {
+	preferred, err := ParsePreferredRanges([]string{"192.168.0.0/16"})
+	assert.NoError(t, err)
+
+	r := NewRemoteList(nil, FamilyPolicyNone)
+	r.Lock()
+	r.UnlockedSetV4("h1", []*api.Ipv4Addr{
+		api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 4242),
+		api.NewIpv4Addr(net.ParseIP("192.168.1.10"), 4242),
+	})
+	r.UnlockedSetV4("h2", []*api.Ipv4Addr{
+		api.NewIpv4Addr(net.ParseIP("10.0.0.1"), 4242),
+		// CGNAT 共享地址与私有地址同级
+		api.NewIpv4Addr(net.ParseIP("100.64.0.1"), 4242),
+	})
+	r.Unlock()
+
+	addrs := r.CopyAddrs(preferred)
+	assert.Equal(t, []string{"1.2.3.4:4242", "192.168.1.10:4242", "10.0.0.1:4242", "100.64.0.1:4242"}, addrStrings(addrs))
+
+	// 没有首选网段时私有地址按地址排序
+	addrs = r.CopyAddrs(nil)
+	assert.Equal(t, []string{"1.2.3.4:4242", "10.0.0.1:4242", "100.64.0.1:4242", "192.168.1.10:4242"}, addrStrings(addrs))
+}
+
+func TestRemoteList_Rebuild(t *testing.T) {
+	r := NewRemoteList(nil, FamilyPolicyPreferV6)
+	r.Lock()
+	r.UnlockedSetV4("h1", []*api.Ipv4Addr{
+		api.NewIpv4Addr(net.ParseIP("5.6.7.8"), 4242),
+		api.NewIpv4Addr(net.ParseIP("1.2.3.4"), 4242),
+		api.NewIpv4Addr(net.ParseIP("5.6.7.8"), 4242),
+		api.NewIpv4Addr(net.ParseIP("192.168.1.10"), 4242),
+	})
+	r.UnlockedSetV6("h1", []*api.Ipv6Addr{
+		api.NewIpv6Addr(net.ParseIP("2001:db8::1"), 4242),
+	})
+	r.Unlock()
+	r.LearnRemote("h1", udp.NewAddr(net.ParseIP("5.6.7.8"), 4242))
+
+	expected := []string{"5.6.7.8:4242", "[2001:db8::1]:4242", "1.2.3.4:4242", "192.168.1.10:4242"}
+	for i := 0; i < 10; i++ {
+		r.shouldRebuild = true
+		assert.Equal(t, expected, addrStrings(r.CopyAddrs(nil)))
+	}
+
+	r = NewRemoteList(nil, FamilyPolicyV4Only)
+	r.Lock()
+	r.UnlockedSetV6("h1", []*api.Ipv6Addr{
+		api.NewIpv6Addr(net.ParseIP("2001:db8::1"), 4242),
+	})
+	r.Unlock()
+	assert.Empty(t, r.CopyAddrs(nil))
+
+	// 中继地址包括两种地址族，清除后为空
+	r.Lock()
+	r.UnlockedSetRelay("h1", []*api.Ipv4Addr{api.NewIpv4Addr(net.ParseIP("5.6.7.8"), 4000)},
+		[]*api.Ipv6Addr{api.NewIpv6Addr(net.ParseIP("2001:db8::2"), 4000)})
+	r.Unlock()
+	assert.Equal(t, []string{"5.6.7.8:4000", "[2001:db8::2]:4000"}, addrStrings(r.CopyRelays()))
+	r.Lock()
+	r.UnlockedSetRelay("h1", nil, nil)
+	r.Unlock()
+	assert.Empty(t, r.CopyRelays())
+}
+
+func addrStrings(addrs []*udp.Addr) []string {
+	var s []string
+	for _, a := range addrs {
+		s = append(s, a.String())
+	}
+	return s
+}
+
+func TestHostInfo_SetRemote(t *testing.T) {
+	h := &HostInfo{Name: "h1", Remotes: NewRemoteList(nil, FamilyPolicyNone)}
+
+	// 多个读取 goroutine 并发更新同一主机学习到的地址
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h.SetRemote(udp.NewAddr(net.ParseIP("1.2.3.4"), uint16(4242+i%2)))
+			_ = h.GetRemote()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Contains(t, []string{"1.2.3.4:4242", "1.2.3.4:4243"}, h.GetRemote().String())
+}
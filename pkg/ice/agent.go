@@ -6,15 +6,17 @@ import (
 	"fmt"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/cossteam/punchline/api/signaling/v1"
+	plugin "github.com/cossteam/punchline/pkg/plugin/client"
 	"github.com/cossteam/punchline/pkg/signal"
 	"github.com/pion/ice/v2"
-	"github.com/pion/randutil"
 	"github.com/pion/stun"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"math/big"
+	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -35,11 +37,38 @@ type Peer struct {
 	source   string
 	target   string
 	restarts atomic.Uint32
+	// started 是否已经调用过 Dial/Accept，pion Agent 只允许调用一次，重启后的会话改为更新远程凭证
+	started atomic.Bool
 
+	// stateLock 保护 connectionState 和两端的凭证，信令消息、Agent 回调和网络变化在不同的 goroutine 中处理
+	stateLock         sync.Mutex
 	connectionState   ConnectionState
 	agent             *ice.Agent
 	remoteCredentials *signaling.Credentials
 	localCredentials  *signaling.Credentials
+
+	// plugins 接收连接事件的插件，只有实现了 plugin.ICEHandler 的插件会收到事件
+	plugins []plugin.Plugin
+	// udpMux 不为 nil 时所有 UDP 候选者都使用这个共用的端口
+	udpMux ice.UniversalUDPMux
+}
+
+// PeerOption Peer 的可选配置
+type PeerOption func(*Peer)
+
+// WithPlugins 将选中的候选者对变化和连接状态变化通知给插件
+func WithPlugins(plugins []plugin.Plugin) PeerOption {
+	return func(p *Peer) {
+		p.plugins = append(p.plugins, plugins...)
+	}
+}
+
+// WithUDPMux 通过 mux 收发连通性检查和 STUN 请求，主机和服务器反射候选者都使用 mux 的端口，
+// 并且只收集 UDP 候选者，例如与 WireGuard 共用端口时
+func WithUDPMux(mux ice.UniversalUDPMux) PeerOption {
+	return func(p *Peer) {
+		p.udpMux = mux
+	}
 }
 
 // NewICEAgentWrapper 创建并返回一个新的 Peer
@@ -49,12 +78,24 @@ func NewICEAgentWrapper(
 	stunServer []string,
 	source string,
 	target string,
+	opts ...PeerOption,
 ) (*Peer, error) {
 	iceURLs, err := convertToStunURIs(stunServer)
 	if err != nil {
 		return nil, err
 	}
 
+	wrapper := &Peer{
+		logger:          logger,
+		client:          signalingClient,
+		source:          source,
+		target:          target,
+		connectionState: ConnectionStateClosed,
+	}
+	for _, opt := range opts {
+		opt(wrapper)
+	}
+
 	// 创建 ICE 配置
 	iceConfig := ice.AgentConfig{
 		Urls: iceURLs,
@@ -71,6 +112,11 @@ func NewICEAgentWrapper(
 			//ice.CandidateTypeRelay,
 		},
 	}
+	if wrapper.udpMux != nil {
+		iceConfig.NetworkTypes = []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6}
+		iceConfig.UDPMux = wrapper.udpMux
+		iceConfig.UDPMuxSrflx = wrapper.udpMux
+	}
 
 	agent, err := ice.NewAgent(&iceConfig)
 	if err != nil {
@@ -82,19 +128,11 @@ func NewICEAgentWrapper(
 		return nil, fmt.Errorf("failed to get local user credentials: %v", err)
 	}
 
-	wrapper := &Peer{
-		logger: logger,
-		client: signalingClient,
-		source: source,
-		target: target,
-
-		agent:           agent,
-		connectionState: ConnectionStateClosed,
-		localCredentials: &signaling.Credentials{
-			Ufrag:     localUfrag,
-			Pwd:       localPwd,
-			NeedCreds: false,
-		},
+	wrapper.agent = agent
+	wrapper.localCredentials = &signaling.Credentials{
+		Ufrag:     localUfrag,
+		Pwd:       localPwd,
+		NeedCreds: false,
 	}
 
 	return wrapper, nil
@@ -111,14 +149,18 @@ func (p *Peer) Start(ctx context.Context) error {
 		close(serverShutdown)
 	}()
 
+	p.stateLock.Lock()
 	if p.connectionState != ConnectionStateClosed {
+		p.stateLock.Unlock()
 		return errCreateNonClosedAgent
-	} else {
-		p.connectionState = ConnectionStateCreating
 	}
+	p.connectionState = ConnectionStateCreating
+	p.stateLock.Unlock()
 
 	// Reset state to ConnectionStateCreating if there is an error later
 	defer func() {
+		p.stateLock.Lock()
+		defer p.stateLock.Unlock()
 		if p.connectionState == ConnectionStateCreating {
 			p.connectionState = ConnectionStateClosed
 		}
@@ -143,13 +185,13 @@ func (p *Peer) Start(ctx context.Context) error {
 		return err
 	}
 
-	currentState := p.connectionState
-
-	if currentState == ConnectionStateCreating {
-		p.connectionState = ConnectionStateIdle
-	} else {
+	p.stateLock.Lock()
+	if p.connectionState != ConnectionStateCreating {
+		p.stateLock.Unlock()
 		return errSwitchToIdle
 	}
+	p.connectionState = ConnectionStateIdle
+	p.stateLock.Unlock()
 
 	// Send peer credentials as long as we remain in ConnectionStateIdle
 	go p.sendCredentialsWhileIdleWithBackoff(true)
@@ -169,38 +211,28 @@ func (p *Peer) connect(ufrag, pwd string) {
 		connect = p.agent.Accept
 	}
 
+	if p.started.Swap(true) {
+		// 重启后的会话复用已有的连接，只需要设置新的远程凭证重新开始连通性检查
+		if err := p.agent.SetRemoteCredentials(ufrag, pwd); err != nil {
+			p.logger.Error("Failed to set remote credentials", zap.Error(err))
+		}
+		return
+	}
+
 	conn, err := connect(context.TODO(), ufrag, pwd)
 	if err != nil {
 		p.logger.Error("Failed to connect", zap.Error(err))
 		return
 	}
 
-	// Send messages in a loop to the remote peer
-	go func() {
-		for {
-			time.Sleep(time.Second * 3)
-
-			val, err := randutil.GenerateCryptoRandomString(15, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-			if err != nil {
-				panic(err)
-			}
-			if _, err = conn.Write([]byte(val)); err != nil {
-				panic(err)
-			}
-
-			fmt.Printf("Sent: '%s'\n", val)
-		}
-	}()
-
-	// Receive messages in a loop from the remote peer
+	// 连接只用于确认两端的端点，应用数据 (例如共用端口的 WireGuard) 不经过它，读取并丢弃收到的数据，
+	// 取消订阅或退出时 Agent 被关闭，读取返回错误后结束
 	buf := make([]byte, 1500)
 	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			panic(err)
+		if _, err := conn.Read(buf); err != nil {
+			p.logger.Debug("ICE connection closed", zap.Error(err))
+			return
 		}
-
-		fmt.Printf("Received: '%s'\n", string(buf[:n]))
 	}
 }
 
@@ -215,12 +247,14 @@ func (p *Peer) onLocalCandidate(c ice.Candidate) {
 	}
 
 	logger := p.logger.With(zap.Stringer("candidate", c))
-	logger.Debug("Added local candidate to agent", zap.Stringer("state", p.connectionState))
+	logger.Debug("Added local candidate to agent", zap.Stringer("state", p.state()))
 
 	if err := p.sendCandidate(c); err != nil {
 		logger.Error("Failed to send candidate", zap.Error(err))
 	}
 
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
 	if p.connectionState == ConnectionStateGatheringLocal {
 		p.connectionState = ConnectionStateConnecting
 		go p.connect(p.remoteCredentials.Ufrag, p.remoteCredentials.Pwd)
@@ -230,6 +264,13 @@ func (p *Peer) onLocalCandidate(c ice.Candidate) {
 	}
 }
 
+// state 返回当前的连接状态
+func (p *Peer) state() ConnectionState {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.connectionState
+}
+
 func (p *Peer) sendCandidate(c ice.Candidate) error {
 	msg := &signaling.Message{
 		Candidate: signaling.NewCandidate(c),
@@ -259,18 +300,49 @@ func (p *Peer) onConnectionStateChange(state ice.ConnectionState) {
 
 	switch cs {
 	case ConnectionStateFailed, ConnectionStateDisconnected:
+		p.emit(&plugin.ICEEvent{Type: plugin.ICEDisconnected, Hostname: p.target})
 
 	case ConnectionStateClosed:
 
 	case ConnectionStateConnected:
+		pair, err := p.agent.GetSelectedCandidatePair()
+		if err != nil || pair == nil {
+			p.logger.Debug("Connected without selected candidate pair", zap.Error(err))
+			return
+		}
+		if event := pairEvent(plugin.ICEConnected, p.target, pair.Local, pair.Remote); event != nil {
+			p.emit(event)
+		}
 
 	default:
 	}
 }
 
+// emit 将事件交给所有处理 ICE 事件的插件
+func (p *Peer) emit(event *plugin.ICEEvent) {
+	for _, pl := range p.plugins {
+		if h, ok := pl.(plugin.ICEHandler); ok {
+			h.HandleICE(context.Background(), event)
+		}
+	}
+}
+
+// pairEvent 根据候选者对创建事件，只有 UDP 候选者对才会产生事件
+func pairEvent(typ plugin.ICEEventType, hostname string, local, remote ice.Candidate) *plugin.ICEEvent {
+	if local == nil || remote == nil || !local.NetworkType().IsUDP() || !remote.NetworkType().IsUDP() {
+		return nil
+	}
+	return &plugin.ICEEvent{
+		Type:     typ,
+		Hostname: hostname,
+		Local:    &net.UDPAddr{IP: net.ParseIP(local.Address()), Port: local.Port()},
+		Remote:   &net.UDPAddr{IP: net.ParseIP(remote.Address()), Port: remote.Port()},
+	}
+}
+
 func (p *Peer) handleSignalingMessage(message *signal.Message) error {
 	p.logger.Debug("Received signaling message",
-		zap.Stringer("state", p.connectionState),
+		zap.Stringer("state", p.state()),
 		zap.Any("credentials", message.Credentials),
 		zap.Any("message", message))
 
@@ -288,47 +360,59 @@ func (p *Peer) handleSignalingMessage(message *signal.Message) error {
 // onRemoteCredentials is a handler called for each received pair of remote Ufrag/Pwd via the signaling channel
 func (p *Peer) onRemoteCredentials(creds *signal.Credentials) {
 	logger := p.logger.With(zap.Reflect("creds", creds))
-	logger.Debug("Received remote credentials", zap.Stringer("state", p.connectionState))
+	logger.Debug("Received remote credentials", zap.Stringer("state", p.state()))
 
+	p.stateLock.Lock()
 	if p.isSessionRestart(creds) {
-		if err := p.Restart(); err != nil {
+		// 对端重启了会话，本端同样重启后将新的凭证作为首次收到的凭证处理
+		if err := p.unlockedRestart(); err != nil {
+			p.stateLock.Unlock()
 			p.logger.Error("Failed to restart ICE session", zap.Error(err))
-		}
-	} else {
-		if p.connectionState != ConnectionStateIdle {
-			p.logger.Debug("Ignoring duplicated credentials")
 			return
 		}
-		// 如果当前状态为 ConnectionStateIdle，更新为 ConnectionStateGathering
-		p.connectionState = ConnectionStateGathering
+	}
 
-		//p.SetStateIf(daemon.PeerStateConnecting, daemon.PeerStateClosed, daemon.PeerStateFailed, daemon.PeerStateNew)
+	if p.connectionState != ConnectionStateIdle && p.connectionState != ConnectionStateRestarting {
+		p.stateLock.Unlock()
+		p.logger.Debug("Ignoring duplicated credentials")
+		return
+	}
+	// 如果当前状态为 ConnectionStateIdle 或 ConnectionStateRestarting，更新为 ConnectionStateGathering
+	p.connectionState = ConnectionStateGathering
 
-		p.remoteCredentials = creds
+	//p.SetStateIf(daemon.PeerStateConnecting, daemon.PeerStateClosed, daemon.PeerStateFailed, daemon.PeerStateNew)
 
-		// Return our own credentials if requested
-		if creds.NeedCreds {
-			if err := p.sendCredentials(false); err != nil {
-				p.logger.Error("Failed to send credentials", zap.Error(err))
-				return
-			}
-		}
+	p.remoteCredentials = creds
+	p.stateLock.Unlock()
 
-		// Start gathering candidates
-		if err := p.agent.GatherCandidates(); err != nil {
-			p.logger.Error("failed to gather candidates", zap.Error(err))
+	// Return our own credentials if requested
+	if creds.NeedCreds {
+		if err := p.sendCredentials(false); err != nil {
+			p.logger.Error("Failed to send credentials", zap.Error(err))
 			return
 		}
 	}
+
+	// Start gathering candidates
+	if err := p.agent.GatherCandidates(); err != nil {
+		p.logger.Error("failed to gather candidates", zap.Error(err))
+		return
+	}
 }
 
 func (p *Peer) sendCredentials(need bool) error {
-	p.localCredentials.NeedCreds = need
+	p.stateLock.Lock()
+	creds := &signaling.Credentials{
+		Ufrag:     p.localCredentials.Ufrag,
+		Pwd:       p.localCredentials.Pwd,
+		NeedCreds: need,
+	}
+	p.stateLock.Unlock()
 
 	msg := &signaling.Message{
 		Topic: p.source,
 
-		Credentials: p.localCredentials,
+		Credentials: creds,
 	}
 
 	// TODO: Is this timeout suitable?
@@ -349,8 +433,16 @@ func (p *Peer) sendCredentials(need bool) error {
 	return nil
 }
 
-// Restart the ICE agent by creating a new one
+// Restart 使用新的本地凭证重启 ICE 会话，清除已有的候选者和远程凭证，
+// 会话保持 ConnectionStateRestarting 直到收到对端的新凭证
 func (p *Peer) Restart() error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.unlockedRestart()
+}
+
+// unlockedRestart 假设您持有 stateLock
+func (p *Peer) unlockedRestart() error {
 	if p.connectionState == ConnectionStateClosed || p.connectionState == ConnectionStateClosing || p.connectionState == ConnectionStateRestarting {
 		return fmt.Errorf("%w: %s", errInvalidConnectionStateForRestart, strings.ToLower(p.connectionState.String()))
 	}
@@ -358,20 +450,51 @@ func (p *Peer) Restart() error {
 	p.connectionState = ConnectionStateRestarting
 	p.logger.Debug("Restarting ICE session")
 
-	if err := p.agent.Close(); err != nil {
-		return fmt.Errorf("failed to close agent: %w", err)
+	if err := p.agent.Restart("", ""); err != nil {
+		return fmt.Errorf("failed to restart agent: %w", err)
 	}
 
-	// The new agent will be recreated in the onConnectionStateChange() handler
-	// once the old agent has been properly closed
+	ufrag, pwd, err := p.agent.GetLocalUserCredentials()
+	if err != nil {
+		return fmt.Errorf("failed to get local user credentials: %w", err)
+	}
+	p.localCredentials = &signaling.Credentials{
+		Ufrag: ufrag,
+		Pwd:   pwd,
+	}
+	p.remoteCredentials = nil
 
 	p.restarts.Add(1)
 
 	return nil
 }
 
+// OnNetworkChange 在本地网络变化时重启已经开始建立或已经建立的会话，
+// 并持续向对端发送新的凭证直到对端响应，尚未收到对端凭证的会话不受影响
+// OnNetworkChange 在网络监视器的 goroutine 中调用，与信令消息和 Agent 回调通过 stateLock 互斥
+func (p *Peer) OnNetworkChange() {
+	p.stateLock.Lock()
+	switch p.connectionState {
+	case ConnectionStateClosed, ConnectionStateClosing, ConnectionStateCreating,
+		ConnectionStateIdle, ConnectionStateRestarting:
+		p.stateLock.Unlock()
+		return
+	}
+
+	p.logger.Info("Restarting ICE session after network change")
+	err := p.unlockedRestart()
+	p.stateLock.Unlock()
+	if err != nil {
+		p.logger.Error("Failed to restart ICE session", zap.Error(err))
+		return
+	}
+
+	go p.sendCredentialsWhileIdleWithBackoff(true)
+}
+
 // isSessionRestart checks if a received offer should restart the
 // ICE session by comparing ufrag & pwd with previously used values.
+// 假设您持有 stateLock
 func (p *Peer) isSessionRestart(c *signal.Credentials) bool {
 	r := p.remoteCredentials
 	return (r != nil) &&
@@ -408,8 +531,10 @@ func (p *Peer) onRemoteCandidate(c *signal.Candidate) {
 		return
 	}
 
-	logger.Debug("Added remote candidate to agent", zap.Stringer("state", p.connectionState))
+	logger.Debug("Added remote candidate to agent", zap.Stringer("state", p.state()))
 
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
 	if p.connectionState == ConnectionStateGatheringRemote {
 		p.connectionState = ConnectionStateConnecting
 		go p.connect(p.remoteCredentials.Ufrag, p.remoteCredentials.Pwd)
@@ -423,6 +548,10 @@ func (p *Peer) onSelectedCandidatePairChange(local ice.Candidate, remote ice.Can
 		zap.Any("local", local),
 		zap.Any("remote", remote),
 	)
+
+	if event := pairEvent(plugin.ICESelectedPairChanged, p.target, local, remote); event != nil {
+		p.emit(event)
+	}
 }
 
 func (p *Peer) sendCredentialsWhileIdleWithBackoff(need bool) {
@@ -431,7 +560,7 @@ func (p *Peer) sendCredentialsWhileIdleWithBackoff(need bool) {
 
 	if err := backoff.RetryNotify(
 		func() error {
-			if p.connectionState != ConnectionStateIdle {
+			if state := p.state(); state != ConnectionStateIdle && state != ConnectionStateRestarting {
 				// We are not idling any more.
 				// No need to send credentials
 				return nil
@@ -2,6 +2,8 @@ package ice
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -132,3 +134,55 @@ func TestPeer_Restart(t *testing.T) {
 	assert.NoError(t, err, "重新启动 ICE 会话时不应该出现错误")
 	assert.Equal(t, ConnectionStateRestarting, peer.connectionState, "重新启动后状态应该是 ConnectionStateRestarting")
 }
+
+func TestPeer_OnNetworkChange(t *testing.T) {
+	logger := zap.NewNop()
+	client := new(MockSignalingClient)
+	client.On("Publish", mock.Anything, mock.Anything).Return(nil)
+
+	peer, _ := NewICEAgentWrapper(logger, client, []string{"stun:stun.l.google.com:19302"}, "source-peer", "target-peer")
+	defer peer.Close()
+
+	// 尚未收到对端凭证的会话不会重启
+	peer.connectionState = ConnectionStateIdle
+	peer.OnNetworkChange()
+	assert.Equal(t, uint32(0), peer.restarts.Load())
+
+	old := peer.localCredentials
+	peer.connectionState = ConnectionStateConnected
+	peer.remoteCredentials = &signal.Credentials{Ufrag: "remoteUfrag", Pwd: "remotePwd"}
+	peer.OnNetworkChange()
+	assert.Equal(t, uint32(1), peer.restarts.Load())
+	assert.Equal(t, ConnectionStateRestarting, peer.connectionState)
+	assert.Nil(t, peer.remoteCredentials)
+	assert.NotEqual(t, old.Ufrag, peer.localCredentials.Ufrag, "重启后应该使用新的本地凭证")
+}
+
+func TestPeer_OnNetworkChangeConcurrent(t *testing.T) {
+	logger := zap.NewNop()
+	client := new(MockSignalingClient)
+	client.On("Publish", mock.Anything, mock.Anything).Return(nil)
+
+	peer, _ := NewICEAgentWrapper(logger, client, nil, "source-peer", "target-peer")
+	defer peer.Close()
+	peer.connectionState = ConnectionStateConnected
+	peer.remoteCredentials = &signal.Credentials{Ufrag: "remoteUfrag", Pwd: "remotePwd"}
+
+	// 网络变化与信令消息在不同的 goroutine 中处理，使用 -race 运行时不应该报告数据竞争
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			peer.OnNetworkChange()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_ = peer.handleSignalingMessage(&signal.Message{
+				Credentials: &signal.Credentials{Ufrag: fmt.Sprintf("ufrag%d", i), Pwd: "pwd"},
+			})
+		}(i)
+	}
+	wg.Wait()
+	assert.NotEqual(t, ConnectionStateConnected, peer.state())
+}
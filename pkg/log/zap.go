@@ -7,10 +7,16 @@ import (
 )
 
 func SetupLogger(logLevel string) (*zap.Logger, error) {
+	logger, _, err := NewLogger(logLevel)
+	return logger, err
+}
+
+// NewLogger 创建日志记录器，同时返回可以在运行时修改日志级别的 AtomicLevel
+func NewLogger(logLevel string) (*zap.Logger, zap.AtomicLevel, error) {
 	// 解析日志级别
 	var zapLevel zapcore.Level
 	if err := zapLevel.UnmarshalText([]byte(logLevel)); err != nil {
-		return nil, err
+		return nil, zap.AtomicLevel{}, err
 	}
 
 	atomicLevel := zap.NewAtomicLevel()
@@ -34,5 +40,5 @@ func SetupLogger(logLevel string) (*zap.Logger, error) {
 
 	logger := zap.New(core, zap.AddCaller(), zap.Development())
 
-	return logger, nil
+	return logger, atomicLevel, nil
 }
@@ -0,0 +1,217 @@
+package netmon
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cossteam/punchline/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDebounce     = 500 * time.Millisecond
+	defaultPollInterval = 10 * time.Second
+)
+
+// 用于查询默认路由源地址的公网地址，不会发送任何数据
+var (
+	routeProbe4 = &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 9}
+	routeProbe6 = &net.UDPAddr{IP: net.ParseIP("2001:4860:4860::8888"), Port: 9}
+)
+
+// Option Monitor 的可选配置
+type Option func(*Monitor)
+
+// WithDebounce 设置合并连续网络事件的时间窗口
+func WithDebounce(d time.Duration) Option {
+	return func(m *Monitor) {
+		if d > 0 {
+			m.debounce = d
+		}
+	}
+}
+
+// WithPollInterval 设置轮询网络状态的间隔，不支持 rtnetlink 的平台和外部地址探测都依赖轮询
+func WithPollInterval(d time.Duration) Option {
+	return func(m *Monitor) {
+		if d > 0 {
+			m.pollInterval = d
+		}
+	}
+}
+
+// WithExternalProbe 将 probe 返回的外部地址 (例如 STUN 观察到的地址) 也作为网络状态的一部分，
+// 每个轮询间隔调用一次，probe 失败时沿用上一次的结果
+func WithExternalProbe(probe func() (string, error)) Option {
+	return func(m *Monitor) {
+		m.probe = probe
+	}
+}
+
+// Monitor 监听本机网络的变化，包括本地地址、默认路由和外部地址，变化时通知所有订阅者。
+// linux 上通过 rtnetlink 订阅地址、路由和链路事件，其他平台上定期轮询，
+// 短时间内的多次事件会被合并，只有网络状态确实发生变化时才会通知
+type Monitor struct {
+	logger       *zap.Logger
+	debounce     time.Duration
+	pollInterval time.Duration
+	probe        func() (string, error)
+
+	// snapshot 返回当前本地网络状态的描述，可以在测试中替换
+	snapshot func() string
+
+	sync.Mutex
+	subscribers []*func()
+	last        string
+	external    string
+
+	events chan struct{}
+}
+
+// NewMonitor 创建一个 Monitor，需要调用 Start 开始监听
+func NewMonitor(logger *zap.Logger, opts ...Option) *Monitor {
+	m := &Monitor{
+		logger:       logger,
+		debounce:     defaultDebounce,
+		pollInterval: defaultPollInterval,
+		snapshot:     localSnapshot,
+		events:       make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Subscribe 注册网络变化时的回调，回调在 Monitor 的 goroutine 中依次调用，不应长时间阻塞。
+// 返回的函数取消注册
+func (m *Monitor) Subscribe(f func()) func() {
+	m.Lock()
+	defer m.Unlock()
+	sub := &f
+	m.subscribers = append(m.subscribers, sub)
+	return func() {
+		m.Lock()
+		defer m.Unlock()
+		for i, s := range m.subscribers {
+			if s == sub {
+				m.subscribers = append(m.subscribers[:i:i], m.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Notify 通知 Monitor 网络可能发生了变化，Monitor 会重新检查网络状态
+func (m *Monitor) Notify() {
+	select {
+	case m.events <- struct{}{}:
+	default:
+	}
+}
+
+// Start 开始监听网络变化，直到上下文关闭
+func (m *Monitor) Start(ctx context.Context) error {
+	m.Lock()
+	m.last = m.snapshot()
+	m.Unlock()
+	m.probeExternal()
+
+	if err := subscribe(ctx, m.Notify); err != nil {
+		m.logger.Warn("Failed to subscribe to rtnetlink, falling back to polling", zap.Error(err))
+	}
+
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			m.check(m.probeExternal())
+		case <-m.events:
+			// 等待事件平息，合并同一次网络切换产生的多个事件
+			timer := time.NewTimer(m.debounce)
+		drain:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case <-m.events:
+				case <-timer.C:
+					break drain
+				}
+			}
+			m.check(false)
+		}
+	}
+}
+
+// probeExternal 探测外部地址，返回外部地址是否发生了变化
+func (m *Monitor) probeExternal() bool {
+	if m.probe == nil {
+		return false
+	}
+	external, err := m.probe()
+	if err != nil {
+		m.logger.Debug("Failed to probe external address", zap.Error(err))
+		return false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	changed := m.external != "" && m.external != external
+	m.external = external
+	return changed
+}
+
+// check 比较网络状态，发生变化时通知订阅者
+func (m *Monitor) check(externalChanged bool) {
+	current := m.snapshot()
+
+	m.Lock()
+	changed := externalChanged || current != m.last
+	old := m.last
+	m.last = current
+	subscribers := append([]*func(){}, m.subscribers...)
+	m.Unlock()
+
+	if !changed {
+		return
+	}
+
+	m.logger.Info("网络发生变化",
+		zap.String("old", old),
+		zap.String("new", current),
+		zap.Bool("external", externalChanged),
+	)
+	for _, f := range subscribers {
+		(*f)()
+	}
+}
+
+// localSnapshot 返回本地地址和默认路由源地址组成的网络状态描述
+func localSnapshot() string {
+	var parts []string
+	for _, ip := range *utils.LocalIps() {
+		parts = append(parts, ip.String())
+	}
+	sort.Strings(parts)
+
+	for _, probe := range []*net.UDPAddr{routeProbe4, routeProbe6} {
+		conn, err := net.DialUDP("udp", nil, probe)
+		if err != nil {
+			parts = append(parts, "default:none")
+			continue
+		}
+		parts = append(parts, "default:"+conn.LocalAddr().(*net.UDPAddr).IP.String())
+		_ = conn.Close()
+	}
+	return strings.Join(parts, ",")
+}
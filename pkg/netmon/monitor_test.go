@@ -0,0 +1,74 @@
+package netmon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMonitor(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		state    = "10.0.0.1,default:10.0.0.1"
+		external = "1.2.3.4:5000"
+		probeErr error
+		notified atomic.Int32
+	)
+
+	m := NewMonitor(zap.NewNop(),
+		WithDebounce(20*time.Millisecond),
+		WithPollInterval(50*time.Millisecond),
+		WithExternalProbe(func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return external, probeErr
+		}),
+	)
+	m.snapshot = func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return state
+	}
+	m.Subscribe(func() { notified.Add(1) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = m.Start(ctx) }()
+
+	// 没有变化的事件不会通知
+	time.Sleep(20 * time.Millisecond)
+	m.Notify()
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(0), notified.Load())
+
+	// 多个事件被合并为一次通知
+	mu.Lock()
+	state = "10.0.0.2,default:10.0.0.2"
+	mu.Unlock()
+	for i := 0; i < 5; i++ {
+		m.Notify()
+	}
+	assert.Eventually(t, func() bool { return notified.Load() == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), notified.Load())
+
+	// 探测失败时不认为外部地址发生变化
+	mu.Lock()
+	probeErr = errors.New("timeout")
+	mu.Unlock()
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(1), notified.Load())
+
+	// 外部地址变化在轮询时被发现
+	mu.Lock()
+	probeErr = nil
+	external = "1.2.3.4:6000"
+	mu.Unlock()
+	assert.Eventually(t, func() bool { return notified.Load() == 2 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// subscribe 订阅 rtnetlink 的地址、路由和链路事件，每个事件调用一次 notify，上下文关闭时停止
+func subscribe(ctx context.Context, notify func()) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open rtnetlink socket: %w", err)
+	}
+
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK |
+			unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("failed to bind rtnetlink socket: %w", err)
+	}
+
+	// 关闭套接字不能唤醒阻塞的 recvfrom，使用接收超时定期检查上下文
+	tv := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("failed to set rtnetlink receive timeout: %w", err)
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		buffer := make([]byte, 1<<16)
+		for ctx.Err() == nil {
+			n, _, err := unix.Recvfrom(fd, buffer, 0)
+			if err != nil {
+				if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) || errors.Is(err, unix.ENOBUFS) {
+					// ENOBUFS 表示事件过多被内核丢弃，同样需要重新检查网络状态
+					if errors.Is(err, unix.ENOBUFS) {
+						notify()
+					}
+					continue
+				}
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buffer[:n])
+			if err != nil {
+				continue
+			}
+			for _, msg := range msgs {
+				switch msg.Header.Type {
+				case unix.RTM_NEWADDR, unix.RTM_DELADDR,
+					unix.RTM_NEWROUTE, unix.RTM_DELROUTE,
+					unix.RTM_NEWLINK, unix.RTM_DELLINK:
+					notify()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package netmon
+
+import (
+	"context"
+	"errors"
+)
+
+// subscribe 只支持 linux，其他平台上 Monitor 依赖轮询
+func subscribe(ctx context.Context, notify func()) error {
+	return errors.New("rtnetlink is only supported on linux")
+}
@@ -0,0 +1,384 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDNSListen = "127.0.0.1:5353"
+	defaultDNSDomain = "punch."
+	defaultDNSTTL    = 5 * time.Second
+)
+
+var (
+	_ ICEHandler  = &DNSPlugin{}
+	_ Lifecycle   = &DNSPlugin{}
+	_ dns.Handler = &DNSPlugin{}
+)
+
+// DNSPlugin 将订阅的主机名解析为主机当前的地址，client2 解析为 client2.punch.，
+// 提供 A、AAAA 记录，以及 _service._proto.client2.punch. 形式的 SRV 记录。
+// ICE 选中的候选者对的远程地址优先，其次是最近一次主机消息中的外部地址，
+// 本地地址只有落在 Prefer 网段内时才会被解析。不是合法 DNS 标签的主机名
+// (例如以 WireGuard 公钥作为主机名) 不会被解析。可以同时或者只将地址写入 hosts 文件
+type DNSPlugin struct {
+	logger *zap.Logger
+	spec   config.DnsSpec
+	ttl    uint32
+	// prefer 解析为 netip.Prefix 的 spec.Prefer
+	prefer []netip.Prefix
+
+	server *dns.Server
+
+	// mu 保护 hosts 和 written，DNS 查询在服务的 goroutine 中处理
+	mu    sync.RWMutex
+	hosts map[string]*dnsHost
+	// written 最近一次写入 hosts 文件的内容
+	written []byte
+	// invalid 已经报告过的不是合法 DNS 标签的主机名
+	invalid map[string]bool
+}
+
+// dnsHost 是主机的地址
+type dnsHost struct {
+	// selected ICE 选中的远程地址，连接断开时清空
+	selected netip.AddrPort
+	// external 最近一次主机消息中的外部地址
+	external []netip.AddrPort
+	// local 最近一次主机消息中的本地地址
+	local []netip.AddrPort
+}
+
+// preferred 返回按优先级排列并去重的地址，本地地址只保留落在 prefer 内的
+func (h *dnsHost) preferred(prefer []netip.Prefix) []netip.AddrPort {
+	candidates := append([]netip.AddrPort{h.selected}, h.external...)
+	for _, addr := range h.local {
+		for _, prefix := range prefer {
+			if prefix.Contains(addr.Addr()) {
+				candidates = append(candidates, addr)
+				break
+			}
+		}
+	}
+
+	seen := make(map[netip.AddrPort]bool)
+	var addrs []netip.AddrPort
+	for _, addr := range candidates {
+		if addr.IsValid() && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// isDNSLabel 判断 name 是否可以作为主机名标签，只允许字母、数字和连字符，
+// base64 编码的公钥中的 + / = 无法出现在查询中
+func isDNSLabel(name string) bool {
+	if len(name) == 0 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func newDNSPlugin(logger *zap.Logger) *DNSPlugin {
+	return &DNSPlugin{
+		logger:  logger,
+		hosts:   make(map[string]*dnsHost),
+		invalid: make(map[string]bool),
+	}
+}
+
+func (p *DNSPlugin) Name() string {
+	return "dns"
+}
+
+func (p *DNSPlugin) Init(cfg *config.Plugin) error {
+	if err := cfg.LoadPluginConfig(&p.spec); err != nil {
+		return fmt.Errorf("failed to decode dns plugin spec: %w", err)
+	}
+	if p.spec.Listen == "" && p.spec.HostsFile == "" {
+		p.spec.Listen = defaultDNSListen
+	}
+	if p.spec.Domain == "" {
+		p.spec.Domain = defaultDNSDomain
+	}
+	p.spec.Domain = dns.Fqdn(strings.ToLower(p.spec.Domain))
+	if p.spec.TTL <= 0 {
+		p.spec.TTL = defaultDNSTTL
+	}
+	p.ttl = uint32(p.spec.TTL / time.Second)
+	p.prefer = nil
+	for _, s := range p.spec.Prefer {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("invalid dns prefer range %q: %w", s, err)
+		}
+		p.prefer = append(p.prefer, prefix.Masked())
+	}
+	return nil
+}
+
+// Start 在 Listen 上启动 DNS 服务
+func (p *DNSPlugin) Start(ctx context.Context) error {
+	if p.spec.Listen == "" {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", p.spec.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", p.spec.Listen, err)
+	}
+	p.server = &dns.Server{PacketConn: conn, Handler: p}
+	go func() {
+		if err := p.server.ActivateAndServe(); err != nil {
+			p.logger.Error("DNS server stopped", zap.Error(err))
+		}
+	}()
+	p.logger.Info("Serving DNS",
+		zap.Stringer("listen", conn.LocalAddr()),
+		zap.String("domain", p.spec.Domain))
+	return nil
+}
+
+// Stop 停止 DNS 服务并删除 hosts 文件
+func (p *DNSPlugin) Stop() error {
+	if p.server != nil {
+		_ = p.server.Shutdown()
+	}
+	if p.spec.HostsFile != "" {
+		if err := os.Remove(p.spec.HostsFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *DNSPlugin) Health() error {
+	return nil
+}
+
+// Handle 记录主机消息中的外部地址和本地地址
+func (p *DNSPlugin) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	switch msg.Type {
+	case apiv1.HostMessage_HostUpdateNotification, apiv1.HostMessage_HostPunchNotification, apiv1.HostMessage_HostOnlineNotification:
+	default:
+		return
+	}
+	if msg.Hostname == "" || !isConcerned(p.spec.Concern, msg.Hostname) {
+		return
+	}
+
+	var external, local []netip.AddrPort
+	add := func(addrs *[]netip.AddrPort, a *net.UDPAddr) {
+		ap := a.AddrPort()
+		if ap.Addr().IsValid() && !ap.Addr().IsUnspecified() {
+			*addrs = append(*addrs, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+		}
+	}
+	if msg.ExternalAddr != nil {
+		add(&external, toUDPAddr(utils.NewUDPAddrFromLH4(msg.ExternalAddr)))
+	}
+	if msg.ExternalAddr6 != nil {
+		add(&external, toUDPAddr(utils.NewUDPAddrFromLH6(msg.ExternalAddr6)))
+	}
+	for _, v4 := range msg.Ipv4Addr {
+		add(&local, toUDPAddr(utils.NewUDPAddrFromLH4(v4)))
+	}
+	for _, v6 := range msg.Ipv6Addr {
+		add(&local, toUDPAddr(utils.NewUDPAddrFromLH6(v6)))
+	}
+	if len(external) == 0 && len(local) == 0 {
+		return
+	}
+
+	p.update(msg.Hostname, func(h *dnsHost) {
+		h.external = external
+		h.local = local
+	})
+}
+
+// HandleICE 记录 ICE 选中的远程地址，连接断开后回退到主机消息中的地址
+func (p *DNSPlugin) HandleICE(ctx context.Context, event *ICEEvent) {
+	if event.Hostname == "" || !isConcerned(p.spec.Concern, event.Hostname) {
+		return
+	}
+	var selected netip.AddrPort
+	if event.Type != ICEDisconnected && event.Remote != nil {
+		ap := event.Remote.AddrPort()
+		selected = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	p.update(event.Hostname, func(h *dnsHost) { h.selected = selected })
+}
+
+func (p *DNSPlugin) update(hostname string, fn func(h *dnsHost)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !isDNSLabel(hostname) {
+		if !p.invalid[hostname] {
+			p.invalid[hostname] = true
+			p.logger.Warn("Hostname is not a valid DNS label, not resolving it", zap.String("hostname", hostname))
+		}
+		return
+	}
+	hostname = strings.ToLower(hostname)
+	h, ok := p.hosts[hostname]
+	if !ok {
+		h = &dnsHost{}
+		p.hosts[hostname] = h
+	}
+	fn(h)
+
+	if p.spec.HostsFile != "" {
+		if err := p.writeHostsFile(); err != nil {
+			p.logger.Error("Failed to write hosts file", zap.String("file", p.spec.HostsFile), zap.Error(err))
+		}
+	}
+}
+
+// writeHostsFile 为每个主机写入每个地址族中优先的地址，内容没有变化时不写入。
+// 先写入临时文件再重命名，读取方不会看到写了一半的文件
+func (p *DNSPlugin) writeHostsFile() error {
+	names := make([]string, 0, len(p.hosts))
+	for name := range p.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by punchline, do not edit\n")
+	for _, name := range names {
+		fqdn := strings.TrimSuffix(name+"."+p.spec.Domain, ".")
+		var v4, v6 bool
+		for _, addr := range p.hosts[name].preferred(p.prefer) {
+			if addr.Addr().Is4() && !v4 || addr.Addr().Is6() && !v6 {
+				fmt.Fprintf(&b, "%s\t%s\n", addr.Addr(), fqdn)
+				v4 = v4 || addr.Addr().Is4()
+				v6 = v6 || addr.Addr().Is6()
+			}
+		}
+	}
+	if bytes.Equal(b.Bytes(), p.written) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.spec.HostsFile), ".punchline-hosts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p.spec.HostsFile); err != nil {
+		return err
+	}
+	p.written = b.Bytes()
+	return nil
+}
+
+// ServeDNS 应答 Domain 下的 A、AAAA 和 SRV 查询
+func (p *DNSPlugin) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		_ = w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(p.spec.Domain, name) {
+		m.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	// SRV 查询的名称是 _service._proto.host.domain.
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, p.spec.Domain))
+	if q.Qtype == dns.TypeSRV && len(labels) == 3 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		labels = labels[2:]
+	}
+	if len(labels) != 1 {
+		m.Rcode = dns.RcodeNameError
+		_ = w.WriteMsg(m)
+		return
+	}
+	hostname := labels[0]
+	target := hostname + "." + p.spec.Domain
+
+	p.mu.RLock()
+	h, ok := p.hosts[hostname]
+	var addrs []netip.AddrPort
+	if ok {
+		addrs = h.preferred(p.prefer)
+	}
+	p.mu.RUnlock()
+	if !ok || len(addrs) == 0 {
+		m.Rcode = dns.RcodeNameError
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	header := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: p.ttl}
+	}
+	seen := make(map[netip.Addr]bool)
+	ports := make(map[uint16]bool)
+	for _, addr := range addrs {
+		switch q.Qtype {
+		case dns.TypeA:
+			if addr.Addr().Is4() && !seen[addr.Addr()] {
+				m.Answer = append(m.Answer, &dns.A{Hdr: header(dns.TypeA), A: addr.Addr().AsSlice()})
+			}
+		case dns.TypeAAAA:
+			if addr.Addr().Is6() && !seen[addr.Addr()] {
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: header(dns.TypeAAAA), AAAA: addr.Addr().AsSlice()})
+			}
+		case dns.TypeSRV:
+			// 越优先的地址的端口优先级越高 (值越小)
+			if !ports[addr.Port()] {
+				m.Answer = append(m.Answer, &dns.SRV{
+					Hdr:      header(dns.TypeSRV),
+					Priority: uint16(len(ports)),
+					Port:     addr.Port(),
+					Target:   target,
+				})
+				ports[addr.Port()] = true
+			}
+		}
+		seen[addr.Addr()] = true
+	}
+	_ = w.WriteMsg(m)
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDNSPlugin(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	p := newDNSPlugin(zap.NewNop())
+	require.NoError(t, p.Init(&config.Plugin{Spec: map[string]interface{}{
+		"listen":    "127.0.0.1:0",
+		"hostsFile": hostsFile,
+		"prefer":    []interface{}{"192.168.0.0/24"},
+	}}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, p.Start(ctx))
+	server := p.server.PacketConn.LocalAddr().String()
+
+	p.Handle(ctx, &apiv1.HostMessage{
+		Type:         apiv1.HostMessage_HostUpdateNotification,
+		Hostname:     "Client2",
+		ExternalAddr: &apiv1.Ipv4Addr{Ip: 0x01020304, Port: 51820},
+		// 10.0.0.2 不在 prefer 网段内，不会被解析
+		Ipv4Addr: []*apiv1.Ipv4Addr{{Ip: 0xc0a80002, Port: 51821}, {Ip: 0x0a000002, Port: 51822}},
+	})
+	// 以公钥作为主机名的主机不是合法的 DNS 标签
+	p.Handle(ctx, &apiv1.HostMessage{
+		Type:         apiv1.HostMessage_HostUpdateNotification,
+		Hostname:     "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+		ExternalAddr: &apiv1.Ipv4Addr{Ip: 0x01020305, Port: 51820},
+	})
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		r, err := dns.Exchange(m, server)
+		require.NoError(t, err)
+		return r
+	}
+
+	r := query("client2.punch.", dns.TypeA)
+	require.Len(t, r.Answer, 2)
+	assert.Equal(t, "1.2.3.4", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "192.168.0.2", r.Answer[1].(*dns.A).A.String())
+	assert.Equal(t, uint32(5), r.Answer[0].Header().Ttl)
+
+	// ICE 选中的地址优先，断开后回退到主机消息中的地址
+	p.HandleICE(ctx, &ICEEvent{Type: ICEConnected, Hostname: "client2", Remote: &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 51821}})
+	r = query("client2.punch.", dns.TypeA)
+	require.Len(t, r.Answer, 2)
+	assert.Equal(t, "192.168.0.2", r.Answer[0].(*dns.A).A.String())
+
+	r = query("_wireguard._udp.client2.punch.", dns.TypeSRV)
+	require.Len(t, r.Answer, 2)
+	assert.Equal(t, uint16(51821), r.Answer[0].(*dns.SRV).Port)
+	assert.Equal(t, uint16(0), r.Answer[0].(*dns.SRV).Priority)
+	assert.Equal(t, uint16(51820), r.Answer[1].(*dns.SRV).Port)
+	assert.Equal(t, "client2.punch.", r.Answer[1].(*dns.SRV).Target)
+
+	b, err := os.ReadFile(hostsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "# Generated by punchline, do not edit\n192.168.0.2\tclient2.punch\n", string(b))
+
+	p.HandleICE(ctx, &ICEEvent{Type: ICEDisconnected, Hostname: "client2"})
+	r = query("client2.punch.", dns.TypeA)
+	require.Len(t, r.Answer, 2)
+	assert.Equal(t, "1.2.3.4", r.Answer[0].(*dns.A).A.String())
+
+	r = query("client2.punch.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Empty(t, r.Answer)
+
+	r = query("client3.punch.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+
+	r = query("example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+
+	require.NoError(t, p.Stop())
+	_, err = os.Stat(hostsFile)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,200 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultExecTimeout hook 处理单个事件的默认超时时间
+	defaultExecTimeout = 10 * time.Second
+
+	// execWaitDelay hook 超时被杀死后等待输出关闭的时间
+	execWaitDelay = time.Second
+
+	// maxExecOutput 记录到日志的 hook 输出的最大长度
+	maxExecOutput = 4096
+)
+
+var (
+	_ ICEHandler = &ExecPlugin{}
+	_ Lifecycle  = &ExecPlugin{}
+)
+
+// ExecPlugin 是外部插件，对每个主机消息和 ICE 事件运行一次 hook，
+// 事件以 JSON (见 ExecEvent) 写入 hook 的标准输入，事件类型和主机名同时通过环境变量
+// PUNCHLINE_EVENT 和 PUNCHLINE_HOSTNAME 传递。
+// hook 由 Runner 按事件到达的顺序依次运行，不会并发执行
+type ExecPlugin struct {
+	logger *zap.Logger
+	name   string
+
+	path string
+	spec config.ExecSpec
+}
+
+// ExecEvent 是写入 hook 标准输入的事件
+type ExecEvent struct {
+	// Event 主机消息的类型，例如 HostPunchNotification，ICE 事件为 ice-connected 这样的形式
+	Event     string `json:"event"`
+	Hostname  string `json:"hostname"`
+	PublicKey string `json:"publicKey,omitempty"`
+	// Endpoints 主机的外部地址和本地地址
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Relays 可以到达主机的中继地址
+	Relays []string `json:"relays,omitempty"`
+	// Local Remote ICE 选中的候选者对的本地和远程地址
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+func newExecPlugin(logger *zap.Logger, name string) *ExecPlugin {
+	return &ExecPlugin{logger: logger, name: name}
+}
+
+func (p *ExecPlugin) Name() string {
+	return p.name
+}
+
+// Init 从 exec:///path 形式的地址中解析 hook 的路径
+func (p *ExecPlugin) Init(cfg *config.Plugin) error {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return fmt.Errorf("invalid plugin address %q: %w", cfg.Address, err)
+	}
+	p.path = u.Path
+	if p.path == "" {
+		p.path = u.Opaque
+	}
+	if p.path == "" {
+		return fmt.Errorf("no hook path in plugin address %q", cfg.Address)
+	}
+
+	if err := cfg.LoadPluginConfig(&p.spec); err != nil {
+		return fmt.Errorf("failed to decode exec plugin spec: %w", err)
+	}
+	if p.spec.Timeout <= 0 {
+		p.spec.Timeout = defaultExecTimeout
+	}
+	return p.Health()
+}
+
+func (p *ExecPlugin) Start(ctx context.Context) error {
+	return nil
+}
+
+func (p *ExecPlugin) Stop() error {
+	return nil
+}
+
+// Health 检查 hook 是否存在并且可以执行
+func (p *ExecPlugin) Health() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("hook %s is not executable", p.path)
+	}
+	return nil
+}
+
+// Handle 将主机消息交给 hook
+func (p *ExecPlugin) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	event := &ExecEvent{
+		Event:     msg.Type.String(),
+		Hostname:  msg.Hostname,
+		PublicKey: msg.PublicKey,
+	}
+	if msg.ExternalAddr != nil {
+		event.Endpoints = append(event.Endpoints, utils.NewUDPAddrFromLH4(msg.ExternalAddr).String())
+	}
+	if msg.ExternalAddr6 != nil {
+		event.Endpoints = append(event.Endpoints, utils.NewUDPAddrFromLH6(msg.ExternalAddr6).String())
+	}
+	for _, addr := range msg.Ipv4Addr {
+		event.Endpoints = append(event.Endpoints, utils.NewUDPAddrFromLH4(addr).String())
+	}
+	for _, addr := range msg.Ipv6Addr {
+		event.Endpoints = append(event.Endpoints, utils.NewUDPAddrFromLH6(addr).String())
+	}
+	for _, addr := range msg.RelayAddr {
+		event.Relays = append(event.Relays, utils.NewUDPAddrFromLH4(addr).String())
+	}
+	for _, addr := range msg.RelayAddr6 {
+		event.Relays = append(event.Relays, utils.NewUDPAddrFromLH6(addr).String())
+	}
+	p.run(ctx, event)
+}
+
+// HandleICE 将 ICE 事件交给 hook
+func (p *ExecPlugin) HandleICE(ctx context.Context, e *ICEEvent) {
+	event := &ExecEvent{
+		Event:    "ice-" + e.Type.String(),
+		Hostname: e.Hostname,
+	}
+	if e.Local != nil {
+		event.Local = e.Local.String()
+	}
+	if e.Remote != nil {
+		event.Remote = e.Remote.String()
+	}
+	p.run(ctx, event)
+}
+
+// run 运行 hook 处理一个事件，失败时记录 hook 的输出
+func (p *ExecPlugin) run(ctx context.Context, event *ExecEvent) {
+	if err := p.exec(ctx, event); err != nil {
+		p.logger.Error("Hook failed",
+			zap.String("hook", p.path),
+			zap.String("event", event.Event),
+			zap.String("hostname", event.Hostname),
+			zap.Error(err))
+	}
+}
+
+func (p *ExecPlugin) exec(ctx context.Context, event *ExecEvent) error {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.spec.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.path, p.spec.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	// hook 被杀死后不再等待仍然持有输出管道的子进程
+	cmd.WaitDelay = execWaitDelay
+	cmd.Env = append(os.Environ(), p.spec.Env...)
+	cmd.Env = append(cmd.Env,
+		"PUNCHLINE_EVENT="+event.Event,
+		"PUNCHLINE_HOSTNAME="+event.Hostname,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s: %w", p.spec.Timeout, err)
+		}
+		if len(output) > maxExecOutput {
+			output = output[:maxExecOutput]
+		}
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	p.logger.Debug("Hook finished",
+		zap.String("event", event.Event),
+		zap.String("hostname", event.Hostname))
+	return nil
+}
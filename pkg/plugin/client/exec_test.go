@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeHook 在临时目录中创建一个 hook，将标准输入和环境变量追加到 out
+func writeHook(t *testing.T, script string) (hook, out string) {
+	dir := t.TempDir()
+	hook = filepath.Join(dir, "hook.sh")
+	out = filepath.Join(dir, "out")
+	require.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\n"+strings.ReplaceAll(script, "$OUT", out)), 0o755))
+	return hook, out
+}
+
+func TestExecPlugin(t *testing.T) {
+	hook, out := writeHook(t, `cat >> $OUT; echo >> $OUT; echo "$PUNCHLINE_EVENT $PUNCHLINE_HOSTNAME $1 $EXTRA" >> $OUT`)
+
+	ps, err := LoadPlugins(zap.NewNop(), &config.Config{Plugins: []config.Plugin{{
+		Name:    "firewall",
+		Address: "exec://" + hook,
+		Spec: map[string]interface{}{
+			"args":    []interface{}{"arg"},
+			"env":     []interface{}{"EXTRA=extra"},
+			"timeout": "5s",
+		},
+	}}})
+	require.NoError(t, err)
+	require.Len(t, ps, 1)
+	p := ps[0].(*ExecPlugin)
+	assert.Equal(t, "firewall", p.Name())
+	assert.Equal(t, 5*time.Second, p.spec.Timeout)
+	require.NoError(t, p.Health())
+
+	p.Handle(context.Background(), &apiv1.HostMessage{
+		Type:         apiv1.HostMessage_HostPunchNotification,
+		Hostname:     "client-2",
+		PublicKey:    "key",
+		ExternalAddr: &apiv1.Ipv4Addr{Ip: 0x01020304, Port: 51820},
+		RelayAddr:    []*apiv1.Ipv4Addr{{Ip: 0x05060708, Port: 4242}},
+	})
+	p.HandleICE(context.Background(), &ICEEvent{
+		Type:     ICEConnected,
+		Hostname: "client-3",
+		Local:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		Remote:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2},
+	})
+
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 4)
+
+	var event ExecEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, ExecEvent{
+		Event:     "HostPunchNotification",
+		Hostname:  "client-2",
+		PublicKey: "key",
+		Endpoints: []string{"1.2.3.4:51820"},
+		Relays:    []string{"5.6.7.8:4242"},
+	}, event)
+	assert.Equal(t, "HostPunchNotification client-2 arg extra", lines[1])
+
+	event = ExecEvent{}
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &event))
+	assert.Equal(t, ExecEvent{Event: "ice-connected", Hostname: "client-3", Local: "10.0.0.1:1", Remote: "10.0.0.2:2"}, event)
+	assert.Equal(t, "ice-connected client-3 arg extra", lines[3])
+}
+
+func TestExecPluginErrors(t *testing.T) {
+	// hook 不存在时加载失败
+	_, err := LoadPlugins(zap.NewNop(), &config.Config{Plugins: []config.Plugin{{Name: "missing", Address: "exec:///nonexistent/hook"}}})
+	assert.Error(t, err)
+
+	_, err = LoadPlugins(zap.NewNop(), &config.Config{Plugins: []config.Plugin{{Name: "grpc", Address: "grpc://127.0.0.1:6976"}}})
+	assert.ErrorContains(t, err, "unsupported address scheme")
+
+	// 超时的 hook 被杀死
+	hook, _ := writeHook(t, "sleep 5")
+	p := newExecPlugin(zap.NewNop(), "slow")
+	require.NoError(t, p.Init(&config.Plugin{Address: "exec:" + hook, Spec: map[string]interface{}{"timeout": "100ms"}}))
+	start := time.Now()
+	err = p.exec(context.Background(), &ExecEvent{Event: "test"})
+	assert.ErrorContains(t, err, "timed out")
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
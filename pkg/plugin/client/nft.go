@@ -0,0 +1,271 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultNftTable = "punchline"
+	defaultNftTTL   = 10 * time.Minute
+)
+
+var errNftMarkRequired = errors.New("nftables: mark is required with a dedicated table, or set chain to insert into an existing table")
+
+var (
+	_ ICEHandler = &NftPlugin{}
+	_ Lifecycle  = &NftPlugin{}
+)
+
+// pinholes 是放行对端 ip:port 的防火墙后端，见 nftables 实现
+type pinholes interface {
+	// setup 删除残留的表并重新创建表、集合和规则
+	setup() error
+	add(addrs []netip.AddrPort) error
+	del(addrs []netip.AddrPort) error
+	// check 检查表是否存在
+	check() error
+	// teardown 删除表
+	teardown() error
+}
+
+// NftPlugin 在插件独占的 nftables 表或者已有的链中维护放行的对端 ip:port 集合，
+// 收到打洞通知或 ICE 连接建立时加入对端的地址，地址在 TTL 内没有再次出现时移除。
+// 同一个地址重复加入只会延长过期时间，ICE 连接使用中的地址不会过期，断开后才开始计算 TTL
+type NftPlugin struct {
+	logger *zap.Logger
+	spec   config.NftSpec
+
+	newPinholes func(spec *config.NftSpec) (pinholes, error)
+
+	// mu 保护 backend、expires 和 connected，过期清理在单独的 goroutine 中进行
+	mu      sync.Mutex
+	backend pinholes
+	expires map[netip.AddrPort]time.Time
+	// connected 每个主机当前 ICE 连接的远程地址
+	connected map[string]netip.AddrPort
+	now       func() time.Time
+}
+
+func newNftPlugin(logger *zap.Logger) *NftPlugin {
+	return &NftPlugin{
+		logger:      logger,
+		newPinholes: newNftPinholes,
+		expires:     make(map[netip.AddrPort]time.Time),
+		connected:   make(map[string]netip.AddrPort),
+		now:         time.Now,
+	}
+}
+
+func (p *NftPlugin) Name() string {
+	return "nftables"
+}
+
+// Init 解析配置并连接 nftables
+func (p *NftPlugin) Init(cfg *config.Plugin) error {
+	if err := cfg.LoadPluginConfig(&p.spec); err != nil {
+		return fmt.Errorf("failed to decode nftables plugin spec: %w", err)
+	}
+	if p.spec.Table == "" {
+		p.spec.Table = defaultNftTable
+	}
+	if p.spec.TTL <= 0 {
+		p.spec.TTL = defaultNftTTL
+	}
+	if p.spec.Chain == "" && p.spec.Mark == 0 {
+		// 独占的表中的 accept 无法越过其他表中默认拒绝的规则，只能由它们放行 mark
+		return errNftMarkRequired
+	}
+
+	backend, err := p.newPinholes(&p.spec)
+	if err != nil {
+		return err
+	}
+	p.backend = backend
+	return nil
+}
+
+// Start 重新创建表 (或者已有的链中的规则)，并定期移除过期的地址
+func (p *NftPlugin) Start(ctx context.Context) error {
+	p.mu.Lock()
+	err := p.backend.setup()
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to set up nftables table %s: %w", p.spec.Table, err)
+	}
+	p.logger.Info("Created nftables table", zap.String("table", p.spec.Table), zap.String("chain", p.spec.Chain))
+
+	go func() {
+		ticker := time.NewTicker(p.spec.TTL / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.expire()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop 删除独占的表或者插入已有的链中的规则，已经建立的连接由其他规则中的 conntrack 状态决定
+func (p *NftPlugin) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expires = make(map[netip.AddrPort]time.Time)
+	p.connected = make(map[string]netip.AddrPort)
+	if err := p.backend.teardown(); err != nil {
+		return fmt.Errorf("failed to delete nftables table %s: %w", p.spec.Table, err)
+	}
+	p.logger.Info("Deleted nftables table", zap.String("table", p.spec.Table), zap.String("chain", p.spec.Chain))
+	return nil
+}
+
+func (p *NftPlugin) Health() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.backend.check()
+}
+
+// Handle 在打洞通知中加入对端的所有候选地址
+func (p *NftPlugin) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	if msg.Type != apiv1.HostMessage_HostPunchNotification || !isConcerned(p.spec.Concern, msg.Hostname) {
+		return
+	}
+
+	var addrs []netip.AddrPort
+	add := func(ip net.IP, port uint16) {
+		if a, ok := netip.AddrFromSlice(ip); ok && port != 0 {
+			addrs = append(addrs, netip.AddrPortFrom(a.Unmap(), port))
+		}
+	}
+	if msg.ExternalAddr != nil {
+		a := utils.NewUDPAddrFromLH4(msg.ExternalAddr)
+		add(a.IP, a.Port)
+	}
+	if msg.ExternalAddr6 != nil {
+		a := utils.NewUDPAddrFromLH6(msg.ExternalAddr6)
+		add(a.IP, a.Port)
+	}
+	for _, v4 := range msg.Ipv4Addr {
+		a := utils.NewUDPAddrFromLH4(v4)
+		add(a.IP, a.Port)
+	}
+	for _, v6 := range msg.Ipv6Addr {
+		a := utils.NewUDPAddrFromLH6(v6)
+		add(a.IP, a.Port)
+	}
+	p.allow(msg.Hostname, addrs)
+}
+
+// HandleICE 在 ICE 连接建立或选中新的候选者对时加入远程地址并保持放行，
+// 连接断开或换用其他地址后旧地址才开始计算 TTL
+func (p *NftPlugin) HandleICE(ctx context.Context, event *ICEEvent) {
+	if !isConcerned(p.spec.Concern, event.Hostname) {
+		return
+	}
+	if event.Type == ICEDisconnected {
+		p.disconnect(event.Hostname)
+		return
+	}
+	if event.Remote == nil {
+		return
+	}
+
+	addr := event.Remote.AddrPort()
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	p.disconnect(event.Hostname)
+	p.allow(event.Hostname, []netip.AddrPort{addr})
+
+	p.mu.Lock()
+	if _, ok := p.expires[addr]; ok {
+		p.connected[event.Hostname] = addr
+	}
+	p.mu.Unlock()
+}
+
+// disconnect 取消 hostname 当前 ICE 连接地址的保持，该地址从现在开始计算 TTL
+func (p *NftPlugin) disconnect(hostname string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addr, ok := p.connected[hostname]
+	if !ok {
+		return
+	}
+	delete(p.connected, hostname)
+	if _, ok := p.expires[addr]; ok {
+		p.expires[addr] = p.now().Add(p.spec.TTL)
+	}
+}
+
+// allow 加入新的地址，已经存在的地址只延长过期时间
+func (p *NftPlugin) allow(hostname string, addrs []netip.AddrPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expire := p.now().Add(p.spec.TTL)
+	var added []netip.AddrPort
+	for _, addr := range addrs {
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if _, ok := p.expires[addr]; !ok {
+			added = append(added, addr)
+		}
+		p.expires[addr] = expire
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	if err := p.backend.add(added); err != nil {
+		for _, addr := range added {
+			delete(p.expires, addr)
+		}
+		p.logger.Error("Failed to allow peer in nftables", zap.String("hostname", hostname), zap.Error(err))
+		return
+	}
+	p.logger.Debug("Allowed peer in nftables", zap.String("hostname", hostname), zap.Any("addrs", added))
+}
+
+// expire 移除过期的地址，ICE 连接使用中的地址除外
+func (p *NftPlugin) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inUse := make(map[netip.AddrPort]bool, len(p.connected))
+	for _, addr := range p.connected {
+		inUse[addr] = true
+	}
+
+	now := p.now()
+	var expired []netip.AddrPort
+	for addr, t := range p.expires {
+		if !now.Before(t) && !inUse[addr] {
+			expired = append(expired, addr)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	if err := p.backend.del(expired); err != nil {
+		p.logger.Error("Failed to remove expired peers from nftables", zap.Error(err))
+		return
+	}
+	for _, addr := range expired {
+		delete(p.expires, addr)
+	}
+	p.logger.Debug("Removed expired peers from nftables", zap.Any("addrs", expired))
+}
@@ -0,0 +1,246 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+
+	"github.com/cossteam/punchline/config"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftRuleTag 标记插件插入已有链中的规则，启动时据此清除上次残留的规则
+var nftRuleTag = []byte("punchline")
+
+// nftPinholes 通过 netlink 管理 inet 表，表中的 input 链放行源地址和端口在 peers4 或 peers6 集合中的 UDP 数据包：
+//
+//	table inet punchline {
+//		set peers4 { type ipv4_addr . inet_service }
+//		set peers6 { type ipv6_addr . inet_service }
+//		chain input {
+//			type filter hook input priority mangle; policy accept;
+//			meta nfproto ipv4 meta l4proto udp ip saddr . udp sport @peers4 [meta mark set <mark>] accept
+//			meta nfproto ipv6 meta l4proto udp ip6 saddr . udp sport @peers6 [meta mark set <mark>] accept
+//		}
+//	}
+//
+// 一个表中的 accept 不会阻止其他表中的链丢弃数据包，默认拒绝的规则集需要放行 mark。
+// 配置了 chain 时不创建表，而是在已有的表中创建 punchline_peers4 和 punchline_peers6 集合，
+// 并将同样的规则插入该链的开头，在链中其他拒绝规则之前放行
+type nftPinholes struct {
+	conn  *nftables.Conn
+	table *nftables.Table
+	mark  uint32
+	// chain 已有的表中插入规则的链，为空时使用独占的表
+	chain string
+
+	peers4 *nftables.Set
+	peers6 *nftables.Set
+}
+
+func newNftPinholes(spec *config.NftSpec) (pinholes, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables netlink connection: %w", err)
+	}
+	table := &nftables.Table{Name: spec.Table, Family: nftables.TableFamilyINet}
+	prefix := ""
+	if spec.Chain != "" {
+		// 已有的表中可能有其他集合，加上前缀避免冲突
+		prefix = "punchline_"
+	}
+	return &nftPinholes{
+		conn:  conn,
+		table: table,
+		mark:  spec.Mark,
+		chain: spec.Chain,
+		peers4: &nftables.Set{
+			Table:         table,
+			Name:          prefix + "peers4",
+			KeyType:       nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService),
+			Concatenation: true,
+		},
+		peers6: &nftables.Set{
+			Table:         table,
+			Name:          prefix + "peers6",
+			KeyType:       nftables.MustConcatSetType(nftables.TypeIP6Addr, nftables.TypeInetService),
+			Concatenation: true,
+		},
+	}, nil
+}
+
+func (n *nftPinholes) setup() error {
+	if n.chain != "" {
+		return n.setupChain()
+	}
+
+	// 上次异常退出时残留的表
+	if _, err := n.conn.ListTableOfFamily(n.table.Name, n.table.Family); err == nil {
+		n.conn.DelTable(n.table)
+		if err := n.conn.Flush(); err != nil {
+			return err
+		}
+	}
+
+	n.conn.AddTable(n.table)
+	if err := n.conn.AddSet(n.peers4, nil); err != nil {
+		return err
+	}
+	if err := n.conn.AddSet(n.peers6, nil); err != nil {
+		return err
+	}
+	chain := n.conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    n.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityMangle,
+	})
+	// ip saddr 偏移 12，ip6 saddr 偏移 8，端口放在地址之后的下一个 32 位寄存器中
+	n.conn.AddRule(&nftables.Rule{Table: n.table, Chain: chain, Exprs: n.rule(unix.NFPROTO_IPV4, 12, 4, 9, n.peers4)})
+	n.conn.AddRule(&nftables.Rule{Table: n.table, Chain: chain, Exprs: n.rule(unix.NFPROTO_IPV6, 8, 16, 12, n.peers6)})
+	return n.conn.Flush()
+}
+
+// setupChain 清除已有的链中上次残留的规则和集合，再创建集合并将规则插入链的开头
+func (n *nftPinholes) setupChain() error {
+	chain, err := n.existingChain()
+	if err != nil {
+		return err
+	}
+	if err := n.removeFromChain(chain); err != nil {
+		return err
+	}
+
+	if err := n.conn.AddSet(n.peers4, nil); err != nil {
+		return err
+	}
+	if err := n.conn.AddSet(n.peers6, nil); err != nil {
+		return err
+	}
+	// 插入到链的开头，后插入的规则在前
+	n.conn.InsertRule(&nftables.Rule{Table: n.table, Chain: chain, Exprs: n.rule(unix.NFPROTO_IPV6, 8, 16, 12, n.peers6), UserData: nftRuleTag})
+	n.conn.InsertRule(&nftables.Rule{Table: n.table, Chain: chain, Exprs: n.rule(unix.NFPROTO_IPV4, 12, 4, 9, n.peers4), UserData: nftRuleTag})
+	return n.conn.Flush()
+}
+
+// existingChain 返回配置的已有的链，表或链不存在时返回错误
+func (n *nftPinholes) existingChain() (*nftables.Chain, error) {
+	if _, err := n.conn.ListTableOfFamily(n.table.Name, n.table.Family); err != nil {
+		return nil, fmt.Errorf("inet table %s not found: %w", n.table.Name, err)
+	}
+	chain, err := n.conn.ListChain(n.table, n.chain)
+	if err != nil {
+		return nil, fmt.Errorf("chain %s not found in inet table %s: %w", n.chain, n.table.Name, err)
+	}
+	return chain, nil
+}
+
+// removeFromChain 删除插件插入链中的规则和创建的集合，不影响表中的其他内容
+func (n *nftPinholes) removeFromChain(chain *nftables.Chain) error {
+	rules, err := n.conn.GetRules(n.table, chain)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if bytes.Equal(r.UserData, nftRuleTag) {
+			if err := n.conn.DelRule(r); err != nil {
+				return err
+			}
+		}
+	}
+	for _, set := range []*nftables.Set{n.peers4, n.peers6} {
+		if _, err := n.conn.GetSetByName(n.table, set.Name); err == nil {
+			n.conn.DelSet(set)
+		}
+	}
+	return n.conn.Flush()
+}
+
+func (n *nftPinholes) rule(nfproto byte, offset, length, portRegister uint32, set *nftables.Set) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Payload{DestRegister: portRegister, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+	if n.mark != 0 {
+		exprs = append(exprs,
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(n.mark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		)
+	}
+	return append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+func (n *nftPinholes) add(addrs []netip.AddrPort) error {
+	v4, v6 := n.elements(addrs)
+	if len(v4) > 0 {
+		if err := n.conn.SetAddElements(n.peers4, v4); err != nil {
+			return err
+		}
+	}
+	if len(v6) > 0 {
+		if err := n.conn.SetAddElements(n.peers6, v6); err != nil {
+			return err
+		}
+	}
+	return n.conn.Flush()
+}
+
+func (n *nftPinholes) del(addrs []netip.AddrPort) error {
+	v4, v6 := n.elements(addrs)
+	if len(v4) > 0 {
+		if err := n.conn.SetDeleteElements(n.peers4, v4); err != nil {
+			return err
+		}
+	}
+	if len(v6) > 0 {
+		if err := n.conn.SetDeleteElements(n.peers6, v6); err != nil {
+			return err
+		}
+	}
+	return n.conn.Flush()
+}
+
+// elements 将地址转换为集合元素，连接的每个部分按 4 字节对齐
+func (n *nftPinholes) elements(addrs []netip.AddrPort) (v4, v6 []nftables.SetElement) {
+	for _, addr := range addrs {
+		port := []byte{byte(addr.Port() >> 8), byte(addr.Port()), 0, 0}
+		if addr.Addr().Is4() {
+			ip := addr.Addr().As4()
+			v4 = append(v4, nftables.SetElement{Key: append(ip[:], port...)})
+		} else {
+			ip := addr.Addr().As16()
+			v6 = append(v6, nftables.SetElement{Key: append(ip[:], port...)})
+		}
+	}
+	return v4, v6
+}
+
+func (n *nftPinholes) check() error {
+	if n.chain != "" {
+		_, err := n.conn.GetSetByName(n.table, n.peers4.Name)
+		return err
+	}
+	_, err := n.conn.ListTableOfFamily(n.table.Name, n.table.Family)
+	return err
+}
+
+func (n *nftPinholes) teardown() error {
+	if n.chain != "" {
+		chain, err := n.existingChain()
+		if err != nil {
+			return err
+		}
+		return n.removeFromChain(chain)
+	}
+	n.conn.DelTable(n.table)
+	return n.conn.Flush()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package plugin
+
+import (
+	"errors"
+
+	"github.com/cossteam/punchline/config"
+)
+
+// newNftPinholes 只支持 linux
+func newNftPinholes(spec *config.NftSpec) (pinholes, error) {
+	return nil, errors.New("nftables is only supported on linux")
+}
@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakePinholes 在内存中保存放行的地址
+type fakePinholes struct {
+	table  bool
+	allows map[netip.AddrPort]bool
+	adds   int
+}
+
+func (f *fakePinholes) setup() error {
+	f.table = true
+	f.allows = make(map[netip.AddrPort]bool)
+	return nil
+}
+
+func (f *fakePinholes) add(addrs []netip.AddrPort) error {
+	f.adds++
+	for _, addr := range addrs {
+		f.allows[addr] = true
+	}
+	return nil
+}
+
+func (f *fakePinholes) del(addrs []netip.AddrPort) error {
+	for _, addr := range addrs {
+		delete(f.allows, addr)
+	}
+	return nil
+}
+
+func (f *fakePinholes) check() error { return nil }
+
+func (f *fakePinholes) teardown() error {
+	f.table = false
+	f.allows = nil
+	return nil
+}
+
+func TestNftPlugin(t *testing.T) {
+	backend := &fakePinholes{}
+	p := newNftPlugin(zap.NewNop())
+	p.newPinholes = func(spec *config.NftSpec) (pinholes, error) {
+		if spec.Chain == "" {
+			assert.Equal(t, defaultNftTable, spec.Table)
+		}
+		return backend, nil
+	}
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	// 独占的表必须配置 mark，插入已有的链时不需要
+	assert.ErrorIs(t, p.Init(&config.Plugin{Spec: map[string]interface{}{"ttl": "1m"}}), errNftMarkRequired)
+	require.NoError(t, p.Init(&config.Plugin{Spec: map[string]interface{}{"table": "filter", "chain": "input"}}))
+	require.NoError(t, p.Init(&config.Plugin{Spec: map[string]interface{}{"ttl": "1m", "mark": 1, "concern": []interface{}{"client-2", "client-3"}}}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, p.Start(ctx))
+	assert.True(t, backend.table)
+
+	punch := &apiv1.HostMessage{
+		Type:         apiv1.HostMessage_HostPunchNotification,
+		Hostname:     "client-2",
+		ExternalAddr: &apiv1.Ipv4Addr{Ip: 0x01020304, Port: 51820},
+		Ipv4Addr:     []*apiv1.Ipv4Addr{{Ip: 0xc0a80002, Port: 51820}},
+	}
+	p.Handle(ctx, punch)
+	p.HandleICE(ctx, &ICEEvent{Type: ICEConnected, Hostname: "client-3", Remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242}})
+	// 不关注的主机和其他类型的消息被忽略
+	p.Handle(ctx, &apiv1.HostMessage{Type: apiv1.HostMessage_HostPunchNotification, Hostname: "client-4", ExternalAddr: &apiv1.Ipv4Addr{Ip: 1, Port: 1}})
+	p.Handle(ctx, &apiv1.HostMessage{Type: apiv1.HostMessage_HostUpdateNotification, Hostname: "client-2", ExternalAddr: &apiv1.Ipv4Addr{Ip: 2, Port: 2}})
+
+	assert.Equal(t, map[netip.AddrPort]bool{
+		netip.MustParseAddrPort("1.2.3.4:51820"):      true,
+		netip.MustParseAddrPort("192.168.0.2:51820"):  true,
+		netip.MustParseAddrPort("[2001:db8::1]:4242"): true,
+	}, backend.allows)
+	assert.Equal(t, 2, backend.adds)
+
+	// 重复的通知只延长过期时间
+	now = now.Add(40 * time.Second)
+	p.Handle(ctx, punch)
+	assert.Equal(t, 2, backend.adds)
+
+	// ICE 连接使用中的地址超过 TTL 也不会过期
+	now = now.Add(30 * time.Second)
+	p.expire()
+	assert.Len(t, backend.allows, 3)
+
+	// 连接断开后开始计算 TTL
+	p.HandleICE(ctx, &ICEEvent{Type: ICEDisconnected, Hostname: "client-3"})
+	now = now.Add(40 * time.Second)
+	p.expire()
+	assert.Equal(t, map[netip.AddrPort]bool{
+		netip.MustParseAddrPort("[2001:db8::1]:4242"): true,
+	}, backend.allows)
+
+	now = now.Add(20 * time.Second)
+	p.expire()
+	assert.Empty(t, backend.allows)
+
+	// 选中新的候选者对后，旧地址开始计算 TTL
+	p.HandleICE(ctx, &ICEEvent{Type: ICEConnected, Hostname: "client-3", Remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242}})
+	now = now.Add(30 * time.Second)
+	p.HandleICE(ctx, &ICEEvent{Type: ICESelectedPairChanged, Hostname: "client-3", Remote: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4242}})
+	now = now.Add(time.Minute)
+	p.expire()
+	assert.Equal(t, map[netip.AddrPort]bool{
+		netip.MustParseAddrPort("[2001:db8::2]:4242"): true,
+	}, backend.allows)
+
+	require.NoError(t, p.Stop())
+	assert.False(t, backend.table)
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	apiv1 "github.com/cossteam/punchline/api/v1"
 	"github.com/cossteam/punchline/config"
-	"github.com/mitchellh/mapstructure"
+	"github.com/pion/ice/v2"
 	"go.uber.org/zap"
+	"net"
+	"net/url"
+	"time"
 )
 
 // Plugin is the interface that all plugins must implement.
@@ -15,24 +18,159 @@ type Plugin interface {
 	Handle(ctx context.Context, msg *apiv1.HostMessage)
 }
 
+// ICEEventType ICE 事件的类型
+type ICEEventType int
+
+const (
+	// ICESelectedPairChanged ICE 选中了新的候选者对
+	ICESelectedPairChanged ICEEventType = iota
+	// ICEConnected ICE 连接建立
+	ICEConnected
+	// ICEDisconnected ICE 连接断开或失败
+	ICEDisconnected
+)
+
+func (t ICEEventType) String() string {
+	switch t {
+	case ICESelectedPairChanged:
+		return "selected-pair-changed"
+	case ICEConnected:
+		return "connected"
+	case ICEDisconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// ICEEvent ICE 模式下与 Hostname 之间连接的事件
+type ICEEvent struct {
+	Type     ICEEventType
+	Hostname string
+	// Local Remote 选中的候选者对的本地和远程地址，ICEDisconnected 时为 nil
+	Local  *net.UDPAddr
+	Remote *net.UDPAddr
+}
+
+// ICEHandler 是可以处理 ICE 事件的插件，ICE 模式下不会收到 HostMessage
+type ICEHandler interface {
+	HandleICE(ctx context.Context, event *ICEEvent)
+}
+
+var _ ICEHandler = &WGPlugin{}
+
+// UDPMuxer 是持有与 ICE 共用端口的插件，ICE Agent 通过返回的 UDPMux 收发连通性检查，为 nil 表示没有共用端口
+type UDPMuxer interface {
+	UDPMux() ice.UniversalUDPMux
+}
+
+var _ UDPMuxer = &WGPlugin{}
+
+// Discoverer 是可以从本地环境发现本端身份和需要订阅的主机的插件，例如自动模式下的 WireGuard 插件
+type Discoverer interface {
+	// PublicKey 返回随主机消息发布的本端公钥，为空表示不发布
+	PublicKey() (string, error)
+	// Subscriptions 返回需要自动订阅的主机名
+	Subscriptions() ([]string, error)
+}
+
+var _ Discoverer = &WGPlugin{}
+
+// DirectProber 是可以在 ICE 之外确认与对端直连的插件，例如观察 WireGuard 在直连端点上的握手，
+// 灯塔客户端据此从中继切换回直连
+type DirectProber interface {
+	// DirectSince 返回 since 之后是否经过非中继的端点与 hostname 完成了握手，ok 为 false 表示无法判断
+	DirectSince(hostname string, since time.Time) (direct, ok bool)
+}
+
+var _ DirectProber = &WGPlugin{}
+
+// Lifecycle 是有生命周期的插件，由 Runner 在 controller.Manager 中管理。
+// Init 在加载时调用，Start 在 Runner 开始处理事件之前调用，Stop 在 Runner 退出时调用
+type Lifecycle interface {
+	// Init 根据插件配置初始化插件
+	Init(cfg *config.Plugin) error
+	// Start 启动插件的后台任务，不阻塞
+	Start(ctx context.Context) error
+	// Stop 停止插件并释放资源
+	Stop() error
+	// Health 返回插件当前的健康状态，nil 表示健康
+	Health() error
+}
+
+var _ Lifecycle = &WGPlugin{}
+
+// factories 按名称创建插件，实现了 Lifecycle 的插件随后通过 Init 读取配置
+var factories = map[string]func(logger *zap.Logger) Plugin{
+	"wg":       func(logger *zap.Logger) Plugin { return &WGPlugin{logger: logger} },
+	"nftables": func(logger *zap.Logger) Plugin { return newNftPlugin(logger) },
+	"dns":      func(logger *zap.Logger) Plugin { return newDNSPlugin(logger) },
+}
+
 // LoadPlugins loads plugins based on the configuration
 func LoadPlugins(logger *zap.Logger, cfg *config.Config) ([]Plugin, error) {
 	var plugins []Plugin
-	for _, pluginConfig := range cfg.Plugins {
-		switch pluginConfig.Name {
-		case "wg":
-			var spec config.WgSpec
-			if err := mapstructure.Decode(pluginConfig.Spec, &spec); err != nil {
-				return nil, fmt.Errorf("failed to decode wg plugin spec: %v", err)
-			}
-			plugins = append(plugins, NewWGPlugin(logger.With(zap.String("plugin", pluginConfig.Name)), &spec))
-		default:
-			logger.Warn("unknown plugin", zap.String("plugin", pluginConfig.Name))
+	for i := range cfg.Plugins {
+		p, err := LoadPlugin(logger, &cfg.Plugins[i])
+		if err != nil {
+			stopPlugins(plugins)
+			return nil, err
+		}
+		if p != nil {
+			plugins = append(plugins, p)
 		}
 	}
 	return plugins, nil
 }
 
+// LoadPlugin 创建并初始化一个插件，未知的内置插件返回 nil
+func LoadPlugin(logger *zap.Logger, pluginConfig *config.Plugin) (Plugin, error) {
+	pluginLogger := logger.With(zap.String("plugin", pluginConfig.Name))
+	var p Plugin
+	if pluginConfig.Address != "" {
+		var err error
+		if p, err = newExternalPlugin(pluginLogger, pluginConfig); err != nil {
+			return nil, err
+		}
+	} else {
+		factory, ok := factories[pluginConfig.Name]
+		if !ok {
+			logger.Warn("unknown plugin", zap.String("plugin", pluginConfig.Name))
+			return nil, nil
+		}
+		p = factory(pluginLogger)
+	}
+	if l, ok := p.(Lifecycle); ok {
+		if err := l.Init(pluginConfig); err != nil {
+			return nil, fmt.Errorf("failed to init %s plugin: %w", pluginConfig.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// newExternalPlugin 根据地址的 scheme 创建外部插件
+func newExternalPlugin(logger *zap.Logger, cfg *config.Plugin) (Plugin, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address of %s plugin: %w", cfg.Name, err)
+	}
+	switch u.Scheme {
+	case "exec":
+		return newExecPlugin(logger, cfg.Name), nil
+	default:
+		return nil, fmt.Errorf("unsupported address scheme %q of %s plugin (exec)", u.Scheme, cfg.Name)
+	}
+}
+
+// stopPlugins 停止已经初始化的插件
+func stopPlugins(plugins []Plugin) {
+	for _, p := range plugins {
+		if l, ok := p.(Lifecycle); ok {
+			_ = l.Stop()
+		}
+	}
+}
+
 // ExamplePlugin is an example implementation of the Plugin interface.
 type ExamplePlugin struct {
 	// Add fields if needed
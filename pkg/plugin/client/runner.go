@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/pkg/controller"
+	"go.uber.org/zap"
+)
+
+const (
+	// queueSize 每个插件排队等待处理的事件数量，超过后丢弃最旧的事件
+	queueSize = 256
+
+	// healthInterval 检查插件健康状态的间隔
+	healthInterval = 30 * time.Second
+)
+
+var errNotRunning = errors.New("plugin is not running")
+
+var (
+	// metricDropped 按插件统计队列已满时丢弃的事件数
+	metricDropped = expvar.NewMap("punchline_plugin_dropped_events")
+
+	// metricUnhealthy 按插件统计健康检查失败的次数
+	metricUnhealthy = expvar.NewMap("punchline_plugin_unhealthy")
+)
+
+var (
+	_ Plugin              = &Runner{}
+	_ ICEHandler          = &Runner{}
+	_ controller.Runnable = &Runner{}
+)
+
+// event 是排队等待插件处理的主机消息或 ICE 事件
+type event struct {
+	msg *apiv1.HostMessage
+	ice *ICEEvent
+}
+
+// Runner 为插件维护一个有界的事件队列，在单独的 goroutine 中按到达顺序交给插件处理，
+// 慢的插件不会阻塞调用方，也不会堆积 goroutine。
+// Runner 是 controller.Runnable，插件的 Start 和 Stop 由 Manager 驱动
+type Runner struct {
+	logger *zap.Logger
+	plugin Plugin
+
+	// mu 保护入队时丢弃最旧事件的过程
+	mu     sync.Mutex
+	events chan event
+
+	running atomic.Bool
+	health  atomic.Pointer[error]
+}
+
+// NewRunner 为插件 p 创建 Runner
+func NewRunner(logger *zap.Logger, p Plugin) *Runner {
+	return &Runner{
+		logger: logger.With(zap.String("plugin", p.Name())),
+		plugin: p,
+		events: make(chan event, queueSize),
+	}
+}
+
+// NewRunners 为每个插件创建 Runner
+func NewRunners(logger *zap.Logger, ps []Plugin) []*Runner {
+	runners := make([]*Runner, 0, len(ps))
+	for _, p := range ps {
+		runners = append(runners, NewRunner(logger, p))
+	}
+	return runners
+}
+
+// Unwrap 返回 Runner 包装的插件，用于判断插件实现的可选接口，p 不是 Runner 时原样返回
+func Unwrap(p Plugin) Plugin {
+	if r, ok := p.(*Runner); ok {
+		return r.plugin
+	}
+	return p
+}
+
+func (r *Runner) Name() string {
+	return r.plugin.Name()
+}
+
+// Handle 将主机消息放入队列，不会阻塞
+func (r *Runner) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	r.enqueue(event{msg: msg})
+}
+
+// HandleICE 将 ICE 事件放入队列，插件没有实现 ICEHandler 时忽略
+func (r *Runner) HandleICE(ctx context.Context, e *ICEEvent) {
+	if _, ok := r.plugin.(ICEHandler); !ok {
+		return
+	}
+	r.enqueue(event{ice: e})
+}
+
+// enqueue 放入事件，队列已满时丢弃最旧的事件，对端点更新来说最新的事件更重要
+func (r *Runner) enqueue(e event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		select {
+		case r.events <- e:
+			return
+		default:
+		}
+		select {
+		case <-r.events:
+			metricDropped.Add(r.plugin.Name(), 1)
+			r.logger.Warn("Plugin event queue is full, dropping the oldest event")
+		default:
+		}
+	}
+}
+
+// Start 启动插件并按顺序处理事件，直到上下文关闭后停止插件
+func (r *Runner) Start(ctx context.Context) error {
+	l, ok := r.plugin.(Lifecycle)
+	if ok {
+		if err := l.Start(ctx); err != nil {
+			return err
+		}
+		defer func() {
+			if err := l.Stop(); err != nil {
+				r.logger.Error("Failed to stop plugin", zap.Error(err))
+			}
+		}()
+	}
+	r.running.Store(true)
+	defer r.running.Store(false)
+
+	r.logger.Info("Plugin started")
+	r.checkHealth()
+
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.logger.Info("Plugin stopped")
+			return nil
+		case e := <-r.events:
+			r.handle(ctx, e)
+		case <-ticker.C:
+			r.checkHealth()
+		}
+	}
+}
+
+func (r *Runner) handle(ctx context.Context, e event) {
+	defer func() {
+		if err := recover(); err != nil {
+			r.logger.Error("Plugin panicked while handling event", zap.Any("panic", err))
+		}
+	}()
+
+	if e.msg != nil {
+		r.plugin.Handle(ctx, e.msg)
+		return
+	}
+	if h, ok := r.plugin.(ICEHandler); ok {
+		h.HandleICE(ctx, e.ice)
+	}
+}
+
+// checkHealth 检查插件的健康状态，状态变化时记录日志
+func (r *Runner) checkHealth() {
+	l, ok := r.plugin.(Lifecycle)
+	if !ok {
+		return
+	}
+	err := l.Health()
+	last := r.health.Swap(&err)
+	if err != nil {
+		metricUnhealthy.Add(r.plugin.Name(), 1)
+		if last == nil || *last == nil {
+			r.logger.Warn("Plugin is unhealthy", zap.Error(err))
+		}
+	} else if last != nil && *last != nil {
+		r.logger.Info("Plugin is healthy again")
+	}
+}
+
+// Health 返回最近一次健康检查的结果，Runner 没有运行时返回 errNotRunning
+func (r *Runner) Health() error {
+	if !r.running.Load() {
+		return errNotRunning
+	}
+	if err := r.health.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
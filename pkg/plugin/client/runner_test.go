@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordPlugin 记录收到的事件和生命周期调用
+type recordPlugin struct {
+	mu      sync.Mutex
+	hosts   []string
+	started bool
+	stopped bool
+	health  error
+}
+
+func (p *recordPlugin) Name() string { return "record" }
+
+func (p *recordPlugin) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts = append(p.hosts, msg.Hostname)
+}
+
+func (p *recordPlugin) HandleICE(ctx context.Context, event *ICEEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts = append(p.hosts, "ice:"+event.Hostname)
+}
+
+func (p *recordPlugin) Init(*config.Plugin) error { return nil }
+
+func (p *recordPlugin) Start(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = true
+	return nil
+}
+
+func (p *recordPlugin) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	return nil
+}
+
+func (p *recordPlugin) Health() error { return p.health }
+
+func (p *recordPlugin) received() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.hosts...)
+}
+
+func TestRunner(t *testing.T) {
+	p := &recordPlugin{health: errors.New("interface down")}
+	r := NewRunner(zap.NewNop(), p)
+	assert.Same(t, p, Unwrap(r))
+	assert.ErrorIs(t, r.Health(), errNotRunning)
+
+	// 启动前的事件在队列中等待，按顺序交给插件
+	r.Handle(context.Background(), &apiv1.HostMessage{Hostname: "a"})
+	r.HandleICE(context.Background(), &ICEEvent{Hostname: "b"})
+	r.Handle(context.Background(), &apiv1.HostMessage{Hostname: "c"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Start(ctx) }()
+
+	require.Eventually(t, func() bool { return len(p.received()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a", "ice:b", "c"}, p.received())
+	assert.EqualError(t, r.Health(), "interface down")
+
+	cancel()
+	require.NoError(t, <-done)
+	assert.True(t, p.started)
+	assert.True(t, p.stopped)
+}
+
+func TestRunnerDropsOldest(t *testing.T) {
+	r := NewRunner(zap.NewNop(), &recordPlugin{})
+
+	// 没有启动的 Runner 不处理事件，队列已满时丢弃最旧的事件，入队不会阻塞
+	for i := 0; i < queueSize+2; i++ {
+		r.Handle(context.Background(), &apiv1.HostMessage{Hostname: string(rune('a' + i%26))})
+	}
+	assert.Len(t, r.events, queueSize)
+	e := <-r.events
+	assert.Equal(t, string(rune('a'+2)), e.msg.Hostname)
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+)
+
+var (
+	_ Plugin       = &Set{}
+	_ ICEHandler   = &Set{}
+	_ Discoverer   = &Set{}
+	_ DirectProber = &Set{}
+)
+
+// Set 将事件交给按配置名称保存的一组插件，成员可以在运行时替换，
+// 持有 Set 的组件 (例如 ICE Peer) 在重新加载配置后不需要重新创建
+type Set struct {
+	mu      sync.RWMutex
+	names   []string
+	plugins map[string]Plugin
+}
+
+func NewSet() *Set {
+	return &Set{plugins: make(map[string]Plugin)}
+}
+
+func (s *Set) Name() string {
+	return "set"
+}
+
+// Put 添加或替换名为 name 的插件，新插件保持原来的顺序
+func (s *Set) Put(name string, p Plugin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.plugins[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.plugins[name] = p
+}
+
+// Remove 移除名为 name 的插件
+func (s *Set) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.plugins[name]; !ok {
+		return
+	}
+	delete(s.plugins, name)
+	for i, n := range s.names {
+		if n == name {
+			s.names = append(s.names[:i:i], s.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get 返回名为 name 的插件
+func (s *Set) Get(name string) (Plugin, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.plugins[name]
+	return p, ok
+}
+
+func (s *Set) list() []Plugin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ps := make([]Plugin, 0, len(s.names))
+	for _, name := range s.names {
+		ps = append(ps, s.plugins[name])
+	}
+	return ps
+}
+
+func (s *Set) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	for _, p := range s.list() {
+		p.Handle(ctx, msg)
+	}
+}
+
+func (s *Set) HandleICE(ctx context.Context, event *ICEEvent) {
+	for _, p := range s.list() {
+		if h, ok := p.(ICEHandler); ok {
+			h.HandleICE(ctx, event)
+		}
+	}
+}
+
+// PublicKey 返回第一个发现了公钥的成员的公钥
+func (s *Set) PublicKey() (string, error) {
+	var errs []error
+	for _, p := range s.list() {
+		d, ok := Unwrap(p).(Discoverer)
+		if !ok {
+			continue
+		}
+		key, err := d.PublicKey()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if key != "" {
+			return key, nil
+		}
+	}
+	return "", errors.Join(errs...)
+}
+
+// Subscriptions 返回所有成员发现的主机名，部分成员失败时仍然返回其他成员发现的主机名
+func (s *Set) Subscriptions() ([]string, error) {
+	var (
+		hosts []string
+		errs  []error
+	)
+	seen := make(map[string]bool)
+	for _, p := range s.list() {
+		d, ok := Unwrap(p).(Discoverer)
+		if !ok {
+			continue
+		}
+		found, err := d.Subscriptions()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, h := range found {
+			if h != "" && !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts, errors.Join(errs...)
+}
+
+// DirectSince 任一成员确认直连即为直连，没有成员可以判断时 ok 为 false
+func (s *Set) DirectSince(hostname string, since time.Time) (direct, ok bool) {
+	for _, p := range s.list() {
+		d, isProber := Unwrap(p).(DirectProber)
+		if !isProber {
+			continue
+		}
+		memberDirect, memberOK := d.DirectSince(hostname, since)
+		if memberOK {
+			ok = true
+			direct = direct || memberDirect
+		}
+	}
+	return direct, ok
+}
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// discoverPlugin 返回固定的公钥和订阅
+type discoverPlugin struct {
+	key   string
+	hosts []string
+	err   error
+}
+
+func (p *discoverPlugin) Name() string { return "discover" }
+
+func (p *discoverPlugin) Handle(ctx context.Context, msg *apiv1.HostMessage) {}
+
+func (p *discoverPlugin) PublicKey() (string, error) { return p.key, p.err }
+
+func (p *discoverPlugin) Subscriptions() ([]string, error) { return p.hosts, p.err }
+
+func TestSetDiscoverer(t *testing.T) {
+	s := NewSet()
+	s.Put("record", &recordPlugin{})
+	s.Put("broken", &discoverPlugin{hosts: []string{"a"}, err: errors.New("broken")})
+	// Runner 包装的插件同样参与发现
+	s.Put("wg", NewRunner(zap.NewNop(), &discoverPlugin{key: "key", hosts: []string{"a", "b"}}))
+
+	key, err := s.PublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "key", key)
+
+	hosts, err := s.Subscriptions()
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a", "b"}, hosts)
+
+	s.Remove("wg")
+	key, err = s.PublicKey()
+	assert.Error(t, err)
+	assert.Empty(t, key)
+}
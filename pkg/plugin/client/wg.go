@@ -2,32 +2,188 @@ package plugin
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
 	apiv1 "github.com/cossteam/punchline/api/v1"
 	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/transport/udp"
 	"github.com/cossteam/punchline/pkg/utils"
+	"github.com/cossteam/punchline/pkg/wgmux"
+	"github.com/pion/ice/v2"
 	"go.uber.org/zap"
-	"os/exec"
-	"strings"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const (
 	_name = "Wg"
 )
 
-// WGPlugin is a plugin that executes a shell command when a message is received.
+var (
+	errNoInterface = errors.New("no wireguard interface configured")
+	errUnknownPeer = errors.New("peer not found on wireguard interface")
+	errNoPeerKey   = errors.New("no wireguard public key for host")
+)
+
+// wgClient 是 wgctrl.Client 中插件用到的方法，测试中可以替换为假的实现
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+var _ wgClient = &wgctrl.Client{}
+
+// WGPlugin 通过 wgctrl 直接配置 WireGuard 接口，将对端的端点更新为打洞或中继得到的地址。
+// 主机名按照接口的对端表、自动模式下对端发布的公钥、主机名本身就是公钥的顺序映射到 WireGuard 对端
 type WGPlugin struct {
 	logger *zap.Logger
-	c      *config.WgSpec
 
-	lastEndpoint string
+	interfaces []*wgInterface
+
+	// mu 保护 client 和 learned，wgctrl.Client 不保证并发安全
+	mu     sync.Mutex
+	client wgClient
+	// learned 自动模式下从主机消息中学到的主机名到公钥的映射
+	learned map[string]wgtypes.Key
+
+	// mux 不为 nil 时 WireGuard 与 ICE 共用端口，端点需要经过 mux 转换
+	mux *wgmux.Mux
+	// muxRemotes 每个主机当前经过 mux 转换的远端地址，端点变化后释放旧地址的代理套接字，由 mu 保护
+	muxRemotes map[string]*net.UDPAddr
+	// relays 每个主机最近一次使用的中继地址，用于判断握手是否经过中继，由 mu 保护
+	relays map[string]*net.UDPAddr
+}
+
+// wgInterface 是解析后的 config.Interface
+type wgInterface struct {
+	config.Interface
+	peers map[string]wgPeer
+}
+
+type wgPeer struct {
+	key        wgtypes.Key
+	allowedIPs []net.IPNet
+}
+
+// NewWGPlugin 创建一个 WGPlugin，未配置 interfaces 时使用 iface 并关注所有主机。
+// 配置了 mux 时同时持有与 ICE 共用的端口，userspace 模式下还会创建 wireguard-go 设备
+func NewWGPlugin(logger *zap.Logger, c *config.WgSpec) (*WGPlugin, error) {
+	p := &WGPlugin{logger: logger}
+	if err := p.init(c); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func newWGPlugin(logger *zap.Logger, c *config.WgSpec, client wgClient) (*WGPlugin, error) {
+	p := &WGPlugin{logger: logger}
+	if err := p.configure(c, client); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Init 解析插件配置中的 spec，打开 wgctrl 客户端和共用的端口
+func (p *WGPlugin) Init(cfg *config.Plugin) error {
+	var spec config.WgSpec
+	if err := cfg.LoadPluginConfig(&spec); err != nil {
+		return fmt.Errorf("failed to decode wg plugin spec: %w", err)
+	}
+	return p.init(&spec)
+}
+
+func (p *WGPlugin) init(c *config.WgSpec) error {
+	var mux *wgmux.Mux
+	if c.Mux != nil {
+		interfaces, err := parseInterfaces(c)
+		if err != nil {
+			return err
+		}
+		if len(interfaces) != 1 {
+			return errors.New("wireguard mux requires exactly one interface")
+		}
+		if mux, err = wgmux.New(p.logger, c.Mux, interfaces[0].Iface); err != nil {
+			return err
+		}
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		if mux != nil {
+			_ = mux.Close()
+		}
+		return fmt.Errorf("failed to open wireguard control client: %w", err)
+	}
+
+	if err := p.configure(c, client); err != nil {
+		if mux != nil {
+			_ = mux.Close()
+		}
+		return err
+	}
+	p.mux = mux
+	return nil
 }
 
-// NewWGPlugin creates a new WGPlugin.
-func NewWGPlugin(logger *zap.Logger, c *config.WgSpec) *WGPlugin {
-	return &WGPlugin{
-		logger: logger,
-		c:      c,
+// configure 解析接口配置，失败时关闭 client
+func (p *WGPlugin) configure(c *config.WgSpec, client wgClient) error {
+	interfaces, err := parseInterfaces(c)
+	if err != nil {
+		_ = client.Close()
+		return err
 	}
+
+	p.interfaces = interfaces
+	p.client = client
+	p.learned = make(map[string]wgtypes.Key)
+	return nil
+}
+
+// parseInterfaces 解析接口配置和对端表
+func parseInterfaces(c *config.WgSpec) ([]*wgInterface, error) {
+	ifaces := c.Interfaces
+	if len(ifaces) == 0 && c.Iface != "" {
+		ifaces = []config.Interface{{Iface: c.Iface, Keepalive: c.Keepalive, Auto: c.Auto, Peers: c.Peers}}
+	}
+	if len(ifaces) == 0 {
+		return nil, errNoInterface
+	}
+
+	interfaces := make([]*wgInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Iface == "" {
+			return nil, fmt.Errorf("wireguard interface name is empty: %+v", iface)
+		}
+		wi := &wgInterface{Interface: iface, peers: make(map[string]wgPeer)}
+		for _, peer := range iface.Peers {
+			if peer.Hostname == "" {
+				return nil, fmt.Errorf("wireguard peer on %s has no hostname", iface.Iface)
+			}
+			if _, ok := wi.peers[peer.Hostname]; ok {
+				return nil, fmt.Errorf("duplicated wireguard peer %s on %s", peer.Hostname, iface.Iface)
+			}
+			key, err := wgtypes.ParseKey(peer.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key for wireguard peer %s on %s: %w", peer.Hostname, iface.Iface, err)
+			}
+			wp := wgPeer{key: key}
+			for _, cidr := range peer.AllowedIPs {
+				_, ipNet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid allowed ip for wireguard peer %s on %s: %w", peer.Hostname, iface.Iface, err)
+				}
+				wp.allowedIPs = append(wp.allowedIPs, *ipNet)
+			}
+			wi.peers[peer.Hostname] = wp
+		}
+		interfaces = append(interfaces, wi)
+	}
+	return interfaces, nil
 }
 
 // Name returns the name of the plugin.
@@ -35,19 +191,93 @@ func (p *WGPlugin) Name() string {
 	return _name
 }
 
-// Handle executes the shell command when a message is received.
+// Handle 根据打洞和中继通知更新对端的端点
 func (p *WGPlugin) Handle(ctx context.Context, msg *apiv1.HostMessage) {
+	p.learn(msg.Hostname, msg.PublicKey)
+
 	switch msg.Type {
 	case apiv1.HostMessage_HostUpdateNotification:
 		p.handleHostUpdateNotification(ctx, msg)
 	case apiv1.HostMessage_HostPunchNotification:
 		// TODO 暂时使用这个类型，后续需要修改
 		p.handleHostPunchNotification(ctx, msg)
+	case apiv1.HostMessage_HostRelayNotification:
+		p.handleHostRelayNotification(ctx, msg)
 	}
 }
 
+// HandleICE 将对端的端点设置为 ICE 选中的候选者对的远程地址。
+// 只有本地候选者使用 WireGuard 的监听端口时，对端才能通过这个端点到达本端的 WireGuard，见 config.WgMux
+func (p *WGPlugin) HandleICE(ctx context.Context, event *ICEEvent) {
+	switch event.Type {
+	case ICESelectedPairChanged, ICEConnected:
+		if event.Remote == nil {
+			return
+		}
+		for _, iface := range p.interfaces {
+			port := iface.Port
+			if p.mux != nil {
+				port = p.mux.Port()
+			}
+			if event.Local != nil && port != 0 && port != event.Local.Port && isConcerned(iface.Concern, event.Hostname) {
+				p.logger.Warn("ICE local candidate does not use the wireguard listen port, the peer may not reach this endpoint",
+					zap.String("interface", iface.Iface),
+					zap.Int("port", port),
+					zap.Stringer("local", event.Local))
+			}
+		}
+		_ = p.setEndpoint(event.Hostname, event.Remote)
+	case ICEDisconnected:
+		p.logger.Debug("ICE disconnected, keeping the last endpoint", zap.String("hostname", event.Hostname))
+	}
+}
+
+// UDPMux 返回与 WireGuard 共用端口的 ICE UDPMux，没有配置 mux 时返回 nil
+func (p *WGPlugin) UDPMux() ice.UniversalUDPMux {
+	if p.mux == nil {
+		return nil
+	}
+	return p.mux.UDPMux()
+}
+
+// Start 没有需要在后台运行的任务
+func (p *WGPlugin) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop 关闭 wgctrl 客户端和共用的端口
+func (p *WGPlugin) Stop() error {
+	return p.Close()
+}
+
+// Health 检查所有配置的 WireGuard 接口是否存在
+func (p *WGPlugin) Health() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, iface := range p.interfaces {
+		if _, err := p.client.Device(iface.Iface); err != nil {
+			return fmt.Errorf("wireguard interface %s: %w", iface.Iface, err)
+		}
+	}
+	return nil
+}
+
+// Close 关闭 wgctrl 客户端和共用的端口
+func (p *WGPlugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mux != nil {
+		_ = p.mux.Close()
+	}
+	return p.client.Close()
+}
+
 // isConcerned checks if the hostname is in the list of concerns.
+// 没有配置 concern 时关注所有主机
 func isConcerned(concerns []string, hostname string) bool {
+	if len(concerns) == 0 {
+		return true
+	}
 	for _, concern := range concerns {
 		if concern == hostname {
 			return true
@@ -56,19 +286,190 @@ func isConcerned(concerns []string, hostname string) bool {
 	return false
 }
 
-func (p *WGPlugin) SetPeerEndpoint(iface string, peer string, endpoint string) error {
-	cmd := []string{"wg", "set", iface, "peer", peer, "endpoint", endpoint}
-	output, err := run(
-		"wg", "set", iface,
-		"peer", peer,
-		"persistent-keepalive", "10",
-		"endpoint", endpoint,
-	)
+// PublicKey 返回第一个自动模式接口的公钥，没有自动模式的接口时返回空字符串
+func (p *WGPlugin) PublicKey() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, iface := range p.interfaces {
+		if !iface.Auto {
+			continue
+		}
+		device, err := p.client.Device(iface.Iface)
+		if err != nil {
+			return "", fmt.Errorf("failed to get wireguard interface %s: %w", iface.Iface, err)
+		}
+		return device.PublicKey.String(), nil
+	}
+	return "", nil
+}
+
+// Subscriptions 返回对端表中的主机名，以及自动模式接口上不在对端表中的对端，
+// 这些对端以公钥作为主机名
+func (p *WGPlugin) Subscriptions() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(hostname string) {
+		if !seen[hostname] {
+			seen[hostname] = true
+			hosts = append(hosts, hostname)
+		}
+	}
+
+	for _, iface := range p.interfaces {
+		known := make(map[wgtypes.Key]bool)
+		for hostname, peer := range iface.peers {
+			known[peer.key] = true
+			add(hostname)
+		}
+		if !iface.Auto {
+			continue
+		}
+		device, err := p.client.Device(iface.Iface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get wireguard interface %s: %w", iface.Iface, err)
+		}
+		for _, peer := range device.Peers {
+			if !known[peer.PublicKey] {
+				add(peer.PublicKey.String())
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// learn 记录自动模式下对端在主机消息中发布的公钥。主机消息没有经过对端签名，
+// 因此公钥只能绑定到第一个声明它的主机名，已经属于对端表中或者其他主机名的公钥会被拒绝，
+// 否则任何主机都可以通过发布别人的公钥把对方的端点改到自己的地址
+func (p *WGPlugin) learn(hostname, publicKey string) {
+	if hostname == "" || publicKey == "" {
+		return
+	}
+	key, err := wgtypes.ParseKey(publicKey)
+	if err != nil {
+		p.logger.Warn("Ignoring invalid public key in host message",
+			zap.String("hostname", hostname),
+			zap.String("publicKey", publicKey),
+			zap.Error(err))
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if owner := p.unlockedKeyOwner(key); owner != "" && owner != hostname {
+		p.logger.Warn("Ignoring public key already claimed by another host",
+			zap.String("hostname", hostname),
+			zap.String("owner", owner),
+			zap.Stringer("publicKey", key))
+		return
+	}
+	if old, ok := p.learned[hostname]; !ok || old != key {
+		p.logger.Info("Learned wireguard public key", zap.String("hostname", hostname), zap.Stringer("publicKey", key))
+		p.learned[hostname] = key
+	}
+}
+
+// unlockedKeyOwner 假设您持有 mu，返回对端表中或者已经学到的使用 key 的主机名，没有时返回空字符串
+func (p *WGPlugin) unlockedKeyOwner(key wgtypes.Key) string {
+	for _, iface := range p.interfaces {
+		for hostname, peer := range iface.peers {
+			if peer.key == key {
+				return hostname
+			}
+		}
+	}
+	for hostname, learned := range p.learned {
+		if learned == key {
+			return hostname
+		}
+	}
+	return ""
+}
+
+// resolve 返回 iface 上 hostname 对应的对端，依次查找对端表、自动模式下学到的公钥、主机名本身
+func (p *WGPlugin) resolve(iface *wgInterface, hostname string) (wgPeer, error) {
+	if peer, ok := iface.peers[hostname]; ok {
+		return peer, nil
+	}
+	if iface.Auto {
+		if key, ok := p.learned[hostname]; ok {
+			return wgPeer{key: key}, nil
+		}
+	}
+	if key, err := wgtypes.ParseKey(hostname); err == nil {
+		return wgPeer{key: key}, nil
+	}
+	return wgPeer{}, fmt.Errorf("%w: %s on %s", errNoPeerKey, hostname, iface.Iface)
+}
+
+// setPeerEndpoint 将 iface 上 hostname 对应的对端的端点设置为 endpoint。
+// 对端必须已经存在于接口上，除非对端表为其配置了 allowed ips，端点没有变化时不做修改
+func (p *WGPlugin) setPeerEndpoint(iface *wgInterface, hostname string, endpoint *net.UDPAddr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peer, err := p.resolve(iface, hostname)
 	if err != nil {
-		p.logger.Error("failed to execute shell command", zap.Error(err), zap.String("cmd", strings.Join(cmd, " ")), zap.String("output", output))
-	} else {
-		p.logger.Info("Shell command executed successfully", zap.String("cmd", strings.Join(cmd, " ")), zap.String("output", output))
+		return err
 	}
+
+	device, err := p.client.Device(iface.Iface)
+	if err != nil {
+		return fmt.Errorf("failed to get wireguard interface %s: %w", iface.Iface, err)
+	}
+
+	var current *wgtypes.Peer
+	for i := range device.Peers {
+		if device.Peers[i].PublicKey == peer.key {
+			current = &device.Peers[i]
+			break
+		}
+	}
+	if current == nil && len(peer.allowedIPs) == 0 {
+		return fmt.Errorf("%w: %s (%s) on %s", errUnknownPeer, hostname, peer.key, iface.Iface)
+	}
+
+	keepalive := time.Duration(iface.Keepalive) * time.Second
+	pc := wgtypes.PeerConfig{
+		PublicKey:  peer.key,
+		UpdateOnly: current != nil,
+		Endpoint:   endpoint,
+	}
+	if iface.Keepalive > 0 {
+		pc.PersistentKeepaliveInterval = &keepalive
+	}
+	if len(peer.allowedIPs) > 0 && (current == nil || !ipNetsEqual(current.AllowedIPs, peer.allowedIPs)) {
+		pc.ReplaceAllowedIPs = true
+		pc.AllowedIPs = peer.allowedIPs
+	}
+
+	var old *net.UDPAddr
+	if current != nil {
+		old = current.Endpoint
+		if endpointEqual(current.Endpoint, endpoint) && !pc.ReplaceAllowedIPs &&
+			(iface.Keepalive == 0 || current.PersistentKeepaliveInterval == keepalive) {
+			p.logger.Debug("Skip setting peer endpoint",
+				zap.String("interface", iface.Iface),
+				zap.String("hostname", hostname),
+				zap.Stringer("endpoint", endpoint))
+			return nil
+		}
+	}
+
+	if err := p.client.ConfigureDevice(iface.Iface, wgtypes.Config{Peers: []wgtypes.PeerConfig{pc}}); err != nil {
+		return fmt.Errorf("failed to configure wireguard interface %s: %w", iface.Iface, err)
+	}
+
+	p.logger.Info("Set peer endpoint",
+		zap.String("interface", iface.Iface),
+		zap.String("hostname", hostname),
+		zap.Stringer("peer", peer.key),
+		zap.Stringer("old", old),
+		zap.Stringer("endpoint", endpoint),
+		zap.Bool("created", current == nil))
 	return nil
 }
 
@@ -78,45 +479,143 @@ func (p *WGPlugin) handleHostUpdateNotification(ctx context.Context, msg *apiv1.
 }
 
 func (p *WGPlugin) handleHostPunchNotification(ctx context.Context, msg *apiv1.HostMessage) {
+	switch {
+	case msg.ExternalAddr != nil:
+		p.setEndpoint(msg.Hostname, toUDPAddr(utils.NewUDPAddrFromLH4(msg.ExternalAddr)))
+	case msg.ExternalAddr6 != nil:
+		p.setEndpoint(msg.Hostname, toUDPAddr(utils.NewUDPAddrFromLH6(msg.ExternalAddr6)))
+	}
+}
 
-	hostname := msg.Hostname
-	externalAddr := utils.NewUDPAddrFromLH4(msg.ExternalAddr).String()
-
-	if p.lastEndpoint != "" && p.lastEndpoint == externalAddr {
-		p.logger.Debug("Skip setting peer endpoint",
-			zap.String("interface", p.c.Iface),
-			zap.String("hostname", hostname),
-			zap.String("externalAddr", externalAddr))
+// handleHostRelayNotification 将对端的端点设置为服务端分配的中继地址，中继会话只有一个地址族，
+// 两种地址都有时优先使用 IPv4
+func (p *WGPlugin) handleHostRelayNotification(ctx context.Context, msg *apiv1.HostMessage) {
+	var relay *net.UDPAddr
+	switch {
+	case len(msg.RelayAddr) > 0:
+		relay = toUDPAddr(utils.NewUDPAddrFromLH4(msg.RelayAddr[0]))
+	case len(msg.RelayAddr6) > 0:
+		relay = toUDPAddr(utils.NewUDPAddrFromLH6(msg.RelayAddr6[0]))
+	default:
 		return
 	}
 
-	p.lastEndpoint = externalAddr
+	p.mu.Lock()
+	if p.relays == nil {
+		p.relays = make(map[string]*net.UDPAddr)
+	}
+	p.relays[msg.Hostname] = relay
+	p.mu.Unlock()
 
-	if err := p.SetPeerEndpoint(p.c.Iface, hostname, externalAddr); err != nil {
-		p.logger.Error("Failed to set peer endpoint",
-			zap.String("interface", p.c.Iface),
-			zap.String("hostname", hostname),
-			zap.String("externalAddr", externalAddr),
-			zap.Error(err))
+	p.setEndpoint(msg.Hostname, relay)
+}
+
+// DirectSince 检查关注 hostname 的接口上，对端在 since 之后是否完成了握手且端点不是中继地址。
+// WireGuard 会把端点漫游到最近收到数据包的地址，因此握手时的端点就是实际的路径。
+// 与 ICE 共用端口时端点是 mux 的代理地址，无法判断，由 ICE 事件确认直连
+func (p *WGPlugin) DirectSince(hostname string, since time.Time) (direct, ok bool) {
+	if p.mux != nil {
+		return false, false
 	}
 
-	//for _, iface := range p.c.Interfaces {
-	//	if isConcerned(iface.Concern, hostname) {
-	//		if err := p.SetPeerEndpoint(iface.Iface, hostname, externalAddr); err != nil {
-	//			p.logger.Error("Failed to set peer endpoint",
-	//				zap.String("interface", iface.Iface),
-	//				zap.String("hostname", hostname),
-	//				zap.String("externalAddr", externalAddr),
-	//				zap.Error(err))
-	//		}
-	//	}
-	//}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	relay := p.relays[hostname]
+	for _, iface := range p.interfaces {
+		if !isConcerned(iface.Concern, hostname) {
+			continue
+		}
+		peer, err := p.resolve(iface, hostname)
+		if err != nil {
+			continue
+		}
+		device, err := p.client.Device(iface.Iface)
+		if err != nil {
+			continue
+		}
+		for _, current := range device.Peers {
+			if current.PublicKey != peer.key {
+				continue
+			}
+			ok = true
+			if current.LastHandshakeTime.After(since) && current.Endpoint != nil && !endpointEqual(current.Endpoint, relay) {
+				return true, true
+			}
+		}
+	}
+	return false, ok
 }
 
-func run(cmd string, args ...string) (string, error) {
-	b, err := exec.Command(cmd, args...).Output()
-	if err != nil {
-		return "", err
+// setEndpoint 在所有关注 hostname 的接口上更新对端的端点，返回所有接口上的错误
+func (p *WGPlugin) setEndpoint(hostname string, endpoint *net.UDPAddr) error {
+	if p.mux != nil {
+		proxy, err := p.mux.Endpoint(endpoint)
+		if err != nil {
+			p.logger.Error("Failed to get mux endpoint", zap.String("hostname", hostname), zap.Stringer("endpoint", endpoint), zap.Error(err))
+			return err
+		}
+		p.swapMuxRemote(hostname, endpoint)
+		endpoint = proxy
 	}
-	return strings.TrimSpace(string(b)), nil
+
+	var errs []error
+	for _, iface := range p.interfaces {
+		if !isConcerned(iface.Concern, hostname) {
+			continue
+		}
+		if err := p.setPeerEndpoint(iface, hostname, endpoint); err != nil {
+			p.logger.Error("Failed to set peer endpoint",
+				zap.String("interface", iface.Iface),
+				zap.String("hostname", hostname),
+				zap.Stringer("endpoint", endpoint),
+				zap.Error(err))
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// swapMuxRemote 记录 hostname 当前经过 mux 的远端地址，并释放之前的远端地址
+func (p *WGPlugin) swapMuxRemote(hostname string, remote *net.UDPAddr) {
+	p.mu.Lock()
+	if p.muxRemotes == nil {
+		p.muxRemotes = make(map[string]*net.UDPAddr)
+	}
+	old := p.muxRemotes[hostname]
+	p.muxRemotes[hostname] = remote
+	p.mu.Unlock()
+
+	if old != nil && !endpointEqual(old, remote) {
+		p.mux.Release(old)
+	}
+}
+
+// endpointEqual 比较两个端点，IPv4 和 IPv4 映射的 IPv6 地址视为相同
+func endpointEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// ipNetsEqual 不考虑顺序比较两组网段
+func ipNetsEqual(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]int, len(a))
+	for _, n := range a {
+		set[n.String()]++
+	}
+	for _, n := range b {
+		if set[n.String()] == 0 {
+			return false
+		}
+		set[n.String()]--
+	}
+	return true
+}
+
+func toUDPAddr(addr *udp.Addr) *net.UDPAddr {
+	return &net.UDPAddr{IP: addr.IP, Port: int(addr.Port)}
 }
@@ -0,0 +1,290 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	apiv1 "github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeWGClient 在内存中保存 WireGuard 接口，模拟 wgctrl.Client
+type fakeWGClient struct {
+	devices    map[string]*wgtypes.Device
+	configured map[string][]wgtypes.Config
+	closed     bool
+}
+
+func newFakeWGClient(devices ...*wgtypes.Device) *fakeWGClient {
+	c := &fakeWGClient{
+		devices:    make(map[string]*wgtypes.Device),
+		configured: make(map[string][]wgtypes.Config),
+	}
+	for _, d := range devices {
+		c.devices[d.Name] = d
+	}
+	return c
+}
+
+func (c *fakeWGClient) Device(name string) (*wgtypes.Device, error) {
+	d, ok := c.devices[name]
+	if !ok {
+		return nil, errors.New("file does not exist")
+	}
+	return d, nil
+}
+
+func (c *fakeWGClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	d, ok := c.devices[name]
+	if !ok {
+		return errors.New("file does not exist")
+	}
+	c.configured[name] = append(c.configured[name], cfg)
+	for _, pc := range cfg.Peers {
+		for i := range d.Peers {
+			if d.Peers[i].PublicKey != pc.PublicKey {
+				continue
+			}
+			if pc.Endpoint != nil {
+				d.Peers[i].Endpoint = pc.Endpoint
+			}
+			if pc.PersistentKeepaliveInterval != nil {
+				d.Peers[i].PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeWGClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key.PublicKey()
+}
+
+func punchMessage(hostname string, ip net.IP, port uint32) *apiv1.HostMessage {
+	return &apiv1.HostMessage{
+		Type:         apiv1.HostMessage_HostPunchNotification,
+		Hostname:     hostname,
+		ExternalAddr: apiv1.NewIpv4Addr(ip, port),
+	}
+}
+
+func TestWGPluginSetEndpoint(t *testing.T) {
+	peer1, peer2, unknown := newKey(t), newKey(t), newKey(t)
+	client := newFakeWGClient(
+		&wgtypes.Device{Name: "wg0", Peers: []wgtypes.Peer{{PublicKey: peer1}, {PublicKey: peer2}}},
+		&wgtypes.Device{Name: "wg1", Peers: []wgtypes.Peer{{PublicKey: peer2}}},
+	)
+
+	p, err := newWGPlugin(zap.NewNop(), &config.WgSpec{
+		Interfaces: []config.Interface{
+			{Iface: "wg0", Keepalive: 25},
+			{Iface: "wg1", Concern: []string{peer2.String()}},
+		},
+	}, client)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	ip := net.IPv4(1, 2, 3, 4)
+
+	// peer1 只在 wg0 上关注
+	p.Handle(ctx, punchMessage(peer1.String(), ip, 5000))
+	require.Len(t, client.configured["wg0"], 1)
+	assert.Empty(t, client.configured["wg1"])
+	pc := client.configured["wg0"][0].Peers[0]
+	assert.True(t, pc.UpdateOnly)
+	assert.Equal(t, 5000, pc.Endpoint.Port)
+	assert.Equal(t, 25*time.Second, *pc.PersistentKeepaliveInterval)
+
+	// 端点没有变化时不重复配置
+	p.Handle(ctx, punchMessage(peer1.String(), ip, 5000))
+	assert.Len(t, client.configured["wg0"], 1)
+
+	// peer2 在两个接口上都被更新，wg1 没有配置 keepalive
+	p.Handle(ctx, punchMessage(peer2.String(), ip, 6000))
+	assert.Len(t, client.configured["wg0"], 2)
+	require.Len(t, client.configured["wg1"], 1)
+	assert.Nil(t, client.configured["wg1"][0].Peers[0].PersistentKeepaliveInterval)
+
+	// 只有 IPv6 的中继会话使用 relay_addr6
+	p.Handle(ctx, &apiv1.HostMessage{
+		Type:       apiv1.HostMessage_HostRelayNotification,
+		Hostname:   peer1.String(),
+		RelayAddr6: []*apiv1.Ipv6Addr{apiv1.NewIpv6Addr(net.ParseIP("2001:db8::1"), 4242)},
+	})
+	require.Len(t, client.configured["wg0"], 3)
+	assert.Equal(t, "[2001:db8::1]:4242", client.configured["wg0"][2].Peers[0].Endpoint.String())
+
+	// 接口上不存在的对端和非法公钥都会报告错误
+	err = p.setEndpoint(unknown.String(), &net.UDPAddr{IP: ip, Port: 7000})
+	assert.ErrorIs(t, err, errUnknownPeer)
+	assert.Error(t, p.setEndpoint("client2", &net.UDPAddr{IP: ip, Port: 7000}))
+	assert.Len(t, client.configured["wg0"], 3)
+
+	require.NoError(t, p.Close())
+	assert.True(t, client.closed)
+}
+
+func TestNewWGPlugin(t *testing.T) {
+	_, err := newWGPlugin(zap.NewNop(), &config.WgSpec{}, newFakeWGClient())
+	assert.ErrorIs(t, err, errNoInterface)
+
+	p, err := newWGPlugin(zap.NewNop(), &config.WgSpec{Iface: "wg0", Keepalive: 10}, newFakeWGClient())
+	require.NoError(t, err)
+	require.Len(t, p.interfaces, 1)
+	assert.Equal(t, config.Interface{Iface: "wg0", Keepalive: 10}, p.interfaces[0].Interface)
+}
+
+func TestWGPluginPeerTable(t *testing.T) {
+	local, peer1, peer2, peer3 := newKey(t), newKey(t), newKey(t), newKey(t)
+	client := newFakeWGClient(&wgtypes.Device{
+		Name:      "wg0",
+		PublicKey: local,
+		Peers:     []wgtypes.Peer{{PublicKey: peer1}, {PublicKey: peer2}},
+	})
+
+	p, err := newWGPlugin(zap.NewNop(), &config.WgSpec{
+		Iface: "wg0",
+		Auto:  true,
+		Peers: []config.WgPeer{
+			{Hostname: "client1", PublicKey: peer1.String()},
+			{Hostname: "client3", PublicKey: peer3.String(), AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+	}, client)
+	require.NoError(t, err)
+
+	key, err := p.PublicKey()
+	require.NoError(t, err)
+	assert.Equal(t, local.String(), key)
+
+	// 对端表中的主机和接口上未映射的对端 (以公钥作为主机名)
+	hosts, err := p.Subscriptions()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"client1", "client3", peer2.String()}, hosts)
+
+	ctx := context.Background()
+	ip := net.IPv4(1, 2, 3, 4)
+
+	// 主机名通过对端表映射到公钥
+	p.Handle(ctx, punchMessage("client1", ip, 5000))
+	require.Len(t, client.configured["wg0"], 1)
+	assert.Equal(t, peer1, client.configured["wg0"][0].Peers[0].PublicKey)
+
+	// 自动模式下使用对端发布的公钥
+	msg := punchMessage("client2", ip, 6000)
+	msg.PublicKey = peer2.String()
+	p.Handle(ctx, msg)
+	require.Len(t, client.configured["wg0"], 2)
+	assert.Equal(t, peer2, client.configured["wg0"][1].Peers[0].PublicKey)
+
+	// 配置了 allowed ips 的对端不存在时被创建
+	p.Handle(ctx, punchMessage("client3", ip, 7000))
+	require.Len(t, client.configured["wg0"], 3)
+	pc := client.configured["wg0"][2].Peers[0]
+	assert.False(t, pc.UpdateOnly)
+	assert.True(t, pc.ReplaceAllowedIPs)
+	require.Len(t, pc.AllowedIPs, 1)
+	assert.Equal(t, "10.0.0.3/32", pc.AllowedIPs[0].String())
+
+	// 未知主机报告错误
+	assert.ErrorIs(t, p.setEndpoint("client4", &net.UDPAddr{IP: ip, Port: 8000}), errNoPeerKey)
+
+	// 已经属于对端表或者其他主机名的公钥不能被再次声明
+	for _, stolen := range []wgtypes.Key{peer1, peer2} {
+		msg = punchMessage("client5", net.IPv4(6, 6, 6, 6), 9000)
+		msg.PublicKey = stolen.String()
+		p.Handle(ctx, msg)
+	}
+	assert.Len(t, client.configured["wg0"], 3)
+	assert.ErrorIs(t, p.setEndpoint("client5", &net.UDPAddr{IP: ip, Port: 9000}), errNoPeerKey)
+}
+
+func TestParseInterfaces(t *testing.T) {
+	_, err := parseInterfaces(&config.WgSpec{Iface: "wg0", Peers: []config.WgPeer{{Hostname: "client1", PublicKey: "invalid"}}})
+	assert.Error(t, err)
+
+	key := newKey(t).String()
+	_, err = parseInterfaces(&config.WgSpec{Iface: "wg0", Peers: []config.WgPeer{
+		{Hostname: "client1", PublicKey: key},
+		{Hostname: "client1", PublicKey: key},
+	}})
+	assert.Error(t, err)
+
+	_, err = parseInterfaces(&config.WgSpec{Iface: "wg0", Peers: []config.WgPeer{
+		{Hostname: "client1", PublicKey: key, AllowedIPs: []string{"10.0.0.1"}},
+	}})
+	assert.Error(t, err)
+}
+
+func TestWGPluginHandleICE(t *testing.T) {
+	peer := newKey(t)
+	client := newFakeWGClient(&wgtypes.Device{Name: "wg0", Peers: []wgtypes.Peer{{PublicKey: peer}}})
+
+	p, err := newWGPlugin(zap.NewNop(), &config.WgSpec{
+		Iface: "wg0",
+		Peers: []config.WgPeer{{Hostname: "client2", PublicKey: peer.String()}},
+	}, client)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	remote := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 51820}
+	p.HandleICE(ctx, &ICEEvent{
+		Type:     ICESelectedPairChanged,
+		Hostname: "client2",
+		Local:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51820},
+		Remote:   remote,
+	})
+	require.Len(t, client.configured["wg0"], 1)
+	assert.Equal(t, remote, client.configured["wg0"][0].Peers[0].Endpoint)
+
+	// 连接建立时端点没有变化，断开时保留最后的端点
+	p.HandleICE(ctx, &ICEEvent{Type: ICEConnected, Hostname: "client2", Remote: remote})
+	p.HandleICE(ctx, &ICEEvent{Type: ICEDisconnected, Hostname: "client2"})
+	assert.Len(t, client.configured["wg0"], 1)
+}
+
+func TestWGPluginDirectSince(t *testing.T) {
+	peer := newKey(t)
+	client := newFakeWGClient(&wgtypes.Device{Name: "wg0", Peers: []wgtypes.Peer{{PublicKey: peer}}})
+	p, err := newWGPlugin(zap.NewNop(), &config.WgSpec{Interfaces: []config.Interface{{Iface: "wg0"}}}, client)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	since := time.Now()
+	p.Handle(ctx, &apiv1.HostMessage{
+		Type:      apiv1.HostMessage_HostRelayNotification,
+		Hostname:  peer.String(),
+		RelayAddr: []*apiv1.Ipv4Addr{apiv1.NewIpv4Addr(net.ParseIP("5.6.7.8"), 4242)},
+	})
+
+	// 经过中继的握手不算直连
+	client.devices["wg0"].Peers[0].LastHandshakeTime = since.Add(time.Second)
+	direct, ok := p.DirectSince(peer.String(), since)
+	assert.True(t, ok)
+	assert.False(t, direct)
+
+	// 切换到直连端点后的握手
+	p.Handle(ctx, punchMessage(peer.String(), net.IPv4(1, 2, 3, 4), 5000))
+	direct, ok = p.DirectSince(peer.String(), since)
+	assert.True(t, ok)
+	assert.True(t, direct)
+	direct, _ = p.DirectSince(peer.String(), since.Add(2*time.Second))
+	assert.False(t, direct)
+
+	// 不在接口上的主机无法判断
+	_, ok = p.DirectSince(newKey(t).String(), since)
+	assert.False(t, ok)
+}
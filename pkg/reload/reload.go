@@ -0,0 +1,114 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cossteam/punchline/config"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const defaultDebounce = 500 * time.Millisecond
+
+// Option Watcher 的可选配置
+type Option func(*Watcher)
+
+// WithDebounce 设置合并连续文件事件的时间窗口，编辑器保存文件时通常会产生多个事件
+func WithDebounce(d time.Duration) Option {
+	return func(w *Watcher) {
+		if d > 0 {
+			w.debounce = d
+		}
+	}
+}
+
+// Watcher 在配置文件变化或者收到 SIGHUP 时重新加载配置，加载成功后交给 apply 应用。
+// 监听的是配置文件所在的目录，编辑器以重命名方式保存文件时也能收到事件，
+// 加载或校验失败时保留正在运行的配置
+type Watcher struct {
+	logger   *zap.Logger
+	path     string
+	debounce time.Duration
+
+	load  func() (*config.Config, error)
+	apply func(*config.Config)
+}
+
+// NewWatcher 创建一个 Watcher，需要调用 Start 开始监听
+func NewWatcher(logger *zap.Logger, path string, load func() (*config.Config, error), apply func(*config.Config), opts ...Option) *Watcher {
+	w := &Watcher{
+		logger:   logger,
+		path:     filepath.Clean(path),
+		debounce: defaultDebounce,
+		load:     load,
+		apply:    apply,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+func (w *Watcher) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(w.path)); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			w.logger.Info("received SIGHUP, reloading configuration")
+			w.reload()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != w.path || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			timer.Reset(w.debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Warn("config watcher error", zap.Error(err))
+		case <-timer.C:
+			// 以重命名方式保存时，原文件被移走后目录中的新文件才出现
+			if _, err := os.Stat(w.path); err != nil {
+				w.logger.Warn("config file is not available", zap.String("path", w.path), zap.Error(err))
+				continue
+			}
+			w.logger.Info("config file changed, reloading configuration", zap.String("path", w.path))
+			w.reload()
+		}
+	}
+}
+
+func (w *Watcher) reload() {
+	c, err := w.load()
+	if err != nil {
+		w.logger.Error("failed to reload configuration, keeping the running configuration", zap.Error(err))
+		return
+	}
+	w.apply(c)
+}
@@ -0,0 +1,70 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("hostname: a\n"), 0o644))
+
+	applied := make(chan *config.Config, 4)
+	w := NewWatcher(zap.NewNop(), file, func() (*config.Config, error) {
+		return config.Load(file)
+	}, func(c *config.Config) {
+		applied <- c
+	}, WithDebounce(50*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Start(ctx) }()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}()
+
+	expect := func(hostname string) {
+		t.Helper()
+		select {
+		case c := <-applied:
+			assert.Equal(t, hostname, c.Hostname)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("configuration %s was not applied", hostname)
+		}
+	}
+
+	// 等待 Watcher 开始监听
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, os.WriteFile(file, []byte("hostname: b\n"), 0o644))
+	expect("b")
+
+	// 以重命名方式保存
+	tmp := filepath.Join(dir, ".config.yaml.swp")
+	require.NoError(t, os.WriteFile(tmp, []byte("hostname: c\n"), 0o644))
+	require.NoError(t, os.Rename(tmp, file))
+	expect("c")
+
+	// 无法解析的配置不会被应用
+	require.NoError(t, os.WriteFile(file, []byte("unknown: true\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("hostname: d\n"), 0o644))
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, applied)
+
+	require.NoError(t, os.WriteFile(file, []byte("hostname: d\n"), 0o644))
+	expect("d")
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	expect("d")
+}
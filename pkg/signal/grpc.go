@@ -110,7 +110,8 @@ func (c *SignalingClient) Subscribe(ctx context.Context, topic string, handler f
 		for {
 			res, err := stream.Recv()
 			if err != nil {
-				if err == io.EOF || c.closed.Load() {
+				// ctx 取消表示订阅方已经退出，例如重新加载配置时移除了该订阅
+				if err == io.EOF || c.closed.Load() || ctx.Err() != nil {
 					break
 				}
 				log.Printf("error receiving message from stream: %v", err)
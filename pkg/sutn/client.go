@@ -5,7 +5,7 @@ import (
 	"github.com/cossteam/punchline/pkg/transport/udp"
 	"github.com/pion/stun"
 	"net"
-	"sync"
+	"strconv"
 )
 
 // STUNClient 是一个用于与 STUN 服务器通信的接口。
@@ -22,6 +22,9 @@ type STUNClient interface {
 
 	ExternalAddrs() ([]*udp.Addr, error)
 
+	// DetectNAT 执行 RFC 5780 行为测试，返回本机所在 NAT 的类型
+	DetectNAT() (*NATType, error)
+
 	Close() error
 }
 
@@ -49,11 +52,16 @@ func NewClient(stunURI string) (STUNClient, error) {
 		return nil, fmt.Errorf("failed to dial STUN server: %w", err)
 	}
 
-	return &stunClient{conn: conn}, nil
+	return &stunClient{
+		conn:   conn,
+		server: net.JoinHostPort(u.Host, strconv.Itoa(u.Port)),
+	}, nil
 }
 
 type stunClient struct {
 	conn *stun.Client
+	// server STUN 服务器的 host:port
+	server string
 }
 
 func (c *stunClient) ExternalAddr() (*udp.Addr, error) {
@@ -103,75 +111,16 @@ func (c *stunClient) ExternalAddr() (*udp.Addr, error) {
 	return resultAddr, nil
 }
 
+// ExternalAddrs 返回单个服务器看到的外部地址，需要查询多个服务器时使用 MultiClient
 func (c *stunClient) ExternalAddrs() ([]*udp.Addr, error) {
-	var wg sync.WaitGroup
-	addrMap := make(map[string]*udp.Addr)
-	var resultErr error
-
-	// Fetch addresses using ExternalAddr
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		addr, err := c.ExternalAddr()
-		if err != nil {
-			resultErr = fmt.Errorf("failed to get external address: %w", err)
-			return
-		}
-		if addr != nil && addr.IP != nil {
-			key := fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
-			addrMap[key] = addr
-		}
-	}()
-
-	// Fetch addresses using OtherAddress
-	//wg.Add(1)
-	//go func() {
-	//	defer wg.Done()
-	//	otherAddr, err := c.OtherAddress()
-	//	if err != nil {
-	//		resultErr = fmt.Errorf("failed to get other address: %w", err)
-	//		return
-	//	}
-	//
-	//	if otherAddr == nil || otherAddr.IP == nil {
-	//		return
-	//	}
-	//
-	//	// Use the address from OtherAddress as a new STUN server
-	//	newStunURI := fmt.Sprintf("stun:%s:%d", otherAddr.IP.String(), otherAddr.Port)
-	//	newClient, err := NewClient(newStunURI)
-	//	if err != nil {
-	//		resultErr = fmt.Errorf("failed to create new STUN client: %w", err)
-	//		return
-	//	}
-	//	defer newClient.Close()
-	//
-	//	// Fetch addresses using the new STUN client
-	//	newAddr, err := newClient.ExternalAddr()
-	//	if err != nil {
-	//		resultErr = fmt.Errorf("failed to get external address from new STUN client: %w", err)
-	//		return
-	//	}
-	//	if newAddr != nil && newAddr.IP != nil {
-	//		key := fmt.Sprintf("%s:%d", newAddr.IP.String(), newAddr.Port)
-	//		addrMap[key] = newAddr
-	//	}
-	//}()
-
-	// Wait for all goroutines to finish
-	wg.Wait()
-
-	if resultErr != nil {
-		return nil, resultErr
+	addr, err := c.ExternalAddr()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get external address: %w", err)
 	}
-
-	// Convert the map to a slice
-	uniqueAddrs := make([]*udp.Addr, 0, len(addrMap))
-	for _, addr := range addrMap {
-		uniqueAddrs = append(uniqueAddrs, addr)
+	if addr == nil || addr.IP == nil {
+		return nil, nil
 	}
-
-	return uniqueAddrs, nil
+	return []*udp.Addr{addr}, nil
 }
 
 func (c *stunClient) XORMappedAddress() (*udp.Addr, error) {
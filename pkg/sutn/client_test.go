@@ -1,48 +1,54 @@
 package stunclient
 
 import (
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSTUNClient(t *testing.T) {
-	client, err := NewClient("stun:stun.easyvoip.com:3478")
-	assert.NoError(t, err)
+	server := newFakeNATServer(t, nil, nil)
+	client, err := NewClient(fmt.Sprintf("stun:%s", server.addr(0, 0)))
+	require.NoError(t, err)
 	defer client.Close()
 
+	other := server.addr(1, 1)
+
 	t.Run("XORMappedAddress", func(t *testing.T) {
 		addr, err := client.XORMappedAddress()
-		assert.NoError(t, err)
-		assert.NotNil(t, addr)
-		t.Logf("XORMappedAddress: %s", addr)
+		require.NoError(t, err)
+		assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)))
+		assert.NotZero(t, addr.Port)
 	})
 
 	t.Run("MappedAddress", func(t *testing.T) {
 		addr, err := client.MappedAddress()
-		assert.NoError(t, err)
-		assert.NotNil(t, addr)
-		t.Logf("MappedAddress: %s", addr)
+		require.NoError(t, err)
+		assert.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)))
+		assert.NotZero(t, addr.Port)
 	})
 
 	t.Run("ChangedAddress", func(t *testing.T) {
 		addr, err := client.ChangedAddress()
-		assert.NoError(t, err)
-		assert.NotNil(t, addr)
-		t.Logf("ChangedAddress: %s", addr)
+		require.NoError(t, err)
+		assert.True(t, addr.IP.Equal(other.IP))
+		assert.Equal(t, uint16(other.Port), addr.Port)
 	})
 
 	t.Run("OtherAddress", func(t *testing.T) {
 		addr, err := client.OtherAddress()
-		assert.NoError(t, err)
-		assert.NotNil(t, addr)
-		t.Logf("OtherAddress: %s", addr)
+		require.NoError(t, err)
+		assert.True(t, addr.IP.Equal(other.IP))
+		assert.Equal(t, uint16(other.Port), addr.Port)
 	})
 
 	t.Run("ExternalAddrs", func(t *testing.T) {
 		addrs, err := client.ExternalAddrs()
-		assert.NoError(t, err)
-		assert.NotNil(t, addrs)
-		t.Logf("ExternalAddrs: %s", addrs)
+		require.NoError(t, err)
+		require.Len(t, addrs, 1)
+		assert.True(t, addrs[0].IP.Equal(net.IPv4(127, 0, 0, 1)))
 	})
 }
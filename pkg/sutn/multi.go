@@ -0,0 +1,427 @@
+package stunclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/pion/stun"
+)
+
+const (
+	defaultServerTimeout = 2 * time.Second
+)
+
+var _ STUNClient = &MultiClient{}
+
+// Option MultiClient 的可选配置
+type Option func(*MultiClient)
+
+// WithTimeout 设置每个 STUN 服务器的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *MultiClient) {
+		if timeout > 0 {
+			c.timeout = timeout
+		}
+	}
+}
+
+// WithPacketConn 使用 conn 查询 STUN 服务器，例如绑定在应用端口上的套接字，
+// 使得到的外部地址就是该端口在 NAT 上的映射，MultiClient 关闭时不会关闭 conn。
+// 多个 MultiClient 可以共用同一个 conn，它们的查询依次进行。
+// conn 只绑定了 IPv4 地址时，IPv6 的服务器仍然通过 MultiClient 自己的 udp6 套接字查询
+func WithPacketConn(conn net.PacketConn) Option {
+	return func(c *MultiClient) {
+		c.conn = conn
+		c.ownConn = false
+	}
+}
+
+// Result 是一次向所有 STUN 服务器查询外部地址的结果
+type Result struct {
+	// Mapped 每个成功响应的服务器看到的外部地址，键为服务器的 URI
+	Mapped map[string]*udp.Addr
+	// Errors 查询失败的服务器及原因
+	Errors map[string]error
+	// Addrs 去重后的外部地址，按服务器的配置顺序排列
+	Addrs []*udp.Addr
+	// Symmetric 同一个本地端口在不同服务器看到的外部地址不一致，说明 NAT 的映射依赖目的地址
+	Symmetric bool
+}
+
+// Equal 判断两次查询得到的外部地址是否相同
+func (r *Result) Equal(o *Result) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	return udp.AddrSlice(r.Addrs).Equal(o.Addrs)
+}
+
+// MultiClient 使用同一个本地套接字并行查询多个 STUN 服务器，容忍部分服务器失败，
+// 由于所有请求都从同一个端口发出，不同服务器看到的外部地址不一致即说明是对称型 NAT
+type MultiClient struct {
+	// mu 同一时间只有一个查询使用套接字，共用同一个 conn 的 MultiClient 使用同一个锁
+	mu *sync.Mutex
+
+	uris    []string
+	conn    net.PacketConn
+	ownConn bool
+	// conn6 conn 无法发送 IPv6 数据报时查询 IPv6 服务器使用的套接字，第一次需要时打开
+	conn6   net.PacketConn
+	timeout time.Duration
+}
+
+// NewMultiClient 创建一个查询 stunURIs 中所有服务器的客户端，无法解析的 URI 会导致错误
+func NewMultiClient(stunURIs []string, opts ...Option) (*MultiClient, error) {
+	if len(stunURIs) == 0 {
+		return nil, errors.New("no STUN server configured")
+	}
+	for _, uri := range stunURIs {
+		if _, err := ServerAddr(uri); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &MultiClient{
+		uris:    stunURIs,
+		timeout: defaultServerTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.conn == nil {
+		conn, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.ownConn = true
+		c.mu = &sync.Mutex{}
+	} else {
+		c.mu = connLock(c.conn)
+	}
+	return c, nil
+}
+
+// connLocks 按外部传入的 conn 保存查询使用的锁
+var connLocks sync.Map
+
+func connLock(conn net.PacketConn) *sync.Mutex {
+	mu, _ := connLocks.LoadOrStore(conn, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// Query 并行查询所有服务器，只要有一个服务器成功响应就不返回错误
+func (c *MultiClient) Query() (*Result, error) {
+	responses, errs := c.do()
+
+	r := &Result{
+		Mapped: make(map[string]*udp.Addr),
+		Errors: errs,
+	}
+
+	byIP := make(map[string]*udp.Addr)
+	// families 每个地址族看到的外部 IP 数量，IPv4 和 IPv6 的外部地址本来就不同
+	families := make(map[bool]int)
+	for _, uri := range c.uris {
+		res, ok := responses[uri]
+		if !ok {
+			continue
+		}
+		addr := mappedAddr(res)
+		if addr == nil {
+			r.Errors[uri] = errors.New("STUN response contains no mapped address")
+			continue
+		}
+		r.Mapped[uri] = addr
+
+		seen := false
+		for _, a := range r.Addrs {
+			if a.Equals(addr) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			r.Addrs = append(r.Addrs, addr)
+		}
+
+		prev, ok := byIP[addr.IP.String()]
+		if ok && prev.Port != addr.Port {
+			r.Symmetric = true
+		}
+		if !ok {
+			families[addr.IP.To4() != nil]++
+		}
+		byIP[addr.IP.String()] = addr
+	}
+	// 同一地址族的不同服务器看到不同的外部 IP 也说明映射依赖目的地址 (或存在多个出口)
+	for _, n := range families {
+		if n > 1 {
+			r.Symmetric = true
+		}
+	}
+
+	if len(r.Mapped) == 0 {
+		return r, fmt.Errorf("all STUN servers failed: %w", joinErrors(c.uris, r.Errors))
+	}
+	return r, nil
+}
+
+func (c *MultiClient) ExternalAddrs() ([]*udp.Addr, error) {
+	r, err := c.Query()
+	if err != nil {
+		return nil, err
+	}
+	return r.Addrs, nil
+}
+
+// ExternalAddr 返回第一个成功响应的服务器 (按配置顺序) 看到的外部地址
+func (c *MultiClient) ExternalAddr() (*udp.Addr, error) {
+	r, err := c.Query()
+	if err != nil {
+		return nil, err
+	}
+	return r.Addrs[0], nil
+}
+
+func (c *MultiClient) XORMappedAddress() (*udp.Addr, error) {
+	return c.first(func(m *stun.Message) (*udp.Addr, error) {
+		var a stun.XORMappedAddress
+		if err := a.GetFrom(m); err != nil {
+			return nil, err
+		}
+		return udp.NewAddr(a.IP, uint16(a.Port)), nil
+	})
+}
+
+func (c *MultiClient) MappedAddress() (*udp.Addr, error) {
+	return c.first(func(m *stun.Message) (*udp.Addr, error) {
+		var a stun.MappedAddress
+		if err := a.GetFrom(m); err != nil {
+			return nil, err
+		}
+		return udp.NewAddr(a.IP, uint16(a.Port)), nil
+	})
+}
+
+func (c *MultiClient) ChangedAddress() (*udp.Addr, error) {
+	return c.first(func(m *stun.Message) (*udp.Addr, error) {
+		var a ChangedAddress
+		if err := a.GetFrom(m); err != nil {
+			return nil, err
+		}
+		return udp.NewAddr(a.IP, uint16(a.Port)), nil
+	})
+}
+
+func (c *MultiClient) OtherAddress() (*udp.Addr, error) {
+	return c.first(func(m *stun.Message) (*udp.Addr, error) {
+		if a := otherAddr(m); a != nil {
+			return a, nil
+		}
+		return nil, ErrNoOtherAddress
+	})
+}
+
+// DetectNAT 依次使用各服务器执行 RFC 5780 行为测试，返回第一个成功的结果
+func (c *MultiClient) DetectNAT() (*NATType, error) {
+	var lastErr error
+	for _, uri := range c.uris {
+		server, err := ServerAddr(uri)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		nat, err := DetectNAT(server, c.timeout)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", uri, err)
+			continue
+		}
+		return nat, nil
+	}
+	return nil, lastErr
+}
+
+func (c *MultiClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	if c.conn6 != nil {
+		errs = append(errs, c.conn6.Close())
+		c.conn6 = nil
+	}
+	if c.ownConn {
+		errs = append(errs, c.conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// unlockedConnFor 假设您持有 mu，返回向 addr 发送请求使用的套接字，
+// conn 只绑定了 IPv4 地址时为 IPv6 的服务器打开一个 udp6 套接字
+func (c *MultiClient) unlockedConnFor(addr *net.UDPAddr) (net.PacketConn, error) {
+	if addr.IP.To4() != nil || !ipv4Only(c.conn) {
+		return c.conn, nil
+	}
+	if c.conn6 == nil {
+		conn, err := net.ListenUDP("udp6", nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open IPv6 socket: %w", err)
+		}
+		c.conn6 = conn
+	}
+	return c.conn6, nil
+}
+
+// ipv4Only 判断 conn 是否只能收发 IPv4 数据报，未绑定具体地址的 udp 套接字同时支持两种地址族
+func ipv4Only(conn net.PacketConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() != nil
+}
+
+// first 按配置顺序返回第一个能从响应中取出地址的结果
+func (c *MultiClient) first(get func(*stun.Message) (*udp.Addr, error)) (*udp.Addr, error) {
+	responses, errs := c.do()
+	for _, uri := range c.uris {
+		res, ok := responses[uri]
+		if !ok {
+			continue
+		}
+		addr, err := get(res)
+		if err == nil {
+			return addr, nil
+		}
+		errs[uri] = err
+	}
+	return nil, joinErrors(c.uris, errs)
+}
+
+// do 向所有服务器发送 Binding 请求并等待响应，每个服务器在超时时间内重传 natRetries 次，
+// 响应按事务 ID 分发，返回成功的响应和失败的原因，键均为服务器的 URI
+func (c *MultiClient) do() (map[string]*stun.Message, map[string]error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	responses := make(map[string]*stun.Message)
+	errs := make(map[string]error)
+
+	type pending struct {
+		uri  string
+		addr *net.UDPAddr
+		conn net.PacketConn
+		req  *stun.Message
+	}
+	inflight := make(map[[stun.TransactionIDSize]byte]*pending)
+
+	for _, uri := range c.uris {
+		server, err := ServerAddr(uri)
+		if err != nil {
+			errs[uri] = err
+			continue
+		}
+		addr, err := resolveServer(server)
+		if err != nil {
+			errs[uri] = err
+			continue
+		}
+		conn, err := c.unlockedConnFor(addr)
+		if err != nil {
+			errs[uri] = err
+			continue
+		}
+		req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+		if err != nil {
+			errs[uri] = fmt.Errorf("failed to build STUN request: %w", err)
+			continue
+		}
+		inflight[req.TransactionID] = &pending{uri: uri, addr: addr, conn: conn, req: req}
+	}
+
+	interval := c.timeout / natRetries
+
+	for i := 0; i < natRetries && len(inflight) > 0; i++ {
+		conns := make(map[net.PacketConn]struct{})
+		for _, p := range inflight {
+			if _, err := p.conn.WriteTo(p.req.Raw, p.addr); err != nil {
+				errs[p.uri] = err
+				delete(inflight, p.req.TransactionID)
+				continue
+			}
+			conns[p.conn] = struct{}{}
+		}
+
+		for raw := range readUntil(conns, time.Now().Add(interval)) {
+			res := &stun.Message{Raw: raw}
+			if err := res.Decode(); err != nil {
+				continue
+			}
+			p, ok := inflight[res.TransactionID]
+			if !ok {
+				// 上一次查询迟到的响应，忽略
+				continue
+			}
+			delete(inflight, res.TransactionID)
+			if len(inflight) == 0 {
+				// 所有响应都已收到，让读取提前结束
+				for conn := range conns {
+					_ = conn.SetReadDeadline(time.Now())
+				}
+			}
+
+			if res.Type != stun.BindingSuccess {
+				errs[p.uri] = fmt.Errorf("unexpected STUN response %s", res.Type)
+				continue
+			}
+			responses[p.uri] = res
+		}
+	}
+
+	for _, p := range inflight {
+		errs[p.uri] = ErrNoResponse
+	}
+	return responses, errs
+}
+
+// readUntil 在 deadline 之前从所有 conns 读取数据报，所有套接字的读取结束后关闭返回的通道
+func readUntil(conns map[net.PacketConn]struct{}, deadline time.Time) <-chan []byte {
+	packets := make(chan []byte)
+	var wg sync.WaitGroup
+	for conn := range conns {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			buffer := make([]byte, udp.MTU)
+			for {
+				n, _, err := conn.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				packets <- append([]byte(nil), buffer[:n]...)
+			}
+		}(conn)
+	}
+	go func() {
+		wg.Wait()
+		close(packets)
+	}()
+	return packets
+}
+
+// joinErrors 按配置顺序合并各服务器的错误
+func joinErrors(uris []string, errs map[string]error) error {
+	var joined []error
+	for _, uri := range uris {
+		if err, ok := errs[uri]; ok {
+			joined = append(joined, fmt.Errorf("%s: %w", uri, err))
+		}
+	}
+	return errors.Join(joined...)
+}
@@ -0,0 +1,174 @@
+package stunclient
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeSTUNServer 启动一个返回 mapped(from) 作为外部地址的 STUN 服务器，返回其 URI
+func newFakeSTUNServer(t *testing.T, mapped func(from *net.UDPAddr) *net.UDPAddr) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	return serveFakeSTUN(t, conn, mapped)
+}
+
+func serveFakeSTUN(t *testing.T, conn *net.UDPConn, mapped func(from *net.UDPAddr) *net.UDPAddr) string {
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte(nil), buffer[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+			addr := mapped(from)
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: addr.IP, Port: addr.Port})
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteToUDP(res.Raw, from)
+		}
+	}()
+
+	return fmt.Sprintf("stun:%s", conn.LocalAddr())
+}
+
+// deadSTUNServer 返回一个不会响应的 STUN 服务器 URI
+func deadSTUNServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return fmt.Sprintf("stun:%s", conn.LocalAddr())
+}
+
+func TestMultiClientQuery(t *testing.T) {
+	same := func(from *net.UDPAddr) *net.UDPAddr { return from }
+	shifted := func(from *net.UDPAddr) *net.UDPAddr { return &net.UDPAddr{IP: from.IP, Port: from.Port + 1} }
+
+	t.Run("fallback and dedupe", func(t *testing.T) {
+		dead := deadSTUNServer(t)
+		c, err := NewMultiClient([]string{dead, newFakeSTUNServer(t, same), newFakeSTUNServer(t, same)},
+			WithTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+		defer c.Close()
+
+		r, err := c.Query()
+		require.NoError(t, err)
+		assert.Len(t, r.Mapped, 2)
+		assert.Len(t, r.Addrs, 1)
+		assert.False(t, r.Symmetric)
+		assert.ErrorIs(t, r.Errors[dead], ErrNoResponse)
+		assert.Equal(t, c.conn.LocalAddr().(*net.UDPAddr).Port, int(r.Addrs[0].Port))
+
+		addr, err := c.ExternalAddr()
+		require.NoError(t, err)
+		assert.True(t, addr.Equals(r.Addrs[0]))
+	})
+
+	t.Run("disagreement", func(t *testing.T) {
+		c, err := NewMultiClient([]string{newFakeSTUNServer(t, same), newFakeSTUNServer(t, shifted)},
+			WithTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+		defer c.Close()
+
+		r, err := c.Query()
+		require.NoError(t, err)
+		assert.Len(t, r.Addrs, 2)
+		assert.True(t, r.Symmetric)
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		c, err := NewMultiClient([]string{deadSTUNServer(t), deadSTUNServer(t)}, WithTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.ExternalAddrs()
+		assert.ErrorIs(t, err, ErrNoResponse)
+	})
+
+	t.Run("caller supplied conn", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		c, err := NewMultiClient([]string{newFakeSTUNServer(t, same)}, WithPacketConn(conn))
+		require.NoError(t, err)
+
+		addr, err := c.ExternalAddr()
+		require.NoError(t, err)
+		assert.Equal(t, conn.LocalAddr().(*net.UDPAddr).Port, int(addr.Port))
+
+		// 关闭 MultiClient 不会关闭调用者的套接字
+		assert.NoError(t, c.Close())
+		_, err = conn.WriteToUDP([]byte("ping"), conn.LocalAddr().(*net.UDPAddr))
+		assert.NoError(t, err)
+	})
+
+	t.Run("shared conn", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// 共用套接字的查询依次进行，不会读走对方的响应
+		a, err := NewMultiClient([]string{newFakeSTUNServer(t, same)}, WithPacketConn(conn), WithTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+		b, err := NewMultiClient([]string{newFakeSTUNServer(t, same)}, WithPacketConn(conn), WithTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+
+		errs := make(chan error, 2)
+		for _, c := range []*MultiClient{a, b} {
+			go func(c *MultiClient) {
+				_, err := c.Query()
+				errs <- err
+			}(c)
+		}
+		assert.NoError(t, <-errs)
+		assert.NoError(t, <-errs)
+	})
+
+	t.Run("ipv6 server", func(t *testing.T) {
+		conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+		if err != nil {
+			t.Skip("IPv6 loopback is not available")
+		}
+		server6 := serveFakeSTUN(t, conn6, same)
+
+		// IPv4 的套接字无法发送到 IPv6 服务器，使用单独的 udp6 套接字查询
+		c, err := NewMultiClient([]string{newFakeSTUNServer(t, same), server6}, WithTimeout(300*time.Millisecond))
+		require.NoError(t, err)
+		defer c.Close()
+
+		r, err := c.Query()
+		require.NoError(t, err)
+		require.Len(t, r.Mapped, 2)
+		assert.False(t, r.Symmetric)
+		assert.NotNil(t, r.Mapped[server6].IP.To16())
+		assert.Nil(t, r.Mapped[server6].IP.To4())
+		require.NotNil(t, c.conn6)
+		assert.Equal(t, c.conn6.LocalAddr().(*net.UDPAddr).Port, int(r.Mapped[server6].Port))
+	})
+
+	t.Run("invalid uri", func(t *testing.T) {
+		_, err := NewMultiClient([]string{"http://example.com"})
+		assert.Error(t, err)
+	})
+}
+
+func TestResultEqual(t *testing.T) {
+	a := &Result{Addrs: nil}
+	assert.True(t, (*Result)(nil).Equal(nil))
+	assert.False(t, a.Equal(nil))
+	assert.True(t, a.Equal(&Result{}))
+}
@@ -0,0 +1,309 @@
+package stunclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/pion/stun"
+)
+
+const (
+	defaultNATTimeout = 3 * time.Second
+	// natRetries 每个测试的请求重传次数，UDP 丢包时避免误判为过滤
+	natRetries = 3
+
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+var (
+	// ErrNoResponse 在超时时间内没有收到 STUN 服务器的响应
+	ErrNoResponse = errors.New("no response from STUN server")
+	// ErrNoOtherAddress STUN 服务器没有返回 OTHER-ADDRESS，不支持 RFC 5780 的行为测试
+	ErrNoOtherAddress = errors.New("STUN server does not support RFC 5780 (no OTHER-ADDRESS)")
+)
+
+// NATType 是 RFC 5780 行为测试的结果
+type NATType struct {
+	// Mapping NAT 的映射行为
+	Mapping api.NatBehavior
+	// Filtering NAT 的过滤行为
+	Filtering api.NatBehavior
+	// Hairpinning 是否支持从内部访问自己的外部地址
+	Hairpinning bool
+	// MappedAddr 测试 I 中 STUN 服务器看到的外部地址
+	MappedAddr *udp.Addr
+}
+
+// Proto 返回可以放入主机更新中的 NAT 类型
+func (n *NATType) Proto() *api.NatType {
+	if n == nil {
+		return nil
+	}
+	return &api.NatType{
+		Mapping:     n.Mapping,
+		Filtering:   n.Filtering,
+		Hairpinning: n.Hairpinning,
+	}
+}
+
+func (n *NATType) String() string {
+	return fmt.Sprintf("mapping=%s filtering=%s hairpinning=%t", n.Mapping, n.Filtering, n.Hairpinning)
+}
+
+// changeRequest 是 CHANGE-REQUEST 属性，要求服务器从另一个 IP 和/或端口发送响应
+type changeRequest uint32
+
+func (c changeRequest) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrChangeRequest, []byte{0, 0, 0, byte(c)})
+	return nil
+}
+
+// DetectNAT 使用 server 执行 RFC 5780 的映射和过滤行为测试以及 hairpinning 测试，
+// server 必须是 host:port 格式并支持 OTHER-ADDRESS 和 CHANGE-REQUEST，timeout 为 0 时使用默认值
+func DetectNAT(server string, timeout time.Duration) (*NATType, error) {
+	primary, err := resolveServer(server)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if primary.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return detectNAT(conn, server, timeout)
+}
+
+// resolveServer 解析 host:port 格式的 STUN 服务器地址，优先使用 IPv4，
+// 只有 IPv6 地址的服务器返回 IPv6 地址
+func resolveServer(server string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err == nil {
+		return addr, nil
+	}
+	if addr, err6 := net.ResolveUDPAddr("udp6", server); err6 == nil {
+		return addr, nil
+	}
+	return nil, fmt.Errorf("failed to resolve STUN server: %w", err)
+}
+
+// ServerAddr 将 stun:host:port 格式的 STUN URI 转换为 host:port
+func ServerAddr(stunURI string) (string, error) {
+	u, err := stun.ParseURI(stunURI)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse STUN URI: %w", err)
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port)), nil
+}
+
+func (c *stunClient) DetectNAT() (*NATType, error) {
+	return DetectNAT(c.server, 0)
+}
+
+func detectNAT(conn *net.UDPConn, server string, timeout time.Duration) (*NATType, error) {
+	if timeout <= 0 {
+		timeout = defaultNATTimeout
+	}
+
+	primary, err := resolveServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &natTester{conn: conn, timeout: timeout}
+
+	// 测试 I: 普通的 Binding 请求
+	res, err := t.request(primary, 0)
+	if err != nil {
+		return nil, err
+	}
+	mapped1 := mappedAddr(res)
+	if mapped1 == nil {
+		return nil, errors.New("STUN response contains no mapped address")
+	}
+	nat := &NATType{MappedAddr: mapped1}
+
+	other := otherAddr(res)
+	if other == nil {
+		return nat, ErrNoOtherAddress
+	}
+
+	nat.Mapping = t.mapping(primary, other, mapped1)
+	nat.Filtering = t.filtering(primary)
+	nat.Hairpinning = t.hairpin(mapped1)
+
+	return nat, nil
+}
+
+// natTester 在同一个套接字上执行各项测试，所有测试必须使用同一个本地端口
+type natTester struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+}
+
+// mapping 执行映射行为测试 II 和 III
+func (t *natTester) mapping(primary *net.UDPAddr, other, mapped1 *udp.Addr) api.NatBehavior {
+	if t.isLocal(mapped1) {
+		return api.NatBehavior_NoNat
+	}
+
+	// 测试 II: 发往备用 IP 和主端口
+	res, err := t.request(&net.UDPAddr{IP: other.IP, Port: primary.Port}, 0)
+	if err != nil {
+		return api.NatBehavior_Unknown
+	}
+	mapped2 := mappedAddr(res)
+	if mapped2 == nil {
+		return api.NatBehavior_Unknown
+	}
+	if mapped2.Equals(mapped1) {
+		return api.NatBehavior_EndpointIndependent
+	}
+
+	// 测试 III: 发往备用 IP 和备用端口
+	res, err = t.request(&net.UDPAddr{IP: other.IP, Port: int(other.Port)}, 0)
+	if err != nil {
+		return api.NatBehavior_Unknown
+	}
+	mapped3 := mappedAddr(res)
+	if mapped3 == nil {
+		return api.NatBehavior_Unknown
+	}
+	if mapped3.Equals(mapped2) {
+		return api.NatBehavior_AddressDependent
+	}
+	return api.NatBehavior_AddressAndPortDependent
+}
+
+// filtering 执行过滤行为测试 II 和 III，没有收到响应视为被过滤
+func (t *natTester) filtering(primary *net.UDPAddr) api.NatBehavior {
+	// 测试 II: 要求从备用 IP 和备用端口响应
+	if _, err := t.request(primary, changeIP|changePort); err == nil {
+		return api.NatBehavior_EndpointIndependent
+	}
+
+	// 测试 III: 要求从主 IP 和备用端口响应
+	if _, err := t.request(primary, changePort); err == nil {
+		return api.NatBehavior_AddressDependent
+	}
+	return api.NatBehavior_AddressAndPortDependent
+}
+
+// hairpin 向自己的外部地址发送一个 Binding 请求，能够收到该请求说明 NAT 支持 hairpinning
+func (t *natTester) hairpin(mapped *udp.Addr) bool {
+	m, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return false
+	}
+
+	received, err := t.roundTrip(m, &net.UDPAddr{IP: mapped.IP, Port: int(mapped.Port)}, func(msg *stun.Message) bool {
+		return msg.Type == stun.BindingRequest
+	})
+	return err == nil && received != nil
+}
+
+// request 发送一个 Binding 请求并等待成功响应
+func (t *natTester) request(to *net.UDPAddr, change changeRequest) (*stun.Message, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if change != 0 {
+		setters = append(setters, change)
+	}
+	m, err := stun.Build(setters...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build STUN request: %w", err)
+	}
+
+	return t.roundTrip(m, to, func(msg *stun.Message) bool {
+		return msg.Type == stun.BindingSuccess
+	})
+}
+
+// roundTrip 发送 m 并等待事务 ID 相同且满足 match 的消息，超时后重传，重传用尽返回 ErrNoResponse
+func (t *natTester) roundTrip(m *stun.Message, to *net.UDPAddr, match func(*stun.Message) bool) (*stun.Message, error) {
+	buffer := make([]byte, udp.MTU)
+	interval := t.timeout / natRetries
+
+	for i := 0; i < natRetries; i++ {
+		if _, err := t.conn.WriteToUDP(m.Raw, to); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(interval)
+		for {
+			if err := t.conn.SetReadDeadline(deadline); err != nil {
+				return nil, err
+			}
+			n, _, err := t.conn.ReadFromUDP(buffer)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			res := &stun.Message{Raw: append([]byte(nil), buffer[:n]...)}
+			if err := res.Decode(); err != nil || res.TransactionID != m.TransactionID || !match(res) {
+				// 之前的测试迟到的响应，忽略
+				continue
+			}
+			return res, nil
+		}
+	}
+
+	return nil, ErrNoResponse
+}
+
+// isLocal 判断 addr 是否为本机地址，即没有经过 NAT
+func (t *natTester) isLocal(addr *udp.Addr) bool {
+	if int(addr.Port) != t.conn.LocalAddr().(*net.UDPAddr).Port {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// mappedAddr 返回响应中的 XOR-MAPPED-ADDRESS，不存在时使用 MAPPED-ADDRESS
+func mappedAddr(m *stun.Message) *udp.Addr {
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(m); err == nil {
+		return udp.NewAddr(xorAddr.IP, uint16(xorAddr.Port))
+	}
+	var addr stun.MappedAddress
+	if err := addr.GetFrom(m); err == nil {
+		return udp.NewAddr(addr.IP, uint16(addr.Port))
+	}
+	return nil
+}
+
+// otherAddr 返回响应中的 OTHER-ADDRESS，不存在时使用 RFC 3489 的 CHANGED-ADDRESS
+func otherAddr(m *stun.Message) *udp.Addr {
+	var other stun.OtherAddress
+	if err := other.GetFrom(m); err == nil {
+		return udp.NewAddr(other.IP, uint16(other.Port))
+	}
+	var changed ChangedAddress
+	if err := changed.GetFrom(m); err == nil {
+		return udp.NewAddr(changed.IP, uint16(changed.Port))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package stunclient
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/api/v1"
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATServer 是一个在 127.0.0.1 和 127.0.0.2 的两个端口上监听的 RFC 5780 服务器，
+// 通过 mapped 和 filter 模拟不同的 NAT 行为
+type fakeNATServer struct {
+	// conns[ip][port]
+	conns [2][2]*net.UDPConn
+	// mapped 返回 server 看到的 client 的外部地址
+	mapped func(server, client *net.UDPAddr) *net.UDPAddr
+	// filter 返回 true 时丢弃从 (changeIP, changePort) 套接字发出的响应
+	filter func(changeIP, changePort bool) bool
+}
+
+// newFakeNATServer 启动 fakeNATServer，mapped 和 filter 为 nil 时模拟没有 NAT 的情况
+func newFakeNATServer(t *testing.T, mapped func(server, client *net.UDPAddr) *net.UDPAddr, filter func(changeIP, changePort bool) bool) *fakeNATServer {
+	if mapped == nil {
+		mapped = func(_, client *net.UDPAddr) *net.UDPAddr { return client }
+	}
+	if filter == nil {
+		filter = func(bool, bool) bool { return false }
+	}
+	s := &fakeNATServer{mapped: mapped, filter: filter}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+	for p := 0; p < 2; p++ {
+		port := 0
+		for i, ip := range ips {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: port})
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = conn.Close() })
+			port = conn.LocalAddr().(*net.UDPAddr).Port
+			s.conns[i][p] = conn
+		}
+	}
+
+	for i := range s.conns {
+		for p := range s.conns[i] {
+			go s.serve(i, p)
+		}
+	}
+	return s
+}
+
+func (s *fakeNATServer) addr(i, p int) *net.UDPAddr {
+	return s.conns[i][p].LocalAddr().(*net.UDPAddr)
+}
+
+func (s *fakeNATServer) serve(i, p int) {
+	conn := s.conns[i][p]
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: append([]byte(nil), buffer[:n]...)}
+		if err := req.Decode(); err != nil {
+			continue
+		}
+
+		var changeIP, changePort bool
+		if v, err := req.Get(stun.AttrChangeRequest); err == nil && len(v) == 4 {
+			changeIP, changePort = v[3]&0x04 != 0, v[3]&0x02 != 0
+		}
+		if s.filter(changeIP, changePort) {
+			continue
+		}
+
+		ri, rp := i, p
+		if changeIP {
+			ri = 1 - i
+		}
+		if changePort {
+			rp = 1 - p
+		}
+
+		other := s.addr(1-i, 1-p)
+		mapped := s.mapped(s.addr(i, p), from)
+		res, err := stun.Build(
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: mapped.IP, Port: mapped.Port},
+			&stun.OtherAddress{IP: other.IP, Port: other.Port},
+			// RFC 3489 服务器使用的属性
+			&stun.MappedAddress{IP: mapped.IP, Port: mapped.Port},
+			changedAddressSetter{IP: other.IP, Port: other.Port},
+		)
+		if err != nil {
+			continue
+		}
+		_, _ = s.conns[ri][rp].WriteToUDP(res.Raw, from)
+	}
+}
+
+// changedAddressSetter 向消息中添加 CHANGED-ADDRESS 属性
+type changedAddressSetter stun.MappedAddress
+
+func (a changedAddressSetter) AddTo(m *stun.Message) error {
+	ma := stun.MappedAddress(a)
+	return ma.AddToAs(m, stun.AttrChangedAddress)
+}
+
+func TestDetectNAT(t *testing.T) {
+	// 伪造的外部 IP，不属于本机，hairpinning 测试会失败
+	external := net.IPv4(192, 0, 2, 1)
+
+	tests := []struct {
+		name        string
+		mapped      func(server, client *net.UDPAddr) *net.UDPAddr
+		filter      func(changeIP, changePort bool) bool
+		mapping     api.NatBehavior
+		filtering   api.NatBehavior
+		hairpinning bool
+	}{
+		{
+			name:        "no nat",
+			mapping:     api.NatBehavior_NoNat,
+			filtering:   api.NatBehavior_EndpointIndependent,
+			hairpinning: true,
+		},
+		{
+			name: "endpoint independent",
+			mapped: func(_, client *net.UDPAddr) *net.UDPAddr {
+				return &net.UDPAddr{IP: external, Port: client.Port}
+			},
+			mapping:   api.NatBehavior_EndpointIndependent,
+			filtering: api.NatBehavior_EndpointIndependent,
+		},
+		{
+			name: "address dependent",
+			mapped: func(server, client *net.UDPAddr) *net.UDPAddr {
+				return &net.UDPAddr{IP: external, Port: client.Port + int(server.IP.To4()[3])}
+			},
+			filter:    func(changeIP, _ bool) bool { return changeIP },
+			mapping:   api.NatBehavior_AddressDependent,
+			filtering: api.NatBehavior_AddressDependent,
+		},
+		{
+			name: "address and port dependent",
+			mapped: func(server, client *net.UDPAddr) *net.UDPAddr {
+				return &net.UDPAddr{IP: external, Port: (client.Port+server.Port+int(server.IP.To4()[3]))%60000 + 1024}
+			},
+			filter:    func(changeIP, changePort bool) bool { return changeIP || changePort },
+			mapping:   api.NatBehavior_AddressAndPortDependent,
+			filtering: api.NatBehavior_AddressAndPortDependent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeNATServer(t, tt.mapped, tt.filter)
+
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			require.NoError(t, err)
+			defer conn.Close()
+
+			nat, err := detectNAT(conn, s.addr(0, 0).String(), 600*time.Millisecond)
+			require.NoError(t, err)
+			assert.Equal(t, tt.mapping, nat.Mapping)
+			assert.Equal(t, tt.filtering, nat.Filtering)
+			assert.Equal(t, tt.hairpinning, nat.Hairpinning)
+		})
+	}
+}
+
+func TestDetectNATWithoutOtherAddress(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer server.Close()
+
+	go func() {
+		buffer := make([]byte, 1500)
+		n, from, err := server.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: buffer[:n]}
+		if req.Decode() != nil {
+			return
+		}
+		res, _ := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: from.IP, Port: from.Port})
+		_, _ = server.WriteToUDP(res.Raw, from)
+	}()
+
+	nat, err := detectNAT(conn, server.LocalAddr().String(), 600*time.Millisecond)
+	assert.ErrorIs(t, err, ErrNoOtherAddress)
+	require.NotNil(t, nat)
+	assert.Equal(t, conn.LocalAddr().(*net.UDPAddr).Port, int(nat.MappedAddr.Port))
+}
@@ -0,0 +1,410 @@
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/stun"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultForwardIdleTimeout = 3 * time.Minute
+
+	// maxSTUNTransactions 最多记录的未完成 STUN 事务数量
+	maxSTUNTransactions = 1024
+	// stunHeaderLen STUN 消息头的长度，事务 ID 位于第 8 到 20 字节
+	stunHeaderLen = 20
+)
+
+var _ TTLWriter = &Forwarder{}
+
+// Forwarder 由 punchline 自己持有应用端口并在用户空间转发数据，不需要 root 或 CAP_NET_RAW。
+// 对每个远端地址，Forwarder 在本地创建一个代理套接字与应用通信，
+// 应用看到的对端端点是该代理套接字的地址，可以通过 Endpoint 获取
+type Forwarder struct {
+	sync.Mutex
+
+	logger      *zap.Logger
+	outside     *net.UDPConn
+	ttl         *ttlControl
+	port        uint16
+	app         *net.UDPAddr
+	idleTimeout time.Duration
+
+	sessions map[string]*forwardSession
+	closed   chan struct{}
+
+	stun *stunConn
+	// ice 接收所有不属于 stun 的 STUN 消息，调用 ICEConn 之后才生效
+	ice *stunConn
+	// receiver 不为 nil 时非 STUN 数据交给它处理而不是转发给应用
+	receiver atomic.Pointer[func(b []byte, from *net.UDPAddr)]
+}
+
+// forwardSession 是一个远端地址与应用之间的转发会话
+type forwardSession struct {
+	remote *net.UDPAddr
+	// local 连接到应用，应用发往 local 的数据会被转发给 remote
+	local *net.UDPConn
+	// pinned 表示代理地址已经通过 Endpoint 交给了应用，空闲时也不会过期，直到调用 Release
+	pinned bool
+
+	lastActive atomic.Int64
+}
+
+// NewForwarder 在 port 上监听并将收到的数据转发给 app
+func NewForwarder(logger *zap.Logger, port int, app *net.UDPAddr) (*Forwarder, error) {
+	outside, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forwarder{
+		logger:      logger,
+		outside:     outside,
+		ttl:         newTTLControl(outside),
+		port:        uint16(outside.LocalAddr().(*net.UDPAddr).Port),
+		app:         app,
+		idleTimeout: defaultForwardIdleTimeout,
+		sessions:    make(map[string]*forwardSession),
+		closed:      make(chan struct{}),
+	}
+	f.stun = newSTUNConn(f, false)
+	f.ice = newSTUNConn(f, true)
+
+	go f.serve()
+	go f.expireLoop()
+
+	return f, nil
+}
+
+// Port 返回 Forwarder 持有的应用端口
+func (f *Forwarder) Port() uint16 {
+	return f.port
+}
+
+// Endpoint 返回应用应该用来到达 remote 的本地代理地址。应用 (例如内核中的 WireGuard) 会一直使用该地址，
+// 因此会话被固定，空闲时不会过期，应用不再使用时调用 Release
+func (f *Forwarder) Endpoint(remote *Addr) (*Addr, error) {
+	s, err := f.session(&net.UDPAddr{IP: remote.IP, Port: int(remote.Port)})
+	if err != nil {
+		return nil, err
+	}
+	f.Lock()
+	s.pinned = true
+	f.Unlock()
+	laddr := s.local.LocalAddr().(*net.UDPAddr)
+	return NewAddr(laddr.IP, uint16(laddr.Port)), nil
+}
+
+// Release 取消 Endpoint 对 remote 会话的固定，会话空闲后正常过期
+func (f *Forwarder) Release(remote *Addr) {
+	f.Lock()
+	defer f.Unlock()
+	if s, ok := f.sessions[(&net.UDPAddr{IP: remote.IP, Port: int(remote.Port)}).String()]; ok {
+		s.pinned = false
+	}
+}
+
+// PacketConn 返回一个从应用端口收发数据的 net.PacketConn，用于在应用端口上查询 STUN 服务器，
+// 只有其发出的 STUN 请求对应的响应会被交给它，其余数据仍然转发给应用
+func (f *Forwarder) PacketConn() net.PacketConn {
+	return f.stun
+}
+
+// ICEConn 返回一个从应用端口收发 STUN 消息的 net.PacketConn，用于 ICE 的 UDPMux，
+// 除了 PacketConn 发出的请求的响应之外，所有 STUN 消息都会交给它，WireGuard 等其他数据仍然转发给应用
+func (f *Forwarder) ICEConn() net.PacketConn {
+	f.ice.active.Store(true)
+	return f.ice
+}
+
+// Divert 将所有非 STUN 数据交给 recv 处理而不是转发给应用，例如交给进程内的 wireguard-go，
+// recv 在读循环中调用，b 在 recv 返回后会被复用
+func (f *Forwarder) Divert(recv func(b []byte, from *net.UDPAddr)) {
+	f.receiver.Store(&recv)
+}
+
+// WriteTo 从应用端口直接向 addr 发送数据
+func (f *Forwarder) WriteTo(srcPort uint16, destPort uint16, b []byte, addr *Addr) error {
+	return f.WriteToTTL(srcPort, destPort, b, addr, 0)
+}
+
+func (f *Forwarder) WriteToTTL(srcPort uint16, destPort uint16, b []byte, addr *Addr, ttl int) error {
+	if srcPort != f.port {
+		return fmt.Errorf("forwarder owns port %d, can not send from port %d", f.port, srcPort)
+	}
+
+	return f.ttl.write(ttl, func() error {
+		_, err := f.outside.WriteToUDP(b, &net.UDPAddr{IP: addr.IP, Port: int(destPort)})
+		return err
+	})
+}
+
+func (f *Forwarder) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	select {
+	case <-f.closed:
+		return nil
+	default:
+	}
+	close(f.closed)
+
+	for key, s := range f.sessions {
+		_ = s.local.Close()
+		delete(f.sessions, key)
+	}
+	return f.outside.Close()
+}
+
+// session 返回 remote 的转发会话，不存在时创建一个新的
+func (f *Forwarder) session(remote *net.UDPAddr) (*forwardSession, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	key := remote.String()
+	if s, ok := f.sessions[key]; ok {
+		return s, nil
+	}
+
+	local, err := net.DialUDP("udp", nil, f.app)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &forwardSession{
+		remote: remote,
+		local:  local,
+	}
+	s.touch()
+	f.sessions[key] = s
+
+	go f.serveSession(s)
+
+	return s, nil
+}
+
+// serve 将远端发来的数据转发给应用
+func (f *Forwarder) serve() {
+	buffer := make([]byte, MTU)
+	for {
+		n, from, err := f.outside.ReadFromUDP(buffer)
+		if err != nil {
+			f.logger.Debug("forwarder socket is closed, exiting read loop", zap.Error(err))
+			return
+		}
+
+		if f.stun.deliver(buffer[:n], from) || f.ice.deliver(buffer[:n], from) {
+			continue
+		}
+
+		if recv := f.receiver.Load(); recv != nil {
+			(*recv)(buffer[:n], from)
+			continue
+		}
+
+		s, err := f.session(from)
+		if err != nil {
+			f.logger.Debug("Failed to create forward session", zap.Stringer("remote", from), zap.Error(err))
+			continue
+		}
+
+		s.touch()
+		if _, err := s.local.Write(buffer[:n]); err != nil {
+			f.logger.Debug("Failed to forward packet to app", zap.Stringer("remote", from), zap.Error(err))
+		}
+	}
+}
+
+// serveSession 将应用发往代理套接字的数据转发给远端
+func (f *Forwarder) serveSession(s *forwardSession) {
+	buffer := make([]byte, MTU)
+	for {
+		n, err := s.local.Read(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 应用尚未监听时会收到 ICMP 端口不可达，忽略即可
+			continue
+		}
+
+		s.touch()
+		if err := f.ttl.write(0, func() error {
+			_, err := f.outside.WriteToUDP(buffer[:n], s.remote)
+			return err
+		}); err != nil {
+			f.logger.Debug("Failed to forward packet to remote", zap.Stringer("remote", s.remote), zap.Error(err))
+		}
+	}
+}
+
+func (f *Forwarder) expireLoop() {
+	ticker := time.NewTicker(f.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.closed:
+			return
+		case now := <-ticker.C:
+			f.expire(now)
+		}
+	}
+}
+
+func (f *Forwarder) expire(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	for key, s := range f.sessions {
+		if !s.pinned && now.Sub(time.Unix(0, s.lastActive.Load())) > f.idleTimeout {
+			_ = s.local.Close()
+			delete(f.sessions, key)
+		}
+	}
+}
+
+func (s *forwardSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// stunConn 是 Forwarder 应用端口上的 net.PacketConn，通过事务 ID 识别自己发出的 STUN 请求的响应，
+// all 为 true 时接收所有 STUN 消息
+type stunConn struct {
+	f       *Forwarder
+	packets chan stunPacket
+	all     bool
+	active  atomic.Bool
+
+	sync.Mutex
+	deadline     time.Time
+	transactions map[string]struct{}
+}
+
+type stunPacket struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+func newSTUNConn(f *Forwarder, all bool) *stunConn {
+	c := &stunConn{
+		f:            f,
+		packets:      make(chan stunPacket, 16),
+		all:          all,
+		transactions: make(map[string]struct{}),
+	}
+	if all {
+		// ICE 连通性检查比 STUN 查询密集得多
+		c.packets = make(chan stunPacket, 256)
+	} else {
+		c.active.Store(true)
+	}
+	return c
+}
+
+// deliver 如果 b 是已发出的 STUN 请求的响应 (all 为 true 时是任意 STUN 消息) 则交给 stunConn 并返回 true
+func (c *stunConn) deliver(b []byte, from *net.UDPAddr) bool {
+	if !c.active.Load() || !stun.IsMessage(b) || isWireGuard(b) {
+		return false
+	}
+
+	if !c.all {
+		key := string(b[8:stunHeaderLen])
+		c.Lock()
+		_, ok := c.transactions[key]
+		delete(c.transactions, key)
+		c.Unlock()
+		if !ok {
+			return false
+		}
+	}
+
+	select {
+	case c.packets <- stunPacket{b: append([]byte(nil), b...), from: from}:
+	default:
+	}
+	return true
+}
+
+// isWireGuard 判断 b 是否像 WireGuard 消息：第一个字节为消息类型 1 到 4，随后三个保留字节为 0。
+// STUN 消息类型的第二个字节不会为 0，两者不会混淆
+func isWireGuard(b []byte) bool {
+	return len(b) >= 4 && b[0] >= 1 && b[0] <= 4 && b[1] == 0 && b[2] == 0 && b[3] == 0
+}
+
+func (c *stunConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.Lock()
+	deadline := c.deadline
+	c.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.packets:
+		return copy(b, p.b), p.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.f.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *stunConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("stun conn only supports *net.UDPAddr")
+	}
+
+	if stun.IsMessage(b) {
+		c.Lock()
+		if len(c.transactions) >= maxSTUNTransactions {
+			c.transactions = make(map[string]struct{})
+		}
+		c.transactions[string(b[8:stunHeaderLen])] = struct{}{}
+		c.Unlock()
+	}
+
+	if err := c.f.WriteTo(c.f.port, uint16(ua.Port), b, NewAddr(ua.IP, uint16(ua.Port))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close 不会关闭 Forwarder
+func (c *stunConn) Close() error {
+	return nil
+}
+
+func (c *stunConn) LocalAddr() net.Addr {
+	return c.f.outside.LocalAddr()
+}
+
+func (c *stunConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline 只对之后开始的 ReadFrom 生效
+func (c *stunConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *stunConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
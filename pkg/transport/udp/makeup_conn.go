@@ -2,58 +2,146 @@ package udp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 )
 
 const (
 	headerLen = 8
+
+	// maxSourceCache 最多缓存的目标地址到源地址的映射数量
+	maxSourceCache = 1024
+)
+
+var (
+	_ MakeupWriter = &makeupWriter{}
+	_ TTLWriter    = &makeupWriter{}
 )
 
-var _ MakeupWriter = &makeupWriter{}
+// TTLWriter 是可以指定 TTL (IPv6 下为 hop limit) 发送的 MakeupWriter，
+// 低 TTL 的打洞包可以在本端 NAT 上建立映射，而不会到达对端 NAT 触发其拦截
+type TTLWriter interface {
+	MakeupWriter
+	WriteToTTL(srcPort uint16, destPort uint16, b []byte, addr *Addr, ttl int) error
+}
 
+// makeupWriter 使用未连接的原始套接字发送伪造源端口的 UDP 数据包，
+// 目标地址由每次调用的 addr 决定，IPv4 和 IPv6 分别使用独立的套接字
 type makeupWriter struct {
-	conn *net.IPConn
+	conn4 *net.IPConn
+	conn6 *net.IPConn
+
+	ttl4 *ttlControl
+	ttl6 *ttlControl
+
+	// srcLock 保护 sources，sources 缓存目标地址对应的本机源地址，用于计算校验和的伪首部
+	srcLock sync.RWMutex
+	sources map[string]net.IP
 }
 
-func DialMakeup(ip net.IP, port int) (MakeupWriter, error) {
-	//raddr := &net.UDPAddr{
-	//	IP:   ip,
-	//	Port: port,
-	//}
-	//conn, err := net.DialUDP("udp4", nil, raddr)
-	//if err != nil {
-	//	return nil, err
-	//}
-	conn, err := net.DialIP("ip4:udp", nil, &net.IPAddr{
-		IP: ip,
-	})
-	if err != nil {
-		return nil, err
+// ListenMakeup 创建一个可以向任意地址发送的 MakeupWriter，需要 root 或 CAP_NET_RAW，
+// 只有一个地址族可用时 (例如没有 IPv6) 另一个地址族的发送会返回错误
+func ListenMakeup() (MakeupWriter, error) {
+	mw := &makeupWriter{
+		sources: make(map[string]net.IP),
+	}
+
+	conn4, err4 := net.ListenIP("ip4:udp", nil)
+	if err4 == nil {
+		mw.conn4 = conn4
+		mw.ttl4 = newTTLControl(conn4)
 	}
 
-	//fmt.Println("ip => ", ip)
+	conn6, err6 := net.ListenIP("ip6:udp", nil)
+	if err6 == nil {
+		mw.conn6 = conn6
+		mw.ttl6 = newTTLControl(conn6)
+	}
 
-	return &makeupWriter{
-		conn: conn,
-	}, nil
+	if err4 != nil && err6 != nil {
+		return nil, err4
+	}
+
+	// 原始套接字会收到本机所有 UDP 数据包的副本，我们从不读取，尽量减小接收缓冲区
+	for _, conn := range []*net.IPConn{mw.conn4, mw.conn6} {
+		if conn != nil {
+			_ = conn.SetReadBuffer(1)
+		}
+	}
+
+	return mw, nil
 }
 
 func (mw *makeupWriter) WriteTo(srcPort uint16, destPort uint16, b []byte, addr *Addr) error {
+	return mw.WriteToTTL(srcPort, destPort, b, addr, 0)
+}
+
+// WriteToTTL 向 addr 发送数据，ttl 为 0 时使用系统默认值
+func (mw *makeupWriter) WriteToTTL(srcPort uint16, destPort uint16, b []byte, addr *Addr, ttl int) error {
+	conn, tc := mw.conn4, mw.ttl4
+	if addr.IP.To4() == nil {
+		conn, tc = mw.conn6, mw.ttl6
+	}
+	if conn == nil {
+		return fmt.Errorf("no raw socket for the address family of %s", addr.IP)
+	}
+
+	src, err := mw.source(addr.IP)
+	if err != nil {
+		return err
+	}
 
 	packet := append(mw.header(srcPort, destPort, uint16(len(b))), b...)
+	binary.BigEndian.PutUint16(packet[6:], checksum(src, addr.IP, packet))
 
-	//fmt.Println("b len => ", len(b))
-	//fmt.Println("packet => ", packet)
-	//fmt.Println("packet len => ", len(packet))
 	//printUDPHeader(packet)
 
-	_, err := mw.conn.Write(packet)
-	return err
+	return tc.write(ttl, func() error {
+		_, err := conn.WriteToIP(packet, &net.IPAddr{IP: addr.IP})
+		return err
+	})
 }
 
 func (mw *makeupWriter) Close() error {
-	return mw.conn.Close()
+	var errs []error
+	if mw.conn4 != nil {
+		errs = append(errs, mw.conn4.Close())
+	}
+	if mw.conn6 != nil {
+		errs = append(errs, mw.conn6.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// source 返回内核向 dst 发送数据时选择的源地址，通过连接一个 UDP 套接字查询路由，不会发送任何数据
+func (mw *makeupWriter) source(dst net.IP) (net.IP, error) {
+	key := string(dst.To16())
+
+	mw.srcLock.RLock()
+	src, ok := mw.sources[key]
+	mw.srcLock.RUnlock()
+	if ok {
+		return src, nil
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %w", dst, err)
+	}
+	src = conn.LocalAddr().(*net.UDPAddr).IP
+	_ = conn.Close()
+
+	mw.srcLock.Lock()
+	if len(mw.sources) >= maxSourceCache {
+		// 路由变化后旧的映射可能已经失效，直接清空
+		mw.sources = make(map[string]net.IP)
+	}
+	mw.sources[key] = src
+	mw.srcLock.Unlock()
+
+	return src, nil
 }
 
 func (mw *makeupWriter) header(srcPort, destPort, payloadLen uint16) []byte {
@@ -61,11 +149,50 @@ func (mw *makeupWriter) header(srcPort, destPort, payloadLen uint16) []byte {
 	binary.BigEndian.PutUint16(h[0:], srcPort)
 	binary.BigEndian.PutUint16(h[2:], destPort)
 	binary.BigEndian.PutUint16(h[4:], headerLen+payloadLen)
-	// No checksum.
+	// 校验和在填充数据之后计算
 	binary.BigEndian.PutUint16(h[6:], 0)
 	return h
 }
 
+// checksum 计算包含伪首部的 UDP 校验和 (RFC 768, RFC 8200 8.1)，
+// IPv4 下校验和可以为 0，但 IPv6 下是必须的，接收方会丢弃校验和为 0 的数据包
+func checksum(src, dst net.IP, packet []byte) uint16 {
+	var sum uint32
+
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		add(src4)
+		add(dst4)
+	} else {
+		add(src.To16())
+		add(dst.To16())
+	}
+	// IPv4 伪首部中的长度为 16 位，IPv6 为 32 位，但由于长度不超过 65535，两者的求和结果相同
+	sum += uint32(len(packet))
+	sum += 17 // IPPROTO_UDP
+
+	add(packet)
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	cs := ^uint16(sum)
+	if cs == 0 {
+		// 计算结果为 0 时以全 1 表示，0 表示未计算校验和
+		cs = 0xffff
+	}
+	return cs
+}
+
 func printUDPHeader(header []byte) {
 	if len(header) < 8 {
 		fmt.Println("Invalid UDP header")
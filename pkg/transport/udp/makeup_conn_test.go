@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	// verify 对包含校验和的伪首部和数据包求和，结果应为全 1
+	verify := func(src, dst net.IP, packet []byte) uint16 {
+		var sum uint32
+		add := func(b []byte) {
+			for i := 0; i+1 < len(b); i += 2 {
+				sum += uint32(binary.BigEndian.Uint16(b[i:]))
+			}
+			if len(b)%2 == 1 {
+				sum += uint32(b[len(b)-1]) << 8
+			}
+		}
+		add(src)
+		add(dst)
+		sum += uint32(len(packet)) + 17
+		add(packet)
+		for sum > 0xffff {
+			sum = (sum >> 16) + (sum & 0xffff)
+		}
+		return uint16(sum)
+	}
+
+	mw := &makeupWriter{}
+	for _, tc := range []struct {
+		name     string
+		src, dst net.IP
+	}{
+		{"ipv4", net.ParseIP("192.168.1.2").To4(), net.ParseIP("8.8.8.8").To4()},
+		{"ipv6", net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, payload := range [][]byte{{}, []byte("punch"), []byte("even")} {
+				packet := append(mw.header(4242, 51820, uint16(len(payload))), payload...)
+				cs := checksum(tc.src, tc.dst, packet)
+				assert.NotZero(t, cs)
+				binary.BigEndian.PutUint16(packet[6:], cs)
+				assert.Equal(t, uint16(0xffff), verify(tc.src, tc.dst, packet))
+			}
+		})
+	}
+}
+
+func TestMakeupWriter(t *testing.T) {
+	if !RawSocketPermitted() {
+		t.Skip("raw sockets require root or CAP_NET_RAW")
+	}
+
+	w, err := ListenMakeup()
+	assert.NoError(t, err)
+	defer w.Close()
+
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Logf("skipping %s: %v", ip, err)
+			continue
+		}
+
+		port := uint16(peer.LocalAddr().(*net.UDPAddr).Port)
+		addr := NewAddr(ip, port)
+
+		// 每次发送都使用调用方指定的目标地址和源端口，且校验和正确，否则内核会丢弃数据包
+		assert.NoError(t, w.WriteTo(4242, port, []byte("punch"), addr))
+		assert.NoError(t, w.(TTLWriter).WriteToTTL(4243, port, []byte("low-ttl"), addr, 1))
+
+		buf := make([]byte, 16)
+		_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for _, want := range []struct {
+			payload string
+			port    int
+		}{{"punch", 4242}, {"low-ttl", 4243}} {
+			n, from, err := peer.ReadFromUDP(buf)
+			assert.NoError(t, err, ip.String())
+			assert.Equal(t, want.payload, string(buf[:n]))
+			assert.Equal(t, want.port, from.Port)
+		}
+		_ = peer.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// PunchMode 决定打洞数据包的发送方式
+type PunchMode string
+
+const (
+	// PunchModeAuto 允许使用原始套接字时使用 PunchModeRaw，否则使用 PunchModeReusePort
+	PunchModeAuto PunchMode = "auto"
+	// PunchModeRaw 使用原始套接字伪造源端口，需要 root 或 CAP_NET_RAW
+	PunchModeRaw PunchMode = "raw"
+	// PunchModeReusePort 使用 SO_REUSEPORT 与应用共享端口，需要应用的套接字也设置了 SO_REUSEPORT
+	PunchModeReusePort PunchMode = "reuseport"
+	// PunchModeForward 由 punchline 持有端口并在用户空间将数据转发给应用
+	PunchModeForward PunchMode = "forward"
+)
+
+// ParsePunchMode 解析打洞模式，空字符串表示 PunchModeAuto
+func ParsePunchMode(s string) (PunchMode, error) {
+	switch mode := PunchMode(s); mode {
+	case "":
+		return PunchModeAuto, nil
+	case PunchModeAuto, PunchModeRaw, PunchModeReusePort, PunchModeForward:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown punch mode %q", s)
+	}
+}
+
+// RawSocketPermitted 检测当前进程是否有权限创建原始套接字
+func RawSocketPermitted() bool {
+	conn, err := net.ListenIP("ip4:udp", &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return !errors.Is(err, os.ErrPermission) && !errors.Is(err, syscall.EPERM)
+	}
+	_ = conn.Close()
+	return true
+}
+
+// MakeupOptions 创建 MakeupWriter 所需的参数
+type MakeupOptions struct {
+	Mode PunchMode
+	// Port 应用的端口，reuseport 和 forward 模式下绑定在该端口上
+	Port int
+	// Network reuseport 模式下绑定的网络，"udp4" 或 "udp6"，为空时使用双栈套接字
+	Network string
+	// ForwardAddr forward 模式下应用实际监听的地址
+	ForwardAddr *net.UDPAddr
+}
+
+// ResolvePunchMode 将 PunchModeAuto 解析为实际使用的模式，其他模式原样返回
+func ResolvePunchMode(logger *zap.Logger, mode PunchMode) PunchMode {
+	if mode != "" && mode != PunchModeAuto {
+		return mode
+	}
+	mode = PunchModeReusePort
+	if RawSocketPermitted() {
+		mode = PunchModeRaw
+	}
+	logger.Info("Selected punch mode", zap.String("mode", string(mode)))
+	return mode
+}
+
+// NewMakeupWriter 按照打洞模式创建 MakeupWriter，返回实际使用的模式
+func NewMakeupWriter(logger *zap.Logger, opts MakeupOptions) (MakeupWriter, PunchMode, error) {
+	mode := ResolvePunchMode(logger, opts.Mode)
+	switch mode {
+	case PunchModeRaw:
+		w, err := ListenMakeup()
+		if err != nil && (errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EPERM)) {
+			return nil, mode, fmt.Errorf("raw sockets require root or CAP_NET_RAW, use punch mode %q or %q instead: %w",
+				PunchModeReusePort, PunchModeForward, err)
+		}
+		return w, mode, err
+	case PunchModeReusePort:
+		w, err := DialReuse(opts.Network, opts.Port)
+		return w, mode, err
+	case PunchModeForward:
+		if opts.ForwardAddr == nil {
+			return nil, mode, errors.New("forward punch mode requires the application address")
+		}
+		w, err := NewForwarder(logger, opts.Port, opts.ForwardAddr)
+		return w, mode, err
+	default:
+		return nil, mode, fmt.Errorf("unknown punch mode %q", mode)
+	}
+}
+
+// PacketConner 是可以提供应用端口上的 net.PacketConn 的 MakeupWriter
+type PacketConner interface {
+	PacketConn() net.PacketConn
+}
+
+// STUNConn 返回一个从应用端口 port 收发数据的 net.PacketConn，用于查询 STUN 服务器，
+// 使得到的外部地址就是应用端口在 NAT 上的映射。w 不能提供时 (例如 raw 模式) 使用原始套接字
+func STUNConn(w MakeupWriter, port int) (net.PacketConn, error) {
+	if pc, ok := w.(PacketConner); ok {
+		return pc.PacketConn(), nil
+	}
+	return ListenRawPacket(uint16(port))
+}
@@ -0,0 +1,246 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParsePunchMode(t *testing.T) {
+	for s, want := range map[string]PunchMode{
+		"":          PunchModeAuto,
+		"auto":      PunchModeAuto,
+		"raw":       PunchModeRaw,
+		"reuseport": PunchModeReusePort,
+		"forward":   PunchModeForward,
+	} {
+		got, err := ParsePunchMode(s)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := ParsePunchMode("spoof")
+	assert.Error(t, err)
+}
+
+func TestReuseWriter(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+
+	// 模拟设置了 SO_REUSEPORT 的应用
+	lc := net.ListenConfig{Control: reuseAddrPortControl}
+	pc, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	w, err := DialReuse("", port)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer peer.Close()
+	paddr := NewAddr(net.IPv4(127, 0, 0, 1), uint16(peer.LocalAddr().(*net.UDPAddr).Port))
+
+	assert.Error(t, w.WriteTo(uint16(port+1), paddr.Port, []byte("punch"), paddr))
+	assert.NoError(t, w.WriteTo(uint16(port), paddr.Port, []byte("punch"), paddr))
+
+	buf := make([]byte, 16)
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := peer.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "punch", string(buf[:n]))
+	// 对端看到的源端口就是应用的端口
+	assert.Equal(t, port, from.Port)
+}
+
+func TestForwarder(t *testing.T) {
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer app.Close()
+
+	f, err := NewForwarder(zap.NewNop(), 0, app.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer remote.Close()
+	raddr := remote.LocalAddr().(*net.UDPAddr)
+	faddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(f.Port())}
+
+	// 打洞数据从应用端口发出
+	assert.NoError(t, f.WriteTo(f.Port(), uint16(raddr.Port), []byte("punch"), NewAddr(raddr.IP, uint16(raddr.Port))))
+	buf := make([]byte, 16)
+	_ = remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := remote.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "punch", string(buf[:n]))
+	assert.Equal(t, int(f.Port()), from.Port)
+
+	// 远端 -> 应用
+	_, err = remote.WriteToUDP([]byte("hello"), faddr)
+	assert.NoError(t, err)
+	_ = app.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, proxy, err := app.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	endpoint, err := f.Endpoint(NewAddr(raddr.IP, uint16(raddr.Port)))
+	assert.NoError(t, err)
+	assert.Equal(t, proxy.Port, int(endpoint.Port))
+
+	// 应用 -> 远端
+	_, err = app.WriteToUDP([]byte("world"), proxy)
+	assert.NoError(t, err)
+	n, from, err = remote.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	assert.Equal(t, int(f.Port()), from.Port)
+
+	// 交给应用的代理地址在空闲时不会过期，直到应用不再使用
+	f.expire(time.Now().Add(time.Hour))
+	f.Lock()
+	assert.Len(t, f.sessions, 1)
+	f.Unlock()
+	f.Release(NewAddr(raddr.IP, uint16(raddr.Port)))
+	f.expire(time.Now().Add(time.Hour))
+	f.Lock()
+	assert.Empty(t, f.sessions)
+	f.Unlock()
+}
+
+func TestForwarderExpire(t *testing.T) {
+	app, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer app.Close()
+
+	f, err := NewForwarder(zap.NewNop(), 0, app.LocalAddr().(*net.UDPAddr))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	pinned, err := f.Endpoint(NewAddr(net.IPv4(127, 0, 0, 1), 40000))
+	assert.NoError(t, err)
+	_, err = f.session(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001})
+	assert.NoError(t, err)
+
+	// 只有没有交给应用的会话空闲过期，之后 Endpoint 返回的代理地址不变
+	f.expire(time.Now().Add(f.idleTimeout + time.Second))
+	f.Lock()
+	assert.Len(t, f.sessions, 1)
+	f.Unlock()
+
+	again, err := f.Endpoint(NewAddr(net.IPv4(127, 0, 0, 1), 40000))
+	assert.NoError(t, err)
+	assert.Equal(t, pinned.Port, again.Port)
+}
+
+// stunEcho 对收到的每个 STUN 请求回复一个事务 ID 相同的成功响应
+func stunEcho(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, MTU)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+			res, _ := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: from.IP, Port: from.Port})
+			_, _ = conn.WriteToUDP(res.Raw, from)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// roundTripSTUN 通过 pc 发送一个 Binding 请求，返回响应中的外部端口
+func roundTripSTUN(t *testing.T, pc net.PacketConn, server *net.UDPAddr) int {
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	_, err := pc.WriteTo(req.Raw, server)
+	assert.NoError(t, err)
+
+	buf := make([]byte, MTU)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() != nil || res.TransactionID != req.TransactionID {
+			continue
+		}
+		var addr stun.XORMappedAddress
+		assert.NoError(t, addr.GetFrom(res))
+		return addr.Port
+	}
+}
+
+func TestSTUNConn(t *testing.T) {
+	server := stunEcho(t)
+
+	t.Run("forward", func(t *testing.T) {
+		app, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		defer app.Close()
+
+		f, err := NewForwarder(zap.NewNop(), 0, app.LocalAddr().(*net.UDPAddr))
+		assert.NoError(t, err)
+		defer f.Close()
+
+		pc, err := STUNConn(f, int(f.Port()))
+		assert.NoError(t, err)
+		assert.Equal(t, int(f.Port()), roundTripSTUN(t, pc, server))
+
+		// 不是自己发出的请求的响应仍然转发给应用
+		other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		defer other.Close()
+		unsolicited := stun.MustBuild(stun.TransactionID, stun.BindingSuccess)
+		_, err = other.WriteToUDP(unsolicited.Raw, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(f.Port())})
+		assert.NoError(t, err)
+
+		buf := make([]byte, MTU)
+		_ = app.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := app.ReadFromUDP(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, unsolicited.Raw, buf[:n])
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		if !RawSocketPermitted() {
+			t.Skip("raw sockets require root or CAP_NET_RAW")
+		}
+
+		// 模拟占用端口的应用
+		app, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		defer app.Close()
+		port := app.LocalAddr().(*net.UDPAddr).Port
+
+		w, err := ListenMakeup()
+		assert.NoError(t, err)
+		defer w.Close()
+
+		pc, err := STUNConn(w, port)
+		assert.NoError(t, err)
+		defer pc.Close()
+		assert.Equal(t, port, roundTripSTUN(t, pc, server))
+	})
+}
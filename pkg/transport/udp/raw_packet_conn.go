@@ -0,0 +1,106 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+)
+
+var _ net.PacketConn = &rawPacketConn{}
+
+// rawPacketConn 是一个以原始套接字实现、源端口固定为 port 的 IPv4 net.PacketConn，
+// 在端口被其他应用 (例如内核中的 WireGuard) 占用时仍然可以从该端口收发数据，
+// 收到的数据包同时也会被投递给占用该端口的应用
+type rawPacketConn struct {
+	w    MakeupWriter
+	r    *net.IPConn
+	port uint16
+}
+
+// ListenRawPacket 创建一个从 port 收发 UDP 数据的 net.PacketConn，需要 root 或 CAP_NET_RAW，只支持 IPv4
+func ListenRawPacket(port uint16) (net.PacketConn, error) {
+	w, err := ListenMakeup()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := net.ListenIP("ip4:udp", nil)
+	if err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	// 原始套接字会收到本机所有 UDP 数据包的副本，在内核中只保留发往 port 的数据包，
+	// 不支持 BPF 的平台上在 ReadFrom 中过滤
+	if prog, err := dstPortFilter(port); err == nil {
+		_ = ipv4.NewPacketConn(r).SetBPF(prog)
+	}
+
+	return &rawPacketConn{w: w, r: r, port: port}, nil
+}
+
+// dstPortFilter 返回只接受 UDP 目的端口为 port 的 IPv4 数据包的 BPF 程序，原始套接字上的数据包包含 IP 首部
+func dstPortFilter(port uint16) ([]bpf.RawInstruction, error) {
+	return bpf.Assemble([]bpf.Instruction{
+		// X = IP 首部长度
+		bpf.LoadMemShift{Off: 0},
+		// A = UDP 目的端口
+		bpf.LoadIndirect{Off: 2, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(port), SkipFalse: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	})
+}
+
+func (c *rawPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := make([]byte, MTU+headerLen)
+	for {
+		// IPv4 原始套接字读取时 IP 首部已经被去掉，剩下 UDP 首部和数据
+		n, from, err := c.r.ReadFromIP(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < headerLen || binary.BigEndian.Uint16(buffer[2:]) != c.port {
+			continue
+		}
+
+		srcPort := binary.BigEndian.Uint16(buffer[0:])
+		return copy(b, buffer[headerLen:n]), &net.UDPAddr{IP: from.IP, Port: int(srcPort)}, nil
+	}
+}
+
+func (c *rawPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("raw packet conn only supports *net.UDPAddr")
+	}
+	if err := c.w.WriteTo(c.port, uint16(ua.Port), b, NewAddr(ua.IP, uint16(ua.Port))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *rawPacketConn) Close() error {
+	return errors.Join(c.w.Close(), c.r.Close())
+}
+
+func (c *rawPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero, Port: int(c.port)}
+}
+
+func (c *rawPacketConn) SetDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *rawPacketConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+// SetWriteDeadline 原始套接字的发送不会阻塞，忽略
+func (c *rawPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+var _ TTLWriter = &reuseWriter{}
+
+// reuseWriter 使用绑定在应用端口上的普通 UDP 套接字打洞，不需要 root 或 CAP_NET_RAW，
+// 前提是应用自己的套接字也设置了 SO_REUSEPORT (且属于同一用户)，
+// 内核中的 WireGuard 等无法共享端口的应用请使用 Forwarder
+type reuseWriter struct {
+	conn *net.UDPConn
+	port uint16
+	ttl  *ttlControl
+}
+
+// DialReuse 创建一个绑定在 port 上并设置了 SO_REUSEADDR/SO_REUSEPORT 的 MakeupWriter，
+// network 为 "udp4" 或 "udp6" 时只使用对应的地址族，为空时使用双栈套接字
+func DialReuse(network string, port int) (MakeupWriter, error) {
+	if network == "" {
+		network = "udp"
+	}
+	lc := net.ListenConfig{Control: reuseAddrPortControl}
+	pc, err := lc.ListenPacket(context.Background(), network, fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to share port %d: %w", port, err)
+	}
+
+	conn := pc.(*net.UDPConn)
+	return &reuseWriter{
+		conn: conn,
+		port: uint16(port),
+		ttl:  newTTLControl(conn),
+	}, nil
+}
+
+// PacketConn 返回绑定在应用端口上的套接字，用于在应用端口上查询 STUN 服务器。
+// 内核按四元组在共享端口的套接字之间分配数据包，响应可能被投递给应用而不是该套接字，此时查询会超时
+func (rw *reuseWriter) PacketConn() net.PacketConn {
+	return rw.conn
+}
+
+func (rw *reuseWriter) WriteTo(srcPort uint16, destPort uint16, b []byte, addr *Addr) error {
+	return rw.WriteToTTL(srcPort, destPort, b, addr, 0)
+}
+
+func (rw *reuseWriter) WriteToTTL(srcPort uint16, destPort uint16, b []byte, addr *Addr, ttl int) error {
+	if srcPort != rw.port {
+		return fmt.Errorf("reuse writer is bound to port %d, can not send from port %d", rw.port, srcPort)
+	}
+
+	return rw.ttl.write(ttl, func() error {
+		_, err := rw.conn.WriteToUDP(b, &net.UDPAddr{IP: addr.IP, Port: int(destPort)})
+		return err
+	})
+}
+
+func (rw *reuseWriter) Close() error {
+	return rw.conn.Close()
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package udp
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl 在绑定之前设置 SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return setsockopt(c, unix.SO_REUSEPORT)
+}
+
+// reuseAddrPortControl 在绑定之前设置 SO_REUSEADDR 和 SO_REUSEPORT，用于与其他应用共享端口
+func reuseAddrPortControl(network, address string, c syscall.RawConn) error {
+	return setsockopt(c, unix.SO_REUSEADDR, unix.SO_REUSEPORT)
+}
+
+func setsockopt(c syscall.RawConn, opts ...int) error {
+	var opErr error
+	if err := c.Control(func(fd uintptr) {
+		for _, opt := range opts {
+			if opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, 1); opErr != nil {
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package udp
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is only supported on linux")
+
+// reusePortControl 仅在 linux 上支持，其他平台请使用单个监听器
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
+
+// reuseAddrPortControl 仅在 linux 上支持
+func reuseAddrPortControl(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
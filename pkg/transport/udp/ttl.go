@@ -0,0 +1,76 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ttlControl 在发送单个数据包时临时修改套接字的 TTL，
+// 修改期间持有写锁，避免同一套接字上的其他数据包使用错误的 TTL
+type ttlControl struct {
+	sync.RWMutex
+
+	v4 *ipv4.Conn
+	v6 *ipv6.Conn
+}
+
+// newTTLControl 为 conn 创建 ttlControl，双栈套接字上同时修改 IPv4 TTL 和 IPv6 hop limit
+func newTTLControl(conn net.Conn) *ttlControl {
+	return &ttlControl{
+		v4: ipv4.NewConn(conn),
+		v6: ipv6.NewConn(conn),
+	}
+}
+
+// write 调用 f 发送数据，ttl 大于 0 时发送期间使用该 TTL
+func (t *ttlControl) write(ttl int, f func() error) error {
+	if ttl <= 0 {
+		t.RLock()
+		defer t.RUnlock()
+		return f()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	restore, err := t.set(ttl)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	return f()
+}
+
+// set 修改 TTL 并返回恢复原值的函数，只要有一个地址族修改成功即可
+func (t *ttlControl) set(ttl int) (func(), error) {
+	var restores []func()
+
+	old4, err4 := t.v4.TTL()
+	if err4 == nil {
+		if err4 = t.v4.SetTTL(ttl); err4 == nil {
+			restores = append(restores, func() { _ = t.v4.SetTTL(old4) })
+		}
+	}
+
+	old6, err6 := t.v6.HopLimit()
+	if err6 == nil {
+		if err6 = t.v6.SetHopLimit(ttl); err6 == nil {
+			restores = append(restores, func() { _ = t.v6.SetHopLimit(old6) })
+		}
+	}
+
+	if len(restores) == 0 {
+		return nil, errors.Join(err4, err6)
+	}
+
+	return func() {
+		for _, r := range restores {
+			r()
+		}
+	}, nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 )
 
 type Addr struct {
@@ -25,7 +26,7 @@ func (a *Addr) Network() string {
 }
 
 func (a *Addr) String() string {
-	return fmt.Sprintf("%s:%d", a.IP.String(), a.Port)
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
 }
 
 func (a *Addr) NetAddr() net.Addr {
@@ -0,0 +1,148 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// DefaultBatch 默认每次系统调用读取的数据包数量
+	DefaultBatch = 64
+)
+
+var _ Conn = &BatchConn{}
+
+// batchConn 由 ipv4.PacketConn 和 ipv6.PacketConn 实现，在 linux 上使用 recvmmsg/sendmmsg
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// BatchConn 一次系统调用读取或写入多个数据包，每个 BatchConn 拥有独立的缓冲区，
+// 多个绑定在同一端口上的 BatchConn 可以由不同的 goroutine 并发读取
+type BatchConn struct {
+	*GenericConn
+	pc    batchConn
+	batch int
+}
+
+// NewBatchListener 创建一个 BatchConn，batch 为每次读取的最大数据包数量，
+// reusePort 为 true 时设置 SO_REUSEPORT，使多个 BatchConn 可以绑定同一端口
+func NewBatchListener(logger *zap.Logger, ip net.IP, port int, batch int, reusePort bool) (*BatchConn, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), "udp", (&net.UDPAddr{IP: ip, Port: port}).String())
+	if err != nil {
+		return nil, err
+	}
+
+	return newBatchConn(logger, pc.(*net.UDPConn), batch), nil
+}
+
+// NewBatchListeners 创建 n 个通过 SO_REUSEPORT 绑定在同一端口上的 BatchConn，
+// 内核按照来源地址将数据包分发给不同的 BatchConn，port 为 0 时所有 BatchConn 使用第一个分配到的端口
+func NewBatchListeners(logger *zap.Logger, ip net.IP, port int, n int, batch int) ([]Conn, error) {
+	if n <= 0 {
+		n = 1
+	}
+
+	conns := make([]Conn, 0, n)
+	closeAll := func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		c, err := NewBatchListener(logger, ip, port, batch, n > 1)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to create listener %d: %w", i, err)
+		}
+		conns = append(conns, c)
+
+		if port == 0 {
+			port = c.UDPConn.LocalAddr().(*net.UDPAddr).Port
+		}
+	}
+
+	return conns, nil
+}
+
+func newBatchConn(logger *zap.Logger, conn *net.UDPConn, batch int) *BatchConn {
+	if batch <= 0 {
+		batch = DefaultBatch
+	}
+
+	var pc batchConn
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; ip.To4() != nil {
+		pc = ipv4.NewPacketConn(conn)
+	} else {
+		pc = ipv6.NewPacketConn(conn)
+	}
+
+	return &BatchConn{
+		GenericConn: &GenericConn{UDPConn: conn, l: logger},
+		pc:          pc,
+		batch:       batch,
+	}
+}
+
+func (u *BatchConn) Listen(r EncReader) {
+	plaintext := make([]byte, MTU)
+	udpAddr := &Addr{IP: make([]byte, 16)}
+
+	msgs := make([]ipv4.Message, u.batch)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, MTU)}
+	}
+
+	for {
+		n, err := u.pc.ReadBatch(msgs, 0)
+		if err != nil {
+			u.l.Debug("udp socket is closed, exiting read loop", zap.Error(err))
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			rua, ok := msgs[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+
+			udpAddr.IP = rua.IP
+			udpAddr.Port = uint16(rua.Port)
+			r(udpAddr, plaintext[:msgs[i].N], msgs[i].Buffers[0][:msgs[i].N])
+		}
+	}
+}
+
+// WriteBatch 尽可能使用一次系统调用将 b[i] 发送到 addrs[i]
+func (u *BatchConn) WriteBatch(b [][]byte, addrs []*Addr) error {
+	if len(b) != len(addrs) {
+		return fmt.Errorf("WriteBatch: %d packets but %d addresses", len(b), len(addrs))
+	}
+
+	msgs := make([]ipv4.Message, len(b))
+	for i := range b {
+		msgs[i].Buffers = [][]byte{b[i]}
+		msgs[i].Addr = &net.UDPAddr{IP: addrs[i].IP, Port: int(addrs[i].Port)}
+	}
+
+	for len(msgs) > 0 {
+		n, err := u.pc.WriteBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
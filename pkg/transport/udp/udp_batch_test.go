@@ -0,0 +1,178 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBatchListeners(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+
+	conns, err := NewBatchListeners(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0, 4, 8)
+	assert.NoError(t, err)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+
+	laddr, err := conns[0].LocalAddr()
+	assert.NoError(t, err)
+	for _, c := range conns[1:] {
+		addr, err := c.LocalAddr()
+		assert.NoError(t, err)
+		assert.Equal(t, laddr.Port, addr.Port)
+	}
+
+	var received atomic.Int64
+	for _, c := range conns {
+		go c.Listen(func(addr *Addr, out []byte, packet []byte) {
+			if string(packet) == "ping" {
+				received.Add(1)
+			}
+		})
+	}
+
+	const senders = 32
+	for i := 0; i < senders; i++ {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: laddr.IP, Port: int(laddr.Port)})
+		assert.NoError(t, err)
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		_ = conn.Close()
+	}
+
+	assert.Eventually(t, func() bool {
+		return received.Load() == senders
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestBatchConnWriteBatch(t *testing.T) {
+	bc, err := NewBatchListener(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0, 0, false)
+	assert.NoError(t, err)
+	defer bc.Close()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer peer.Close()
+	paddr := NewAddr(net.IPv4(127, 0, 0, 1), uint16(peer.LocalAddr().(*net.UDPAddr).Port))
+
+	assert.Error(t, bc.WriteBatch([][]byte{[]byte("a")}, nil))
+	assert.NoError(t, bc.WriteBatch([][]byte{[]byte("a"), []byte("b")}, []*Addr{paddr, paddr}))
+
+	buf := make([]byte, 16)
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"a", "b"} {
+		n, _, err := peer.ReadFromUDP(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(buf[:n]))
+	}
+}
+
+// BenchmarkListen 在回环地址上测量不同接收方式每秒处理的数据包数量，
+// 由于 UDP 会丢包，结果以 pkts/s 为准，而不是 ns/op
+//
+//	go test -run '^$' -bench BenchmarkListen ./pkg/transport/udp/
+func BenchmarkListen(b *testing.B) {
+	newGeneric := func(n int) ([]Conn, error) {
+		c, err := NewGenericListener(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0)
+		return []Conn{c}, err
+	}
+
+	cases := []struct {
+		name   string
+		listen func() ([]Conn, error)
+	}{
+		{"generic", func() ([]Conn, error) { return newGeneric(1) }},
+		{"batch", func() ([]Conn, error) {
+			return NewBatchListeners(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0, 1, DefaultBatch)
+		}},
+	}
+	if runtime.GOOS == "linux" {
+		for _, n := range []int{2, 4} {
+			n := n
+			cases = append(cases, struct {
+				name   string
+				listen func() ([]Conn, error)
+			}{fmt.Sprintf("batch-reuseport-%d", n), func() ([]Conn, error) {
+				return NewBatchListeners(zap.NewNop(), net.IPv4(127, 0, 0, 1), 0, n, DefaultBatch)
+			}})
+		}
+	}
+
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			conns, err := tc.listen()
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchmarkListen(b, conns)
+		})
+	}
+}
+
+func benchmarkListen(b *testing.B, conns []Conn) {
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+
+	laddr, err := conns[0].LocalAddr()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var received atomic.Int64
+	for _, c := range conns {
+		go c.Listen(func(addr *Addr, out []byte, packet []byte) {
+			received.Add(1)
+		})
+	}
+
+	// 使用多个来源端口，使 SO_REUSEPORT 可以把数据包分发给不同的监听器
+	const senders = 8
+	payload := make([]byte, 128)
+
+	b.ResetTimer()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: laddr.IP, Port: int(laddr.Port)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		wg.Add(1)
+		go func(conn *net.UDPConn, n int) {
+			defer wg.Done()
+			defer conn.Close()
+			for j := 0; j < n; j++ {
+				_, _ = conn.Write(payload)
+			}
+		}(conn, b.N/senders+1)
+	}
+	wg.Wait()
+
+	// 等待接收方处理完剩余的数据包
+	for last := int64(-1); last != received.Load(); {
+		last = received.Load()
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	sent := float64(senders * (b.N/senders + 1))
+	b.ReportMetric(float64(received.Load())/elapsed.Seconds(), "pkts/s")
+	b.ReportMetric(1-float64(received.Load())/sent, "loss")
+}
@@ -0,0 +1,142 @@
+package wgmux
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// bindQueueSize 等待 wireguard-go 读取的数据包数量，超过后丢弃
+const bindQueueSize = 1024
+
+var _ conn.Bind = &bind{}
+
+// bind 是 wireguard-go 的 conn.Bind，通过 Forwarder 持有的端口收发数据。
+// wireguard-go 修改监听端口时会重新 Open，端口始终是 Forwarder 的端口
+type bind struct {
+	f       *udp.Forwarder
+	packets chan bindPacket
+
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+type bindPacket struct {
+	b    []byte
+	from netip.AddrPort
+}
+
+func newBind(f *udp.Forwarder) *bind {
+	b := &bind{
+		f:       f,
+		packets: make(chan bindPacket, bindQueueSize),
+	}
+	f.Divert(b.deliver)
+	return b
+}
+
+// deliver 将 Forwarder 收到的非 STUN 数据交给 wireguard-go，
+// 双栈套接字上的 IPv4 地址是 IPv4 映射的 IPv6 地址，转换为 IPv4 地址与 wg 配置的端点一致
+func (b *bind) deliver(p []byte, from *net.UDPAddr) {
+	ap := from.AddrPort()
+	ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	select {
+	case b.packets <- bindPacket{b: append([]byte(nil), p...), from: ap}:
+	default:
+	}
+}
+
+func (b *bind) Open(uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+
+	receive := func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case p := <-b.packets:
+			sizes[0] = copy(packets[0], p.b)
+			eps[0] = endpoint(p.from)
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return []conn.ReceiveFunc{receive}, b.f.Port(), nil
+}
+
+// Close 只停止接收，端口由 Mux 关闭
+func (b *bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	return nil
+}
+
+func (b *bind) SetMark(uint32) error {
+	return nil
+}
+
+func (b *bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(endpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	ap := netip.AddrPort(e)
+	addr := udp.NewAddr(ap.Addr().AsSlice(), ap.Port())
+	for _, buf := range bufs {
+		if err := b.f.WriteTo(b.f.Port(), ap.Port(), buf, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint(ap), nil
+}
+
+func (b *bind) BatchSize() int {
+	return 1
+}
+
+// endpoint 是 bind 使用的 conn.Endpoint，不记录源地址
+type endpoint netip.AddrPort
+
+func (e endpoint) ClearSrc() {}
+
+func (e endpoint) SrcToString() string {
+	return ""
+}
+
+func (e endpoint) DstToString() string {
+	return netip.AddrPort(e).String()
+}
+
+func (e endpoint) DstToBytes() []byte {
+	b, _ := netip.AddrPort(e).MarshalBinary()
+	return b
+}
+
+func (e endpoint) DstIP() netip.Addr {
+	return netip.AddrPort(e).Addr()
+}
+
+func (e endpoint) SrcIP() netip.Addr {
+	return netip.Addr{}
+}
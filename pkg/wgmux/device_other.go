@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package wgmux
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// startDevice 在其他平台上不支持 userspace 模式
+func startDevice(logger *zap.Logger, iface string, mtu int, bind conn.Bind) (interface{ Close() error }, error) {
+	return nil, errors.New("userspace wireguard is not supported on this platform")
+}
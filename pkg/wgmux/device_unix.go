@@ -0,0 +1,73 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package wgmux
+
+import (
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// userspaceDevice 是进程内的 wireguard-go 设备及其 UAPI 监听器
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+// startDevice 创建 TUN 设备并启动 wireguard-go，同时监听 UAPI 套接字使 wg 和 wgctrl 可以配置设备
+func startDevice(logger *zap.Logger, iface string, mtu int, bind conn.Bind) (*userspaceDevice, error) {
+	tunDevice, err := tun.CreateTUN(iface, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tun device: %w", err)
+	}
+	if name, err := tunDevice.Name(); err == nil {
+		iface = name
+	}
+
+	sugar := logger.Sugar()
+	dev := device.NewDevice(tunDevice, bind, &device.Logger{
+		Verbosef: sugar.Debugf,
+		Errorf:   sugar.Errorf,
+	})
+
+	file, err := ipc.UAPIOpen(iface)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to open uapi socket: %w", err)
+	}
+	uapi, err := ipc.UAPIListen(iface, file)
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to listen on uapi socket: %w", err)
+	}
+
+	go func() {
+		for {
+			c, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(c)
+		}
+	}()
+
+	if err := dev.Up(); err != nil {
+		_ = uapi.Close()
+		dev.Close()
+		return nil, fmt.Errorf("failed to bring up device: %w", err)
+	}
+
+	logger.Info("Started userspace wireguard device", zap.String("interface", iface))
+	return &userspaceDevice{device: dev, uapi: uapi}, nil
+}
+
+func (d *userspaceDevice) Close() error {
+	err := d.uapi.Close()
+	d.device.Close()
+	return err
+}
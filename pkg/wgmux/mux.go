@@ -0,0 +1,146 @@
+// Package wgmux 让 ICE 和 WireGuard 共用同一个 UDP 端口。
+// punchline 持有该端口，将 STUN 消息 (ICE 连通性检查) 交给 ICE 的 UDPMux，
+// 将 WireGuard 数据转发给监听在回环地址上的内核接口，或者交给进程内的 wireguard-go，
+// 这样 ICE 选中的候选者对就是 WireGuard 实际使用的端点
+package wgmux
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/pion/ice/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	ModeKernel    = "kernel"
+	ModeUserspace = "userspace"
+
+	defaultMTU = 1420
+)
+
+var errNoForwardAddr = errors.New("kernel mode requires forwardAddr, the loopback address of the kernel wireguard interface")
+
+// Mux 持有 ICE 和 WireGuard 共用的 UDP 端口
+type Mux struct {
+	logger *zap.Logger
+	mode   string
+
+	forwarder *udp.Forwarder
+	udpMux    *ice.UniversalUDPMuxDefault
+
+	// device userspace 模式下的 wireguard-go 设备
+	device interface{ Close() error }
+}
+
+// New 在 cfg.Port 上创建 Mux，userspace 模式下同时创建名为 iface 的 wireguard-go 设备，
+// 设备的密钥和对端仍然通过 wg 或 wgctrl 配置
+func New(logger *zap.Logger, cfg *config.WgMux, iface string) (*Mux, error) {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = ModeKernel
+	}
+
+	var app *net.UDPAddr
+	switch mode {
+	case ModeKernel:
+		if cfg.ForwardAddr == "" {
+			return nil, errNoForwardAddr
+		}
+		var err error
+		if app, err = net.ResolveUDPAddr("udp", cfg.ForwardAddr); err != nil {
+			return nil, fmt.Errorf("invalid forwardAddr: %w", err)
+		}
+	case ModeUserspace:
+	default:
+		return nil, fmt.Errorf("unknown wireguard mux mode %q (kernel userspace)", cfg.Mode)
+	}
+
+	forwarder, err := udp.NewForwarder(logger, cfg.Port, app)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", cfg.Port, err)
+	}
+
+	// NewUniversalUDPMuxDefault 启动读循环后才设置自己的字段，在构造完成之前不向其交付数据
+	conn := &gatedConn{PacketConn: forwarder.ICEConn(), ready: make(chan struct{})}
+	m := &Mux{
+		logger:    logger,
+		mode:      mode,
+		forwarder: forwarder,
+		udpMux:    ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{UDPConn: conn}),
+	}
+	close(conn.ready)
+
+	if mode == ModeUserspace {
+		mtu := cfg.MTU
+		if mtu == 0 {
+			mtu = defaultMTU
+		}
+		dev, err := startDevice(logger, iface, mtu, newBind(forwarder))
+		if err != nil {
+			_ = m.Close()
+			return nil, fmt.Errorf("failed to start userspace wireguard device %s: %w", iface, err)
+		}
+		m.device = dev
+	}
+
+	logger.Info("Sharing port between ICE and wireguard",
+		zap.Uint16("port", forwarder.Port()),
+		zap.String("mode", mode),
+		zap.Stringer("forwardAddr", app))
+	return m, nil
+}
+
+// Port 返回共用的端口
+func (m *Mux) Port() int {
+	return int(m.forwarder.Port())
+}
+
+// UDPMux 返回 ICE Agent 使用的 UDPMux，同时用于主机候选者和服务器反射候选者
+func (m *Mux) UDPMux() ice.UniversalUDPMux {
+	return m.udpMux
+}
+
+// Endpoint 返回 WireGuard 到达 remote 应该使用的端点。
+// kernel 模式下内核接口只能看到 Mux 在回环地址上为 remote 创建的代理套接字，userspace 模式下就是 remote
+func (m *Mux) Endpoint(remote *net.UDPAddr) (*net.UDPAddr, error) {
+	if m.mode != ModeKernel {
+		return remote, nil
+	}
+	addr, err := m.forwarder.Endpoint(udp.NewAddr(remote.IP, uint16(remote.Port)))
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: int(addr.Port)}, nil
+}
+
+// Release 释放 Endpoint 为 remote 创建的代理套接字，WireGuard 不再使用该端点时调用
+func (m *Mux) Release(remote *net.UDPAddr) {
+	if m.mode != ModeKernel {
+		return
+	}
+	m.forwarder.Release(udp.NewAddr(remote.IP, uint16(remote.Port)))
+}
+
+// Close 关闭 wireguard-go 设备、UDPMux 和端口
+func (m *Mux) Close() error {
+	if m.device != nil {
+		_ = m.device.Close()
+	}
+	_ = m.udpMux.Close()
+	return m.forwarder.Close()
+}
+
+// gatedConn 在 ready 关闭之前阻塞读取
+type gatedConn struct {
+	net.PacketConn
+	ready chan struct{}
+}
+
+func (c *gatedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	<-c.ready
+	return c.PacketConn.ReadFrom(b)
+}
@@ -0,0 +1,120 @@
+package wgmux
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cossteam/punchline/config"
+	"github.com/cossteam/punchline/pkg/transport/udp"
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// wgPacket 返回一个 WireGuard 数据消息 (类型 4)
+func wgPacket(payload string) []byte {
+	return append([]byte{4, 0, 0, 0, 1, 2, 3, 4}, payload...)
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func read(t *testing.T, c *net.UDPConn) ([]byte, *net.UDPAddr) {
+	buffer := make([]byte, 1500)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, from, err := c.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	return buffer[:n], from
+}
+
+func TestMuxKernel(t *testing.T) {
+	kernel := listenLoopback(t)
+	remote := listenLoopback(t)
+
+	m, err := New(zap.NewNop(), &config.WgMux{ForwardAddr: kernel.LocalAddr().String()}, "wg0")
+	require.NoError(t, err)
+	defer m.Close()
+	assert.NotNil(t, m.UDPMux())
+
+	port := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: m.Port()}
+
+	// WireGuard 数据被转发给内核接口，内核接口看到的是 Endpoint 返回的代理地址
+	_, err = remote.WriteToUDP(wgPacket("hello"), port)
+	require.NoError(t, err)
+	b, from := read(t, kernel)
+	assert.Equal(t, wgPacket("hello"), b)
+
+	proxy, err := m.Endpoint(remote.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	assert.Equal(t, proxy.Port, from.Port)
+
+	// 内核接口发往代理地址的数据从共用端口发给远端
+	_, err = kernel.WriteToUDP(wgPacket("world"), proxy)
+	require.NoError(t, err)
+	b, from = read(t, remote)
+	assert.Equal(t, wgPacket("world"), b)
+	assert.Equal(t, m.Port(), from.Port)
+
+	// STUN 消息交给 ICE，不会转发给内核接口
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	_, err = remote.WriteToUDP(req.Raw, port)
+	require.NoError(t, err)
+	require.NoError(t, kernel.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, _, err = kernel.ReadFromUDP(make([]byte, 1500))
+	assert.Error(t, err)
+}
+
+func TestMuxInvalidConfig(t *testing.T) {
+	_, err := New(zap.NewNop(), &config.WgMux{}, "wg0")
+	assert.ErrorIs(t, err, errNoForwardAddr)
+
+	_, err = New(zap.NewNop(), &config.WgMux{Mode: "tap"}, "wg0")
+	assert.Error(t, err)
+}
+
+func TestBind(t *testing.T) {
+	f, err := udp.NewForwarder(zap.NewNop(), 0, nil)
+	require.NoError(t, err)
+	defer f.Close()
+	_ = f.ICEConn()
+
+	b := newBind(f)
+	fns, port, err := b.Open(51820)
+	require.NoError(t, err)
+	require.Len(t, fns, 1)
+	assert.Equal(t, f.Port(), port)
+
+	_, _, err = b.Open(0)
+	assert.ErrorIs(t, err, conn.ErrBindAlreadyOpen)
+
+	remote := listenLoopback(t)
+	_, err = remote.WriteToUDP(wgPacket("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	require.NoError(t, err)
+
+	packets := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+	n, err := fns[0](packets, sizes, eps)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	assert.Equal(t, wgPacket("hello"), packets[0][:sizes[0]])
+	assert.Equal(t, remote.LocalAddr().String(), eps[0].DstToString())
+
+	require.NoError(t, b.Send([][]byte{wgPacket("world")}, eps[0]))
+	got, _ := read(t, remote)
+	assert.Equal(t, wgPacket("world"), got)
+
+	// 关闭后接收函数返回 net.ErrClosed，可以重新打开
+	require.NoError(t, b.Close())
+	_, err = fns[0](packets, sizes, eps)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, _, err = b.Open(0)
+	assert.NoError(t, err)
+}